@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ctrox/csi-s3/pkg/driver"
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// commands are the admin subcommands of the driver binary, run as e.g.
+// s3driver preflight. Each parses its own flags, so the flags of the
+// driver are rejected instead of being silently ignored.
+var commands = map[string]func(args []string) error{
+	"preflight":        preflightCommand,
+	"reconstruct-meta": reconstructMetaCommand,
+}
+
+// runCommand runs the subcommand named by the first argument, it returns
+// false if there is none
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// parseCommandFlags parses the flags of a subcommand, which takes no
+// further arguments
+func parseCommandFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	return nil
+}
+
+func preflightCommand(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	kubeletDir := flags.String("kubelet-dir", driver.DefaultKubeletPodsDir, "directory kubelet creates the target paths of volumes in, checked for Bidirectional mount propagation")
+	mounters := flags.String("mounters", "", "comma separated mounters which have to be installed, the others are only checked if they are installed")
+	unprivileged := flags.Bool("unprivileged", false, "check the prerequisites of running the node plugin with --unprivileged")
+	if err := parseCommandFlags(flags, args); err != nil {
+		return err
+	}
+	d, err := driver.New("admin", "", driver.Options{
+		PreflightKubeletDir: *kubeletDir,
+		PreflightMounters:   splitList(*mounters),
+		Unprivileged:        *unprivileged,
+	})
+	if err != nil {
+		return err
+	}
+	return d.Preflight(os.Stdout)
+}
+
+func reconstructMetaCommand(args []string) error {
+	flags := flag.NewFlagSet("reconstruct-meta", flag.ExitOnError)
+	secret := flags.String("default-secret-dir", "", "directory containing the secret of the object store")
+	bucket := flags.String("bucket", "", "bucket whose volumes get their missing metadata back")
+	pvList := flags.String("pvs", "", "output of kubectl get pv -o json the volumes and their attributes are taken from, empty to find the volumes by their csi-fs directory")
+	mounterType := flags.String("mounter", "", "mounter of the volumes whose metadata is reconstructed without --pvs, which requires it")
+	apply := flags.Bool("apply", false, "write the reconstructed metadata instead of only reporting it, existing metadata is never overwritten")
+	ctrlPfx := flags.String("control-prefix", "", "reserved prefix of the objects managed by the driver, as passed to the driver")
+	idKeys := flags.String("access-key-id-keys", "", "comma separated keys of the secret the access key ID is read from, as passed to the driver")
+	skKeys := flags.String("secret-access-key-keys", "", "comma separated keys of the secret the secret access key is read from, as passed to the driver")
+	if err := parseCommandFlags(flags, args); err != nil {
+		return err
+	}
+	if *secret == "" {
+		return errors.New("reconstructing metadata requires --default-secret-dir")
+	}
+	if *bucket == "" {
+		return errors.New("reconstructing metadata requires --bucket")
+	}
+	d, err := driver.New("admin", "", driver.Options{
+		DefaultSecretDir: *secret,
+		S3: s3.Options{
+			ControlPrefix:       *ctrlPfx,
+			AccessKeyIDKeys:     splitList(*idKeys),
+			SecretAccessKeyKeys: splitList(*skKeys),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var pvs io.Reader
+	if *pvList != "" {
+		f, err := os.Open(*pvList)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		pvs = f
+	}
+	return d.ReconstructMeta(pvs, driver.MetaReconstruction{Bucket: *bucket, Apply: *apply, Mounter: *mounterType}, os.Stdout)
+}
@@ -20,8 +20,13 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ctrox/csi-s3/pkg/driver"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
 )
 
 func init() {
@@ -31,15 +36,266 @@ func init() {
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
+	events   = flag.Bool("enable-events", false, "emit Kubernetes events on PVs, requires the driver to run in-cluster")
+	secret   = flag.String("default-secret-dir", "", "directory containing the secret used for requests without secrets")
+	sockMode = flag.String("socket-mode", "", "octal permissions of the unix socket, e.g. 0600")
+	sockGID  = flag.Int("socket-gid", 0, "group id owning the unix socket, 0 keeps the group of the driver")
+	systemd  = flag.String("systemd-state-dir", "", "run supported mounters as transient systemd units, tracked in this directory")
+	unitMax  = flag.Int("systemd-restart-limit", mounter.DefaultUnitRestartLimit, "number of times a failed systemd unit of a mounter is restarted before its volume is poisoned and left failed")
+	workers  = flag.Int("delete-workers", 4, "number of parallel workers deleting objects of a volume")
+	adopt    = flag.Bool("adopt-empty-buckets", false, "treat empty buckets without metadata named after the volume as created by the driver")
+	noCreate = flag.Bool("disable-bucket-creation", false, "only provision volumes in existing buckets, never create buckets")
+	strictBk = flag.Bool("strict-bucket-names", false, "reject volumes whose bucket parameter is not a valid bucket name, e.g. with uppercase letters or underscores, with the name to use instead")
+	maxDepth = flag.Int("max-prefix-depth", 16, "reject volumes whose prefix contains more slashes, 0 does not limit the depth")
+	capacity = flag.Int64("default-capacity-bytes", 0, "capacity of volumes requested without one, 0 leaves them unbounded")
+	noTags   = flag.Bool("disable-object-tagging", false, "do not tag internal objects, for providers without object tagging")
+	allowOld = flag.Bool("allow-metadata-downgrade", false, "change and delete volumes whose metadata has been written by a newer major version of the driver")
+	attach   = flag.Bool("enable-attach", false, "record the nodes volumes are attached to with ControllerPublishVolume and refuse to attach s3backer volumes to a second node, requires the external-attacher and attachRequired: true")
+	rwop     = flag.Bool("enable-read-write-once-pod", false, "advertise the single node writer access modes of CSI spec v1.5 needed for ReadWriteOncePod volumes, requires Kubernetes and sidecars supporting them")
+	strict   = flag.Bool("strict-context-check", false, "refuse to publish volumes whose metadata conflicts with the volume attributes of their PV")
+	otlp     = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint spans of RPCs and S3 calls are exported to, e.g. http://otel-collector:4318, empty disables tracing")
+	auditLog = flag.String("audit-log-path", "", "file every bucket and object the driver creates, changes or removes is recorded in as JSON lines, - for stdout, empty disables the audit log")
+	flushTo  = flag.Duration("unpublish-flush-timeout", 30*time.Second, "maximum time to wait for pending uploads of a volume before it is unmounted, 0 unmounts without waiting")
+	metrics  = flag.String("metrics-address", "", "address metrics of the published volumes are served on in the Prometheus format, e.g. :9090, empty disables them")
+	debug    = flag.String("debug-endpoint", "", "endpoint the volumes published on the node are listed on at /mounts, unix://<path> or tcp://127.0.0.1:<port>, empty disables it")
+	rawWait  = flag.Duration("read-after-write-timeout", 10*time.Second, "maximum time to wait until metadata written by the driver can be read back, for eventually consistent backends, 0 disables the check")
+	idleConn = flag.Int("s3-max-idle-conns", 16, "number of idle connections kept open to each S3 endpoint")
+	maxConns = flag.Int("s3-max-conns-per-host", 0, "maximum number of connections to each S3 endpoint, 0 is unlimited")
+	idleTo   = flag.Duration("s3-idle-conn-timeout", time.Minute, "time after which idle connections to S3 endpoints are closed")
+	noKeep   = flag.Bool("s3-disable-keep-alives", false, "close the connection to the S3 endpoint after every request")
+	dnsTTL   = flag.Duration("s3-dns-cache-ttl", 0, "time the resolved addresses of S3 endpoints are kept, 0 resolves them for every new connection")
+	ownsBkt  = flag.Bool("recovered-meta-owns-bucket", false, "have volumes without prefix whose metadata is recovered, or whose bucket exists without metadata, claim their bucket, so it is removed with the volume, only if all such buckets were created by csi-s3")
+	listPage = flag.Int("s3-list-page-size", 0, "number of objects requested with each page of a listing, e.g. when deleting a volume, at most 1000, 0 keeps the default of the provider")
+	idKeys   = flag.String("access-key-id-keys", "", "comma separated keys of secrets the access key ID is read from, the first one set wins, empty for accessKeyID and the keys of other S3 drivers")
+	skKeys   = flag.String("secret-access-key-keys", "", "comma separated keys of secrets the secret access key is read from, the first one set wins, empty for secretAccessKey and the keys of other S3 drivers")
+	dnsSrv   = flag.String("s3-dns-server", "", "host:port of the DNS server S3 endpoints are resolved with, empty uses the resolver of the system")
+	mountTo  = flag.String("mount-timeouts", "", "maximum time to wait for mounters to serve their mount, e.g. s3backer=10m,rclone=30s, unlisted mounters keep their default")
+	mntLog   = flag.Int64("mounter-log-max-bytes", 0, "capture the output of rclone and s3fs in mounter.log next to the target of their mount, trimmed once it grows past this size, 0 does not capture it")
+	maxParts = flag.Int("max-multipart-uploads", 0, "maximum number of parts of multipart uploads sent at the same time on the node, 0 does not limit them")
+	linger   = flag.Int("mount-linger-seconds", 0, "keep the mount of an unpublished volume for this many seconds and reuse it if the volume is published again, requires --mount-linger-dir")
+	lingerTo = flag.String("mount-linger-dir", "", "directory lingering mounts are kept and tracked in, has to survive restarts of the driver, empty disables lingering")
+	noReaper = flag.Bool("disable-orphan-reaper", false, "keep mounter processes running after their mount is gone instead of terminating them, for debugging")
+	retries  = flag.Int("mount-retries", 0, "number of times a mount failing because the S3 endpoint cannot be reached is retried before the error is returned to kubelet")
+	retryTo  = flag.Duration("mount-retry-backoff", time.Second, "wait before the first retry of a failed mount, doubled for every further retry")
+	quotas   = flag.String("namespace-quotas", "", "maximum total capacity of the volumes of the PVCs of a namespace, e.g. team-a=100Gi,*=10Gi, * applies to the namespaces which are not listed, requires --namespace-quota-bucket")
+	quotaBkt = flag.String("namespace-quota-bucket", "", "existing bucket the usage of the namespaces with a quota is kept in, below the control prefix")
+	unpriv   = flag.Bool("unprivileged", false, "run the node plugin without privileges, mounting through fusermount3 or in a user namespace with /dev/fuse of a device plugin, the controller then rejects volumes of mounters which need privileges")
+	ctrlPfx  = flag.String("control-prefix", "", "reserved prefix of the objects managed by the driver, e.g. "+s3.DefaultControlPrefix+", empty to keep them next to the data")
+	noMeta   = flag.String("on-missing-meta-delete", driver.MissingMetaFail, "what DeleteVolume does with a volume whose metadata cannot be read: fail, skip to leave its objects and succeed, or forceRemovePrefix to remove its prefix but never its bucket")
+
+	clearProtection  = flag.String("clear-delete-protection", "", "clear the delete protection of the volume with this ID using the default secret, then exit")
+	setMaintenance   = flag.String("set-maintenance", "", "put the volume with this ID in maintenance, remounting it read-only on the nodes for the containers started from then on, using the default secret, then exit")
+	clearMaintenance = flag.String("clear-maintenance", "", "end the maintenance of the volume with this ID, remounting it writable on the nodes, using the default secret, then exit")
+
+	exportMeta         = flag.String("export-meta", "", "write the metadata of all volumes in the buckets of the default secret to this JSON file, - for stdout, then exit")
+	importMeta         = flag.String("import-meta", "", "write the metadata of a file of --export-meta to the object store of the default secret, then exit")
+	importMetaBuckets  = flag.String("import-meta-buckets", "", "buckets the exported volumes are imported to, e.g. old-bucket=new-bucket,other=renamed")
+	importMetaEndpoint = flag.String("import-meta-endpoint", "", "endpoint the metadata is imported to, empty for the endpoint of the default secret")
+	importMetaDryRun   = flag.Bool("import-meta-dry-run", false, "only report which volumes would be imported")
+
+	preflightOnStart  = flag.Bool("preflight-on-start", false, "run the preflight checks on startup of the node plugin and report it as not ready if any fails")
+	preflightKubelet  = flag.String("preflight-kubelet-dir", driver.DefaultKubeletPodsDir, "directory kubelet creates the target paths of volumes in, checked for Bidirectional mount propagation")
+	preflightMounters = flag.String("preflight-mounters", "", "comma separated mounters which have to be installed, the others are only checked if they are installed")
+	probeMounters     = flag.Bool("probe-mounter-binaries", false, "report the plugin as not ready while the binary of a mounter of --preflight-mounters, or of one installed on startup, is missing or not executable")
+
+	selfTest        = flag.Bool("self-test", false, "provision, mount, write, read and delete a test volume using the default secret, then exit")
+	selfTestMounter = flag.String("self-test-mounter", "", "mounter used by the self test, empty for the default mounter")
+	selfTestBucket  = flag.String("self-test-bucket", "", "existing bucket the self test volume is created in, empty to create a new bucket")
+	selfTestConfirm = flag.Bool("self-test-confirm", false, "confirm that the self test performs real writes against the object store")
 )
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		os.Exit(0)
+	}
 	flag.Parse()
 
-	driver, err := driver.New(*nodeID, *endpoint)
+	var mode uint64
+	if *sockMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(*sockMode, 8, 32); err != nil {
+			log.Fatalf("invalid socket mode %q: %v", *sockMode, err)
+		}
+	}
+
+	mountTimeouts, err := mounter.ParseMountTimeouts(*mountTo)
 	if err != nil {
 		log.Fatal(err)
 	}
+	namespaceQuotas, err := driver.ParseNamespaceQuotas(*quotas)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metaBuckets, err := driver.ParseBucketMap(*importMetaBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metaImport := driver.MetaImport{
+		Endpoint: *importMetaEndpoint,
+		Buckets:  metaBuckets,
+		DryRun:   *importMetaDryRun,
+	}
+
+	requiredMounters := splitList(*preflightMounters)
+	accessKeyIDKeys := splitList(*idKeys)
+	secretAccessKeyKeys := splitList(*skKeys)
+
+	if *selfTest && *nodeID == "" {
+		*nodeID = "self-test"
+	}
+	if (*clearProtection != "" || *setMaintenance != "" || *clearMaintenance != "" || *exportMeta != "" || *importMeta != "") && *nodeID == "" {
+		*nodeID = "admin"
+	}
+	driver, err := driver.New(*nodeID, *endpoint, driver.Options{
+		EnableEvents:          *events,
+		DefaultSecretDir:      *secret,
+		SocketMode:            os.FileMode(mode),
+		SocketGID:             *sockGID,
+		SystemdStateDir:       *systemd,
+		SystemdRestartLimit:   *unitMax,
+		AdoptEmptyBuckets:     *adopt,
+		DisableBucketCreation: *noCreate,
+		MaxPrefixDepth:        *maxDepth,
+		StrictBucketNames:     *strictBk,
+		DefaultCapacityBytes:  *capacity,
+		EnableAttach:          *attach,
+		ReadWriteOncePod:      *rwop,
+		StrictContextCheck:    *strict,
+		OTLPEndpoint:          *otlp,
+		AuditLogPath:          *auditLog,
+		UnpublishFlushTimeout: *flushTo,
+		MetricsAddress:        *metrics,
+		DebugEndpoint:         *debug,
+		MountTimeouts:         mountTimeouts,
+		MultipartUploadLimit:  *maxParts,
+		MounterLogMaxBytes:    *mntLog,
+		MountLinger:           time.Duration(*linger) * time.Second,
+		MountLingerDir:        *lingerTo,
+		ReapOrphans:           !*noReaper,
+		PreflightOnStart:      *preflightOnStart,
+		PreflightKubeletDir:   *preflightKubelet,
+		PreflightMounters:     requiredMounters,
+		ProbeMounterBinaries:  *probeMounters,
+		NamespaceQuotas:       namespaceQuotas,
+		NamespaceQuotaBucket:  *quotaBkt,
+		MountRetries:          *retries,
+		MountRetryBackoff:     *retryTo,
+		Unprivileged:          *unpriv,
+		OnMissingMetaDelete:   *noMeta,
+		S3: s3.Options{
+			RemoveWorkers:           *workers,
+			DisableObjectTagging:    *noTags,
+			ControlPrefix:           *ctrlPfx,
+			ReadAfterWriteTimeout:   *rawWait,
+			MaxIdleConns:            *idleConn,
+			MaxConnsPerHost:         *maxConns,
+			IdleConnTimeout:         *idleTo,
+			DisableKeepAlives:       *noKeep,
+			DNSCacheTTL:             *dnsTTL,
+			DNSServer:               *dnsSrv,
+			AllowMetadataDowngrade:  *allowOld,
+			ListPageSize:            *listPage,
+			RecoveredMetaOwnsBucket: *ownsBkt,
+			AccessKeyIDKeys:         accessKeyIDKeys,
+			SecretAccessKeyKeys:     secretAccessKeyKeys,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *clearProtection != "" {
+		if *secret == "" {
+			log.Fatal("clearing the delete protection requires --default-secret-dir")
+		}
+		if err := driver.ClearDeleteProtection(*clearProtection); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *setMaintenance != "" || *clearMaintenance != "" {
+		if *secret == "" {
+			log.Fatal("setting the maintenance of a volume requires --default-secret-dir")
+		}
+		if *setMaintenance != "" && *clearMaintenance != "" {
+			log.Fatal("--set-maintenance and --clear-maintenance are mutually exclusive")
+		}
+		volumeID, enabled := *setMaintenance, true
+		if volumeID == "" {
+			volumeID, enabled = *clearMaintenance, false
+		}
+		if err := driver.SetMaintenance(volumeID, enabled); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *exportMeta != "" || *importMeta != "" {
+		if *secret == "" {
+			log.Fatal("exporting and importing metadata requires --default-secret-dir")
+		}
+		if *exportMeta != "" {
+			out := os.Stdout
+			if *exportMeta != "-" {
+				// the metadata is written in plain text, even if it is
+				// encrypted in the bucket
+				if out, err = os.OpenFile(*exportMeta, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+					log.Fatal(err)
+				}
+				if err := out.Chmod(0600); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if err := driver.ExportMeta(out, os.Stderr); err != nil {
+				log.Fatal(err)
+			}
+			if err := out.Close(); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+		in, err := os.Open(*importMeta)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := driver.ImportMeta(in, metaImport, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *selfTest {
+		if !*selfTestConfirm {
+			log.Fatal("the self test creates and deletes a volume in the object store, pass --self-test-confirm to run it")
+		}
+		if *secret == "" {
+			log.Fatal("the self test requires --default-secret-dir")
+		}
+		params := map[string]string{}
+		if *selfTestMounter != "" {
+			params[mounter.TypeKey] = *selfTestMounter
+		}
+		if *selfTestBucket != "" {
+			params[mounter.BucketKey] = *selfTestBucket
+		}
+		err := driver.SelfTest(params, os.Stdout)
+		driver.Stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	driver.Run()
+	driver.Stop()
 	os.Exit(0)
 }
+
+// splitList splits a comma separated flag, e.g. "a, b", into its entries
+// without surrounding whitespace, empty entries are dropped
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,229 @@
+// Package audit records every bucket and object the driver creates,
+// changes or removes as JSON lines tagged with "audit": true. Auditing is
+// disabled until Open is called, Log and LogSync are no-ops then.
+//
+// Records are buffered and written at most every flushInterval, except
+// those of destructive operations: their intent is written and synced to
+// disk together with the buffered records before the operation starts,
+// and their result once it is done.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	flushInterval = time.Second
+	// resultStarted is the result of the intent record of a destructive
+	// operation
+	resultStarted = "started"
+)
+
+var (
+	auditMu  sync.Mutex
+	auditLog *logger
+)
+
+// current returns the open audit log, nil if auditing is disabled
+func current() *logger {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	return auditLog
+}
+
+// Identity is who an operation is done for, as far as it is known
+type Identity struct {
+	VolumeID string
+	// PVC is the namespace/name of the claim of the volume
+	PVC string
+	PV  string
+}
+
+type identityKey struct{}
+
+// record is a line of the audit log. It only has fields of the operation
+// and its volume, never any of the secrets of the driver.
+type record struct {
+	Time      time.Time `json:"time"`
+	Audit     bool      `json:"audit"`
+	Operation string    `json:"operation"`
+	Bucket    string    `json:"bucket"`
+	Prefix    string    `json:"prefix,omitempty"`
+	VolumeID  string    `json:"volumeId,omitempty"`
+	PVC       string    `json:"pvc,omitempty"`
+	PV        string    `json:"pv,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type logger struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	stop   chan struct{}
+	closed bool
+}
+
+// Open writes the audit log to the file at path, appending to it, or to
+// stdout if path is -
+func Open(path string) error {
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		if file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return fmt.Errorf("failed to open audit log: %v", err)
+		}
+	}
+	l := &logger{file: file, w: bufio.NewWriter(file), stop: make(chan struct{})}
+	auditMu.Lock()
+	auditLog = l
+	auditMu.Unlock()
+	go l.run()
+	return nil
+}
+
+// Close writes the buffered records and closes the audit log. Records of
+// operations which are still running are dropped.
+func Close() error {
+	auditMu.Lock()
+	l := auditLog
+	auditLog = nil
+	auditMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.file == os.Stdout {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// WithIdentity returns ctx holding the identity the operations done with
+// it are recorded with
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// WithIdentityOf returns ctx holding the identity of from, if any
+func WithIdentityOf(ctx, from context.Context) context.Context {
+	if id, ok := from.Value(identityKey{}).(Identity); ok {
+		return WithIdentity(ctx, id)
+	}
+	return ctx
+}
+
+// IdentityFrom returns the identity of ctx, the zero identity if it has
+// none
+func IdentityFrom(ctx context.Context) Identity {
+	id, _ := ctx.Value(identityKey{}).(Identity)
+	return id
+}
+
+// Log records an operation on the bucket and prefix which failed if err
+// points to an error, so it can be deferred like the end of a span. The
+// record is buffered.
+func Log(ctx context.Context, operation, bucket, prefix string, err *error) {
+	if l := current(); l != nil {
+		l.write(newRecord(ctx, operation, bucket, prefix, err), false)
+	}
+}
+
+// LogSync records the intent of a destructive operation and returns once
+// it is synced to disk, so a crash during the operation cannot lose it.
+// The returned function records the result like Log, synced as well, and
+// is meant to be deferred before the operation starts:
+//
+//	defer audit.LogSync(ctx, "RemoveBucket", bucket, "")(&err)
+func LogSync(ctx context.Context, operation, bucket, prefix string) func(err *error) {
+	if l := current(); l != nil {
+		r := newRecord(ctx, operation, bucket, prefix, nil)
+		r.Result = resultStarted
+		l.write(r, true)
+	}
+	return func(err *error) {
+		if l := current(); l != nil {
+			l.write(newRecord(ctx, operation, bucket, prefix, err), true)
+		}
+	}
+}
+
+func newRecord(ctx context.Context, operation, bucket, prefix string, err *error) record {
+	id := IdentityFrom(ctx)
+	r := record{
+		Time:      time.Now().UTC(),
+		Audit:     true,
+		Operation: operation,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		VolumeID:  id.VolumeID,
+		PVC:       id.PVC,
+		PV:        id.PV,
+		Result:    "success",
+	}
+	if err != nil && *err != nil {
+		r.Result = "failure"
+		r.Error = (*err).Error()
+	}
+	return r
+}
+
+func (l *logger) write(r record, sync bool) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Failed to encode audit record of %s: %v", r.Operation, err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.w.Write(append(b, '\n'))
+	if !sync {
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		glog.Errorf("Failed to write audit record of %s: %v", r.Operation, err)
+		return
+	}
+	// stdout cannot be synced if it is a pipe, which is fine
+	if l.file != os.Stdout {
+		if err := l.file.Sync(); err != nil {
+			glog.Errorf("Failed to sync audit record of %s: %v", r.Operation, err)
+		}
+	}
+}
+
+// run writes the buffered records every flushInterval until the log is
+// closed
+func (l *logger) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if err := l.w.Flush(); err != nil {
+				glog.Errorf("Failed to write audit records: %v", err)
+			}
+			l.mu.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readRecords(t *testing.T, path string) []record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestLog(t *testing.T) {
+	// disabled until opened
+	Log(context.Background(), "CreateBucket", "bucket", "", nil)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	ctx := WithIdentity(context.Background(), Identity{VolumeID: "shared/pvc-a", PVC: "team/data", PV: "pv-a"})
+	var err1 error
+	Log(ctx, "SetFSMeta", "shared", "pvc-a", &err1)
+	done := LogSync(WithIdentityOf(context.Background(), ctx), "RemovePrefix", "shared", "pvc-a")
+
+	// the intent of the destructive operation is written with the buffered
+	// records before it starts
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if r := records[0]; !r.Audit || r.Operation != "SetFSMeta" || r.Result != "success" || r.Error != "" ||
+		r.VolumeID != "shared/pvc-a" || r.PVC != "team/data" || r.PV != "pv-a" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r := records[1]; r.Operation != "RemovePrefix" || r.Bucket != "shared" || r.Prefix != "pvc-a" ||
+		r.Result != resultStarted || r.Error != "" || r.VolumeID != "shared/pvc-a" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	err2 := errors.New("access denied")
+	done(&err2)
+	records = readRecords(t, path)
+	if len(records) != 3 {
+		t.Fatalf("expected the result to be written, got %+v", records)
+	}
+	if r := records[2]; r.Operation != "RemovePrefix" || r.Result != "failure" || r.Error != "access denied" || r.VolumeID != "shared/pvc-a" {
+		t.Errorf("unexpected record %+v", r)
+	}
+
+	Log(context.Background(), "CreateBucket", "other", "", nil)
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if records := readRecords(t, path); len(records) != 4 || records[3].VolumeID != "" {
+		t.Fatalf("expected the buffered record to be written on close, got %+v", records)
+	}
+}
+
+func TestLogConcurrentlyWithClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			var err error
+			LogSync(context.Background(), "RemoveBucket", "bucket", "")(&err)
+		}
+	}()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	for _, r := range readRecords(t, path) {
+		if r.Operation != "RemoveBucket" {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
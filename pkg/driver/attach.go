@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// attacher records the nodes volumes are attached to in their metadata,
+// so a volume of a mounter which must only run on one node is never
+// attached to a second one. The zero value does not record anything.
+type attacher struct {
+	enabled bool
+
+	// mu serializes the updates of the metadata, the controller runs as
+	// a single leader
+	mu sync.Mutex
+}
+
+// otherAttachments returns the nodes other than nodeID the volume is
+// attached to. Attachments never expire: the time of an attachment does
+// not tell if the node still mounts the volume, a node which is gone is
+// detached by Kubernetes.
+func otherAttachments(meta *s3.FSMeta, nodeID string) []string {
+	var nodes []string
+	for node := range meta.Attachments {
+		if node != nodeID {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if _, _, err := parseVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if !cs.attach.enabled || isReferenceVolume(volumeID) {
+		// nothing to record, the metadata of a reference volume is never
+		// written
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	cs.attach.mu.Lock()
+	defer cs.attach.mu.Unlock()
+	client, meta, err := cs.attachedMeta(ctx, volumeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	nodeID := req.GetNodeId()
+	if _, ok := meta.Attachments[nodeID]; ok {
+		glog.V(4).Infof("Volume %s is already attached to node %s", volumeID, nodeID)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	c, err := mounter.GetCapabilities(meta.Mounter)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if c.SingleNode() {
+		if nodes := otherAttachments(meta, nodeID); len(nodes) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s of mounter %s is attached to node %s, it cannot be attached to more than one node",
+				volumeID, meta.Mounter, strings.Join(nodes, ", "))
+		}
+	}
+	if meta.Attachments == nil {
+		meta.Attachments = make(map[string]time.Time)
+	}
+	meta.Attachments[nodeID] = time.Now()
+	if err := client.SetFSMeta(meta); err != nil {
+		return nil, s3Error(err, "failed to record the attachment of volume %s to node %s", volumeID, nodeID)
+	}
+	glog.V(2).Infof("Attached volume %s to node %s", volumeID, nodeID)
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if _, _, err := parseVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	if !cs.attach.enabled || isReferenceVolume(volumeID) {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	cs.attach.mu.Lock()
+	defer cs.attach.mu.Unlock()
+	client, meta, err := cs.attachedMeta(ctx, volumeID, req.GetSecrets())
+	if status.Code(err) == codes.NotFound {
+		// the volume is gone, so is its attachment
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// an empty node ID detaches the volume from all nodes
+	nodeID := req.GetNodeId()
+	var detached []string
+	for node := range meta.Attachments {
+		if nodeID == "" || node == nodeID {
+			detached = append(detached, node)
+			delete(meta.Attachments, node)
+		}
+	}
+	if len(detached) == 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		return nil, s3Error(err, "failed to clear the attachment of volume %s", volumeID)
+	}
+	sort.Strings(detached)
+	glog.V(2).Infof("Detached volume %s from node %s", volumeID, strings.Join(detached, ", "))
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// metaStore reads and writes the metadata of volumes
+type metaStore interface {
+	GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error)
+	SetFSMeta(meta *s3.FSMeta) error
+}
+
+// attachedMeta reads the metadata of a volume to record its attachments
+func (cs *controllerServer) attachedMeta(ctx context.Context, volumeID string, secrets map[string]string) (metaStore, *s3.FSMeta, error) {
+	client, err := s3.NewClientFromSecret(cs.defaultSecret.orDefault(secrets))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	client = client.WithContext(ctx)
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if errors.Is(err, s3.ErrBucketNotFound) || errors.Is(err, s3.ErrObjectNotFound) {
+		return nil, nil, status.Errorf(codes.NotFound, "volume %s does not exist", volumeID)
+	}
+	if err != nil {
+		return nil, nil, s3Error(err, "failed to get metadata of volume %s", volumeID)
+	}
+	return client, meta, nil
+}
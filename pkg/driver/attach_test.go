@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newAttachingControllerServer() *controllerServer {
+	cs := newTestControllerServer()
+	cs.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	})
+	cs.attach = attacher{enabled: true}
+	return cs
+}
+
+func publishRequest(volumeID, nodeID string, secrets map[string]string) *csi.ControllerPublishVolumeRequest {
+	return &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeID,
+		Secrets:  secrets,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+// attachments returns the nodes recorded in the metadata of the volume
+func attachments(t *testing.T, srv *s3test.Server, volumeID string) map[string]time.Time {
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta(volumeID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta.Attachments
+}
+
+func TestAttachDisabled(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-unattached", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	puts := srv.Requests("PUT")
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-unattached", "node-a", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-unattached", NodeId: "node-a", Secrets: srv.Secret()}
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests("PUT") != puts {
+		t.Fatal("expected attaching to be a no-op")
+	}
+}
+
+func TestAttachSingleNodeMounter(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newAttachingControllerServer()
+	req := createVolumeRequest("pvc-block", srv.Secret())
+	req.Parameters["mounter"] = "s3backer"
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-block", "node-a", srv.Secret())); err != nil {
+			t.Fatalf("expected attaching to be idempotent: %v", err)
+		}
+	}
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-block", "node-b", srv.Secret())); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	unpublish := &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-block", NodeId: "node-a", Secrets: srv.Secret()}
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), unpublish); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-block", "node-b", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := attachments(t, srv, "pvc-block"); len(nodes) != 1 || nodes["node-b"].IsZero() {
+		t.Fatalf("expected the volume to be attached to node-b only, got %v", nodes)
+	}
+
+	// node-b went away without detaching the volume
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-block", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Attachments["node-b"] = time.Now().Add(-2 * time.Hour)
+	b, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("pvc-block", ".metadata.json", b)
+	// the node might still mount the volume, however old its attachment is
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-block", "node-c", srv.Secret())); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected an old attachment to be kept, got %v", err)
+	}
+	if nodes := attachments(t, srv, "pvc-block"); len(nodes) != 1 || nodes["node-b"].IsZero() {
+		t.Fatalf("expected the volume to be attached to node-b only, got %v", nodes)
+	}
+}
+
+func TestAttachMultiNodeMounter(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newAttachingControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-shared", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []string{"node-a", "node-b"} {
+		if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-shared", node, srv.Secret())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nodes := attachments(t, srv, "pvc-shared"); len(nodes) != 2 {
+		t.Fatalf("expected the volume to be attached to both nodes, got %v", nodes)
+	}
+
+	// an empty node ID detaches the volume from all nodes
+	unpublish := &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-shared", Secrets: srv.Secret()}
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), unpublish); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := attachments(t, srv, "pvc-shared"); len(nodes) != 0 {
+		t.Fatalf("expected the volume to be detached, got %v", nodes)
+	}
+
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest("pvc-missing", "node-a", srv.Secret())); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	unpublish.VolumeId = "pvc-missing"
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), unpublish); err != nil {
+		t.Fatalf("expected a missing volume to be detached, got %v", err)
+	}
+}
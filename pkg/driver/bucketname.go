@@ -0,0 +1,34 @@
+package driver
+
+import (
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkBucketName validates the bucket parameter of a storage class with
+// strict bucket names and returns it without surrounding whitespace.
+// Unlike generated names, it is never lowercased or otherwise changed
+// silently, as that would provision the volume in another bucket than the
+// one asked for. The error names the bucket which would be valid instead.
+func checkBucketName(bucketName string) (string, error) {
+	bucketName = strings.TrimSpace(bucketName)
+	var changes []string
+	if strings.ToLower(bucketName) != bucketName {
+		changes = append(changes, "lowercase the uppercase letters")
+	}
+	if strings.Contains(bucketName, "_") {
+		changes = append(changes, "replace the underscores with hyphens")
+	}
+	if len(changes) > 0 {
+		valid := strings.ReplaceAll(strings.ToLower(bucketName), "_", "-")
+		return "", status.Errorf(codes.InvalidArgument, "%s %s is not a valid bucket name, %s: use %s %s", mounter.BucketKey, bucketName, strings.Join(changes, " and "), mounter.BucketKey, valid)
+	}
+	if err := s3utils.CheckValidBucketNameStrict(bucketName); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s is not a valid bucket name: %v", mounter.BucketKey, bucketName, err)
+	}
+	return bucketName, nil
+}
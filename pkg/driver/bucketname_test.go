@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckBucketName(t *testing.T) {
+	tests := []struct {
+		bucketName string
+		expected   string
+		// hint is part of the error of an invalid name
+		hint string
+	}{
+		{bucketName: "my-data", expected: "my-data"},
+		{bucketName: " my-data\n", expected: "my-data"},
+		{bucketName: "MyData", hint: "use bucket mydata"},
+		{bucketName: "my_data", hint: "replace the underscores with hyphens: use bucket my-data"},
+		{bucketName: "My_Data", hint: "lowercase the uppercase letters and replace the underscores with hyphens: use bucket my-data"},
+		{bucketName: "my..data", hint: "not a valid bucket name"},
+		{bucketName: "ab", hint: "not a valid bucket name"},
+	}
+	for _, test := range tests {
+		bucketName, err := checkBucketName(test.bucketName)
+		if test.hint == "" {
+			if err != nil || bucketName != test.expected {
+				t.Errorf("%q: expected %s, got %s, %v", test.bucketName, test.expected, bucketName, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), test.hint) {
+			t.Errorf("%q: expected InvalidArgument with %q, got %v", test.bucketName, test.hint, err)
+		}
+	}
+}
+
+func TestCreateVolumeStrictBucketNames(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	cs.strictBucketNames = true
+	req := createVolumeRequest("pvc-strict", srv.Secret())
+	req.Parameters[mounter.BucketKey] = "Shared_Data"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "use bucket shared-data") {
+		t.Fatalf("expected InvalidArgument naming the valid bucket, got %v", err)
+	}
+	if srv.BucketExists("shared-data") || srv.BucketExists("Shared_Data") {
+		t.Fatal("expected no bucket to be created")
+	}
+	req.Parameters[mounter.BucketKey] = "shared-data "
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.GetVolume().GetVolumeId(); id != "shared-data/pvc-strict" {
+		t.Fatalf("unexpected volume ID %s", id)
+	}
+}
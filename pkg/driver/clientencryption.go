@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// clientEncryptionKeyRefKey names the key of the node publish secret
+// holding the passphrase of a client-side encrypted volume
+const clientEncryptionKeyRefKey = "clientEncryptionKeyRef"
+
+// clientEncryptionPassphrase returns the passphrase to mount the volume
+// with. The metadata decides if a volume is encrypted, so an encrypted
+// volume is never mounted without its passphrase and vice versa.
+func clientEncryptionPassphrase(meta *s3.FSMeta, volumeContext, secrets map[string]string) (string, error) {
+	ref := volumeContext[clientEncryptionKeyRefKey]
+	if !meta.ClientEncrypted {
+		if ref != "" {
+			return "", fmt.Errorf("volume was not created with client-side encryption, but %s is set", clientEncryptionKeyRefKey)
+		}
+		return "", nil
+	}
+	if ref == "" {
+		return "", fmt.Errorf("volume is client-side encrypted, but %s is not set", clientEncryptionKeyRefKey)
+	}
+	passphrase := secrets[ref]
+	if passphrase == "" {
+		return "", fmt.Errorf("volume is client-side encrypted, but the secret has no key %s", ref)
+	}
+	return passphrase, nil
+}
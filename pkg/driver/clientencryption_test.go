@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeClientEncryption(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-encrypted", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters[clientEncryptionKeyRefKey] = "passphrase"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-encrypted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.ClientEncrypted {
+		t.Fatal("expected the volume to be recorded as client-side encrypted")
+	}
+
+	// the same volume without encryption would expose the ciphertext
+	delete(req.Parameters, clientEncryptionKeyRefKey)
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+
+	req = createVolumeRequest("pvc-encrypted-s3fs", srv.Secret())
+	req.Parameters[clientEncryptionKeyRefKey] = "passphrase"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestClientEncryptionPassphrase(t *testing.T) {
+	secrets := map[string]string{"passphrase": "secret"}
+	tests := []struct {
+		name       string
+		encrypted  bool
+		ref        string
+		passphrase string
+		invalid    bool
+	}{
+		{name: "unencrypted"},
+		{name: "encrypted", encrypted: true, ref: "passphrase", passphrase: "secret"},
+		{name: "missing reference", encrypted: true, invalid: true},
+		{name: "missing key", encrypted: true, ref: "other", invalid: true},
+		{name: "not encrypted", ref: "passphrase", invalid: true},
+	}
+	for _, test := range tests {
+		volumeContext := map[string]string{}
+		if test.ref != "" {
+			volumeContext[clientEncryptionKeyRefKey] = test.ref
+		}
+		passphrase, err := clientEncryptionPassphrase(&s3.FSMeta{ClientEncrypted: test.encrypted}, volumeContext, secrets)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil || passphrase != test.passphrase {
+			t.Errorf("%s: expected passphrase %q, got %q: %v", test.name, test.passphrase, passphrase, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"path"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metaReader reads the metadata of volumes
+type metaReader interface {
+	GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error)
+}
+
+// metaIdentity reports if the metadata belongs to the volume requested
+// with name. known is false for metadata written by older versions, which
+// did not record the name of the volume.
+func metaIdentity(meta *s3.FSMeta, name, pvName string) (matches, known bool) {
+	switch {
+	case meta.VolumeName != "":
+		return meta.VolumeName == name, true
+	case meta.PVName != "" && pvName != "":
+		return meta.PVName == pvName, true
+	}
+	return false, false
+}
+
+// collisionSuffix is appended to the prefix of a volume whose sanitized
+// name collides with the prefix of another volume. It is derived from
+// the name, so every retry resolves the same prefix.
+func collisionSuffix(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return "-" + hex.EncodeToString(sum[:4])
+}
+
+// resolvePrefix returns the prefix of the volume requested with name in an
+// existing bucket. Two names can be sanitized to the same volume ID, e.g.
+// if they only differ by case. If the prefix belongs to another volume,
+// the prefix with the collision suffix is used instead. Metadata of older
+// versions, which do not record the name, belongs to any name sanitized to
+// its prefix. A volume without prefix owns the whole bucket, so it has no
+// alternative.
+func resolvePrefix(client metaReader, bucketName, prefix, name, pvName string) (string, error) {
+	candidates := []string{prefix}
+	if prefix != "" {
+		candidates = append(candidates, prefix+collisionSuffix(name))
+	}
+	for _, candidate := range candidates {
+		location := path.Join(bucketName, candidate)
+		meta, err := client.GetFSMeta(bucketName, candidate)
+		if errors.Is(err, s3.ErrObjectNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", s3Error(err, "failed to get metadata of %s", location)
+		}
+		matches, known := metaIdentity(meta, name, pvName)
+		if !known && candidate == prefix && path.Base(prefix) == sanitizeVolumeID(name) {
+			// older versions used the prefix of the sanitized name for every
+			// name sanitized to it, the volume is taken over like they did
+			glog.Warningf("Metadata at %s does not record the name of its volume, assuming it is volume %s", location, name)
+			matches, known = true, true
+		}
+		if !known {
+			return "", status.Errorf(codes.AlreadyExists, "%s belongs to a volume whose metadata does not record its name, unable to tell if it is the volume %s", location, name)
+		}
+		if matches {
+			return candidate, nil
+		}
+		other := meta.VolumeName
+		if other == "" {
+			other = meta.PVName
+		}
+		glog.Warningf("Volume %s collides with volume %s at %s", name, other, location)
+	}
+	return "", status.Errorf(codes.AlreadyExists, "the volume ID of %s collides with the volume ID of another volume", name)
+}
@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeCollidingNames(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	cs := newTestControllerServer()
+
+	create := func(name string) (string, error) {
+		req := createVolumeRequest(name, srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		resp, err := cs.CreateVolume(context.Background(), req)
+		return resp.GetVolume().GetVolumeId(), err
+	}
+	// both names are sanitized to the volume ID shared/pvc-data
+	first, err := create("pvc-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := create("PVC-Data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "shared/pvc-data" || second != "shared/pvc-data"+collisionSuffix("PVC-Data") {
+		t.Fatalf("expected the second volume to get a prefix of its own, got %s and %s", first, second)
+	}
+	// retries resolve the same volumes
+	for name, expected := range map[string]string{"pvc-data": first, "PVC-Data": second} {
+		if volumeID, err := create(name); err != nil || volumeID != expected {
+			t.Fatalf("%s: expected volume %s on retry, got %s: %v", name, expected, volumeID, err)
+		}
+	}
+
+	// metadata of older versions does not tell which volume it belongs to
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFSMeta(&s3.FSMeta{BucketName: "shared", Prefix: "pvc-old", FSPath: defaultFsPath}); err != nil {
+		t.Fatal(err)
+	}
+	if volumeID, err := create("PVC-Old"); err != nil || volumeID != "shared/pvc-old" {
+		t.Fatalf("expected the volume of the sanitized name, got %s: %v", volumeID, err)
+	}
+	// which records the name from then on
+	if volumeID, err := create("pvc-old"); err != nil || volumeID != "shared/pvc-old"+collisionSuffix("pvc-old") {
+		t.Fatalf("expected the other name to get a prefix of its own, got %s: %v", volumeID, err)
+	}
+	// metadata at a prefix not derived from the name is never taken over
+	if err := client.SetFSMeta(&s3.FSMeta{BucketName: "shared", Prefix: "pvc-other" + collisionSuffix("PVC-Other"), FSPath: defaultFsPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFSMeta(&s3.FSMeta{BucketName: "shared", Prefix: "pvc-other", VolumeName: "pvc-other", FSPath: defaultFsPath}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := create("PVC-Other"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+
+	// a volume without prefix owns its bucket, there is no alternative
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-bucket", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("PVC-Bucket", srv.Secret())); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: second, Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-data/.metadata.json") == nil {
+		t.Fatal("expected the volume of the first name to be kept")
+	}
+}
@@ -19,11 +19,15 @@ package driver
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ctrox/csi-s3/pkg/audit"
 	"github.com/ctrox/csi-s3/pkg/mounter"
 	"github.com/ctrox/csi-s3/pkg/s3"
 	"github.com/golang/glog"
@@ -32,18 +36,81 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	events        eventRecorder
+	defaultSecret defaultSecret
+	// adoptEmptyBuckets treats empty buckets without metadata which are
+	// named after the volume as created by csi-s3
+	adoptEmptyBuckets bool
+	// disableBucketCreation only provisions volumes in existing buckets
+	disableBucketCreation bool
+	// maxPrefixDepth is the most slashes allowed in the prefix of a volume,
+	// 0 does not limit it
+	maxPrefixDepth int
+	// strictBucketNames rejects bucket parameters which are not valid
+	// bucket names instead of passing them to the backend
+	strictBucketNames bool
+	// defaultCapacityBytes is the capacity of volumes requested without
+	// one, 0 leaves them unbounded
+	defaultCapacityBytes int64
+	// attach records the nodes volumes are attached to, if enabled
+	attach attacher
+	// quotas limits the capacity of the volumes of a namespace, nil if
+	// they are not enforced
+	quotas *namespaceQuotas
+	// missingMetaPolicy is what DeleteVolume does with a volume whose
+	// metadata cannot be read, empty fails the deletion
+	missingMetaPolicy string
 }
 
 const (
 	defaultFsPath = "csi-fs"
+	// fsPathKey overrides the directory below the prefix of a volume its
+	// data is stored in, "/" stores the data in the prefix itself
+	fsPathKey = "fsPath"
+	// pvNameKey is passed by the external-provisioner when started with --extra-create-metadata
+	pvNameKey = "csi.storage.k8s.io/pv/name"
+
+	replicationTargetArnKey    = "replicationTargetArn"
+	replicationTargetBucketKey = "replicationTargetBucket"
+	// replicationBestEffortKey provisions the volume even if replication
+	// could not be configured
+	replicationBestEffortKey = "replicationBestEffort"
+	// replicationRoleKey and replicationDestinationKey replicate the whole
+	// bucket of the volume, e.g. to a bucket in another region on AWS
+	replicationRoleKey        = "replicationRole"
+	replicationDestinationKey = "replicationDestination"
+	// objectOwnershipKey sets the object ownership of created buckets
+	objectOwnershipKey = "objectOwnership"
+	// deleteProtectionKey protects the volume from deletion until the
+	// protection is cleared with --clear-delete-protection
+	deleteProtectionKey = "deleteProtection"
+	// createBucketKey set to false only provisions volumes in existing buckets
+	createBucketKey = "createBucket"
+	// metadataPolicyKey set to immutable never overwrites the metadata of
+	// the volume, for write-once backends
+	metadataPolicyKey = "metadataPolicy"
+	// grantReadKey and grantWriteKey share the objects written by the
+	// driver with canonical user IDs or email addresses, grantsRequiredKey
+	// fails the provisioning if the backend does not support grants
+	grantReadKey      = "grantRead"
+	grantWriteKey     = "grantWrite"
+	grantsRequiredKey = "grantsRequired"
+	// locationKey is added to the volume context of a created volume, it
+	// shows the URL of its data on the PV
+	locationKey = "csi-s3.ctrox.dev/location"
+
+	// foreignObjectsLimit is the most objects counted in a bucket before
+	// it is removed with a volume
+	foreignObjectsLimit = 1000
 )
 
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (_ *csi.CreateVolumeResponse, err error) {
 	params := req.GetParameters()
 
 	volumeID := sanitizeVolumeID(req.GetName())
@@ -52,13 +119,18 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	// check if bucket name is overridden
 	if nameOverride, ok := params[mounter.BucketKey]; ok {
+		if cs.strictBucketNames {
+			if nameOverride, err = checkBucketName(nameOverride); err != nil {
+				return nil, err
+			}
+		}
 		bucketName = nameOverride
 		prefix = volumeID
 		volumeID = path.Join(bucketName, prefix)
 	}
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("invalid create volume req: %v", req)
+		glog.V(3).Infof("invalid create volume req: %s", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
 
@@ -69,114 +141,810 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	if err := validateMounterCapabilities(params[mounter.TypeKey], req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := mounter.ValidateUnprivileged(params[mounter.TypeKey]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cacheMode := params[mounter.CacheModeKey]
+	if err := mounter.ValidateCacheMode(params[mounter.TypeKey], cacheMode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	smallFileCacheMB, err := mounter.ParseSmallFileCache(params[mounter.TypeKey], cacheMode, params[mounter.SmallFileCacheKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cacheOnlyOnError, err := mounter.ParseCacheOnlyOnError(params[mounter.TypeKey], cacheMode, params[mounter.CacheOnlyOnErrorKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mimeTypesFile, err := mounter.ParseMimeTypesFile(params[mounter.TypeKey], params[mounter.MimeTypesFileKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	consistency, err := mounter.ParseConsistency(params[mounter.TypeKey], params[mounter.ConsistencyKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// caches of data would outlive the attributes strict consistency expires
+	if consistency == mounter.ConsistencyStrict {
+		switch {
+		case smallFileCacheMB > 0:
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with %s %s", mounter.SmallFileCacheKey, mounter.ConsistencyKey, consistency)
+		case cacheOnlyOnError:
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with %s %s", mounter.CacheOnlyOnErrorKey, mounter.ConsistencyKey, consistency)
+		}
+	}
+	checksumAlgorithm, err := mounter.ParseChecksumAlgorithm(params[mounter.TypeKey], params[mounter.ChecksumAlgorithmKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	keyEncoding, err := mounter.ParseKeyEncoding(params[mounter.TypeKey], params[mounter.KeyEncodingKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	env, err := mounter.ParseEnv(params[mounter.TypeKey], params[mounter.EnvKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := mounter.ParseRemotePath(params[mounter.TypeKey], params[mounter.RemotePathKey]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	objectTags, err := parseObjectTags(params[mounter.TypeKey], params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the remote of the config is not necessarily S3
+	if objectTags != nil && params[mounter.RemotePathKey] != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s", mounter.ObjectTagsKey, mounter.RemotePathKey)
+	}
+	s3backerOptions, err := mounter.ParseS3backerOptions(params[mounter.TypeKey], params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	kmsOptions, err := mounter.ParseKMSOptions(params[mounter.TypeKey], params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// volumes created before the options existed are left as they are
+	newS3backerOptions := s3backerOptions
+	if newS3backerOptions == nil {
+		newS3backerOptions = mounter.DefaultS3backerOptions(params[mounter.TypeKey])
+	}
+	fsPath, err := parseFSPath(params[fsPathKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	prefetchOpts, err := parsePrefetch(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if prefetchOpts != nil && cacheMode == mounter.CacheModeNone {
+		return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with %s %s, nothing would keep the prefetched data", prefetchKey, mounter.CacheModeKey, cacheMode)
+	}
+	if prefetchOpts != nil && consistency == mounter.ConsistencyStrict {
+		return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with %s %s, nothing would keep the prefetched data", prefetchKey, mounter.ConsistencyKey, consistency)
+	}
+	prefixes, err := parsePrefixes(params[mounter.PrefixesKey])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if prefixes != nil {
+		if err := mounter.ValidatePrefixes(params[mounter.TypeKey]); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		// the prefixes are looked up in the bucket, which must not be the
+		// volume's own
+		if prefix == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s requires a %s", mounter.PrefixesKey, mounter.BucketKey)
+		}
+		for _, key := range []string{fsPathKey, seedFromKey, provisioningModeKey} {
+			if params[key] != "" {
+				return nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s", mounter.PrefixesKey, key)
+			}
+		}
+	}
+	if _, err := readinessMarker(params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseMountLinger(params, 0); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	seedFrom := params[seedFromKey]
+	var seedBucket, seedPrefix string
+	if seedFrom != "" {
+		if seedBucket, seedPrefix, err = parseSeedFrom(seedFrom); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		seedFrom = path.Join(seedBucket, seedPrefix)
+	}
+	deleteProtection := params[deleteProtectionKey] == "true"
+	createBucket := !cs.disableBucketCreation && params[createBucketKey] != "false"
+	clientEncrypted := params[clientEncryptionKeyRefKey] != ""
+	if clientEncrypted {
+		if err := mounter.ValidateClientEncryption(params[mounter.TypeKey]); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		// the copied objects would not be encrypted by the mounter
+		if seedFrom != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s", seedFromKey, clientEncryptionKeyRefKey)
+		}
+	}
+
+	if err := cs.checkPrefixDepth(prefix); err != nil {
+		return nil, err
+	}
+	if (&s3.FSMeta{Prefix: prefix, FSPath: fsPath}).DataContainsControlObjects() {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s requires a %s and the control prefix, the metadata of the volume would be stored in its data", fsPathKey, params[fsPathKey], mounter.BucketKey)
+	}
+
+	switch params[provisioningModeKey] {
+	case "":
+	case provisioningModeNone:
+		return cs.createReferenceVolume(ctx, req)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %s", provisioningModeKey, params[provisioningModeKey])
+	}
+
+	if params[replicationTargetArnKey] != "" && params[replicationTargetBucketKey] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s requires %s", replicationTargetArnKey, replicationTargetBucketKey)
+	}
+	var bucketReplication *s3.ReplicationTarget
+	if role, dest := params[replicationRoleKey], params[replicationDestinationKey]; role != "" || dest != "" {
+		if role == "" || dest == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s and %s must be set together", replicationRoleKey, replicationDestinationKey)
+		}
+		if params[replicationTargetArnKey] != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s", replicationRoleKey, replicationTargetArnKey)
+		}
+		bucketReplication = &s3.ReplicationTarget{Arn: role, Bucket: dest}
+		if err := bucketReplication.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid bucket replication: %v", err)
+		}
+	}
+
+	metadataPolicy := params[metadataPolicyKey]
+	if metadataPolicy != "" && metadataPolicy != s3.MetadataPolicyImmutable {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %s", metadataPolicyKey, metadataPolicy)
+	}
+
+	ownership := params[objectOwnershipKey]
+	if ownership != "" && !s3.ValidObjectOwnership(ownership) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %s", objectOwnershipKey, ownership)
+	}
+
+	grants, err := parseGrants(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !grants.Empty() && ownership == s3.OwnershipBucketOwnerEnforced {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s disables ACLs, objects cannot be written with grants", objectOwnershipKey, ownership)
+	}
 
-	capacityBytes := int64(req.GetCapacityRange().GetRequiredBytes())
+	capacityBytes := cs.volumeCapacity(req.GetCapacityRange())
 
-	mounter := params[mounter.TypeKey]
+	mounterType := params[mounter.TypeKey]
+	pvName := params[pvNameKey]
+	ctx = audit.WithIdentity(ctx, audit.Identity{VolumeID: volumeID, PVC: pvcIdentity(params), PV: pvName})
 
 	glog.V(4).Infof("Got a request to create volume %s", volumeID)
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	secrets := cs.defaultSecret.orDefault(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(secrets)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
+	if err := mounter.ValidateEndpoint(mounterType, client.Config); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := mounter.ValidateKeyCaseSensitivity(mounterType, client.Config); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkContext(ctx, "checking if bucket "+bucketName+" exists"); err != nil {
+		return nil, err
+	}
+	var quotaNamespace string
+	if cs.quotas.enabled() {
+		quotaNamespace = params[pvcNamespaceKey]
+		// the usage is written without the grants of the volume
+		quotaClient := client.WithContext(ctx)
+		// assigned to the named result, which the release below checks
+		var reserved bool
+		reserved, err = cs.quotas.reserve(quotaClient, quotaNamespace, req.GetName(), capacityBytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cs.quotas.limit(quotaNamespace); !ok {
+			quotaNamespace = ""
+		}
+		if reserved {
+			// a later failure must not keep the capacity of the volume
+			defer func() {
+				if err != nil {
+					if releaseErr := cs.quotas.release(quotaClient, quotaNamespace, req.GetName()); releaseErr != nil {
+						glog.Warningf("Failed to release volume %s from the quota of namespace %s: %v", req.GetName(), quotaNamespace, releaseErr)
+					}
+				}
+			}()
+		}
+	}
+	client = client.WithContext(ctx).WithGrants(grants).WithChecksum(checksumAlgorithm).WithKMS(kmsOptions)
 	exists, err := client.BucketExists(bucketName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if bucket %s exists: %v", volumeID, err)
+		return nil, s3Error(err, "failed to check if bucket %s exists", volumeID)
+	}
+	// the seed source of a volume in an existing bucket is checked once its
+	// metadata tells whether it has been seeded already
+	if seedFrom != "" && !exists {
+		if err := checkSeedSource(client, seedBucket, seedPrefix); err != nil {
+			return nil, err
+		}
+	}
+	createdConcurrently := false
+	if !exists {
+		if !createBucket {
+			return nil, status.Errorf(codes.FailedPrecondition, "bucket %s does not exist and bucket creation is disabled", bucketName)
+		}
+		if err := checkContext(ctx, "creating bucket "+bucketName); err != nil {
+			return nil, err
+		}
+		err = client.CreateBucket(bucketName)
+		if errors.Is(err, s3.ErrBucketAlreadyExists) {
+			// another volume in the same bucket won the race, the volume is
+			// provisioned like one in an existing bucket. A bucket owned by
+			// someone else fails once the metadata is written.
+			glog.Infof("Bucket %s of volume %s has been created concurrently", bucketName, volumeID)
+			exists = true
+			createdConcurrently = true
+		} else if err != nil {
+			return nil, s3Error(err, "failed to create bucket %s", bucketName)
+		}
+	}
+	if exists {
+		if prefix, err = resolvePrefix(client, bucketName, prefix, req.GetName(), pvName); err != nil {
+			return nil, err
+		}
+		if prefix != "" {
+			volumeID = path.Join(bucketName, prefix)
+			ctx = audit.WithIdentity(ctx, audit.Identity{VolumeID: volumeID, PVC: pvcIdentity(params), PV: pvName})
+			client = client.WithContext(ctx)
+		}
+		if err := checkContext(ctx, "reading the metadata of volume "+volumeID); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPrefixesOfVolume(prefixes, prefix); err != nil {
+		return nil, err
 	}
 	var meta *s3.FSMeta
 	if exists {
 		meta, err = client.GetFSMeta(bucketName, prefix)
-
+		if errors.Is(err, s3.ErrObjectNotFound) {
+			// the volume is created in existing data for the first time
+			dataPrefix := prefix
+			if dataPrefix == "" {
+				dataPrefix = fsPath
+			}
+			if err := checkExpectedData(client, params, bucketName, prefix, dataPrefix); err != nil {
+				return nil, err
+			}
+			// existing data is never overwritten by the seed
+			if seedFrom != "" {
+				empty, err := client.IsEmpty(bucketName, s3.DirPrefix(path.Join(prefix, fsPath)))
+				if err != nil {
+					return nil, s3Error(err, "failed to check if volume %s is empty", volumeID)
+				}
+				if !empty {
+					return nil, status.Errorf(codes.FailedPrecondition, "volume %s already contains data, it cannot be seeded with %s %s", volumeID, seedFromKey, seedFrom)
+				}
+			}
+			// the metadata might have been expired by a lifecycle rule
+			meta, err = client.RecoverFSMeta(bucketName, prefix, fsPath)
+			if err == nil {
+				glog.Warningf("Metadata of volume %s is missing, recovered it from the existing data", volumeID)
+				meta.CapacityBytes = capacityBytes
+				meta.ClientEncrypted = clientEncrypted
+			}
+		}
+		if err != nil && !errors.Is(err, s3.ErrObjectNotFound) {
+			return nil, s3Error(err, "failed to get metadata of bucket %s", volumeID)
+		}
+		// a retry after the seed completed does not need the source anymore,
+		// it may have been removed in the meantime
+		if seedFrom != "" && (meta == nil || !meta.Seeded) {
+			if err := checkSeedSource(client, seedBucket, seedPrefix); err != nil {
+				return nil, err
+			}
+		}
 		if err != nil {
 			glog.Warningf("Bucket %s exists, but failed to get its metadata: %v", volumeID, err)
+			// an empty bucket named after the volume is what a failed
+			// attempt before writing the metadata leaves behind
+			// a bucket csi-s3 may not create is never removed either
+			adopt := false
+			// the bucket may be left behind by an attempt which failed to
+			// remove it, or have been created by someone else
+			recovered := prefix == "" && !createdConcurrently
+			if createdConcurrently && prefix == "" {
+				// a concurrent attempt for the same volume created the
+				// bucket and has not written its metadata yet, which must
+				// not be overwritten with a bucket that is never removed
+				adopt = true
+			} else if cs.adoptEmptyBuckets && createBucket && prefix == "" {
+				if adopt, err = client.IsEmpty(bucketName, ""); err != nil {
+					return nil, s3Error(err, "failed to check if bucket %s is empty", bucketName)
+				}
+				if adopt {
+					glog.Infof("Adopting empty bucket %s without metadata as created by csi-s3", bucketName)
+				}
+			}
+			if recovered && !adopt {
+				if adopt, err = client.RecoveredOwnsBucket(bucketName); err != nil {
+					return nil, s3Error(err, "failed to check if bucket %s has been retained", bucketName)
+				}
+			}
+			if err := checkManagedPrefixes(client, bucketName, prefixes); err != nil {
+				return nil, err
+			}
+			if err := checkPrefixesOfBucket(client, bucketName, prefix, prefixes); err != nil {
+				return nil, err
+			}
+			// data already below the prefix is retained on deletion
+			prefixCreated := adopt
+			if prefix != "" {
+				if prefixCreated, err = client.IsEmpty(bucketName, s3.DirPrefix(prefix)); err != nil {
+					return nil, s3Error(err, "failed to check if prefix %s is empty", prefix)
+				}
+				if !prefixCreated {
+					glog.Infof("Prefix %s of bucket %s already contains data, it will be retained on deletion", prefix, bucketName)
+				}
+			}
 			meta = &s3.FSMeta{
-				BucketName:    bucketName,
-				Prefix:        prefix,
-				Mounter:       mounter,
-				CapacityBytes: capacityBytes,
-				FSPath:        defaultFsPath,
-				CreatedByCsi:  false,
+				BucketName:         bucketName,
+				Prefix:             prefix,
+				Mounter:            mounterType,
+				CapacityBytes:      capacityBytes,
+				FSPath:             fsPath,
+				CreatedByCsi:       adopt,
+				CreatedByVersion:   vendorVersion,
+				PVName:             pvName,
+				VolumeName:         req.GetName(),
+				Recovered:          recovered,
+				CacheMode:          cacheMode,
+				SmallFileCacheMB:   smallFileCacheMB,
+				CacheOnlyOnError:   cacheOnlyOnError,
+				Consistency:        consistency,
+				MimeTypesFile:      mimeTypesFile,
+				ChecksumAlgorithm:  checksumAlgorithm,
+				KeyEncoding:        keyEncoding,
+				Prefetch:           prefetchOpts.prefetchMeta(),
+				Prefixes:           prefixes,
+				ObjectTags:         objectTags,
+				S3backer:           newS3backerOptions,
+				KMS:                kmsOptions,
+				Env:                env,
+				GrantRead:          grants.Read,
+				GrantWrite:         grants.Write,
+				ClientEncrypted:    clientEncrypted,
+				DeleteProtection:   deleteProtection,
+				MetadataPolicy:     metadataPolicy,
+				SeedFrom:           seedFrom,
+				QuotaNamespace:     quotaNamespace,
+				PrefixCreatedByCsi: &prefixCreated,
 			}
 		} else {
 			// Check if volume capacity requested is bigger than the already existing capacity
-			if capacityBytes > meta.CapacityBytes {
+			if !meta.Unbounded() && capacityBytes > meta.CapacityBytes {
 				return nil, status.Error(
 					codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with smaller size already exist", volumeID),
 				)
 			}
-			meta.Mounter = mounter
+			if meta.ClientEncrypted != clientEncrypted {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different client-side encryption already exist", volumeID)
+			}
+			if meta.FSPath != fsPath {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with a different %s already exist", volumeID, fsPathKey)
+			}
+			if meta.SeedFrom != seedFrom {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with a different %s already exist", volumeID, seedFromKey)
+			}
+			// the keys written before would show up under other names
+			if meta.KeyEncoding != keyEncoding {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with a different %s already exist", volumeID, mounter.KeyEncodingKey)
+			}
+			// a managed prefix left out would never be removed
+			if !prefixesEqual(meta.Prefixes, prefixes) {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different %s already exist", volumeID, mounter.PrefixesKey)
+			}
+			meta.Mounter = mounterType
+			meta.CacheMode = cacheMode
+			meta.SmallFileCacheMB = smallFileCacheMB
+			meta.CacheOnlyOnError = cacheOnlyOnError
+			meta.Consistency = consistency
+			meta.MimeTypesFile = mimeTypesFile
+			meta.ChecksumAlgorithm = checksumAlgorithm
+			meta.Prefetch = prefetchOpts.prefetchMeta()
+			meta.Env = env
+			// objects written before keep their tags
+			meta.ObjectTags = objectTags
+			if s3backerOptions != nil {
+				meta.S3backer = s3backerOptions
+			}
+			// objects written before keep their encryption
+			if kmsOptions != nil {
+				meta.KMS = kmsOptions
+			}
+			if quotaNamespace != "" {
+				meta.QuotaNamespace = quotaNamespace
+			}
+			meta.GrantRead = grants.Read
+			meta.GrantWrite = grants.Write
+			// only cleared explicitly
+			if deleteProtection {
+				meta.DeleteProtection = true
+			}
+			// never switched back, the versions would shadow the metadata
+			if metadataPolicy != "" {
+				meta.MetadataPolicy = metadataPolicy
+			}
+			if pvName != "" {
+				meta.PVName = pvName
+			}
+			meta.VolumeName = req.GetName()
 		}
-	} else {
-		if err = client.CreateBucket(bucketName); err != nil {
-			return nil, fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
+		if ownership != "" {
+			// the ownership of a bucket created by someone else is left to
+			// its owner, it only tells the mounters whether ACLs work
+			if meta.CreatedByCsi && meta.ObjectOwnership != ownership {
+				if err := client.SetObjectOwnership(bucketName, ownership); err != nil {
+					return nil, s3Error(err, "failed to set the object ownership of bucket %s", bucketName)
+				}
+			}
+			meta.ObjectOwnership = ownership
+		}
+		// replication of an existing bucket is left to its owner
+		if bucketReplication != nil && meta.BucketReplication == nil {
+			if err := client.CheckBucketReplication(bucketName, *bucketReplication); err != nil {
+				return nil, s3Error(err, "bucket %s exists, but cannot be used for volume %s with bucket replication", bucketName, volumeID)
+			}
+			meta.BucketReplication = bucketReplication
+		}
+		// the metadata, the placeholder and the seed are written with the
+		// encryption of the volume
+		client = client.WithKMS(meta.KMS)
+		// nothing has been written yet, a retry starts over
+		if err := checkContext(ctx, "writing the metadata of volume "+volumeID); err != nil {
+			return nil, err
+		}
+		// The metadata is written first, a prefix written by a failed
+		// attempt would otherwise look like existing data on a retry.
+		if err := client.SetFSMeta(meta); errors.Is(err, s3.ErrAccessDenied) {
+			return nil, s3Error(err, "bucket %s exists, but the metadata of volume %s cannot be written, the bucket might be owned by someone else", bucketName, volumeID)
+		} else if err != nil {
+			return nil, s3Error(err, "error setting bucket metadata")
 		}
-		if err = client.CreatePrefix(bucketName, path.Join(prefix, defaultFsPath)); err != nil {
-			return nil, fmt.Errorf("failed to create prefix %s: %v", path.Join(prefix, defaultFsPath), err)
+		// an earlier attempt might have failed before the prefix was written
+		if err := checkContext(ctx, "creating the prefix of volume "+volumeID); err != nil {
+			return nil, err
 		}
+		if fsPrefix := meta.DataPrefix(); fsPrefix != "" {
+			if err := client.CreatePrefix(bucketName, fsPrefix); err != nil {
+				return nil, s3Error(err, "failed to create prefix %s", fsPrefix)
+			}
+		}
+		if err := createManagedPrefixes(client, meta); err != nil {
+			return nil, s3Error(err, "failed to create the prefixes of volume %s", volumeID)
+		}
+	} else {
+		created := true
 		meta = &s3.FSMeta{
-			BucketName:    bucketName,
-			Prefix:        prefix,
-			Mounter:       mounter,
-			CapacityBytes: capacityBytes,
-			FSPath:        defaultFsPath,
-			CreatedByCsi:  !exists,
+			BucketName:         bucketName,
+			Prefix:             prefix,
+			Mounter:            mounterType,
+			CapacityBytes:      capacityBytes,
+			FSPath:             fsPath,
+			CreatedByCsi:       true,
+			CreatedByVersion:   vendorVersion,
+			PVName:             pvName,
+			VolumeName:         req.GetName(),
+			ObjectOwnership:    ownership,
+			CacheMode:          cacheMode,
+			SmallFileCacheMB:   smallFileCacheMB,
+			CacheOnlyOnError:   cacheOnlyOnError,
+			Consistency:        consistency,
+			MimeTypesFile:      mimeTypesFile,
+			ChecksumAlgorithm:  checksumAlgorithm,
+			KeyEncoding:        keyEncoding,
+			Prefetch:           prefetchOpts.prefetchMeta(),
+			Prefixes:           prefixes,
+			ObjectTags:         objectTags,
+			S3backer:           newS3backerOptions,
+			KMS:                kmsOptions,
+			Env:                env,
+			GrantRead:          grants.Read,
+			GrantWrite:         grants.Write,
+			ClientEncrypted:    clientEncrypted,
+			DeleteProtection:   deleteProtection,
+			MetadataPolicy:     metadataPolicy,
+			SeedFrom:           seedFrom,
+			QuotaNamespace:     quotaNamespace,
+			PrefixCreatedByCsi: &created,
+			BucketReplication:  bucketReplication,
+		}
+		// The metadata is written first, so a retry always finds out that
+		// the bucket has been created by csi-s3. A cancelled request still
+		// completes the attempt in progress, it only stops waiting for a
+		// lagging bucket, which is then removed like on any failure.
+		err = retryNewBucket(ctx, func() error {
+			// configured before any object is written, so the bucket can
+			// still be removed without its versions on failure
+			if bucketReplication != nil {
+				if _, err := client.EnableBucketReplication(bucketName, *bucketReplication); err != nil {
+					return err
+				}
+			}
+			if err := client.SetFSMeta(meta); err != nil {
+				return err
+			}
+			if err := client.CreatePrefix(bucketName, meta.DataPrefix()); err != nil {
+				return err
+			}
+			if err := createManagedPrefixes(client, meta); err != nil {
+				return err
+			}
+			if ownership != "" {
+				return client.SetObjectOwnership(bucketName, ownership)
+			}
+			return nil
+		})
+		if err != nil {
+			// do not leave an empty bucket behind which a retry would
+			// mistake for a bucket not created by csi-s3.
+			if rmErr := client.RemoveBucket(meta.BucketName); rmErr != nil {
+				glog.Warningf("Failed to clean up bucket %s after failed creation: %v", bucketName, rmErr)
+			}
+			if ctxErr := checkContext(ctx, "initializing bucket "+bucketName); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, s3Error(err, "failed to initialize bucket %s", bucketName)
+		}
+	}
+
+	// seeded after the prefix has been created, a retry repeats the copy
+	if meta.SeedFrom != "" && !meta.Seeded {
+		if err := checkContext(ctx, "seeding volume "+volumeID); err != nil {
+			return nil, err
+		}
+		if err := seedVolume(client, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if target := params[replicationTargetArnKey]; target != "" && meta.ReplicationRuleID == "" {
+		if err := checkContext(ctx, "configuring the replication of volume "+volumeID); err != nil {
+			return nil, err
+		}
+		ruleID, err := client.AddReplicationRule(bucketName, prefix, s3.ReplicationTarget{
+			Arn:    target,
+			Bucket: params[replicationTargetBucketKey],
+		})
+		if err == nil {
+			meta.ReplicationRuleID = ruleID
+			err = client.SetFSMeta(meta)
+		}
+		if err != nil {
+			if params[replicationBestEffortKey] != "true" {
+				return nil, s3Error(err, "failed to configure replication of volume %s", volumeID)
+			}
+			glog.Warningf("Failed to configure replication of volume %s: %v", volumeID, err)
+			cs.events.Eventf(pvName, eventTypeWarning, "ReplicationFailed",
+				"Volume %s is not replicated: %v", volumeID, err)
 		}
 	}
-	if err := client.SetFSMeta(meta); err != nil {
-		return nil, fmt.Errorf("error setting bucket metadata: %w", err)
+
+	// the volume is only reported once the nodes can mount it
+	if err := checkNodeAccess(secrets, meta, true); err != nil {
+		return nil, err
 	}
 
+	location := client.Config.Location(bucketName, meta.DataPrefix())
+	cs.events.Eventf(pvName, eventTypeNormal, "Provisioned", "Volume %s provisioned at %s", volumeID, location)
 	glog.V(4).Infof("create volume %s", volumeID)
+	volumeContext := withLocation(req.GetParameters(), location)
+	volumeContext[createdAtKey] = time.Now().UTC().Format(time.RFC3339)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: req.GetParameters(),
+			CapacityBytes: meta.CapacityBytes,
+			VolumeContext: volumeContext,
 		},
 	}, nil
 }
 
+// withLocation returns a copy of the volume context with the location of
+// the data of the volume
+func withLocation(volumeContext map[string]string, location string) map[string]string {
+	withLocation := make(map[string]string, len(volumeContext)+1)
+	for k, v := range volumeContext {
+		withLocation[k] = v
+	}
+	withLocation[locationKey] = location
+	return withLocation
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
 
 	// Check arguments
-	if len(volumeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	bucketName, prefix, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("Invalid delete volume req: %v", req)
+		glog.V(3).Infof("Invalid delete volume req: %s", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
 	glog.V(4).Infof("Deleting volume %s", volumeID)
+	if isReferenceVolume(volumeID) {
+		// the data of a reference volume is never touched
+		glog.V(4).Infof("Volume %s is a reference to existing data, nothing to delete", volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(cs.defaultSecret.orDefault(req.GetSecrets()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
+	if err := checkContext(ctx, "checking if bucket "+bucketName+" exists"); err != nil {
+		return nil, err
+	}
+	client = client.WithContext(ctx)
 	exists, err := client.BucketExists(bucketName)
 	if err != nil {
-		return nil, err
+		return nil, s3Error(err, "failed to check if bucket %s exists", bucketName)
 	}
 	if exists {
+		if err := checkContext(ctx, "reading the metadata of volume "+volumeID); err != nil {
+			return nil, err
+		}
 		meta, err := client.GetFSMeta(bucketName, prefix)
+		if errors.Is(err, s3.ErrObjectNotFound) {
+			meta, err = client.RecoverFSMeta(bucketName, prefix, defaultFsPath)
+			if err == nil {
+				glog.Warningf("Metadata of volume %s is missing, recovered it from the existing data", volumeID)
+			}
+		}
+		if errors.Is(err, s3.ErrObjectNotFound) {
+			// neither metadata nor data is left, e.g. after the bucket of a
+			// previous attempt was retained
+			glog.V(4).Infof("Volume %s has no metadata and no data, nothing to delete", volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to get metadata of buckect %s", volumeID)
+			return cs.deleteWithoutMeta(client, volumeID, bucketName, prefix, err)
+		}
+		client = client.WithContext(audit.WithIdentity(ctx, audit.Identity{VolumeID: volumeID, PV: meta.PVName}))
+		if meta.DeleteProtection {
+			cs.events.Eventf(meta.PVName, eventTypeWarning, "DeletionRefused",
+				"Volume %s is protected from deletion, its data has not been removed", volumeID)
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is protected from deletion, clear the protection with --clear-delete-protection=%s", volumeID, volumeID)
+		}
+		// the newer driver might keep data of the volume this one does not know about
+		if err := s3.CheckMetaVersion(meta); err != nil {
+			return nil, s3Error(err, "cannot delete volume %s", volumeID)
+		}
+		// released first, a retry of a failed deletion might not find the
+		// metadata anymore
+		if meta.QuotaNamespace != "" && cs.quotas.enabled() {
+			if err := cs.quotas.release(client, meta.QuotaNamespace, meta.VolumeName); err != nil {
+				return nil, err
+			}
+		}
+		// every step of the deletion can be repeated, a retry continues
+		// where a cancelled request stopped
+		if err := checkContext(ctx, "removing volume "+volumeID); err != nil {
+			return nil, err
+		}
+		if meta.ReplicationRuleID != "" {
+			if err := client.RemoveReplicationRule(bucketName, meta.ReplicationRuleID); err != nil {
+				return nil, s3Error(err, "failed to remove replication rule of volume %s", volumeID)
+			}
+		}
+		if err := removeManagedPrefixes(client, meta); err != nil {
+			return nil, s3Error(err, "failed to remove the prefixes of volume %s", volumeID)
 		}
 		if prefix != "" {
-			if err := client.RemovePrefix(bucketName, prefix); err != nil {
-				return nil, fmt.Errorf("unable to remove prefix: %w", err)
+			if meta.OwnsPrefix() {
+				if err := checkContext(ctx, "removing the prefix of volume "+volumeID); err != nil {
+					return nil, err
+				}
+				if err := client.RemovePrefix(bucketName, prefix); err != nil {
+					return nil, s3Error(err, "unable to remove prefix")
+				}
+			} else {
+				glog.V(4).Infof("Prefix %s of bucket %s is not created by csi-s3, will not be deleted by csi-s3 automatically.", prefix, bucketName)
+				if err := retainData(client.WithGrants(meta.Grants()).WithKMS(meta.KMS), meta); err != nil {
+					return nil, err
+				}
+				cs.events.Eventf(meta.PVName, eventTypeNormal, "DataRetained",
+					"Prefix %s of bucket %s was not created by csi-s3 and has intentionally been retained", prefix, bucketName)
 			}
 		}
-		if meta.CreatedByCsi {
-			if err := client.RemoveBucket(bucketName); err != nil {
-				glog.V(3).Infof("Failed to remove volume %s: %v", volumeID, err)
+		if meta.CreatedByCsi && (prefix == "" || meta.OwnsPrefix()) {
+			if prefix == "" {
+				// volumes provisioned in the bucket of the volume keep it,
+				// only the data directory and the metadata of the volume
+				// are removed
+				others, err := client.FindPrefixVolumes(bucketName)
+				if err != nil {
+					return nil, s3Error(err, "failed to list the volumes of bucket %s", bucketName)
+				}
+				if len(others) > 0 {
+					other := others[0]
+					if err := handOverBucket(client, bucketName, others); err != nil {
+						return nil, s3Error(err, "failed to hand bucket %s over to its other volumes", bucketName)
+					}
+					if s3.CleanPrefix(meta.FSPath) == "" {
+						// the data of the volume is the whole bucket
+						if err := retainData(client.WithGrants(meta.Grants()).WithKMS(meta.KMS), meta); err != nil {
+							return nil, err
+						}
+					} else if err := client.RemovePrefix(bucketName, meta.FSPath); err != nil {
+						return nil, s3Error(err, "failed to remove the data of volume %s", volumeID)
+					} else if err := client.RemoveFSMeta(bucketName, prefix); err != nil {
+						return nil, s3Error(err, "failed to remove metadata of volume %s", volumeID)
+					}
+					glog.Infof("Bucket %s of volume %s retained: contains volume %s", bucketName, volumeID, path.Join(bucketName, other))
+					cs.events.Eventf(meta.PVName, eventTypeNormal, "BucketRetained",
+						"Bucket %s retained: contains volume %s", bucketName, path.Join(bucketName, other))
+					return &csi.DeleteVolumeResponse{}, nil
+				}
+			} else {
+				// other volumes or users may have written to the bucket,
+				// which must neither be removed nor fail the deletion
+				foreign, err := client.CountObjects(bucketName, prefix, foreignObjectsLimit)
+				if err != nil {
+					return nil, s3Error(err, "failed to list objects of bucket %s", bucketName)
+				}
+				if foreign > 0 {
+					if err := client.RemoveFSMeta(bucketName, prefix); err != nil {
+						return nil, s3Error(err, "failed to remove metadata of volume %s", volumeID)
+					}
+					count := strconv.Itoa(foreign)
+					if foreign == foreignObjectsLimit {
+						count = "at least " + count
+					}
+					glog.Infof("Bucket %s of volume %s retained: contains %s foreign objects", bucketName, volumeID, count)
+					cs.events.Eventf(meta.PVName, eventTypeNormal, "BucketRetained",
+						"Bucket %s retained: contains %s foreign objects", bucketName, count)
+					return &csi.DeleteVolumeResponse{}, nil
+				}
+			}
+			if err := checkContext(ctx, "removing bucket "+bucketName); err != nil {
 				return nil, err
 			}
+			if err := client.RemoveBucket(meta.BucketName); err != nil {
+				glog.V(3).Infof("Failed to remove volume %s: %v", volumeID, err)
+				return nil, s3Error(err, "failed to remove bucket %s", bucketName)
+			}
 			glog.V(4).Infof("Bucket %s removed", volumeID)
 		} else {
 			glog.V(4).Infof("Bucket %s is not created by csi-s3, will not be deleted by csi-s3 automatically.", volumeID)
+			// the data of a volume without prefix is the whole bucket, leave a
+			// trace so the bucket left behind can be attributed to its volume.
+			if prefix == "" {
+				if err := retainData(client.WithGrants(meta.Grants()).WithKMS(meta.KMS), meta); err != nil {
+					return nil, err
+				}
+				if meta.Recovered {
+					cs.events.Eventf(meta.PVName, eventTypeNormal, "DataRetained",
+						"Bucket %s existed without metadata, it may not have been created by csi-s3 and has intentionally been retained", bucketName)
+				} else {
+					cs.events.Eventf(meta.PVName, eventTypeNormal, "DataRetained",
+						"Bucket %s was not created by csi-s3 and has intentionally been retained", bucketName)
+				}
+			}
 		}
 	} else {
 		glog.V(5).Infof("Bucket %s does not exist, ignoring request", volumeID)
@@ -188,21 +956,22 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	// Check arguments
-	if len(req.GetVolumeId()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	bucketName, prefix, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
 	}
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
-	bucketName, prefix := volumeIDToBucketPrefix(req.GetVolumeId())
 
-	s3, err := s3.NewClientFromSecret(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(cs.defaultSecret.orDefault(req.GetSecrets()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
-	exists, err := s3.BucketExists(bucketName)
+	client = client.WithContext(ctx)
+	exists, err := client.BucketExists(bucketName)
 	if err != nil {
-		return nil, err
+		return nil, s3Error(err, "failed to check if bucket %s exists", bucketName)
 	}
 
 	if !exists {
@@ -210,35 +979,204 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("bucket of volume with id %s does not exist", req.GetVolumeId()))
 	}
 
-	if _, err := s3.GetFSMeta(bucketName, prefix); err != nil {
+	var meta *s3.FSMeta
+	if isReferenceVolume(req.GetVolumeId()) {
+		meta = referenceMeta(req.GetVolumeId(), req.GetVolumeContext())
+	} else if meta, err = client.GetFSMeta(bucketName, prefix); err != nil {
 		// return an error if the fsmeta of the requested volume does not exist
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("fsmeta of volume with id %s does not exist", req.GetVolumeId()))
 	}
 
-	// We currently only support RWO
-	supportedAccessMode := &csi.VolumeCapability_AccessMode{
-		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-	}
-
-	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != supportedAccessMode.GetMode() {
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "Only single node writer is supported"}, nil
-		}
+	if err := validateMounterCapabilities(meta.Mounter, req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedAccessMode,
-				},
-			},
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
 		},
 	}, nil
 }
 
-func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerExpandVolume is not implemented")
+var (
+	// newBucketBackoff is the initial wait between writes to a new bucket
+	newBucketBackoff = 200 * time.Millisecond
+	// newBucketTimeout bounds the time spent waiting for a new bucket
+	newBucketTimeout = 10 * time.Second
+)
+
+// retryNewBucket retries fn while a bucket which has just been created is
+// not yet visible. Some S3 compatible providers return success on bucket
+// creation while writes to the bucket fail with NoSuchBucket for a while.
+func retryNewBucket(ctx context.Context, fn func() error) error {
+	backoff := newBucketBackoff
+	deadline := time.Now().Add(newBucketTimeout)
+	for {
+		err := fn()
+		if err == nil || !errors.Is(err, s3.ErrBucketNotFound) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		glog.V(4).Infof("New bucket is not yet available, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// checkContext returns DeadlineExceeded or Canceled if the caller of the
+// request has given up, so the next step is not started. The S3 calls
+// themselves are not cancelled, a step is either done or not started.
+func checkContext(ctx context.Context, step string) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return status.Errorf(codes.DeadlineExceeded, "deadline exceeded before %s", step)
+	default:
+		return status.Errorf(codes.Canceled, "request cancelled before %s", step)
+	}
+}
+
+// volumeCapacity returns the capacity a volume is created with, 0 for an
+// unbounded volume. Requests without a capacity get the default capacity,
+// capped by their limit.
+func (cs *controllerServer) volumeCapacity(capacityRange *csi.CapacityRange) int64 {
+	if required := capacityRange.GetRequiredBytes(); required > 0 {
+		return required
+	}
+	capacity := cs.defaultCapacityBytes
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && (capacity == 0 || capacity > limit) {
+		capacity = limit
+	}
+	return capacity
+}
+
+// parseFSPath returns the directory below the prefix of a volume its data
+// is stored in, empty for the prefix itself
+func parseFSPath(value string) (string, error) {
+	if value == "" {
+		return defaultFsPath, nil
+	}
+	for _, segment := range strings.Split(value, "/") {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid %s %s, must not contain . or ..", fsPathKey, value)
+		}
+	}
+	return s3.CleanPrefix(value), nil
+}
+
+// parseGrants returns the grants the objects of a volume are written with
+func parseGrants(params map[string]string) (s3.Grants, error) {
+	var grants s3.Grants
+	var err error
+	if grants.Read, err = s3.ParseGrantees(params[grantReadKey]); err != nil {
+		return grants, fmt.Errorf("invalid %s: %v", grantReadKey, err)
+	}
+	if grants.Write, err = s3.ParseGrantees(params[grantWriteKey]); err != nil {
+		return grants, fmt.Errorf("invalid %s: %v", grantWriteKey, err)
+	}
+	switch params[grantsRequiredKey] {
+	case "", "false":
+	case "true":
+		if grants.Empty() {
+			return grants, fmt.Errorf("%s requires %s or %s", grantsRequiredKey, grantReadKey, grantWriteKey)
+		}
+		grants.Required = true
+	default:
+		return grants, fmt.Errorf("invalid %s %s, must be true or false", grantsRequiredKey, params[grantsRequiredKey])
+	}
+	return grants, nil
+}
+
+// s3Error converts an error of the s3 package into a gRPC status error
+func s3Error(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, s3.ErrBucketNotFound), errors.Is(err, s3.ErrObjectNotFound):
+		code = codes.NotFound
+	case errors.Is(err, s3.ErrAccessDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, s3.ErrBucketNotEmpty), errors.Is(err, s3.ErrReplicationNotConfigured), errors.Is(err, s3.ErrObjectRetained),
+		errors.Is(err, s3.ErrGrantsNotSupported), errors.Is(err, s3.ErrMetadataTooNew):
+		code = codes.FailedPrecondition
+	case errors.Is(err, s3.ErrChecksumMismatch):
+		code = codes.DataLoss
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+type dataRetainer interface {
+	SetRetainedMarker(bucketName, prefix, pvName string) error
+	RemoveFSMeta(bucketName, prefix string) error
+}
+
+// retainData writes the retained marker of a volume whose data is kept on
+// deletion and then removes its metadata, so a volume created again at
+// its location does not inherit it. Without the marker the metadata is
+// kept, a retry must not take the data for data created by csi-s3.
+func retainData(client dataRetainer, meta *s3.FSMeta) error {
+	volumeID := path.Join(meta.BucketName, meta.Prefix)
+	if err := client.SetRetainedMarker(meta.BucketName, meta.Prefix, meta.PVName); err != nil {
+		glog.Warningf("Failed to write retained marker of volume %s, keeping its metadata: %v", volumeID, err)
+		return nil
+	}
+	if err := client.RemoveFSMeta(meta.BucketName, meta.Prefix); err != nil {
+		return s3Error(err, "failed to remove metadata of volume %s", volumeID)
+	}
+	return nil
+}
+
+// handOverBucket makes the volumes at prefixes own the bucket created for
+// the volume at its root, which is deleted before them. Each of them keeps
+// the bucket while it contains other volumes, the last one removes it.
+func handOverBucket(client metaStore, bucketName string, prefixes []string) error {
+	for _, prefix := range prefixes {
+		meta, err := client.GetFSMeta(bucketName, prefix)
+		if err != nil {
+			return err
+		}
+		if meta.CreatedByCsi {
+			continue
+		}
+		// the prefix of the volume stays as owned as it was
+		ownsPrefix := meta.OwnsPrefix()
+		meta.PrefixCreatedByCsi = &ownsPrefix
+		meta.CreatedByCsi = true
+		if err := client.SetFSMeta(meta); err != nil {
+			return err
+		}
+		glog.Infof("Volume %s owns bucket %s from now on", path.Join(bucketName, prefix), bucketName)
+	}
+	return nil
+}
+
+// validateMounterCapabilities checks the requested capabilities against
+// the capabilities of the mounter type.
+func validateMounterCapabilities(mounterType string, capabilities []*csi.VolumeCapability) error {
+	caps, err := mounter.GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	for _, capability := range capabilities {
+		if err := caps.Validate(mounterType, capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pvcIdentity returns the namespace/name of the PVC a volume is created
+// for, empty if the provisioner does not pass it
+func pvcIdentity(params map[string]string) string {
+	if params[pvcNameKey] == "" {
+		return ""
+	}
+	return path.Join(params[pvcNamespaceKey], params[pvcNameKey])
 }
 
 func sanitizeVolumeID(volumeID string) string {
@@ -251,14 +1189,24 @@ func sanitizeVolumeID(volumeID string) string {
 	return volumeID
 }
 
+// checkPrefixDepth rejects prefixes nested deeper than the limit of the
+// driver, which usually is the result of a misconfiguration
+func (cs *controllerServer) checkPrefixDepth(prefix string) error {
+	if depth := strings.Count(s3.CleanPrefix(prefix), "/"); cs.maxPrefixDepth > 0 && depth > cs.maxPrefixDepth {
+		return status.Errorf(codes.InvalidArgument, "prefix %s is nested %d levels deep, at most %d are allowed", prefix, depth, cs.maxPrefixDepth)
+	}
+	return nil
+}
+
 // volumeIDToBucketPrefix returns the bucket name and prefix based on the volumeID.
-// Prefix is empty if volumeID does not have a slash in the name.
+// Prefix is empty if volumeID does not have a slash in the name. The volume
+// ID of a request is validated with parseVolumeID first.
 func volumeIDToBucketPrefix(volumeID string) (string, string) {
 	// if the volumeID has a slash in it, this volume is
 	// stored under a certain prefix within the bucket.
-	splitVolumeID := strings.Split(volumeID, "/")
+	splitVolumeID := strings.SplitN(volumeID, "/", 2)
 	if len(splitVolumeID) > 1 {
-		return splitVolumeID[0], splitVolumeID[1]
+		return splitVolumeID[0], s3.CleanPrefix(splitVolumeID[1])
 	}
 
 	return volumeID, ""
@@ -0,0 +1,1762 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestControllerServer() *controllerServer {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		events:                  noopRecorder{},
+	}
+}
+
+func createVolumeRequest(name string, secrets map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:    name,
+		Secrets: secrets,
+		Parameters: map[string]string{
+			"mounter": "s3fs",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	}
+}
+
+// setS3Options changes the options of the S3 clients for the test, the
+// driver of the test suite runs with the defaults of driver.New
+func setS3Options(t *testing.T, opts s3.Options) {
+	t.Cleanup(func() { s3.SetOptions(s3.Options{DriverVersion: vendorVersion}) })
+	opts.DriverVersion = vendorVersion
+	s3.SetOptions(opts)
+}
+
+func TestCreateVolumeRetriesLaggingBucket(t *testing.T) {
+	defer func(backoff time.Duration) { newBucketBackoff = backoff }(newBucketBackoff)
+	newBucketBackoff = time.Millisecond
+
+	srv := s3test.NewServer()
+	defer srv.Close()
+	// the new bucket is not visible to the first writes
+	lagging := 2
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		isObject := strings.Count(strings.Trim(r.URL.Path, "/"), "/") > 0
+		if r.Method == http.MethodPut && isObject && lagging > 0 {
+			lagging--
+			s3test.Error(w, http.StatusNotFound, "NoSuchBucket")
+			return true
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-lagging", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-lagging", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.CreatedByCsi {
+		t.Fatal("expected bucket to be marked as created by csi-s3")
+	}
+	if srv.GetObject("pvc-lagging", defaultFsPath+"/") == nil {
+		t.Fatal("expected fs path to be created")
+	}
+}
+
+func TestCreateVolumeCompletesMissingPrefix(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-prefix", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-prefix/"+defaultFsPath+"/") == nil {
+		t.Fatal("expected fs path to be created in the existing bucket")
+	}
+	if srv.GetObject("shared", "pvc-prefix/.metadata.json") == nil {
+		t.Fatal("expected metadata to be written")
+	}
+}
+
+func TestDeleteVolumeRecoversExpiredMetadata(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-expired", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("pvc-expired", defaultFsPath+"/file", []byte("data"))
+	// a lifecycle rule expires the metadata
+	srv.DeleteObject("pvc-expired", ".metadata.json")
+
+	req := &csi.DeleteVolumeRequest{VolumeId: "pvc-expired", Secrets: srv.Secret()}
+	if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	// the bucket might have been adopted, it is retained with its data
+	if srv.GetObject("pvc-expired", defaultFsPath+"/file") == nil {
+		t.Fatalf("expected the bucket to be retained, got %v", srv.Keys("pvc-expired"))
+	}
+
+	setS3Options(t, s3.Options{RecoveredMetaOwnsBucket: true})
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-owned", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("pvc-owned", defaultFsPath+"/file", []byte("data"))
+	srv.DeleteObject("pvc-owned", ".metadata.json")
+	req.VolumeId = "pvc-owned"
+	if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.BucketExists("pvc-owned") {
+		t.Fatal("expected the claimed bucket to be removed")
+	}
+}
+
+func TestReplicationRulePerVolume(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+
+	cs := newTestControllerServer()
+	var volumeIDs []string
+	for _, name := range []string{"pvc-a", "pvc-b"} {
+		req := createVolumeRequest(name, srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		req.Parameters[replicationTargetArnKey] = "arn:minio:replication::site-b:shared"
+		req.Parameters[replicationTargetBucketKey] = "shared"
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, resp.GetVolume().GetVolumeId())
+	}
+	config := string(srv.BucketConfig("shared", "replication"))
+	if strings.Count(config, "<Rule>") != 2 || !strings.Contains(config, "<Prefix>pvc-a/</Prefix>") {
+		t.Fatalf("expected a rule for each volume prefix, got %s", config)
+	}
+
+	for i, volumeID := range volumeIDs {
+		req := &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: srv.Secret()}
+		if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		rules := strings.Count(string(srv.BucketConfig("shared", "replication")), "<Rule>")
+		if rules != len(volumeIDs)-i-1 {
+			t.Fatalf("expected the rule of %s to be removed, %d rules left", volumeID, rules)
+		}
+	}
+}
+
+func TestReplicationFailureFailsProvisioning(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if _, ok := r.URL.Query()["replication"]; ok && r.Method == http.MethodPut {
+			s3test.Error(w, http.StatusBadRequest, "XMinioAdminRemoteTargetNotFoundError")
+			return true
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-replicated", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	req.Parameters[replicationTargetArnKey] = "arn:minio:replication::site-b:shared"
+	req.Parameters[replicationTargetBucketKey] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+
+	req.Parameters[replicationBestEffortKey] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("expected best effort replication not to fail provisioning: %v", err)
+	}
+}
+
+func TestBucketReplication(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-dr", srv.Secret())
+	req.Parameters[replicationRoleKey] = "arn:aws:iam::123456789012:role/replication"
+	req.Parameters[replicationDestinationKey] = "arn:aws:s3:::pvc-dr-replica"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if versioning := string(srv.BucketConfig("pvc-dr", "versioning")); !strings.Contains(versioning, "<Status>Enabled</Status>") {
+		t.Fatalf("expected versioning to be enabled, got %q", versioning)
+	}
+	config := string(srv.BucketConfig("pvc-dr", "replication"))
+	if !strings.Contains(config, "<Role>arn:aws:iam::123456789012:role/replication</Role>") || !strings.Contains(config, "<Bucket>arn:aws:s3:::pvc-dr-replica</Bucket>") {
+		t.Fatalf("expected the bucket to be replicated, got %s", config)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-dr", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.BucketReplication == nil || meta.BucketReplication.Bucket != "arn:aws:s3:::pvc-dr-replica" {
+		t.Fatalf("expected the replication to be recorded in the metadata, got %+v", meta.BucketReplication)
+	}
+
+	// volumes in an existing bucket require it to be replicated already
+	srv.CreateBucket("unreplicated")
+	req = createVolumeRequest("pvc-shared", srv.Secret())
+	req.Parameters["bucket"] = "unreplicated"
+	req.Parameters[replicationRoleKey] = "arn:aws:iam::123456789012:role/replication"
+	req.Parameters[replicationDestinationKey] = "unreplicated-replica"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for an unreplicated bucket, got %v", err)
+	}
+	req.Parameters["bucket"] = "pvc-dr"
+	req.Parameters[replicationDestinationKey] = "pvc-dr-replica"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("expected a volume in the replicated bucket to be provisioned: %v", err)
+	}
+
+	req = createVolumeRequest("pvc-invalid", srv.Secret())
+	req.Parameters[replicationRoleKey] = "replication"
+	req.Parameters[replicationDestinationKey] = "pvc-invalid-replica"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a role which is no ARN, got %v", err)
+	}
+	delete(req.Parameters, replicationDestinationKey)
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without destination, got %v", err)
+	}
+
+	// the versions of the objects are removed together with the bucket
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-dr/pvc-shared", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-dr", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.BucketExists("pvc-dr") {
+		t.Fatal("expected the replicated bucket to be removed")
+	}
+}
+
+func TestCreateVolumeObjectOwnership(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-owned", srv.Secret())
+	req.Parameters[objectOwnershipKey] = "BucketOwnerEnforced"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if controls := string(srv.BucketConfig("pvc-owned", "ownershipControls")); !strings.Contains(controls, "<ObjectOwnership>BucketOwnerEnforced</ObjectOwnership>") {
+		t.Fatalf("expected ownership controls to be set, got %q", controls)
+	}
+
+	// a retry applies a changed ownership to the bucket created by csi-s3
+	req.Parameters[objectOwnershipKey] = "BucketOwnerPreferred"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if controls := string(srv.BucketConfig("pvc-owned", "ownershipControls")); !strings.Contains(controls, "<ObjectOwnership>BucketOwnerPreferred</ObjectOwnership>") {
+		t.Fatalf("expected ownership controls to be updated, got %q", controls)
+	}
+	// but leaves an existing bucket to its owner
+	srv.CreateBucket("shared")
+	req = createVolumeRequest("pvc-shared", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	req.Parameters[objectOwnershipKey] = "BucketOwnerEnforced"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if controls := srv.BucketConfig("shared", "ownershipControls"); controls != nil {
+		t.Fatalf("expected the ownership of the existing bucket to be kept, got %q", controls)
+	}
+
+	req = createVolumeRequest("pvc-invalid", srv.Secret())
+	req.Parameters[objectOwnershipKey] = "Everyone"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestCreateVolumeEmptyBucket(t *testing.T) {
+	tests := []struct {
+		name      string
+		adopt     bool
+		owns      bool
+		data      bool
+		bucket    string
+		created   bool
+		recovered bool
+	}{
+		{name: "not adopted by default", recovered: true},
+		{name: "adopted", adopt: true, created: true, recovered: true},
+		{name: "bucket with data", adopt: true, data: true, recovered: true},
+		{name: "bucket override", adopt: true, bucket: "shared"},
+		{name: "recovered metadata owns bucket", owns: true, data: true, created: true, recovered: true},
+	}
+	for _, test := range tests {
+		setS3Options(t, s3.Options{RecoveredMetaOwnsBucket: test.owns})
+		srv := s3test.NewServer()
+		bucketName := "pvc-empty"
+		if test.bucket != "" {
+			bucketName = test.bucket
+		}
+		srv.CreateBucket(bucketName)
+		if test.data {
+			srv.PutObject(bucketName, "file", []byte("data"))
+		}
+
+		cs := newTestControllerServer()
+		cs.adoptEmptyBuckets = test.adopt
+		req := createVolumeRequest("pvc-empty", srv.Secret())
+		if test.bucket != "" {
+			req.Parameters["bucket"] = test.bucket
+		}
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			srv.Close()
+			continue
+		}
+		bucketName, prefix := volumeIDToBucketPrefix(resp.GetVolume().GetVolumeId())
+		client, err := s3.NewClientFromSecret(srv.Secret())
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := client.GetFSMeta(bucketName, prefix)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if meta.CreatedByCsi != test.created || meta.Recovered != test.recovered {
+			t.Errorf("%s: expected CreatedByCsi %v and Recovered %v, got %+v", test.name, test.created, test.recovered, meta)
+		}
+		srv.Close()
+	}
+}
+
+func TestCreateVolumeCacheMode(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-uncached", srv.Secret())
+	req.Parameters["cacheMode"] = "none"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-uncached", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CacheMode != "none" {
+		t.Fatalf("expected cache mode to be persisted, got %q", meta.CacheMode)
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "s3backer", "cacheMode": "none"},
+		{"mounter": "s3fs", "cacheMode": "sometimes"},
+	} {
+		req := createVolumeRequest("pvc-cache-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeSmallFileCache(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-small-files", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters["smallFileCacheMB"] = "64"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-small-files", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SmallFileCacheMB != 64 {
+		t.Fatalf("expected small file cache to be persisted, got %d", meta.SmallFileCacheMB)
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "s3fs", "smallFileCacheMB": "64"},
+		{"mounter": "rclone", "smallFileCacheMB": "0"},
+		{"mounter": "rclone", "smallFileCacheMB": "64M"},
+		{"mounter": "rclone", "cacheMode": "none", "smallFileCacheMB": "64"},
+	} {
+		req := createVolumeRequest("pvc-small-files-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeCacheOnlyOnError(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-offline", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters["cacheOnlyOnError"] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-offline", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.CacheOnlyOnError {
+		t.Fatal("expected cacheOnlyOnError to be persisted")
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "s3fs", "cacheOnlyOnError": "true"},
+		{"mounter": "rclone", "cacheOnlyOnError": "yes"},
+		{"mounter": "rclone", "cacheMode": "none", "cacheOnlyOnError": "true"},
+	} {
+		req := createVolumeRequest("pvc-offline-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeFSPath(t *testing.T) {
+	setS3Options(t, s3.Options{ControlPrefix: s3.DefaultControlPrefix})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+
+	cs := newTestControllerServer()
+	for _, tc := range []struct {
+		name, fsPath, placeholder string
+	}{
+		{"pvc-default", "", "pvc-default/csi-fs/"},
+		{"pvc-root", "/", "pvc-root/"},
+		{"pvc-data", "data/", "pvc-data/data/"},
+	} {
+		req := createVolumeRequest(tc.name, srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		if tc.fsPath != "" {
+			req.Parameters["fsPath"] = tc.fsPath
+		}
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if srv.GetObject("shared", tc.placeholder) == nil {
+			t.Errorf("%q: expected the placeholder %s, got %v", tc.fsPath, tc.placeholder, srv.Keys("shared"))
+		}
+	}
+
+	// the data of an existing volume is never moved
+	req := createVolumeRequest("pvc-root", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+	for _, params := range []map[string]string{
+		{"fsPath": "../other"},
+		// the control prefix would be at the root of the data
+		{"fsPath": "/"},
+		{"fsPath": "data", "bucket": "shared", "provisioningMode": "none"},
+	} {
+		req := createVolumeRequest("pvc-fs-path-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeGrants(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-grants", srv.Secret())
+	req.Parameters["grantRead"] = "79a59df9,ops@example.com"
+	req.Parameters["grantWrite"] = "c0ffee"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-grants", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta.GrantRead, []string{"79a59df9", "ops@example.com"}) || !reflect.DeepEqual(meta.GrantWrite, []string{"c0ffee"}) {
+		t.Fatalf("expected the grants to be persisted, got %v and %v", meta.GrantRead, meta.GrantWrite)
+	}
+
+	// a backend without ACLs only fails required grants
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("x-amz-grant-read") != "" {
+			s3test.Error(w, http.StatusBadRequest, "AccessControlListNotSupported")
+			return true
+		}
+		return false
+	}
+	req = createVolumeRequest("pvc-grants-unsupported", srv.Secret())
+	req.Parameters["grantRead"] = "79a59df9"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	req = createVolumeRequest("pvc-grants-required", srv.Secret())
+	req.Parameters["grantRead"] = "79a59df9"
+	req.Parameters["grantsRequired"] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	if srv.BucketExists("pvc-grants-required") {
+		t.Fatal("expected the bucket to be removed")
+	}
+
+	for _, params := range []map[string]string{
+		{"grantRead": "id=79a59df9"},
+		{"grantsRequired": "true"},
+		{"grantRead": "79a59df9", "grantsRequired": "yes"},
+		{"grantRead": "79a59df9", "objectOwnership": "BucketOwnerEnforced"},
+		{"grantWrite": "79a59df9", "bucket": "shared", "provisioningMode": "none"},
+	} {
+		req := createVolumeRequest("pvc-grants-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeMimeTypesFile(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-mime", srv.Secret())
+	req.Parameters["mimeTypesFile"] = "/etc/csi-s3/mime.types"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-mime", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.MimeTypesFile != "/etc/csi-s3/mime.types" {
+		t.Fatalf("expected the MIME types file to be persisted, got %q", meta.MimeTypesFile)
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "rclone", "mimeTypesFile": "/etc/csi-s3/mime.types"},
+		{"mounter": "s3fs", "mimeTypesFile": "mime.types"},
+		{"mounter": "s3fs", "mimeTypesFile": "/etc/../mime.types"},
+	} {
+		req := createVolumeRequest("pvc-mime-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+
+	// the file is only checked on the node
+	dir := t.TempDir()
+	writeFile(t, dir+"/mime.types", "text/markdown md\n")
+	if err := mounter.CheckMimeTypesFile("s3fs", dir+"/mime.types"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, dir + "/missing"} {
+		if err := mounter.CheckMimeTypesFile("s3fs", path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestCreateVolumeChecksum(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-checksum", srv.Secret())
+	req.Parameters["checksumAlgorithm"] = "crc32c"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-checksum", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ChecksumAlgorithm != s3.ChecksumCRC32C {
+		t.Fatalf("expected the checksum algorithm to be persisted, got %q", meta.ChecksumAlgorithm)
+	}
+
+	// the metadata is corrupted on its way from the backend
+	srv.GetObject("pvc-checksum", ".metadata.json").Data[0] ^= 1
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss, got %v", err)
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "goofys", "checksumAlgorithm": "SHA256"},
+		{"mounter": "s3fs", "checksumAlgorithm": "MD5"},
+	} {
+		req := createVolumeRequest("pvc-checksum-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+}
+
+func TestCreateVolumeEnv(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-env", srv.Secret())
+	req.Parameters["env"] = "RCLONE_S3_UPLOAD_CUTOFF=64M, GOGC=50"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-env", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"RCLONE_S3_UPLOAD_CUTOFF": "64M", "GOGC": "50"}
+	if !reflect.DeepEqual(meta.Env, expected) {
+		t.Fatalf("expected the env to be persisted, got %v", meta.Env)
+	}
+
+	for _, env := range []string{"AWS_SECRET_ACCESS_KEY=other", "RCLONE_CONFIG_S3_TYPE=s3", "1KEY=value", "GOGC"} {
+		req := createVolumeRequest("pvc-env-invalid", srv.Secret())
+		req.Parameters["env"] = env
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", env, err)
+		}
+	}
+}
+
+func TestMetadataVersionSkew(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-versioned", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-versioned", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CreatedByVersion != vendorVersion || meta.LastWrittenByVersion != vendorVersion {
+		t.Fatalf("expected the versions to be recorded, got %q and %q", meta.CreatedByVersion, meta.LastWrittenByVersion)
+	}
+
+	// a newer major version wrote the metadata before a rollback
+	meta.LastWrittenByVersion = "v9.0.0"
+	b, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("pvc-versioned", ".metadata.json", b)
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-versioned", srv.Secret())); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected CreateVolume to fail with FailedPrecondition, got %v", err)
+	}
+	req := &csi.DeleteVolumeRequest{VolumeId: "pvc-versioned", Secrets: srv.Secret()}
+	if _, err := cs.DeleteVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected DeleteVolume to fail with FailedPrecondition, got %v", err)
+	}
+	if !srv.BucketExists("pvc-versioned") {
+		t.Fatal("expected the volume to be kept")
+	}
+
+	setS3Options(t, s3.Options{AllowMetadataDowngrade: true})
+	if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.BucketExists("pvc-versioned") {
+		t.Fatal("expected the volume to be deleted")
+	}
+}
+
+func TestVolumeCapacity(t *testing.T) {
+	cs := newTestControllerServer()
+	for _, tc := range []struct {
+		defaultCapacity int64
+		capacityRange   *csi.CapacityRange
+		expected        int64
+	}{
+		{0, nil, 0},
+		{0, &csi.CapacityRange{LimitBytes: 1 << 20}, 1 << 20},
+		{1 << 30, nil, 1 << 30},
+		{1 << 30, &csi.CapacityRange{RequiredBytes: 2 << 30}, 2 << 30},
+		{1 << 30, &csi.CapacityRange{LimitBytes: 1 << 20}, 1 << 20},
+		{1 << 30, &csi.CapacityRange{LimitBytes: 2 << 30}, 1 << 30},
+	} {
+		cs.defaultCapacityBytes = tc.defaultCapacity
+		if capacity := cs.volumeCapacity(tc.capacityRange); capacity != tc.expected {
+			t.Errorf("default %d, range %v: expected %d, got %d", tc.defaultCapacity, tc.capacityRange, tc.expected, capacity)
+		}
+	}
+}
+
+func TestCreateVolumeUnbounded(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newTestControllerServer()
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-unbounded", srv.Secret()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-unbounded", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Unbounded() || resp.GetVolume().GetCapacityBytes() != 0 {
+		t.Fatalf("expected an unbounded volume, got %d and %d", meta.CapacityBytes, resp.GetVolume().GetCapacityBytes())
+	}
+	// an unbounded volume satisfies any capacity
+	req := createVolumeRequest("pvc-unbounded", srv.Secret())
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 40}
+	if resp, err = cs.CreateVolume(context.Background(), req); err != nil || resp.GetVolume().GetCapacityBytes() != 0 {
+		t.Fatalf("expected the unbounded volume, got %v, %v", resp, err)
+	}
+
+	cs.defaultCapacityBytes = 1 << 30
+	if resp, err = cs.CreateVolume(context.Background(), createVolumeRequest("pvc-default-capacity", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-default-capacity", ""); err != nil {
+		t.Fatal(err)
+	}
+	if meta.CapacityBytes != 1<<30 || resp.GetVolume().GetCapacityBytes() != 1<<30 {
+		t.Fatalf("expected the default capacity, got %d and %d", meta.CapacityBytes, resp.GetVolume().GetCapacityBytes())
+	}
+	req = createVolumeRequest("pvc-default-capacity", srv.Secret())
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 << 30}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+}
+
+func TestCreateVolumeLocation(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-location", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeContext := resp.GetVolume().GetVolumeContext()
+	if expected := srv.URL + "/shared/pvc-location/csi-fs"; volumeContext[locationKey] != expected {
+		t.Fatalf("expected location %s, got %v", expected, volumeContext)
+	}
+	if _, ok := req.Parameters[locationKey]; ok {
+		t.Fatal("expected the parameters of the request not to be modified")
+	}
+	if !freshVolume(volumeContext, time.Now()) {
+		t.Fatalf("expected the creation of the volume to be recorded, got %v", volumeContext)
+	}
+	secret := srv.Secret()
+	for k, v := range volumeContext {
+		if strings.Contains(v, secret["accessKeyID"]) || strings.Contains(v, secret["secretAccessKey"]) {
+			t.Errorf("expected no credentials in the volume context, got %s=%s", k, v)
+		}
+	}
+}
+
+func TestCreateVolumeEndpointBasePath(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	secret := srv.Secret()
+	secret["endpoint"] = srv.URL + "/s3"
+	req := createVolumeRequest("pvc-base-path", secret)
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	if srv.BucketExists("pvc-base-path") {
+		t.Fatal("expected no bucket to be created")
+	}
+}
+
+func TestCreateVolumeAccessModes(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	tests := []struct {
+		mounter string
+		mode    csi.VolumeCapability_AccessMode_Mode
+		invalid bool
+	}{
+		{mounter: "s3backer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{mounter: "s3backer", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, invalid: true},
+		{mounter: "s3backer", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, invalid: true},
+		{mounter: "", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, invalid: true},
+		{mounter: "rclone", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	for i, test := range tests {
+		name := fmt.Sprintf("pvc-modes-%d", i)
+		req := createVolumeRequest(name, srv.Secret())
+		req.Parameters["mounter"] = test.mounter
+		req.VolumeCapabilities = append(req.VolumeCapabilities, &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode},
+		})
+		_, err := cs.CreateVolume(context.Background(), req)
+		if !test.invalid {
+			if err != nil {
+				t.Errorf("%s %s: %v", test.mounter, test.mode, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s %s: expected InvalidArgument, got %v", test.mounter, test.mode, err)
+		} else if !strings.Contains(err.Error(), test.mode.String()) {
+			t.Errorf("%s %s: expected the error to name the access mode, got %v", test.mounter, test.mode, err)
+		}
+		if srv.BucketExists(name) {
+			t.Errorf("%s %s: expected no bucket to be created", test.mounter, test.mode)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilitiesSingleWriter(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	for _, m := range []string{"s3fs", "s3backer"} {
+		req := createVolumeRequest("pvc-"+m, srv.Secret())
+		req.Parameters["mounter"] = m
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		volumeID  string
+		mode      csi.VolumeCapability_AccessMode_Mode
+		confirmed bool
+	}{
+		{volumeID: "pvc-s3fs", mode: mounter.SingleNodeSingleWriter, confirmed: true},
+		{volumeID: "pvc-s3backer", mode: mounter.SingleNodeSingleWriter, confirmed: true},
+		{volumeID: "pvc-s3backer", mode: mounter.SingleNodeMultiWriter, confirmed: true},
+		{volumeID: "pvc-s3backer", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{volumeID: "pvc-s3backer", mode: csi.VolumeCapability_AccessMode_UNKNOWN},
+	}
+	for _, test := range tests {
+		resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: test.volumeID,
+			Secrets:  srv.Secret(),
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.volumeID, test.mode, err)
+		}
+		if confirmed := resp.GetConfirmed() != nil; confirmed != test.confirmed {
+			t.Errorf("%s %s: expected confirmed %v, got %v: %s", test.volumeID, test.mode, test.confirmed, confirmed, resp.GetMessage())
+		}
+	}
+}
+
+func TestDeleteVolumePrefixProvenance(t *testing.T) {
+	created, adopted := true, false
+	tests := []struct {
+		name          string
+		bucketCreated bool
+		prefixCreated *bool
+		removed       bool
+	}{
+		{name: "old metadata of a created bucket", bucketCreated: true, removed: true},
+		{name: "old metadata of an existing bucket"},
+		{name: "created prefix", prefixCreated: &created, removed: true},
+		{name: "adopted prefix", prefixCreated: &adopted},
+		{name: "adopted prefix of a created bucket", bucketCreated: true, prefixCreated: &adopted},
+	}
+	for _, test := range tests {
+		srv := s3test.NewServer()
+		srv.CreateBucket("shared")
+		srv.PutObject("shared", "volume/csi-fs/file", []byte("data"))
+		client, err := s3.NewClientFromSecret(srv.Secret())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SetFSMeta(&s3.FSMeta{
+			BucketName:         "shared",
+			Prefix:             "volume",
+			FSPath:             defaultFsPath,
+			CreatedByCsi:       test.bucketCreated,
+			PrefixCreatedByCsi: test.prefixCreated,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs := newTestControllerServer()
+		if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "shared/volume", Secrets: srv.Secret()}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.removed {
+			if srv.GetObject("shared", "volume/csi-fs/file") != nil {
+				t.Errorf("%s: expected the data to be removed", test.name)
+			}
+		} else {
+			if srv.GetObject("shared", "volume/csi-fs/file") == nil {
+				t.Errorf("%s: expected the data to be retained", test.name)
+			}
+			if srv.GetObject("shared", "volume/.csi-s3-retained") == nil {
+				t.Errorf("%s: expected a retained marker", test.name)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestCreateVolumePrefixProvenance(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.PutObject("shared", "pvc-existing/data", []byte("data"))
+
+	cs := newTestControllerServer()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"pvc-new": true, "pvc-existing": false} {
+		req := createVolumeRequest(name, srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := client.GetFSMeta("shared", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.PrefixCreatedByCsi == nil || *meta.PrefixCreatedByCsi != expected {
+			t.Errorf("%s: expected PrefixCreatedByCsi %v, got %v", name, expected, meta.PrefixCreatedByCsi)
+		}
+	}
+}
+
+func TestCreateVolumeBucketCreationDisabled(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-missing", srv.Secret())
+	req.Parameters[createBucketKey] = "false"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	if srv.BucketExists("pvc-missing") {
+		t.Fatal("expected no bucket to be created")
+	}
+
+	// an empty bucket named after the volume is never adopted
+	srv.CreateBucket("pvc-existing")
+	cs.adoptEmptyBuckets = true
+	cs.disableBucketCreation = true
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-existing", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-existing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CreatedByCsi {
+		t.Fatal("expected a bucket not created by csi-s3")
+	}
+
+	// prefixes are still created in existing buckets
+	srv.CreateBucket("shared")
+	req = createVolumeRequest("pvc-prefix", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-prefix/csi-fs/") == nil {
+		t.Fatal("expected the prefix of the volume to be created")
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "shared/pvc-prefix", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.BucketExists("shared") {
+		t.Fatal("expected the bucket to be kept")
+	}
+}
+
+func TestDeleteVolumeRetainsBucketWithForeignObjects(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	var volumeIDs []string
+	for _, name := range []string{"pvc-a", "pvc-b"} {
+		// the first volume creates the bucket
+		req := createVolumeRequest(name, srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, resp.GetVolume().GetVolumeId())
+	}
+	srv.PutObject("shared", "pvc-b/"+defaultFsPath+"/file", []byte("data"))
+
+	req := &csi.DeleteVolumeRequest{VolumeId: volumeIDs[0], Secrets: srv.Secret()}
+	for i := 0; i < 2; i++ {
+		if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if !srv.BucketExists("shared") || srv.GetObject("shared", "pvc-b/"+defaultFsPath+"/file") == nil {
+		t.Fatal("expected the bucket with the data of the other volume to be retained")
+	}
+	if srv.GetObject("shared", "pvc-a/.metadata.json") != nil {
+		t.Fatal("expected the metadata of the deleted volume to be removed")
+	}
+
+	req.VolumeId = volumeIDs[1]
+	if _, err := cs.DeleteVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-b/"+defaultFsPath+"/file") != nil || !srv.BucketExists("shared") {
+		t.Fatal("expected only the prefix of the other volume to be removed")
+	}
+}
+
+func TestDeleteVolumeBucketRootAndPrefix(t *testing.T) {
+	tests := []struct {
+		name          string
+		existing      bool
+		rootFirst     bool
+		bucketRemoved bool
+	}{
+		{name: "created bucket, root first", rootFirst: true, bucketRemoved: true},
+		{name: "created bucket, prefix first", bucketRemoved: true},
+		{name: "existing bucket, root first", existing: true, rootFirst: true},
+		{name: "existing bucket, prefix first", existing: true},
+	}
+	for _, test := range tests {
+		srv := s3test.NewServer()
+		client, err := s3.NewClientFromSecret(srv.Secret())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.existing {
+			srv.CreateBucket("pvc-root")
+		}
+		cs := newTestControllerServer()
+		if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-root", srv.Secret())); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		req := createVolumeRequest("pvc-prefix", srv.Secret())
+		req.Parameters["bucket"] = "pvc-root"
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		srv.PutObject("pvc-root", defaultFsPath+"/root-file", []byte("data"))
+		srv.PutObject("pvc-root", "pvc-prefix/"+defaultFsPath+"/prefix-file", []byte("data"))
+
+		order := []string{"pvc-prefix", ""}
+		if test.rootFirst {
+			order = []string{"", "pvc-prefix"}
+		}
+		for i, prefix := range order {
+			volumeID := path.Join("pvc-root", prefix)
+			// every deletion is repeated like by the provisioner after a
+			// lost response
+			for attempt := 0; attempt < 2; attempt++ {
+				if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: srv.Secret()}); err != nil {
+					t.Fatalf("%s: deleting %s: %v", test.name, volumeID, err)
+				}
+			}
+			if !srv.BucketExists("pvc-root") {
+				continue
+			}
+			if _, err := client.GetFSMeta("pvc-root", prefix); !errors.Is(err, s3.ErrObjectNotFound) {
+				t.Errorf("%s: expected the metadata of %s to be removed, got %v", test.name, volumeID, err)
+			}
+			if i > 0 {
+				continue
+			}
+			// the other volume is untouched
+			other := order[1]
+			if _, err := client.GetFSMeta("pvc-root", other); err != nil {
+				t.Errorf("%s: expected the metadata of %s to be kept, got %v", test.name, path.Join("pvc-root", other), err)
+			}
+			otherFile := defaultFsPath + "/root-file"
+			if other != "" {
+				otherFile = other + "/" + defaultFsPath + "/prefix-file"
+			}
+			if srv.GetObject("pvc-root", otherFile) == nil {
+				t.Errorf("%s: expected the data of %s to be kept", test.name, path.Join("pvc-root", other))
+			}
+		}
+		if srv.BucketExists("pvc-root") == test.bucketRemoved {
+			t.Errorf("%s: expected the bucket to be removed: %v", test.name, test.bucketRemoved)
+		}
+		if srv.BucketExists("pvc-root") {
+			if srv.GetObject("pvc-root", "pvc-prefix/"+defaultFsPath+"/prefix-file") != nil {
+				t.Errorf("%s: expected the data of the prefix volume to be removed", test.name)
+			}
+			// the data of the root volume is only kept in a bucket csi-s3
+			// did not create
+			if (srv.GetObject("pvc-root", defaultFsPath+"/root-file") != nil) != test.existing {
+				t.Errorf("%s: expected the data of the root volume to be kept: %v", test.name, test.existing)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestDeleteVolumeRetainedPrefixMeta(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.PutObject("shared", "pvc-existing/"+defaultFsPath+"/file", []byte("data"))
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-existing", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 20}
+	req.Parameters[deleteProtectionKey] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearDeleteProtection(srv.Secret(), "shared/pvc-existing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "shared/pvc-existing", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-existing/"+defaultFsPath+"/file") == nil || srv.GetObject("shared", "pvc-existing/.csi-s3-retained") == nil {
+		t.Fatal("expected the data to be retained with a retained marker")
+	}
+	if _, err := client.GetFSMeta("shared", "pvc-existing"); !errors.Is(err, s3.ErrObjectNotFound) {
+		t.Fatalf("expected the metadata to be removed, got %v", err)
+	}
+
+	// provisioned again without the settings of the deleted volume
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 << 20}
+	delete(req.Parameters, deleteProtectionKey)
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("shared", "pvc-existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DeleteProtection || meta.CapacityBytes != 2<<20 || meta.OwnsPrefix() {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestCreateVolumeBucketCreatedConcurrently(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another CreateVolume creates the bucket between the existence check
+	// and the creation
+	var checked int32
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead && strings.Trim(r.URL.Path, "/") == "shared" && atomic.CompareAndSwapInt32(&checked, 0, 1) {
+			w.WriteHeader(http.StatusNotFound)
+			srv.CreateBucket("shared")
+			return true
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-loser", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("shared", "pvc-loser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CreatedByCsi || !meta.OwnsPrefix() {
+		t.Fatalf("expected only the prefix to be owned by the volume, got %+v", meta)
+	}
+	if srv.GetObject("shared", "pvc-loser/"+defaultFsPath+"/") == nil {
+		t.Fatal("expected fs path to be created")
+	}
+
+	// a retry of the same volume creates its bucket before this attempt,
+	// but has not written the metadata yet
+	var retried int32
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead && strings.Trim(r.URL.Path, "/") == "pvc-retry" && atomic.CompareAndSwapInt32(&retried, 0, 1) {
+			w.WriteHeader(http.StatusNotFound)
+			srv.CreateBucket("pvc-retry")
+			return true
+		}
+		return false
+	}
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-retry", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-retry", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.CreatedByCsi {
+		t.Fatalf("expected the bucket created by the other attempt to be owned by the volume, got %+v", meta)
+	}
+
+	// a bucket of another account exists, but cannot be written to
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.Method == http.MethodHead && strings.Trim(r.URL.Path, "/") == "foreign":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && strings.Trim(r.URL.Path, "/") == "foreign":
+			s3test.Error(w, http.StatusConflict, "BucketAlreadyExists")
+		case strings.HasPrefix(r.URL.Path, "/foreign/"):
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+		default:
+			return false
+		}
+		return true
+	}
+	req = createVolumeRequest("pvc-foreign", srv.Secret())
+	req.Parameters["bucket"] = "foreign"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+}
+
+func TestCreateVolumeCaseInsensitiveKeys(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	secret := srv.Secret()
+	secret["keyCaseSensitivity"] = s3.KeyCaseInsensitive
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-s3fs", secret)); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a mounter creating colliding keys, got %v", err)
+	}
+	req := createVolumeRequest("pvc-rclone", secret)
+	req.Parameters[mounter.TypeKey] = "rclone"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	secret["keyCaseSensitivity"] = "maybe"
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-invalid", secret)); err == nil {
+		t.Fatal("expected an invalid keyCaseSensitivity to be rejected")
+	}
+}
+
+func TestCreateVolumeImmutableMetadata(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-worm", srv.Secret())
+	req.Parameters[metadataPolicyKey] = "append"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an unknown metadata policy, got %v", err)
+	}
+	req.Parameters[metadataPolicyKey] = s3.MetadataPolicyImmutable
+	for i := 0; i < 2; i++ {
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var versions []string
+	for _, key := range srv.Keys("pvc-worm") {
+		if strings.Contains(key, ".metadata") {
+			versions = append(versions, key)
+		}
+	}
+	if len(versions) != 2 || !strings.HasSuffix(versions[1], ".metadata.v2.json") {
+		t.Fatalf("expected a version of the metadata for every write, got %v", versions)
+	}
+
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: "pvc-worm", Secrets: srv.Secret()}
+	if _, err := cs.DeleteVolume(context.Background(), deleteReq); err != nil {
+		t.Fatal(err)
+	}
+	if srv.BucketExists("pvc-worm") {
+		t.Fatal("expected the bucket to be removed with all versions of the metadata")
+	}
+}
+
+// cancelAtRequest cancels the returned context when the server receives its
+// nth request, the request itself is still handled
+func cancelAtRequest(srv *s3test.Server, n int32) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int32
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.AddInt32(&count, 1) == n {
+			cancel()
+		}
+		return false
+	}
+	return ctx
+}
+
+// countRequests returns the number of requests fn sends to the server
+func countRequests(srv *s3test.Server, fn func()) int32 {
+	var count int32
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		atomic.AddInt32(&count, 1)
+		return false
+	}
+	fn()
+	srv.Intercept = nil
+	return atomic.LoadInt32(&count)
+}
+
+func TestCreateVolumeCancelledAtEachStep(t *testing.T) {
+	for _, bucket := range []string{"", "shared"} {
+		create := func(ctx context.Context, srv *s3test.Server) (*csi.CreateVolumeResponse, error) {
+			if bucket != "" {
+				srv.CreateBucket(bucket)
+			}
+			req := createVolumeRequest("pvc-cancelled", srv.Secret())
+			if bucket != "" {
+				req.Parameters["bucket"] = bucket
+			}
+			return newTestControllerServer().CreateVolume(ctx, req)
+		}
+		ref := s3test.NewServer()
+		var expected *csi.CreateVolumeResponse
+		steps := countRequests(ref, func() {
+			var err error
+			if expected, err = create(context.Background(), ref); err != nil {
+				t.Fatal(err)
+			}
+		})
+		bucketName, _ := volumeIDToBucketPrefix(expected.GetVolume().GetVolumeId())
+		expectedKeys := ref.Keys(bucketName)
+		ref.Close()
+
+		for n := int32(1); n <= steps; n++ {
+			srv := s3test.NewServer()
+			_, err := create(cancelAtRequest(srv, n), srv)
+			if err != nil && status.Code(err) != codes.Canceled {
+				t.Errorf("bucket %q, cancelled at request %d: expected Canceled, got %v", bucket, n, err)
+			}
+			srv.Intercept = nil
+			// the retry converges on the volume of an uncancelled request
+			resp, err := create(context.Background(), srv)
+			if err != nil {
+				t.Fatalf("bucket %q, cancelled at request %d: retry failed: %v", bucket, n, err)
+			}
+			if resp.GetVolume().GetVolumeId() != expected.GetVolume().GetVolumeId() {
+				t.Errorf("bucket %q, cancelled at request %d: expected volume %s on retry, got %s", bucket, n, expected.GetVolume().GetVolumeId(), resp.GetVolume().GetVolumeId())
+			}
+			if keys := srv.Keys(bucketName); !reflect.DeepEqual(keys, expectedKeys) {
+				t.Errorf("bucket %q, cancelled at request %d: expected objects %v, got %v", bucket, n, expectedKeys, keys)
+			}
+			client, err := s3.NewClientFromSecret(srv.Secret())
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := client.GetFSMeta(volumeIDToBucketPrefix(resp.GetVolume().GetVolumeId()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the data of the volume is removed on deletion
+			if owned := meta.CreatedByCsi || bucket != "" && meta.OwnsPrefix(); !owned {
+				t.Errorf("bucket %q, cancelled at request %d: expected the volume to be recognized as created by csi-s3, got %+v", bucket, n, meta)
+			}
+			srv.Close()
+		}
+	}
+}
+
+func TestDeleteVolumeCancelledAtEachStep(t *testing.T) {
+	setup := func(srv *s3test.Server) *csi.DeleteVolumeRequest {
+		resp, err := newTestControllerServer().CreateVolume(context.Background(), createVolumeRequest("pvc-cancelled", srv.Secret()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId(), Secrets: srv.Secret()}
+	}
+	ref := s3test.NewServer()
+	req := setup(ref)
+	steps := countRequests(ref, func() {
+		if _, err := newTestControllerServer().DeleteVolume(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ref.Close()
+
+	for n := int32(1); n <= steps; n++ {
+		srv := s3test.NewServer()
+		req := setup(srv)
+		_, err := newTestControllerServer().DeleteVolume(cancelAtRequest(srv, n), req)
+		if err != nil && status.Code(err) != codes.Canceled {
+			t.Errorf("cancelled at request %d: expected Canceled, got %v", n, err)
+		}
+		srv.Intercept = nil
+		if _, err := newTestControllerServer().DeleteVolume(context.Background(), req); err != nil {
+			t.Fatalf("cancelled at request %d: retry failed: %v", n, err)
+		}
+		if srv.BucketExists("pvc-cancelled") {
+			t.Errorf("cancelled at request %d: expected the bucket to be removed on retry", n)
+		}
+		srv.Close()
+	}
+}
+
+func TestCreateVolumeDeadlineExceeded(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(ctx, createVolumeRequest("pvc-late", srv.Secret())); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if srv.BucketExists("pvc-late") || srv.Requests(http.MethodPut) != 0 {
+		t.Fatal("expected nothing to be written after the deadline")
+	}
+}
+
+func TestCreateVolumeS3backerOptions(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-s3backer", srv.Secret())
+	req.Parameters["mounter"] = "s3backer"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-s3backer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.S3backer == nil || !meta.S3backer.MD5Check {
+		t.Fatalf("expected MD5 checks for a new volume, got %+v", meta.S3backer)
+	}
+
+	// a volume created before the options existed keeps none
+	meta.S3backer = nil
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-s3backer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if meta.S3backer != nil {
+		t.Fatalf("expected the existing volume to be left untouched, got %+v", meta.S3backer)
+	}
+	req.Parameters["s3backerRetryCount"] = "5"
+	req.Parameters["s3backerTimeout"] = "1m"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-s3backer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := (s3.S3backerOptions{MD5Check: true, RetryCount: 5, TimeoutSeconds: 60}); meta.S3backer == nil || *meta.S3backer != want {
+		t.Fatalf("expected %+v, got %+v", want, meta.S3backer)
+	}
+
+	for _, params := range []map[string]string{
+		{"mounter": "rclone", "s3backerMD5Check": "true"},
+		{"mounter": "s3backer", "s3backerMD5Check": "yes please"},
+		{"mounter": "s3backer", "s3backerRetryCount": "-1"},
+		{"s3backerTimeout": "500ms"},
+	} {
+		req := createVolumeRequest("pvc-s3backer-invalid", srv.Secret())
+		req.Parameters = params
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected InvalidArgument, got %v", params, err)
+		}
+	}
+
+	req = createVolumeRequest("pvc-rclone", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-rclone", ""); err != nil {
+		t.Fatal(err)
+	}
+	if meta.S3backer != nil {
+		t.Fatalf("expected no s3backer options for rclone, got %+v", meta.S3backer)
+	}
+}
+
+func TestCreateVolumeKMSOptions(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted []string
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && r.Header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" {
+			encrypted = append(encrypted, r.URL.Path)
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-kms", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters[mounter.KMSKeyIDKey] = "alias/volumes"
+	req.Parameters[mounter.KMSEncryptionContextKey] = `{"volume":"pvc-kms"}`
+	req.Parameters[mounter.KMSBucketKeyKey] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-kms", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &s3.KMSOptions{KeyID: "alias/volumes", Context: map[string]string{"volume": "pvc-kms"}, BucketKey: true}
+	if !reflect.DeepEqual(meta.KMS, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, meta.KMS)
+	}
+	if want := []string{"/pvc-kms/.metadata.json", "/pvc-kms/csi-fs/"}; !reflect.DeepEqual(encrypted, want) {
+		t.Fatalf("expected %v to be written with SSE-KMS, got %v", want, encrypted)
+	}
+
+	req = createVolumeRequest("pvc-kms-required", srv.Secret())
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters[mounter.KMSEncryptionContextKey] = `{"volume":"pvc-kms-required"}`
+	req.Parameters[mounter.KMSContextRequiredKey] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a mounter without the encryption context, got %v", err)
+	}
+}
+
+func TestCreateVolumeUnprivileged(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	mounter.SetUnprivileged(true)
+	defer mounter.SetUnprivileged(false)
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-unprivileged", srv.Secret())
+	req.Parameters["mounter"] = "s3backer"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected s3backer to be rejected without privileges, got %v", err)
+	}
+	if srv.BucketExists("pvc-unprivileged") {
+		t.Fatal("expected nothing to be created")
+	}
+	req.Parameters["mounter"] = "rclone"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-audited", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	req.Parameters[pvcNamespaceKey] = "team"
+	req.Parameters[pvcNameKey] = "data"
+	req.Parameters[pvNameKey] = "pv-audited"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	ctx := audit.WithIdentity(context.Background(), audit.Identity{VolumeID: "shared/pvc-audited"})
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "shared/pvc-audited", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"accessKeyID", "secretAccessKey"} {
+		if secret := srv.Secret()[key]; strings.Contains(string(b), secret) {
+			t.Fatalf("expected no secrets in the audit log, found %q in:\n%s", secret, b)
+		}
+	}
+	var operations []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r struct {
+			Audit                                        bool
+			Operation, Bucket, VolumeID, PVC, PV, Result string
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if !r.Audit || r.Bucket != "shared" || r.VolumeID != "shared/pvc-audited" {
+			t.Errorf("unexpected record %s", line)
+		}
+		if r.Operation == "SetFSMeta" && (r.PVC != "team/data" || r.PV != "pv-audited") {
+			t.Errorf("expected the PVC and PV of the volume, got %s", line)
+		}
+		if r.Operation == "RemovePrefix" && r.PV != "pv-audited" {
+			t.Errorf("expected the PV of the deleted volume, got %s", line)
+		}
+		operations = append(operations, r.Operation+" "+r.Result)
+	}
+	// destructive operations record their intent before they start
+	if expected := []string{"CreateBucket success", "SetFSMeta success", "CreatePrefix success",
+		"RemovePrefix started", "RemovePrefix success", "RemoveBucket started", "RemoveBucket success"}; !reflect.DeepEqual(operations, expected) {
+		t.Fatalf("expected operations %v, got %v", expected, operations)
+	}
+}
+
+func TestCreateVolumeConsistency(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-strict", srv.Secret())
+	req.Parameters[mounter.TypeKey] = "rclone"
+	req.Parameters[mounter.ConsistencyKey] = mounter.ConsistencyStrict
+	req.Parameters[mounter.SmallFileCacheKey] = "64"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected the small file cache to be rejected with strict consistency, got %v", err)
+	}
+	delete(req.Parameters, mounter.SmallFileCacheKey)
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-strict", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Consistency != mounter.ConsistencyStrict {
+		t.Fatalf("expected the consistency to be stored, got %q", meta.Consistency)
+	}
+	// the mode can be changed, the nodes read it on the next publish
+	req.Parameters[mounter.ConsistencyKey] = mounter.ConsistencyDefault
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = client.GetFSMeta("pvc-strict", ""); err != nil || meta.Consistency != "" {
+		t.Fatalf("expected the default consistency, got %q, %v", meta.Consistency, err)
+	}
+}
@@ -0,0 +1,235 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// healthCheckTimeout bounds the wait for the probe of a mount when the
+// debug endpoint is queried
+const healthCheckTimeout = 5 * time.Second
+
+// debugMount is a published volume as listed by the debug endpoint
+type debugMount struct {
+	VolumeID    string      `json:"volumeID"`
+	PVName      string      `json:"pvName,omitempty"`
+	TargetPath  string      `json:"targetPath"`
+	Mounter     string      `json:"mounter"`
+	PublishedAt time.Time   `json:"publishedAt"`
+	Pod         *podInfo    `json:"pod,omitempty"`
+	Health      mountHealth `json:"health"`
+	// IntegrityErrors counts the blocks whose checksum did not match, for
+	// the mounters which report them
+	IntegrityErrors uint64 `json:"integrityErrors,omitempty"`
+	// MounterLog is the log file the output of the mounter is captured in,
+	// served at /mounterlog?target=<targetPath>
+	MounterLog string `json:"mounterLog,omitempty"`
+}
+
+// debugMounter is the capabilities of a mounter as listed by the debug
+// endpoint
+type debugMounter struct {
+	Type         string   `json:"type"`
+	AccessModes  []string `json:"accessModes"`
+	Features     []string `json:"features"`
+	MountOptions []string `json:"mountOptions,omitempty"`
+}
+
+// mountHealth is the result of probing a mount
+type mountHealth struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// healthProbe probes a mount, which might never return on a hung FUSE
+// mount
+type healthProbe struct {
+	startedAt time.Time
+	done      chan struct{}
+	result    mountHealth
+}
+
+// health returns the result of the probe or that it is still running
+func (p *healthProbe) health() mountHealth {
+	select {
+	case <-p.done:
+		return p.result
+	default:
+		return mountHealth{CheckedAt: p.startedAt, Error: "probe has not returned yet, the mount might hang"}
+	}
+}
+
+// startHealthCheck probes the mount at targetPath in the background. A
+// probe which has not returned yet is reused instead of starting another
+// one, which would hang as well.
+func (ns *nodeServer) startHealthCheck(targetPath string) *healthProbe {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if p, ok := ns.probes[targetPath]; ok {
+		select {
+		case <-p.done:
+		default:
+			return p
+		}
+	}
+	if ns.probes == nil {
+		ns.probes = make(map[string]*healthProbe)
+	}
+	p := &healthProbe{startedAt: time.Now(), done: make(chan struct{})}
+	ns.probes[targetPath] = p
+	go func() {
+		defer close(p.done)
+		p.result = mountHealth{CheckedAt: p.startedAt}
+		notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+		if err == nil && notMnt {
+			err = fmt.Errorf("%s is not mounted", targetPath)
+		}
+		if err == nil {
+			_, err = ioutil.ReadDir(targetPath)
+		}
+		if err != nil {
+			p.result.Error = err.Error()
+			return
+		}
+		p.result.Healthy = true
+	}()
+	return p
+}
+
+// serveDebug serves the volumes published on the node at /mounts, the
+// capabilities of the mounters at /mounters and the captured output of a
+// mounter at /mounterlog of the endpoint in the background. The failures
+// of a systemd unit are reset with a POST to /resetunit. A tcp endpoint has to be bound to a
+// loopback address, as the listing is not authenticated.
+func (ns *nodeServer) serveDebug(endpoint string) error {
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if proto == "tcp" {
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("debug endpoint %s must be bound to localhost", endpoint)
+		}
+	}
+	listener, err := listen(endpoint, 0600, 0)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mounts", ns.handleDebugMounts)
+	mux.HandleFunc("/mounters", handleDebugMounters)
+	mux.HandleFunc("/mounterlog", ns.handleDebugMounterLog)
+	mux.HandleFunc("/resetunit", handleDebugResetUnit)
+	go func() {
+		glog.Infof("Serving debug endpoint on %s", endpoint)
+		if err := http.Serve(listener, mux); err != nil {
+			glog.Errorf("Failed to serve debug endpoint: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (ns *nodeServer) handleDebugMounts(w http.ResponseWriter, r *http.Request) {
+	targets := ns.publishedTargets()
+	mounts := make([]debugMount, 0, len(targets))
+	stagingPaths := make([]string, 0, len(targets))
+	for target, v := range targets {
+		m := debugMount{
+			VolumeID:    v.volumeID,
+			PVName:      v.pvName,
+			TargetPath:  target,
+			Mounter:     v.mounter,
+			PublishedAt: v.publishedAt,
+		}
+		if v.pod.known() {
+			pod := v.pod
+			m.Pod = &pod
+		}
+		if _, err := os.Stat(mounter.OutputLogPath(target)); err == nil {
+			m.MounterLog = mounter.OutputLogPath(target)
+		}
+		mounts = append(mounts, m)
+		stagingPaths = append(stagingPaths, v.stagingPath)
+	}
+	// the probes run in parallel, hung mounts delay the listing by at most
+	// healthCheckTimeout
+	probes := make([]*healthProbe, len(mounts))
+	for i := range mounts {
+		probes[i] = ns.startHealthCheck(mounts[i].TargetPath)
+	}
+	timeout := time.NewTimer(healthCheckTimeout)
+	defer timeout.Stop()
+	expired := false
+	for i, p := range probes {
+		if !expired {
+			select {
+			case <-p.done:
+			case <-timeout.C:
+				expired = true
+			}
+		}
+		mounts[i].Health = p.health()
+		if n := ns.integrityErrorCount(stagingPaths[i]); n > 0 {
+			mounts[i].IntegrityErrors = n
+			mounts[i].Health.Healthy = false
+			mounts[i].Health.Error = fmt.Sprintf("%d blocks do not match their checksum, reading them fails", n)
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].TargetPath < mounts[j].TargetPath })
+	writeDebugListing(w, mounts)
+}
+
+// handleDebugMounters lists which access modes, parameters and mount
+// options each mounter supports
+func handleDebugMounters(w http.ResponseWriter, r *http.Request) {
+	var mounters []debugMounter
+	for _, t := range mounter.Types() {
+		c, err := mounter.GetCapabilities(t)
+		if err != nil {
+			continue
+		}
+		m := debugMounter{Type: t, Features: c.Features(), MountOptions: c.AllowedOptions}
+		for _, mode := range c.AccessModes {
+			m.AccessModes = append(m.AccessModes, accessModeName(mode))
+		}
+		if m.Features == nil {
+			m.Features = []string{}
+		}
+		mounters = append(mounters, m)
+	}
+	writeDebugListing(w, mounters)
+}
+
+// accessModeName returns the name of an access mode, including the single
+// node writer modes the vendored spec does not name
+func accessModeName(mode csi.VolumeCapability_AccessMode_Mode) string {
+	switch mode {
+	case mounter.SingleNodeSingleWriter:
+		return "SINGLE_NODE_SINGLE_WRITER"
+	case mounter.SingleNodeMultiWriter:
+		return "SINGLE_NODE_MULTI_WRITER"
+	}
+	return mode.String()
+}
+
+func writeDebugListing(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		glog.Warningf("Failed to write debug listing: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+func TestDebugMounts(t *testing.T) {
+	ns := &nodeServer{}
+	target := filepath.Join(t.TempDir(), "target")
+	ns.trackPublished(target, publishedVolume{volumeID: "bucket/volume", pvName: "pv", mounter: "rclone"})
+
+	rec := httptest.NewRecorder()
+	ns.handleDebugMounts(rec, httptest.NewRequest("GET", "/mounts", nil))
+	var mounts []debugMount
+	if err := json.Unmarshal(rec.Body.Bytes(), &mounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].VolumeID != "bucket/volume" || mounts[0].TargetPath != target || mounts[0].Mounter != "rclone" {
+		t.Fatalf("unexpected listing %+v", mounts)
+	}
+	// the target has never been mounted
+	if health := mounts[0].Health; health.Healthy || health.Error == "" || health.CheckedAt.IsZero() {
+		t.Fatalf("expected a failed health check, got %+v", health)
+	}
+
+	ns.untrackPublished(target)
+	if len(ns.probes) != 0 {
+		t.Fatal("expected the probe of an unpublished volume to be forgotten")
+	}
+}
+
+func TestDebugMounterLog(t *testing.T) {
+	ns := &nodeServer{}
+	target := filepath.Join(t.TempDir(), "target")
+	ns.trackPublished(target, publishedVolume{volumeID: "bucket/volume", mounter: "rclone"})
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ns.handleDebugMounterLog(rec, httptest.NewRequest("GET", "/mounterlog?target="+url.QueryEscape(target), nil))
+		return rec
+	}
+	if rec := get(target); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no log without captured output, got %d", rec.Code)
+	}
+	if err := ioutil.WriteFile(mounter.OutputLogPath(target), []byte("mount failed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(target); rec.Code != http.StatusOK || rec.Body.String() != "mount failed\n" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	// only the logs of published volumes are served
+	if rec := get(filepath.Join(filepath.Dir(target), "other")); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected the log of an unknown target to be refused, got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	ns.handleDebugMounts(rec, httptest.NewRequest("GET", "/mounts", nil))
+	var mounts []debugMount
+	if err := json.Unmarshal(rec.Body.Bytes(), &mounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].MounterLog != mounter.OutputLogPath(target) {
+		t.Fatalf("expected the mounter log to be listed, got %+v", mounts)
+	}
+}
+
+func TestServeDebugLocalhostOnly(t *testing.T) {
+	ns := &nodeServer{}
+	for _, endpoint := range []string{"tcp://:0", "tcp://0.0.0.0:0", "tcp://10.0.0.1:0"} {
+		if err := ns.serveDebug(endpoint); err == nil || !strings.Contains(err.Error(), "localhost") {
+			t.Errorf("%s: expected endpoint to be rejected, got %v", endpoint, err)
+		}
+	}
+	if err := ns.serveDebug("tcp://127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugMounters(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleDebugMounters(rec, httptest.NewRequest("GET", "/mounters", nil))
+	var mounters []debugMounter
+	if err := json.Unmarshal(rec.Body.Bytes(), &mounters); err != nil {
+		t.Fatal(err)
+	}
+	byType := make(map[string]debugMounter)
+	for _, m := range mounters {
+		byType[m.Type] = m
+	}
+	if len(byType) != len(mounter.Types()) {
+		t.Fatalf("expected every mounter to be listed, got %+v", mounters)
+	}
+	rclone := byType["rclone"]
+	if !contains(rclone.Features, mounter.SmallFileCacheKey) || !contains(rclone.AccessModes, "MULTI_NODE_MULTI_WRITER") {
+		t.Fatalf("unexpected capabilities of rclone %+v", rclone)
+	}
+	s3backer := byType["s3backer"]
+	if contains(s3backer.AccessModes, "MULTI_NODE_MULTI_WRITER") || !contains(s3backer.AccessModes, "SINGLE_NODE_SINGLE_WRITER") {
+		t.Fatalf("unexpected access modes of s3backer %v", s3backer.AccessModes)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
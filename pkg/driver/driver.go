@@ -17,8 +17,21 @@ limitations under the License.
 package driver
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/tracing"
 	"github.com/golang/glog"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -26,63 +39,407 @@ import (
 type driver struct {
 	driver   *csicommon.CSIDriver
 	endpoint string
+	opts     Options
+	events   eventRecorder
+	// tracer exports the spans of RPCs and S3 calls, nil without tracing
+	tracer *sdktrace.TracerProvider
 
 	ids *identityServer
 	ns  *nodeServer
 	cs  *controllerServer
 }
 
+// Options holds the optional settings of the driver
+type Options struct {
+	// EnableEvents emits Kubernetes events on PVs for noteworthy decisions of the driver
+	EnableEvents bool
+	// DefaultSecretDir is a directory holding the secret used for requests without secrets
+	DefaultSecretDir string
+	// SocketMode sets the permissions of the unix socket, 0 keeps the default
+	SocketMode os.FileMode
+	// SocketGID sets the group of the unix socket, 0 keeps the group of the driver
+	SocketGID int
+	// SystemdStateDir enables mounting via transient systemd units and keeps track of them
+	SystemdStateDir string
+	// SystemdRestartLimit is how often a failed systemd unit of a mounter
+	// is restarted before its volume is poisoned
+	SystemdRestartLimit int
+	// AdoptEmptyBuckets treats existing empty buckets without metadata which
+	// are named after the volume as created by the driver
+	AdoptEmptyBuckets bool
+	// DisableBucketCreation only provisions volumes in existing buckets
+	DisableBucketCreation bool
+	// MaxPrefixDepth rejects volumes whose prefix contains more slashes,
+	// 0 does not limit the depth
+	MaxPrefixDepth int
+	// StrictBucketNames rejects volumes whose bucket parameter is not a
+	// valid bucket name, naming the valid one, instead of passing it on
+	StrictBucketNames bool
+	// DefaultCapacityBytes is the capacity of volumes requested without
+	// one, 0 leaves them unbounded
+	DefaultCapacityBytes int64
+	// EnableAttach records the nodes volumes are attached to with
+	// ControllerPublishVolume and refuses to attach a volume of a single
+	// node mounter to a second node
+	EnableAttach bool
+	// ReadWriteOncePod advertises the single node writer access modes of
+	// CSI spec v1.5, which Kubernetes requires for ReadWriteOncePod
+	ReadWriteOncePod bool
+	// StrictContextCheck refuses to publish volumes whose metadata conflicts
+	// with the volume context of their PV
+	StrictContextCheck bool
+	// OTLPEndpoint enables tracing of RPCs and S3 calls, spans are
+	// exported to this OTLP/HTTP endpoint
+	OTLPEndpoint string
+	// UnpublishFlushTimeout bounds the wait for pending uploads of a volume
+	// before it is unmounted, 0 unmounts without flushing
+	UnpublishFlushTimeout time.Duration
+	// MetricsAddress serves metrics of the published volumes in the
+	// Prometheus format, empty disables them
+	MetricsAddress string
+	// DebugEndpoint serves the volumes published on the node and their
+	// health, unix://<path> or tcp://<loopback address>:<port>, empty
+	// disables it
+	DebugEndpoint string
+	// MountTimeouts overrides the maximum time to wait for a mounter to
+	// serve its mount by mounter type
+	MountTimeouts map[string]time.Duration
+	// MultipartUploadLimit caps the parts of multipart uploads sent at the
+	// same time on the node, 0 does not limit them
+	MultipartUploadLimit int
+	// MounterLogMaxBytes captures the output of the mounters in a log file
+	// next to their mount, trimmed once it grows past this size. 0 does
+	// not capture it.
+	MounterLogMaxBytes int64
+	// MountLinger keeps the mount of an unpublished volume for this long,
+	// so it is reused if the volume is published again in the meantime
+	MountLinger time.Duration
+	// MountLingerDir is where lingering mounts are kept and tracked, it
+	// has to survive restarts of the driver. Empty disables lingering.
+	MountLingerDir string
+	// ReapOrphans terminates mounter processes of the node plugin whose
+	// mount is gone, e.g. after an unpublish failed halfway. It does
+	// nothing in the controller.
+	ReapOrphans bool
+	// PreflightOnStart checks the prerequisites of mounting volumes on
+	// startup, the plugin is not ready if any check fails
+	PreflightOnStart bool
+	// PreflightKubeletDir is the directory whose mount propagation is
+	// checked, empty for DefaultKubeletPodsDir
+	PreflightKubeletDir string
+	// PreflightMounters are the mounters which have to be installed, the
+	// others are only checked if they are installed
+	PreflightMounters []string
+	// ProbeMounterBinaries reports the plugin as not ready while the
+	// binary of a mounter is missing or not executable. The mounters of
+	// PreflightMounters are checked, or the ones installed on startup.
+	ProbeMounterBinaries bool
+	// NamespaceQuotas limits the total capacity of the volumes of the PVCs
+	// of a namespace, * applies to the namespaces which are not listed
+	NamespaceQuotas map[string]int64
+	// NamespaceQuotaBucket keeps the usage of the namespaces, it is
+	// required by NamespaceQuotas
+	NamespaceQuotaBucket string
+	// MountRetries is how often a mount failing because the endpoint is
+	// unavailable is retried before the error is returned to kubelet
+	MountRetries int
+	// MountRetryBackoff is the wait before the first retry of a mount, it
+	// doubles after every further retry
+	MountRetryBackoff time.Duration
+	// Unprivileged runs the node plugin without privileges. Only the
+	// mounters which can mount through fusermount or in a user namespace
+	// are used, the controller rejects volumes of the others.
+	Unprivileged bool
+	// AuditLogPath is the file every bucket and object the driver creates,
+	// changes or removes is recorded in, - for stdout, empty disables the
+	// audit log
+	AuditLogPath string
+	// OnMissingMetaDelete is what DeleteVolume does with a volume whose
+	// metadata cannot be read: MissingMetaFail, MissingMetaSkip or
+	// MissingMetaForceRemovePrefix, empty for MissingMetaFail
+	OnMissingMetaDelete string
+	// S3 are the options applied to every S3 client
+	S3 s3.Options
+}
+
 var (
+	// vendorVersion is set when building a release with
+	// -ldflags "-X github.com/ctrox/csi-s3/pkg/driver.vendorVersion=<version>"
 	vendorVersion = "v1.1.1"
 	driverName    = "ch.ctrox.csi.s3-driver"
 )
 
 // New initializes the driver
-func New(nodeID string, endpoint string) (*driver, error) {
+func New(nodeID string, endpoint string, opts Options) (*driver, error) {
 	d := csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
 	if d == nil {
 		glog.Fatalln("Failed to initialize CSI Driver.")
 	}
 
+	if opts.DefaultCapacityBytes < 0 {
+		return nil, fmt.Errorf("invalid default capacity %d, must not be negative", opts.DefaultCapacityBytes)
+	}
+	if opts.S3.ListPageSize < 0 || opts.S3.ListPageSize > s3.MaxListPageSize {
+		return nil, fmt.Errorf("invalid list page size %d, must be between 1 and %d, or 0 for the default of the provider", opts.S3.ListPageSize, s3.MaxListPageSize)
+	}
+	opts.S3.DriverVersion = vendorVersion
+	s3.SetOptions(opts.S3)
+	if err := mounter.SetMountTimeouts(opts.MountTimeouts); err != nil {
+		return nil, err
+	}
+	if err := mounter.SetMultipartUploadLimit(opts.MultipartUploadLimit); err != nil {
+		return nil, err
+	}
+	if err := mounter.SetOutputLogLimit(opts.MounterLogMaxBytes); err != nil {
+		return nil, err
+	}
+	if err := mounter.SetUnitRestartLimit(opts.SystemdRestartLimit); err != nil {
+		return nil, err
+	}
+	if len(opts.NamespaceQuotas) > 0 && opts.NamespaceQuotaBucket == "" {
+		return nil, fmt.Errorf("namespace quotas require a bucket to keep the usage of the namespaces in")
+	}
+	if err := validateMissingMetaPolicy(opts.OnMissingMetaDelete); err != nil {
+		return nil, err
+	}
+	if opts.MountRetries < 0 {
+		return nil, fmt.Errorf("invalid mount retries %d, must not be negative", opts.MountRetries)
+	}
+	if opts.MountRetries > 0 && opts.MountRetryBackoff <= 0 {
+		return nil, fmt.Errorf("invalid mount retry backoff %v, must be positive", opts.MountRetryBackoff)
+	}
+	if opts.Unprivileged {
+		// systemd-run needs the systemd of the host and lingering moves
+		// mounts, both need privileges
+		if opts.SystemdStateDir != "" {
+			return nil, fmt.Errorf("--unprivileged cannot be combined with --systemd-state-dir")
+		}
+		if opts.MountLingerDir != "" {
+			return nil, fmt.Errorf("--unprivileged cannot be combined with --mount-linger-dir")
+		}
+	}
+	mounter.SetUnprivileged(opts.Unprivileged)
+	var tracer *sdktrace.TracerProvider
+	if opts.OTLPEndpoint != "" {
+		var err error
+		if tracer, err = tracing.NewProvider(opts.OTLPEndpoint, "csi-s3"); err != nil {
+			return nil, err
+		}
+	}
+	if opts.AuditLogPath != "" {
+		if err := audit.Open(opts.AuditLogPath); err != nil {
+			return nil, err
+		}
+	}
+
 	s3Driver := &driver{
 		endpoint: endpoint,
 		driver:   d,
+		opts:     opts,
+		events:   newEventRecorder(opts.EnableEvents),
+		tracer:   tracer,
 	}
 	return s3Driver, nil
 }
 
 func (s3 *driver) newIdentityServer(d *csicommon.CSIDriver) *identityServer {
-	return &identityServer{
+	versions := mounter.DetectVersions()
+	for _, t := range mounter.Types() {
+		glog.Infof("Mounter %s: %s", t, versions[t])
+	}
+	glog.V(4).Infof("Mount timeouts: %v", mounter.MountTimeouts())
+	ids := &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		mounterVersions:       versions,
 	}
+	if s3.opts.ProbeMounterBinaries {
+		ids.probeMounters = probedMounters(s3.opts.PreflightMounters, versions)
+		glog.Infof("Probing the binaries of the mounters %v", ids.probeMounters)
+	}
+	return ids
+}
+
+// probedMounters returns the mounters whose binaries are probed: the
+// required ones if any, otherwise the ones installed on startup
+func probedMounters(required []string, versions map[string]string) []string {
+	if len(required) > 0 {
+		return required
+	}
+	var installed []string
+	for _, t := range mounter.Types() {
+		if versions[t] != mounter.VersionNotInstalled {
+			installed = append(installed, t)
+		}
+	}
+	return installed
 }
 
 func (s3 *driver) newControllerServer(d *csicommon.CSIDriver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		events:                  s3.events,
+		defaultSecret:           defaultSecret(s3.opts.DefaultSecretDir),
+		adoptEmptyBuckets:       s3.opts.AdoptEmptyBuckets,
+		disableBucketCreation:   s3.opts.DisableBucketCreation,
+		maxPrefixDepth:          s3.opts.MaxPrefixDepth,
+		strictBucketNames:       s3.opts.StrictBucketNames,
+		defaultCapacityBytes:    s3.opts.DefaultCapacityBytes,
+		attach:                  attacher{enabled: s3.opts.EnableAttach},
+		quotas:                  newNamespaceQuotas(s3.opts.NamespaceQuotaBucket, s3.opts.NamespaceQuotas),
+		missingMetaPolicy:       s3.opts.OnMissingMetaDelete,
 	}
 }
 
 func (s3 *driver) newNodeServer(d *csicommon.CSIDriver) *nodeServer {
 	return &nodeServer{
-		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		DefaultNodeServer:  csicommon.NewDefaultNodeServer(d),
+		defaultSecret:      defaultSecret(s3.opts.DefaultSecretDir),
+		strictContextCheck: s3.opts.StrictContextCheck,
+		flushTimeout:       s3.opts.UnpublishFlushTimeout,
+		events:             s3.events,
+		mountLinger:        s3.opts.MountLinger,
+		lingering:          lingerer{dir: s3.opts.MountLingerDir},
+		mountRetry:         mountRetry{retries: s3.opts.MountRetries, backoff: s3.opts.MountRetryBackoff},
+		readWriteOncePod:   s3.opts.ReadWriteOncePod,
 	}
 }
 
-func (s3 *driver) Run() {
-	glog.Infof("Driver: %v ", driverName)
-	glog.Infof("Version: %v ", vendorVersion)
-	// Initialize default library driver
+// The capabilities advertising the single node writer access modes of CSI
+// spec v1.5 are not named by the vendored spec yet.
+const (
+	controllerSingleNodeMultiWriter = csi.ControllerServiceCapability_RPC_Type(13)
+	nodeSingleNodeMultiWriter       = csi.NodeServiceCapability_RPC_Type(5)
+)
 
-	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
-	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+// gracefulStopTimeout is how long running RPCs may take to finish on
+// shutdown of the driver
+const gracefulStopTimeout = 20 * time.Second
+
+// tracingShutdownTimeout bounds the export of the queued spans on Stop
+const tracingShutdownTimeout = 5 * time.Second
+
+// setup initializes the capabilities and the servers of the driver
+func (s3 *driver) setup() {
+	controllerCapabilities := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	}
+	if s3.opts.ReadWriteOncePod {
+		controllerCapabilities = append(controllerCapabilities, controllerSingleNodeMultiWriter)
+	}
+	if s3.opts.EnableAttach {
+		controllerCapabilities = append(controllerCapabilities, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	}
+	s3.driver.AddControllerServiceCapabilities(controllerCapabilities)
+	s3.driver.AddVolumeCapabilityAccessModes(mounter.AccessModes())
 
-	// Create GRPC servers
 	s3.ids = s3.newIdentityServer(s3.driver)
 	s3.ns = s3.newNodeServer(s3.driver)
 	s3.cs = s3.newControllerServer(s3.driver)
+}
+
+func (s3 *driver) Run() {
+	glog.Infof("Driver: %v ", driverName)
+	glog.Infof("Version: %v ", vendorVersion)
+
+	if s3.opts.SystemdStateDir != "" {
+		if err := mounter.EnableSystemd(s3.opts.SystemdStateDir); err != nil {
+			glog.Fatalf("Failed to enable systemd mounts: %v", err)
+		}
+		if err := mounter.ReconcileSystemdUnits(); err != nil {
+			glog.Errorf("Failed to reconcile systemd mount units: %v", err)
+		}
+	}
+
+	// Initialize default library driver and create GRPC servers
+	s3.setup()
+	// without privileges mounting fails in many ways, they are reported
+	// before the first volume is published
+	if s3.preflightOnStartEnabled() {
+		s3.preflightOnStart()
+	}
+	if err := s3.ns.lingering.reconcile(); err != nil {
+		glog.Errorf("Failed to clean up lingering mounts: %v", err)
+	}
+	if s3.opts.ReapOrphans && s3.servesNode() {
+		s3.ns.orphans = newOrphanReaper(s3.ns.mountedVolumes)
+		go s3.ns.orphans.run()
+		defer s3.ns.orphans.stop()
+	}
+	stopIntegrityChecks := make(chan struct{})
+	go s3.ns.runIntegrityChecks(stopIntegrityChecks)
+	defer close(stopIntegrityChecks)
+	stopMaintenanceChecks := make(chan struct{})
+	go s3.ns.runMaintenanceChecks(stopMaintenanceChecks)
+	defer close(stopMaintenanceChecks)
+	if s3.opts.SystemdStateDir != "" {
+		stopUnitSupervisor := make(chan struct{})
+		go s3.ns.runUnitSupervisor(stopUnitSupervisor)
+		defer close(stopUnitSupervisor)
+	}
+	if s3.opts.MounterLogMaxBytes > 0 {
+		stopMounterLogTrims := make(chan struct{})
+		go s3.ns.runMounterLogTrims(stopMounterLogTrims)
+		defer close(stopMounterLogTrims)
+	}
+	if s3.opts.MetricsAddress != "" {
+		s3.ns.registerMetrics()
+		registerConnectionMetrics()
+		if s3.opts.MultipartUploadLimit > 0 {
+			registerUploadMetrics()
+		}
+		if s3.opts.SystemdStateDir != "" {
+			registerUnitMetrics()
+		}
+		metrics.Serve(s3.opts.MetricsAddress)
+	}
+	if s3.opts.DebugEndpoint != "" {
+		if err := s3.ns.serveDebug(s3.opts.DebugEndpoint); err != nil {
+			glog.Fatalf("Failed to serve debug endpoint: %v", err)
+		}
+	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(s3.endpoint, s3.ids, s3.cs, s3.ns)
-	s.Wait()
+	listener, err := listen(s3.endpoint, s3.opts.SocketMode, s3.opts.SocketGID)
+	if err != nil {
+		glog.Fatalf("Failed to listen: %v", err)
+	}
+	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+	server := newGRPCServer(s3.ids, s3.cs, s3.ns)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		glog.Infof("Received %v, shutting down", sig)
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(gracefulStopTimeout):
+			// a mount hanging on its backend must not keep the driver
+			// from cleaning up
+			glog.Warningf("RPCs still running after %v, stopping anyway", gracefulStopTimeout)
+			server.Stop()
+		}
+	}()
+	if err := server.Serve(listener); err != nil {
+		glog.Fatalf("Failed to serve: %v", err)
+	}
+	// the mounts of volumes which are not published would be left behind
+	s3.ns.lingering.stop()
+}
+
+// Stop releases what the driver holds beyond Run or SelfTest, it exports
+// the spans which are still queued
+func (s3 *driver) Stop() {
+	if s3.tracer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := s3.tracer.Shutdown(ctx); err != nil {
+		glog.Warningf("Failed to export the remaining spans: %v", err)
+	}
 }
@@ -3,6 +3,7 @@ package driver_test
 import (
 	"log"
 	"os"
+	"sync"
 
 	"github.com/ctrox/csi-s3/pkg/driver"
 	"github.com/ctrox/csi-s3/pkg/mounter"
@@ -20,11 +21,11 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, driver.Options{})
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		BeforeEach(runOnce(driver))
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.Config{
@@ -47,11 +48,11 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, driver.Options{})
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		BeforeEach(runOnce(driver))
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.Config{
@@ -73,11 +74,11 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, driver.Options{})
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		BeforeEach(runOnce(driver))
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.Config{
@@ -103,11 +104,11 @@ var _ = Describe("S3Driver", func() {
 		}
 		// Clear loop device so we cover the creation of it
 		os.Remove(mounter.S3backerLoopDevice)
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, driver.Options{})
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		BeforeEach(runOnce(driver))
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.Config{
@@ -131,11 +132,11 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, driver.Options{})
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		BeforeEach(runOnce(driver))
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.Config{
@@ -152,3 +153,11 @@ var _ = Describe("S3Driver", func() {
 		})
 	})
 })
+
+// runOnce starts the driver before the first spec of its context. Starting
+// it while the specs are declared would log before the test binary parsed
+// the flags of glog.
+func runOnce(d interface{ Run() }) func() {
+	var once sync.Once
+	return func() { once.Do(func() { go d.Run() }) }
+}
@@ -0,0 +1,190 @@
+package driver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// serviceAccountReload is how long the token and the CA of the service
+	// account are used before they are read again, kubelet rotates
+	// projected tokens long before they expire
+	serviceAccountReload = time.Minute
+	// events of cluster scoped objects like PVs are stored in the default namespace
+	eventNamespace = "default"
+
+	eventTypeNormal  = "Normal"
+	eventTypeWarning = "Warning"
+)
+
+// eventRecorder emits events about a PersistentVolume
+type eventRecorder interface {
+	Eventf(pvName, eventType, reason, messageFmt string, args ...interface{})
+}
+
+// noopRecorder is used when the events integration is disabled
+type noopRecorder struct{}
+
+func (noopRecorder) Eventf(pvName, eventType, reason, messageFmt string, args ...interface{}) {}
+
+// kubeRecorder creates events through the Kubernetes API using the
+// in-cluster service account of the driver pod.
+type kubeRecorder struct {
+	host string
+	// dir holds the token and the CA of the service account
+	dir string
+
+	mu     sync.Mutex
+	client *http.Client
+	ca     []byte
+	token  string
+	readAt time.Time
+}
+
+func newEventRecorder(enabled bool) eventRecorder {
+	if !enabled {
+		return noopRecorder{}
+	}
+	recorder, err := newKubeRecorder()
+	if err != nil {
+		glog.Errorf("Unable to initialize events integration, no events will be emitted: %v", err)
+		return noopRecorder{}
+	}
+	return recorder
+}
+
+func newKubeRecorder() (*kubeRecorder, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	r := &kubeRecorder{host: "https://" + net.JoinHostPort(host, port), dir: serviceAccountDir}
+	if _, _, err := r.credentials(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// credentials returns the token of the service account and a client
+// trusting its CA. Both are read again once serviceAccountReload has
+// passed, as the token expires after it has been rotated, the client is
+// only replaced if the CA changed.
+func (r *kubeRecorder) credentials() (string, *http.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil && time.Since(r.readAt) < serviceAccountReload {
+		return r.token, r.client, nil
+	}
+	token, err := ioutil.ReadFile(filepath.Join(r.dir, "token"))
+	if err != nil {
+		return "", nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(r.dir, "ca.crt"))
+	if err != nil {
+		return "", nil, err
+	}
+	if r.client == nil || !bytes.Equal(ca, r.ca) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return "", nil, fmt.Errorf("no certificates found in %s", filepath.Join(r.dir, "ca.crt"))
+		}
+		r.client = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+		r.ca = ca
+	}
+	r.token = string(token)
+	r.readAt = time.Now()
+	return r.token, r.client, nil
+}
+
+type objectReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+}
+
+type event struct {
+	APIVersion     string            `json:"apiVersion"`
+	Kind           string            `json:"kind"`
+	Metadata       map[string]string `json:"metadata"`
+	InvolvedObject objectReference   `json:"involvedObject"`
+	Reason         string            `json:"reason"`
+	Message        string            `json:"message"`
+	Type           string            `json:"type"`
+	Source         map[string]string `json:"source"`
+	FirstTimestamp time.Time         `json:"firstTimestamp"`
+	LastTimestamp  time.Time         `json:"lastTimestamp"`
+	Count          int               `json:"count"`
+}
+
+// Eventf emits the event asynchronously, failures are only logged.
+func (r *kubeRecorder) Eventf(pvName, eventType, reason, messageFmt string, args ...interface{}) {
+	if pvName == "" {
+		glog.V(4).Infof("Not emitting event %s, PV name is unknown", reason)
+		return
+	}
+	now := time.Now().UTC()
+	e := &event{
+		APIVersion: "v1",
+		Kind:       "Event",
+		Metadata: map[string]string{
+			"generateName": pvName + ".",
+			"namespace":    eventNamespace,
+		},
+		InvolvedObject: objectReference{APIVersion: "v1", Kind: "PersistentVolume", Name: pvName},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           eventType,
+		Source:         map[string]string{"component": driverName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	go func() {
+		if err := r.post(e); err != nil {
+			glog.Errorf("Failed to emit event %s on PV %s: %v", reason, pvName, err)
+		}
+	}()
+}
+
+func (r *kubeRecorder) post(e *event) error {
+	token, client, err := r.credentials()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/namespaces/%s/events", r.host, eventNamespace), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKubeRecorderRereadsRotatedToken(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeToken := func(token string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeToken("first")
+	r := &kubeRecorder{host: server.URL, dir: dir}
+	e := &event{Reason: "Test"}
+	if err := r.post(e); err != nil {
+		t.Fatal(err)
+	}
+	client := r.client
+
+	// the rotated token is only read once the reload interval has passed
+	writeToken("rotated")
+	if err := r.post(e); err != nil {
+		t.Fatal(err)
+	}
+	r.readAt = time.Now().Add(-serviceAccountReload)
+	if err := r.post(e); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Bearer first", "Bearer first", "Bearer rotated"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, tokens)
+		}
+	}
+	if r.client != client {
+		t.Error("expected the client to be kept while the CA is unchanged")
+	}
+}
@@ -0,0 +1,138 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxExpansionHistory is how many expansions are kept in the metadata of a
+// volume, older ones are dropped
+const maxExpansionHistory = 10
+
+// ControllerExpandVolume raises the capacity recorded in the metadata of a
+// volume. None of the FUSE mounters limits the space a volume uses, so the
+// capacity is advisory and the nodes never have to grow the volume, unless
+// it counts against a namespace quota, which is raised as well. s3backer
+// volumes cannot grow, the capacity is the size of their filesystem.
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if _, _, err := parseVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+	capacityBytes, err := expandedCapacity(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	if isReferenceVolume(volumeID) {
+		// the capacity of a reference volume is not recorded anywhere
+		glog.V(2).Infof("Expanded reference volume %s to %d bytes, its capacity is advisory", volumeID, capacityBytes)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+
+	client, err := s3.NewClientFromSecret(cs.defaultSecret.orDefault(req.GetSecrets()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	client = client.WithContext(ctx)
+	// the attachments are recorded in the same metadata
+	cs.attach.mu.Lock()
+	defer cs.attach.mu.Unlock()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if errors.Is(err, s3.ErrBucketNotFound) || errors.Is(err, s3.ErrObjectNotFound) {
+		return nil, status.Errorf(codes.NotFound, "volume %s does not exist", volumeID)
+	}
+	if err != nil {
+		return nil, s3Error(err, "failed to get metadata of volume %s", volumeID)
+	}
+	c, err := mounter.GetCapabilities(meta.Mounter)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if c.FixedCapacity {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s of mounter %s cannot be expanded, its capacity is the size of its filesystem", volumeID, meta.Mounter)
+	}
+	if meta.Unbounded() {
+		glog.V(2).Infof("Volume %s has no capacity, it is not limited by the expansion to %d bytes", volumeID, capacityBytes)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+	oldCapacityBytes := meta.CapacityBytes
+	if capacityBytes <= oldCapacityBytes {
+		// a retry of an expansion which has been recorded already
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: oldCapacityBytes}, nil
+	}
+
+	var quotaNamespace string
+	if meta.QuotaNamespace != "" && cs.quotas.enabled() {
+		raised, err := cs.quotas.resize(client, meta.QuotaNamespace, meta.VolumeName, capacityBytes)
+		if err != nil {
+			return nil, err
+		}
+		if raised {
+			quotaNamespace = meta.QuotaNamespace
+		}
+	}
+	meta.CapacityBytes = capacityBytes
+	meta.ExpansionHistory = append(meta.ExpansionHistory, s3.Expansion{
+		Time:             time.Now().UTC(),
+		OldCapacityBytes: oldCapacityBytes,
+		NewCapacityBytes: capacityBytes,
+		QuotaNamespace:   quotaNamespace,
+	})
+	if n := len(meta.ExpansionHistory); n > maxExpansionHistory {
+		meta.ExpansionHistory = meta.ExpansionHistory[n-maxExpansionHistory:]
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		if quotaNamespace != "" {
+			// the volume keeps its old capacity
+			if _, resizeErr := cs.quotas.resize(client, quotaNamespace, meta.VolumeName, oldCapacityBytes); resizeErr != nil {
+				glog.Warningf("Failed to restore the capacity of volume %s in the quota of namespace %s: %v", meta.VolumeName, quotaNamespace, resizeErr)
+			}
+		}
+		return nil, s3Error(err, "failed to record the capacity of volume %s", volumeID)
+	}
+
+	if quotaNamespace != "" {
+		glog.V(2).Infof("Expanded volume %s from %d to %d bytes in the quota of namespace %s", volumeID, oldCapacityBytes, capacityBytes, quotaNamespace)
+		cs.events.Eventf(meta.PVName, eventTypeNormal, "Expanded",
+			"Capacity of volume %s has been raised from %d to %d bytes in the quota of namespace %s. The mounter %s does not limit the space the volume uses, the quota limits the capacity provisioned for the namespace.",
+			volumeID, oldCapacityBytes, capacityBytes, quotaNamespace, meta.Mounter)
+	} else {
+		glog.V(2).Infof("Expanded volume %s from %d to %d bytes, its capacity is advisory", volumeID, oldCapacityBytes, capacityBytes)
+		cs.events.Eventf(meta.PVName, eventTypeNormal, "CapacityAdvisory",
+			"Capacity of volume %s has been raised from %d to %d bytes. The capacity of volumes mounted with %s is advisory: S3 does not limit the space they use, so the usable space has not changed and the volume is not remounted.",
+			volumeID, oldCapacityBytes, capacityBytes, meta.Mounter)
+	}
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+}
+
+// expandedCapacity returns the capacity a volume is expanded to, the
+// required bytes or else the limit
+func expandedCapacity(capacityRange *csi.CapacityRange) (int64, error) {
+	required, limit := capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity must not be negative")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.OutOfRange, "required capacity of %d bytes exceeds the limit of %d bytes", required, limit)
+	}
+	if required > 0 {
+		return required, nil
+	}
+	if limit > 0 {
+		return limit, nil
+	}
+	return 0, status.Error(codes.InvalidArgument, "Capacity range missing in request")
+}
@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expandTestVolume resizes a volume like the external-resizer, which
+// finishes the expansion with the capacity of the response as the capacity
+// of the PVC unless the nodes have to grow the volume as well
+func expandTestVolume(cs *controllerServer, volumeID string, secrets map[string]string, capacityBytes int64) (int64, error) {
+	resp, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: capacityBytes},
+		Secrets:       secrets,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.GetNodeExpansionRequired() {
+		return 0, status.Error(codes.Internal, "expected the expansion to finish in the controller")
+	}
+	return resp.GetCapacityBytes(), nil
+}
+
+func newExpandTestControllerServer(recorder eventRecorder) *controllerServer {
+	cs := newTestControllerServer()
+	cs.events = recorder
+	cs.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	})
+	return cs
+}
+
+func TestControllerExpandVolumeAdvisory(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	recorder := &fakeRecorder{}
+	cs := newExpandTestControllerServer(recorder)
+
+	req := createVolumeRequest("pvc-expand", srv.Secret())
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	req.Parameters[pvNameKey] = "pv-expand"
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+
+	capacity, err := expandTestVolume(cs, volumeID, srv.Secret(), 2<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity != 2<<30 {
+		t.Fatalf("expected the PVC to get a capacity of %d bytes, got %d", 2<<30, capacity)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CapacityBytes != 2<<30 || len(meta.ExpansionHistory) != 1 {
+		t.Fatalf("expected the expansion to be recorded, got %d bytes and %+v", meta.CapacityBytes, meta.ExpansionHistory)
+	}
+	if e := meta.ExpansionHistory[0]; e.OldCapacityBytes != 1<<30 || e.NewCapacityBytes != 2<<30 || e.NodeExpansionRequired || e.QuotaNamespace != "" || e.Time.IsZero() {
+		t.Fatalf("unexpected expansion %+v", e)
+	}
+	if e := recorder.events[len(recorder.events)-1]; e.reason != "CapacityAdvisory" || e.pvName != "pv-expand" {
+		t.Fatalf("expected an event explaining the advisory capacity, got %+v", recorder.events)
+	}
+
+	// a retry of the resizer and a smaller size keep the capacity
+	for _, size := range []int64{2 << 30, 1 << 30} {
+		if capacity, err := expandTestVolume(cs, volumeID, srv.Secret(), size); err != nil || capacity != 2<<30 {
+			t.Fatalf("expected the recorded capacity, got %d, %v", capacity, err)
+		}
+	}
+	// only the latest expansions are kept
+	for i := int64(3); i < 3+maxExpansionHistory; i++ {
+		if _, err := expandTestVolume(cs, volumeID, srv.Secret(), i<<30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta, err = client.GetFSMeta(bucketName, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.ExpansionHistory) != maxExpansionHistory || meta.ExpansionHistory[0].OldCapacityBytes != 2<<30 {
+		t.Fatalf("expected the first expansion to be dropped, got %+v", meta.ExpansionHistory)
+	}
+
+	if _, err := expandTestVolume(cs, "missing/pvc-missing", srv.Secret(), 1<<30); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a missing volume, got %v", err)
+	}
+	if _, err := expandTestVolume(cs, volumeID, srv.Secret(), 0); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without a capacity, got %v", err)
+	}
+
+	// the size of the filesystem of s3backer is fixed
+	req = createVolumeRequest("pvc-block", srv.Secret())
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	req.Parameters["mounter"] = "s3backer"
+	if resp, err = cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expandTestVolume(cs, resp.GetVolume().GetVolumeId(), srv.Secret(), 2<<30); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an s3backer volume to be rejected, got %v", err)
+	}
+}
+
+func TestControllerExpandVolumeQuota(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("quotas")
+	recorder := &fakeRecorder{}
+	cs := newExpandTestControllerServer(recorder)
+	cs.quotas = newNamespaceQuotas("quotas", map[string]int64{"team-a": 3 << 30})
+
+	req := createVolumeRequest("pvc-quota", srv.Secret())
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	req.Parameters[pvcNamespaceKey] = "team-a"
+	req.Parameters[pvNameKey] = "pv-quota"
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+
+	capacity, err := expandTestVolume(cs, volumeID, srv.Secret(), 2<<30)
+	if err != nil || capacity != 2<<30 {
+		t.Fatalf("expected the PVC to get a capacity of %d bytes, got %d, %v", 2<<30, capacity, err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := client.GetNamespaceUsage("quotas", "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Total() != 2<<30 {
+		t.Fatalf("expected the quota to count the new capacity, got %v", usage.Volumes)
+	}
+	if e := recorder.events[len(recorder.events)-1]; e.reason != "Expanded" || e.pvName != "pv-quota" {
+		t.Fatalf("expected an event naming the quota, got %+v", recorder.events)
+	}
+
+	// the PVC keeps its capacity if the quota is exceeded
+	if _, err := expandTestVolume(cs, volumeID, srv.Secret(), 4<<30); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CapacityBytes != 2<<30 || len(meta.ExpansionHistory) != 1 || meta.ExpansionHistory[0].QuotaNamespace != "team-a" {
+		t.Fatalf("expected only the first expansion to be recorded, got %d bytes and %+v", meta.CapacityBytes, meta.ExpansionHistory)
+	}
+	if usage, err = client.GetNamespaceUsage("quotas", "team-a"); err != nil || usage.Total() != 2<<30 {
+		t.Fatalf("expected the usage to be unchanged, got %v, %v", usage, err)
+	}
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"path"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// expectEmptyKey refuses to create a volume in an existing bucket or
+	// prefix which already contains data
+	expectEmptyKey = "expectEmpty"
+	// expectPrefixOnlyKey refuses to create a volume in an existing bucket
+	// which contains data outside of the prefix of the volume
+	expectPrefixOnlyKey = "expectPrefixOnly"
+)
+
+// dataInspector lists the data of a bucket
+type dataInspector interface {
+	IsEmpty(bucketName, prefix string) (bool, error)
+	FindForeignObject(bucketName, prefix string) (string, error)
+}
+
+// checkExpectedData verifies the data found at prefix of an existing
+// bucket against the expectations of the parameters, before a volume is
+// created there. dataPrefix is where the data of the volume is kept.
+func checkExpectedData(client dataInspector, params map[string]string, bucketName, prefix, dataPrefix string) error {
+	location := path.Join(bucketName, prefix)
+	if params[expectEmptyKey] == "true" {
+		empty, err := client.IsEmpty(bucketName, s3.DirPrefix(prefix))
+		if err != nil {
+			return s3Error(err, "failed to check if %s is empty", location)
+		}
+		if !empty {
+			return status.Errorf(codes.FailedPrecondition, "%s is expected to be empty, but already contains data", location)
+		}
+	}
+	if params[expectPrefixOnlyKey] == "true" {
+		key, err := client.FindForeignObject(bucketName, dataPrefix)
+		if err != nil {
+			return s3Error(err, "failed to list bucket %s", bucketName)
+		}
+		if key != "" {
+			return status.Errorf(codes.FailedPrecondition, "bucket %s is expected to only contain %s, but also contains %s", bucketName, dataPrefix, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeExpectedData(t *testing.T) {
+	tests := []struct {
+		name        string
+		objects     []string
+		param       string
+		prefix      string
+		unexpected  bool
+		isReference bool
+	}{
+		{name: "empty prefix", objects: []string{"other/file"}, param: expectEmptyKey},
+		{name: "prefix with data", objects: []string{"pvc-import/file"}, param: expectEmptyKey, unexpected: true},
+		{name: "prefix only", objects: []string{"pvc-import/file", ".csi-s3-ready"}, param: expectPrefixOnlyKey},
+		{name: "unrelated data", objects: []string{"pvc-import/file", "other/file"}, param: expectPrefixOnlyKey, unexpected: true},
+		{name: "reference prefix only", objects: []string{"data/set/file"}, param: expectPrefixOnlyKey, prefix: "data/set", isReference: true},
+		{name: "reference next to unrelated data", objects: []string{"data/set/file", "data/other"}, param: expectPrefixOnlyKey, prefix: "data/set", isReference: true, unexpected: true},
+		{name: "reference of a bucket with data", objects: []string{"file"}, param: expectEmptyKey, isReference: true, unexpected: true},
+	}
+	for _, test := range tests {
+		srv := s3test.NewServer()
+		srv.CreateBucket("shared")
+		for _, key := range test.objects {
+			srv.PutObject("shared", key, []byte("data"))
+		}
+
+		cs := newTestControllerServer()
+		req := createVolumeRequest("pvc-import", srv.Secret())
+		req.Parameters["bucket"] = "shared"
+		req.Parameters[test.param] = "true"
+		if test.isReference {
+			req.Parameters[provisioningModeKey] = provisioningModeNone
+			req.Parameters[referencePrefixKey] = test.prefix
+		}
+		_, err := cs.CreateVolume(context.Background(), req)
+		if test.unexpected {
+			if status.Code(err) != codes.FailedPrecondition {
+				t.Errorf("%s: expected FailedPrecondition, got %v", test.name, err)
+			}
+			if srv.GetObject("shared", "pvc-import/.metadata.json") != nil {
+				t.Errorf("%s: expected no metadata to be written", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		srv.Close()
+	}
+}
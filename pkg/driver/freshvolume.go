@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// createdAtKey is added to the volume context of a created volume, the
+// nodes retry reading the metadata of a volume created moments ago
+const createdAtKey = "csi-s3.ctrox.dev/createdAt"
+
+var (
+	// freshVolumeAge is how long after its creation a volume is fresh
+	freshVolumeAge = time.Minute
+	// freshVolumeAttempts and freshVolumeBackoff bound the reads of the
+	// metadata of a fresh volume, the backoff doubles after every attempt
+	freshVolumeAttempts = 3
+	freshVolumeBackoff  = time.Second
+)
+
+// freshVolume returns true if the volume context records a creation within
+// freshVolumeAge
+func freshVolume(volumeContext map[string]string, now time.Time) bool {
+	createdAt, err := time.Parse(time.RFC3339, volumeContext[createdAtKey])
+	return err == nil && now.Sub(createdAt) < freshVolumeAge
+}
+
+// getVolumeMeta reads the metadata of a volume. An eventually consistent
+// backend might not return the bucket or the metadata of a volume created
+// moments ago, so for a fresh volume missing ones are read again a few
+// times before giving up. The attempts are logged as a single line. A
+// missing one of a volume ID which older versions mapped to another
+// volume fails with FailedPrecondition.
+func getVolumeMeta(ctx context.Context, client metaReader, volumeID, bucketName, prefix string, volumeContext map[string]string) (*s3.FSMeta, error) {
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if !notYetVisible(err) || !freshVolume(volumeContext, time.Now()) {
+		return meta, checkLegacyVolumeID(client, volumeID, bucketName, prefix, err)
+	}
+	start := time.Now()
+	backoff := freshVolumeBackoff
+	attempts := 1
+	for ; attempts < freshVolumeAttempts && notYetVisible(err); attempts++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		meta, err = client.GetFSMeta(bucketName, prefix)
+	}
+	if err != nil {
+		glog.Warningf("Metadata of volume %s created at %s is still not visible after %d attempts in %v: %v",
+			volumeID, volumeContext[createdAtKey], attempts, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+	glog.Infof("Metadata of volume %s became visible after %d attempts in %v", volumeID, attempts, time.Since(start).Round(time.Millisecond))
+	return meta, nil
+}
+
+func notYetVisible(err error) bool {
+	return errors.Is(err, s3.ErrObjectNotFound) || errors.Is(err, s3.ErrBucketNotFound)
+}
@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// lateMeta returns the metadata once it has been read a number of times
+type lateMeta struct {
+	missing int
+	reads   int
+}
+
+func (m *lateMeta) GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error) {
+	m.reads++
+	if m.reads <= m.missing {
+		return nil, s3.ErrObjectNotFound
+	}
+	return &s3.FSMeta{BucketName: bucketName, Prefix: prefix}, nil
+}
+
+func TestGetVolumeMeta(t *testing.T) {
+	defer func(backoff time.Duration) { freshVolumeBackoff = backoff }(freshVolumeBackoff)
+	freshVolumeBackoff = time.Millisecond
+
+	fresh := map[string]string{createdAtKey: time.Now().UTC().Format(time.RFC3339)}
+	old := map[string]string{createdAtKey: time.Now().Add(-2 * freshVolumeAge).UTC().Format(time.RFC3339)}
+	for _, tc := range []struct {
+		name          string
+		volumeContext map[string]string
+		missing       int
+		reads         int
+		found         bool
+	}{
+		{"visible", fresh, 0, 1, true},
+		{"fresh", fresh, 2, 3, true},
+		{"never visible", fresh, 3, 3, false},
+		{"old", old, 1, 1, false},
+		{"unknown creation", nil, 1, 1, false},
+	} {
+		client := &lateMeta{missing: tc.missing}
+		meta, err := getVolumeMeta(context.Background(), client, "shared/pvc-1", "shared", "pvc-1", tc.volumeContext)
+		if client.reads != tc.reads {
+			t.Errorf("%s: expected %d reads, got %d", tc.name, tc.reads, client.reads)
+		}
+		if tc.found != (meta != nil && err == nil) {
+			t.Errorf("%s: expected found=%v, got %v, %v", tc.name, tc.found, meta, err)
+		}
+		if !tc.found && !errors.Is(err, s3.ErrObjectNotFound) {
+			t.Errorf("%s: expected the missing metadata to be returned, got %v", tc.name, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := getVolumeMeta(ctx, &lateMeta{missing: 1}, "shared/pvc-1", "shared", "pvc-1", fresh); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the retries to stop with the request, got %v", err)
+	}
+}
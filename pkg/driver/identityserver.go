@@ -17,9 +17,92 @@ limitations under the License.
 package driver
 
 import (
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"golang.org/x/net/context"
+
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// mounterVersions are detected once on startup
+	mounterVersions map[string]string
+	// preflightFailed is set if the preflight checks failed on startup
+	preflightFailed bool
+	// probeMounters are the mounters whose binaries are checked on every
+	// probe, none if disabled
+	probeMounters []string
+	// mu guards probeFailure, the last failed check of a probe, which is
+	// only logged when it changes
+	mu           sync.Mutex
+	probeFailure string
+}
+
+// mounterVersionKeyPrefix prefixes the mounter versions in the manifest of
+// the plugin info, e.g. mounter.rclone
+const mounterVersionKeyPrefix = "mounter."
+
+// GetPluginInfo reports the versions of the mounters in the manifest
+func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Manifest = make(map[string]string, len(ids.mounterVersions))
+	for t, v := range ids.mounterVersions {
+		resp.Manifest[mounterVersionKeyPrefix+t] = v
+	}
+	return resp, nil
+}
+
+// GetPluginCapabilities adds online expansion to the controller service,
+// which only records the capacity while the volume stays mounted
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+		Type: &csi.PluginCapability_VolumeExpansion_{
+			VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+		},
+	})
+	return resp, nil
+}
+
+// Probe reports the plugin as not ready while its preflight checks failed
+// or the binary of a mounter is missing, mounting volumes would fail anyway
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if ids.preflightFailed || !ids.mounterBinariesUsable() {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+	}
+	return ids.DefaultIdentityServer.Probe(ctx, req)
+}
+
+// mounterBinariesUsable checks the binaries of the probed mounters, a
+// failure is logged with the binary once until it changes
+func (ids *identityServer) mounterBinariesUsable() bool {
+	var failure string
+	for _, t := range ids.probeMounters {
+		if err := mounter.CheckBinary(t); err != nil {
+			failure = err.Error()
+			break
+		}
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if failure != ids.probeFailure {
+		if failure != "" {
+			glog.Errorf("The node plugin is not ready: %s", failure)
+		} else {
+			glog.Infof("The binaries of the mounters %v are usable again", ids.probeMounters)
+		}
+		ids.probeFailure = failure
+	}
+	return failure == ""
 }
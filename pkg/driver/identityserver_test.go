@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func TestGetPluginInfo(t *testing.T) {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	ids := &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		mounterVersions:       map[string]string{"rclone": "rclone v1.53.3", "s3fs": "not installed"},
+	}
+	resp, err := ids.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetVendorVersion() != vendorVersion {
+		t.Errorf("expected version %s, got %s", vendorVersion, resp.GetVendorVersion())
+	}
+	if resp.Manifest["mounter.rclone"] != "rclone v1.53.3" || resp.Manifest["mounter.s3fs"] != "not installed" {
+		t.Errorf("unexpected manifest %v", resp.Manifest)
+	}
+}
+
+func TestProbeMounterBinaries(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+	rclone := filepath.Join(dir, "rclone")
+	if err := ioutil.WriteFile(rclone, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	ids := &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		probeMounters:         []string{"goofys", "rclone"},
+	}
+	ready := func() bool {
+		resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an unset value stands for ready
+		return resp.GetReady() == nil || resp.GetReady().GetValue()
+	}
+	if !ready() {
+		t.Fatal("expected the plugin to be ready")
+	}
+	if err := os.Chmod(rclone, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ready() {
+		t.Fatal("expected the plugin not to be ready without an executable rclone")
+	}
+	if !strings.Contains(ids.probeFailure, "rclone") {
+		t.Errorf("expected the failure to name the binary, got %q", ids.probeFailure)
+	}
+	if err := os.Remove(rclone); err != nil {
+		t.Fatal(err)
+	}
+	if ready() {
+		t.Fatal("expected the plugin not to be ready without rclone")
+	}
+	if err := ioutil.WriteFile(rclone, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !ready() || ids.probeFailure != "" {
+		t.Fatal("expected the plugin to be ready again")
+	}
+}
+
+func TestProbedMounters(t *testing.T) {
+	versions := map[string]string{"goofys": "v0.24.0", "rclone": "rclone v1.53.3", "s3backer": "not installed", "s3fs": "unknown"}
+	if probed := probedMounters(nil, versions); !reflect.DeepEqual(probed, []string{"goofys", "rclone", "s3fs"}) {
+		t.Errorf("expected the installed mounters to be probed, got %v", probed)
+	}
+	if probed := probedMounters([]string{"s3backer"}, versions); !reflect.DeepEqual(probed, []string{"s3backer"}) {
+		t.Errorf("expected the required mounters to be probed, got %v", probed)
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	ids := &identityServer{DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d)}
+	resp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var controller, expansion bool
+	for _, c := range resp.GetCapabilities() {
+		controller = controller || c.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE
+		expansion = expansion || c.GetVolumeExpansion().GetType() == csi.PluginCapability_VolumeExpansion_ONLINE
+	}
+	if !controller || !expansion {
+		t.Fatalf("expected the controller service and online expansion, got %v", resp.GetCapabilities())
+	}
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+)
+
+const (
+	integrityCheckInterval = time.Minute
+	// integrityCheckTimeout bounds the read of the counters of a mounter,
+	// which hangs with its FUSE mount
+	integrityCheckTimeout = 5 * time.Second
+)
+
+// integrityErrorsFunc returns the integrity errors the mounter of the
+// volume staged at a path has reported since it was mounted
+type integrityErrorsFunc func(stagingPath string) (uint64, error)
+
+// runIntegrityChecks checks the integrity errors of the staged volumes
+// until stop is closed
+func (ns *nodeServer) runIntegrityChecks(stop <-chan struct{}) {
+	ticker := time.NewTicker(integrityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ns.checkIntegrity(mounter.IntegrityErrors)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkIntegrity reads the integrity errors of the staged volumes
+// and emits a warning on the PV of a volume whose errors have increased.
+// Reads of the corrupted blocks fail with EIO in the pod, the event tells
+// why.
+func (ns *nodeServer) checkIntegrity(integrityErrors integrityErrorsFunc) {
+	volumes := make(map[string]publishedVolume)
+	for _, v := range ns.publishedTargets() {
+		if c, err := mounter.GetCapabilities(v.mounter); err == nil && c.ReportsIntegrityErrors && v.stagingPath != "" {
+			volumes[v.stagingPath] = v
+		}
+	}
+	counts := make(map[string]uint64, len(volumes))
+	for stagingPath, v := range volumes {
+		n, err := readIntegrityErrors(integrityErrors, stagingPath)
+		if err != nil {
+			glog.V(4).Infof("Failed to read the integrity errors of volume %s: %v", v.volumeID, err)
+			// keep the last count, a hung mount does not clear the errors
+			n = ns.integrityErrorCount(stagingPath)
+		}
+		counts[stagingPath] = n
+		if last := ns.integrityErrorCount(stagingPath); n > last {
+			glog.Errorf("Mounter of volume %s detected %d blocks whose checksum does not match their object", v.volumeID, n)
+			ns.events.Eventf(v.pvName, eventTypeWarning, "IntegrityError",
+				"%s detected %d blocks of volume %s whose checksum does not match their object, reading them fails with an I/O error", v.mounter, n-last, v.volumeID)
+		}
+	}
+	ns.mu.Lock()
+	ns.integrityErrors = counts
+	ns.mu.Unlock()
+}
+
+// readIntegrityErrors reads the integrity errors of a volume in the
+// background, giving up after integrityCheckTimeout
+func readIntegrityErrors(integrityErrors integrityErrorsFunc, stagingPath string) (uint64, error) {
+	type result struct {
+		n   uint64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := integrityErrors(stagingPath)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-time.After(integrityCheckTimeout):
+		return 0, fmt.Errorf("reading the counters did not return within %v, the mount might hang", integrityCheckTimeout)
+	}
+}
+
+// integrityErrorCount returns the integrity errors of the volume staged
+// at stagingPath as of the last check
+func (ns *nodeServer) integrityErrorCount(stagingPath string) uint64 {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.integrityErrors[stagingPath]
+}
@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"fmt"
+	"testing"
+)
+
+type recordedEvent struct {
+	pvName, eventType, reason, message string
+}
+
+type fakeRecorder struct {
+	events []recordedEvent
+}
+
+func (r *fakeRecorder) Eventf(pvName, eventType, reason, messageFmt string, args ...interface{}) {
+	r.events = append(r.events, recordedEvent{pvName, eventType, reason, fmt.Sprintf(messageFmt, args...)})
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	recorder := &fakeRecorder{}
+	ns := &nodeServer{events: recorder}
+	ns.trackPublished("/target/a", publishedVolume{volumeID: "pvc-a", pvName: "pv-a", mounter: "s3backer", stagingPath: "/staging/a"})
+	// both targets share the staging mount
+	ns.trackPublished("/target/b", publishedVolume{volumeID: "pvc-a", pvName: "pv-a", mounter: "s3backer", stagingPath: "/staging/a"})
+	ns.trackPublished("/target/c", publishedVolume{volumeID: "pvc-c", pvName: "pv-c", mounter: "rclone", stagingPath: "/staging/c"})
+
+	errors := map[string]uint64{"/staging/a": 0}
+	integrityErrors := func(stagingPath string) (uint64, error) {
+		n, ok := errors[stagingPath]
+		if !ok {
+			t.Errorf("unexpected check of %s", stagingPath)
+		}
+		return n, nil
+	}
+	ns.checkIntegrity(integrityErrors)
+	if len(recorder.events) != 0 {
+		t.Fatalf("expected no events, got %v", recorder.events)
+	}
+	errors["/staging/a"] = 3
+	ns.checkIntegrity(integrityErrors)
+	ns.checkIntegrity(integrityErrors)
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected a single event, got %v", recorder.events)
+	}
+	if e := recorder.events[0]; e.pvName != "pv-a" || e.eventType != eventTypeWarning || e.reason != "IntegrityError" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if n := ns.integrityErrorCount("/staging/a"); n != 3 {
+		t.Fatalf("expected 3 integrity errors, got %d", n)
+	}
+
+	// the errors of an unpublished volume are forgotten
+	ns.untrackPublished("/target/a")
+	ns.untrackPublished("/target/b")
+	ns.checkIntegrity(integrityErrors)
+	if n := ns.integrityErrorCount("/staging/a"); n != 0 {
+		t.Fatalf("expected the errors to be forgotten, got %d", n)
+	}
+}
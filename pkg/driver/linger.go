@@ -0,0 +1,333 @@
+package driver
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// mountLingerKey keeps the mount of an unpublished volume alive for
+	// this many seconds, overriding --mount-linger-seconds
+	mountLingerKey = "mountLinger"
+	// lingerStateSuffix is the suffix of the state of a lingering mount
+	lingerStateSuffix = ".json"
+)
+
+// parseMountLinger returns how long the mount of the volume lingers after
+// it is unpublished, def unless the volume context overrides it
+func parseMountLinger(volumeContext map[string]string, def time.Duration) (time.Duration, error) {
+	s, ok := volumeContext[mountLingerKey]
+	if !ok {
+		return def, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid %s %s, must be a number of seconds", mountLingerKey, s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// lingerState is persisted for every lingering mount, so the driver can
+// keep it lingering or clean up after a restart
+type lingerState struct {
+	VolumeID string `json:"VolumeID"`
+	// Target is the target path the volume has been unpublished from
+	Target string `json:"Target"`
+	// Parked is where the mount is kept
+	Parked string    `json:"Parked"`
+	Since  time.Time `json:"Since"`
+	// Linger is how long the mount is kept after Since, the rest is what
+	// is needed to publish the mount again
+	Linger      time.Duration `json:"Linger,omitempty"`
+	ReadOnly    bool          `json:"ReadOnly,omitempty"`
+	PVName      string        `json:"PVName,omitempty"`
+	Mounter     string        `json:"Mounter,omitempty"`
+	StagingPath string        `json:"StagingPath,omitempty"`
+}
+
+// lingeringMount is the mount of an unpublished volume kept alive until
+// its timer fires or the volume is published again
+type lingeringMount struct {
+	state  lingerState
+	volume publishedVolume
+	timer  *time.Timer
+}
+
+// lingerer parks the mounts of unpublished volumes for a while, so a pod
+// restarting right away finds the mount with its warm cache. A volume
+// lingers with at most one mount, the state of the lingering mounts is
+// kept in dir. The zero value never lingers.
+type lingerer struct {
+	dir string
+
+	mu     sync.Mutex
+	mounts map[string]*lingeringMount
+}
+
+func lingerName(volumeID string) string {
+	h := sha1.New()
+	h.Write([]byte(volumeID))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// park moves the mount of the volume at targetPath aside, it is unmounted
+// once it has lingered for v.linger. It returns false if the mount has to
+// be unmounted right away instead.
+func (l *lingerer) park(targetPath string, v publishedVolume) bool {
+	if l.dir == "" || v.linger <= 0 || v.volumeID == "" {
+		return false
+	}
+	if notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath); err != nil || notMnt {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.mounts[v.volumeID]; ok {
+		return false
+	}
+	name := lingerName(v.volumeID)
+	m := &lingeringMount{
+		state: lingerState{
+			VolumeID:    v.volumeID,
+			Target:      targetPath,
+			Parked:      filepath.Join(l.dir, name),
+			Since:       time.Now(),
+			Linger:      v.linger,
+			ReadOnly:    v.readOnly,
+			PVName:      v.pvName,
+			Mounter:     v.mounter,
+			StagingPath: v.stagingPath,
+		},
+		volume: v,
+	}
+	if err := os.MkdirAll(m.state.Parked, 0750); err != nil {
+		glog.Warningf("Failed to create directory to keep the mount of volume %s: %v", v.volumeID, err)
+		return false
+	}
+	if err := l.writeState(name, &m.state); err != nil {
+		glog.Warningf("Failed to record lingering mount of volume %s: %v", v.volumeID, err)
+		return false
+	}
+	if err := mounter.Park(targetPath, m.state.Parked); err != nil {
+		glog.Warningf("Failed to keep the mount of volume %s: %v", v.volumeID, err)
+		l.removeState(name)
+		return false
+	}
+	if l.mounts == nil {
+		l.mounts = make(map[string]*lingeringMount)
+	}
+	l.mounts[v.volumeID] = m
+	m.timer = time.AfterFunc(v.linger, func() { l.expire(v.volumeID, m) })
+	glog.Infof("Mount of volume %s lingers for %v after it has been unpublished from %s", v.volumeID, v.linger, targetPath)
+	return true
+}
+
+// reuse moves the lingering mount of the volume to targetPath. It returns
+// the published volume of the mount, false if the volume has no lingering
+// mount which can be reused.
+func (l *lingerer) reuse(volumeID, targetPath string, readOnly bool) (publishedVolume, bool) {
+	m := l.take(volumeID)
+	if m == nil {
+		return publishedVolume{}, false
+	}
+	if m.volume.readOnly != readOnly {
+		glog.V(2).Infof("Not reusing the lingering mount of volume %s, it has been mounted with readonly=%v", volumeID, m.volume.readOnly)
+		l.unmount(m)
+		return publishedVolume{}, false
+	}
+	if err := mounter.Unpark(m.state.Parked, targetPath); err != nil {
+		glog.Warningf("Failed to reuse the lingering mount of volume %s: %v", volumeID, err)
+		l.unmount(m)
+		return publishedVolume{}, false
+	}
+	l.removeState(lingerName(volumeID))
+	glog.Infof("Reusing the mount of volume %s which lingered for %v", volumeID, time.Since(m.state.Since).Round(time.Millisecond))
+	return m.volume, true
+}
+
+// cancel unmounts the lingering mount of the volume right away, e.g.
+// because the volume is unstaged
+func (l *lingerer) cancel(volumeID string) {
+	if m := l.take(volumeID); m != nil {
+		glog.V(2).Infof("Unmounting the lingering mount of volume %s", volumeID)
+		l.unmount(m)
+	}
+}
+
+// stop unmounts all lingering mounts, on shutdown of the driver
+func (l *lingerer) stop() {
+	l.mu.Lock()
+	var volumeIDs []string
+	for volumeID := range l.mounts {
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	l.mu.Unlock()
+	for _, volumeID := range volumeIDs {
+		l.cancel(volumeID)
+	}
+}
+
+// parkedVolumes maps the paths the lingering mounts are kept at to their
+// volume IDs
+func (l *lingerer) parkedVolumes() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	volumes := make(map[string]string, len(l.mounts))
+	for volumeID, m := range l.mounts {
+		volumes[m.state.Parked] = volumeID
+	}
+	return volumes
+}
+
+// take removes the lingering mount of the volume and stops its timer
+func (l *lingerer) take(volumeID string) *lingeringMount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.mounts[volumeID]
+	if !ok {
+		return nil
+	}
+	m.timer.Stop()
+	delete(l.mounts, volumeID)
+	return m
+}
+
+func (l *lingerer) expire(volumeID string, m *lingeringMount) {
+	l.mu.Lock()
+	if l.mounts[volumeID] != m {
+		// reused or cancelled concurrently
+		l.mu.Unlock()
+		return
+	}
+	delete(l.mounts, volumeID)
+	l.mu.Unlock()
+	glog.Infof("Unmounting volume %s, it has not been published again within %v", volumeID, m.volume.linger)
+	l.unmount(m)
+}
+
+func (l *lingerer) unmount(m *lingeringMount) {
+	if err := mounter.FuseUnmount(m.state.Parked); err != nil {
+		// the state is kept, so the mount is cleaned up on the next start
+		glog.Errorf("Failed to unmount the lingering mount of volume %s at %s: %v", m.state.VolumeID, m.state.Parked, err)
+		return
+	}
+	if err := os.Remove(m.state.Parked); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove %s: %v", m.state.Parked, err)
+	}
+	l.removeState(lingerName(m.state.VolumeID))
+}
+
+func (l *lingerer) statePath(name string) string {
+	return filepath.Join(l.dir, name+lingerStateSuffix)
+}
+
+func (l *lingerer) writeState(name string, state *lingerState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.statePath(name), b, 0600)
+}
+
+func (l *lingerer) removeState(name string) {
+	if err := os.Remove(l.statePath(name)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove the state of lingering mount %s: %v", name, err)
+	}
+}
+
+// reconcile is run on startup of the driver. The mounts which lingered
+// when the driver stopped keep lingering for the rest of their time if
+// their mounter survived the restart, e.g. as a systemd unit. The others
+// are unmounted and their caches are removed.
+func (l *lingerer) reconcile() error {
+	if l.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(l.dir, "*"+lingerStateSuffix))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), lingerStateSuffix)
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var state lingerState
+		if err := json.Unmarshal(b, &state); err != nil {
+			glog.Warningf("Removing unreadable state of lingering mount %s: %v", f, err)
+			l.removeState(name)
+			continue
+		}
+		mounted := false
+		if notMnt, err := mount.New("").IsLikelyNotMountPoint(state.Parked); err == nil && !notMnt {
+			mounted = true
+			// the cache and the unit of the mount stay with its target
+			mounter.RestoreParked(state.Target, state.Parked)
+		}
+		if remaining := state.Linger - time.Since(state.Since); mounted && remaining > 0 && serves(state.Parked) {
+			l.restore(state, remaining)
+			continue
+		}
+		glog.Warningf("Cleaning up mount of volume %s which lingered at %s when the driver stopped", state.VolumeID, state.Parked)
+		if mounted {
+			if err := mounter.FuseUnmount(state.Parked); err != nil {
+				glog.Errorf("Failed to unmount %s: %v", state.Parked, err)
+				continue
+			}
+		}
+		if err := os.Remove(state.Parked); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Failed to remove %s: %v", state.Parked, err)
+		}
+		mounter.RemoveStaleCache(state.Target)
+		l.removeState(name)
+	}
+	return nil
+}
+
+// serves returns true if the mount at path can still be read, the mount
+// of a mounter which is gone fails
+func serves(path string) bool {
+	_, err := ioutil.ReadDir(path)
+	return err == nil
+}
+
+// restore keeps the mount of state, which survived a restart of the
+// driver, lingering for the remaining time
+func (l *lingerer) restore(state lingerState, remaining time.Duration) {
+	m := &lingeringMount{
+		state: state,
+		volume: publishedVolume{
+			volumeID:    state.VolumeID,
+			pvName:      state.PVName,
+			mounter:     state.Mounter,
+			stagingPath: state.StagingPath,
+			readOnly:    state.ReadOnly,
+			linger:      state.Linger,
+		},
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mounts == nil {
+		l.mounts = make(map[string]*lingeringMount)
+	}
+	l.mounts[state.VolumeID] = m
+	m.timer = time.AfterFunc(remaining, func() { l.expire(state.VolumeID, m) })
+	glog.Infof("Mount of volume %s keeps lingering for %v after the restart of the driver", state.VolumeID, remaining.Round(time.Second))
+}
@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestParseMountLinger(t *testing.T) {
+	if linger, err := parseMountLinger(map[string]string{}, time.Minute); err != nil || linger != time.Minute {
+		t.Fatalf("expected the default, got %v, %v", linger, err)
+	}
+	if linger, err := parseMountLinger(map[string]string{mountLingerKey: "0"}, time.Minute); err != nil || linger != 0 {
+		t.Fatalf("expected the volume to disable lingering, got %v, %v", linger, err)
+	}
+	for _, value := range []string{"-1", "1m", ""} {
+		if _, err := parseMountLinger(map[string]string{mountLingerKey: value}, 0); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+// mountTmpfs mounts a tmpfs holding a file at a new target, the test is
+// skipped if mounting is not permitted
+func mountTmpfs(t *testing.T) string {
+	target := filepath.Join(t.TempDir(), "pod", "mount")
+	if err := os.MkdirAll(target, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := mount.New("").Mount("tmpfs", target, "tmpfs", nil); err != nil {
+		t.Skipf("mounting is not permitted: %v", err)
+	}
+	t.Cleanup(func() { mount.New("").Unmount(target) })
+	if err := ioutil.WriteFile(filepath.Join(target, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func mounted(t *testing.T, path string) bool {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(path)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return !notMnt
+}
+
+func TestLingeringMountIsReused(t *testing.T) {
+	target := mountTmpfs(t)
+	l := &lingerer{dir: t.TempDir()}
+	v := publishedVolume{volumeID: "bucket/pvc-1", linger: time.Minute}
+	if !l.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	if mounted(t, target) {
+		t.Fatal("expected the target to be unmounted")
+	}
+	if states, _ := filepath.Glob(filepath.Join(l.dir, "*"+lingerStateSuffix)); len(states) != 1 {
+		t.Fatalf("expected the lingering mount to be recorded, got %v", states)
+	}
+
+	if _, ok := l.reuse(v.volumeID, target, true); ok {
+		t.Fatal("expected a read-only publish not to reuse a writable mount")
+	}
+	target = mountTmpfs(t)
+	if !l.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	next := filepath.Join(t.TempDir(), "mount")
+	if err := os.Mkdir(next, 0750); err != nil {
+		t.Fatal(err)
+	}
+	defer mount.New("").Unmount(next)
+	reused, ok := l.reuse(v.volumeID, next, false)
+	if !ok || reused.volumeID != v.volumeID {
+		t.Fatal("expected the lingering mount to be reused")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(next, "file")); err != nil || string(b) != "data" {
+		t.Fatalf("expected the data of the mount at the new target, got %q, %v", b, err)
+	}
+	if states, _ := filepath.Glob(filepath.Join(l.dir, "*"+lingerStateSuffix)); len(states) != 0 {
+		t.Fatalf("expected the state of the reused mount to be removed, got %v", states)
+	}
+}
+
+func TestLingeringMountExpires(t *testing.T) {
+	target := mountTmpfs(t)
+	l := &lingerer{dir: t.TempDir()}
+	v := publishedVolume{volumeID: "pvc-1", linger: 50 * time.Millisecond}
+	if !l.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	parked := filepath.Join(l.dir, lingerName(v.volumeID))
+	deadline := time.Now().Add(5 * time.Second)
+	for mounted(t, parked) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lingering mount to be unmounted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := l.reuse(v.volumeID, target, false); ok {
+		t.Fatal("expected an expired mount not to be reused")
+	}
+
+	// unstaging and shutdown unmount right away
+	target = mountTmpfs(t)
+	v.linger = time.Hour
+	if !l.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	l.stop()
+	if mounted(t, parked) {
+		t.Fatal("expected the lingering mount to be unmounted on shutdown")
+	}
+}
+
+func TestReconcileLingeringMounts(t *testing.T) {
+	target := mountTmpfs(t)
+	dir := t.TempDir()
+	l := &lingerer{dir: dir}
+	v := publishedVolume{volumeID: "pvc-1", pvName: "pv-1", linger: time.Hour}
+	if !l.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	l.take("pvc-1")
+	parked := filepath.Join(dir, lingerName("pvc-1"))
+
+	// a restarted driver keeps the mount which survived lingering
+	restarted := &lingerer{dir: dir}
+	if err := restarted.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if !mounted(t, parked) {
+		t.Fatal("expected the mount of the previous run to keep lingering")
+	}
+	reused, ok := restarted.reuse("pvc-1", target, false)
+	if !ok {
+		t.Fatal("expected the restored mount to be reused")
+	}
+	if reused.pvName != "pv-1" || reused.linger != time.Hour {
+		t.Errorf("expected the volume to be restored, got %+v", reused)
+	}
+	if !mounted(t, target) {
+		t.Fatal("expected the mount to be moved back to its target")
+	}
+
+	// the mount is cleaned up once its time is over
+	if !restarted.park(target, v) {
+		t.Fatal("expected the mount to linger")
+	}
+	restarted.take("pvc-1")
+	state := lingerState{}
+	b, err := ioutil.ReadFile(restarted.statePath(lingerName("pvc-1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Since = time.Now().Add(-2 * time.Hour)
+	if err := restarted.writeState(lingerName("pvc-1"), &state); err != nil {
+		t.Fatal(err)
+	}
+	expired := &lingerer{dir: dir}
+	if err := expired.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if mounted(t, parked) {
+		t.Fatal("expected the expired mount of the previous run to be unmounted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected the lingering mount to be cleaned up, found %d files", len(files))
+	}
+}
+
+func TestNoLingerWithoutDir(t *testing.T) {
+	target := mountTmpfs(t)
+	l := &lingerer{}
+	if l.park(target, publishedVolume{volumeID: "pvc-1", linger: time.Hour}) {
+		t.Fatal("expected lingering to be disabled without a directory")
+	}
+	if !mounted(t, target) {
+		t.Fatal("expected the mount to be left to the caller")
+	}
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// maintenanceCheckInterval is how often the node reads the maintenance
+// flag of the published volumes
+const maintenanceCheckInterval = time.Minute
+
+// remountFunc makes the mount at a target path read-only or writable
+type remountFunc func(targetPath string, readOnly bool) error
+
+// SetMaintenance sets or clears the maintenance flag of a volume using the
+// default secret of the driver. The nodes remount the target paths of a
+// volume in maintenance read-only, which only applies to the containers
+// started from then on.
+func (s3 *driver) SetMaintenance(volumeID string, enabled bool) error {
+	return setMaintenance(defaultSecret(s3.opts.DefaultSecretDir).orDefault(nil), volumeID, enabled)
+}
+
+func setMaintenance(secrets map[string]string, volumeID string, enabled bool) error {
+	bucketName, prefix, err := parseVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	if isReferenceVolume(volumeID) {
+		return fmt.Errorf("volume %s is a reference volume, it has no metadata to store the maintenance flag in", volumeID)
+	}
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of volume %s: %v", volumeID, err)
+	}
+	if meta.Maintenance == enabled {
+		glog.Infof("Maintenance of volume %s is already set to %t", volumeID, enabled)
+		return nil
+	}
+	meta.Maintenance = enabled
+	if err := client.SetFSMeta(meta); err != nil {
+		return fmt.Errorf("failed to update metadata of volume %s: %v", volumeID, err)
+	}
+	glog.Infof("Set the maintenance of volume %s to %t", volumeID, enabled)
+	return nil
+}
+
+// runMaintenanceChecks remounts the target paths of the published volumes
+// whose maintenance flag changed until stop is closed
+func (ns *nodeServer) runMaintenanceChecks(stop <-chan struct{}) {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ns.checkMaintenance(remountTarget)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkMaintenance reads the maintenance flag of the published volumes and
+// remounts the target paths of the volumes whose flag changed. Volumes
+// published read-only are left as they are.
+func (ns *nodeServer) checkMaintenance(remount remountFunc) {
+	for targetPath, v := range ns.publishedTargets() {
+		if v.readMeta == nil || v.readOnly {
+			continue
+		}
+		meta, err := v.readMeta()
+		if err != nil {
+			glog.V(4).Infof("Failed to read the maintenance flag of volume %s: %v", v.volumeID, err)
+			continue
+		}
+		if meta.Maintenance == v.frozen {
+			continue
+		}
+		if err := remountAll(remount, writablePaths(targetPath, v.prefixes), meta.Maintenance); err != nil {
+			glog.Errorf("Failed to remount %s of volume %s for its maintenance: %v", targetPath, v.volumeID, err)
+			ns.events.Eventf(v.pvName, eventTypeWarning, "MaintenanceFailed", "failed to remount %s of volume %s for its maintenance: %v", targetPath, v.volumeID, err)
+			continue
+		}
+		ns.setFrozen(targetPath, meta.Maintenance)
+		if meta.Maintenance {
+			glog.Infof("Remounted %s of volume %s read-only for its maintenance", targetPath, v.volumeID)
+			ns.events.Eventf(v.pvName, eventTypeNormal, "MaintenanceStarted", "%s of volume %s remounted read-only, containers started from now on cannot write to it", targetPath, v.volumeID)
+		} else {
+			glog.Infof("Remounted %s of volume %s writable after its maintenance", targetPath, v.volumeID)
+			ns.events.Eventf(v.pvName, eventTypeNormal, "MaintenanceEnded", "%s of volume %s remounted writable, containers started from now on can write to it again", targetPath, v.volumeID)
+		}
+	}
+}
+
+// restorePublished tracks a volume which has been published at the target
+// of req before the node plugin restarted. Whether the volume is frozen
+// for its maintenance is taken from its mount, the next check remounts it
+// if the flag changed in the meantime.
+func (ns *nodeServer) restorePublished(req *csi.NodePublishVolumeRequest, identity *s3.WebIdentity, linger time.Duration) {
+	volumeID, targetPath := req.GetVolumeId(), req.GetTargetPath()
+	v := publishedVolume{
+		volumeID:    volumeID,
+		stagingPath: req.GetStagingTargetPath(),
+		publishedAt: time.Now(),
+		pod:         podInfoFromContext(req.GetVolumeContext()),
+		readOnly:    req.GetReadonly(),
+		linger:      linger,
+	}
+	if !isReferenceVolume(volumeID) {
+		secrets := ns.defaultSecret.orDefault(req.GetSecrets())
+		client, err := s3.NewClientFromSecret(secrets)
+		if identity != nil {
+			client, err = s3.NewClientFromWebIdentity(secrets, identity)
+		}
+		if err != nil {
+			glog.Warningf("Failed to initialize S3 client for volume %s: %v", volumeID, err)
+		} else {
+			bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+			v.readMeta = func() (*s3.FSMeta, error) { return client.GetFSMeta(bucketName, prefix) }
+			if meta, err := v.readMeta(); err != nil {
+				glog.Warningf("Failed to read the metadata of volume %s published at %s: %v", volumeID, targetPath, err)
+			} else {
+				v.pvName = meta.PVName
+				v.mounter = mounter.Type(meta, client.Config)
+				v.prefixes = meta.Prefixes
+			}
+		}
+	}
+	if len(v.prefixes) > 0 {
+		v.linger = 0
+	}
+	if !v.readOnly {
+		v.frozen = mountedReadOnly(writablePaths(targetPath, v.prefixes))
+	}
+	ns.trackPublished(targetPath, v)
+	glog.Infof("Restored volume %s published at %s, frozen for its maintenance: %t", volumeID, targetPath, v.frozen)
+}
+
+// mountedReadOnly returns true if the first of paths is mounted read-only,
+// the paths of a volume are remounted together
+func mountedReadOnly(paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(paths[0], &st); err != nil {
+		glog.Warningf("Failed to read the mount flags of %s: %v", paths[0], err)
+		return false
+	}
+	return st.Flags&syscall.MS_RDONLY != 0
+}
+
+// remountAll remounts the paths, the ones remounted before a failure are
+// remounted again by the next check
+func remountAll(remount remountFunc, paths []string, readOnly bool) error {
+	for _, p := range paths {
+		if err := remount(p, readOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFrozen records if the target path of a published volume is remounted
+// read-only for its maintenance
+func (ns *nodeServer) setFrozen(targetPath string, frozen bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if v, ok := ns.published[targetPath]; ok {
+		v.frozen = frozen
+		ns.published[targetPath] = v
+	}
+}
+
+// remountTarget makes the mount at a target path read-only or writable.
+// Only the flags of this mount change, the mount of the mounter stays as
+// it is, as do the bind mounts of the containers which are running, which
+// keep writing to the volume. The
+// flags which are set on the mount have to be repeated by the remount.
+func remountTarget(targetPath string, readOnly bool) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(targetPath, &st); err != nil {
+		return err
+	}
+	kept := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	flags := uintptr(st.Flags)&kept | syscall.MS_REMOUNT | syscall.MS_BIND
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount("", targetPath, "", flags, "")
+}
@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestSetMaintenance(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-maintenance", srv.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enabled := range []bool{true, true, false} {
+		if err := setMaintenance(srv.Secret(), "pvc-maintenance", enabled); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := client.GetFSMeta("pvc-maintenance", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Maintenance != enabled {
+			t.Fatalf("expected maintenance %t, got %t", enabled, meta.Maintenance)
+		}
+	}
+	if err := setMaintenance(srv.Secret(), "pvc-missing", true); err == nil {
+		t.Fatal("expected an error for a volume without metadata")
+	}
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	recorder := &fakeRecorder{}
+	ns := &nodeServer{events: recorder}
+	meta := &s3.FSMeta{}
+	readMeta := func() (*s3.FSMeta, error) { return meta, nil }
+	ns.trackPublished("/target/a", publishedVolume{volumeID: "pvc-a", pvName: "pv-a", readMeta: readMeta})
+	// volumes published read-only stay read-only
+	ns.trackPublished("/target/b", publishedVolume{volumeID: "pvc-a", pvName: "pv-a", readMeta: readMeta, readOnly: true})
+	ns.trackPublished("/target/c", publishedVolume{volumeID: "pvc-c", pvName: "pv-c", readMeta: func() (*s3.FSMeta, error) {
+		return nil, errors.New("unavailable")
+	}})
+
+	remounts := map[string]bool{}
+	var remountErr error
+	remount := func(targetPath string, readOnly bool) error {
+		if remountErr != nil {
+			return remountErr
+		}
+		remounts[targetPath] = readOnly
+		return nil
+	}
+	ns.checkMaintenance(remount)
+	if len(remounts) != 0 || len(recorder.events) != 0 {
+		t.Fatalf("expected no remounts and events, got %v and %v", remounts, recorder.events)
+	}
+
+	meta.Maintenance = true
+	remountErr = errors.New("permission denied")
+	ns.checkMaintenance(remount)
+	if len(recorder.events) != 1 || recorder.events[0].reason != "MaintenanceFailed" || recorder.events[0].eventType != eventTypeWarning {
+		t.Fatalf("expected a MaintenanceFailed event, got %v", recorder.events)
+	}
+	// the remount is retried by the next check
+	remountErr = nil
+	ns.checkMaintenance(remount)
+	ns.checkMaintenance(remount)
+	if len(remounts) != 1 || !remounts["/target/a"] {
+		t.Fatalf("expected /target/a to be remounted read-only once, got %v", remounts)
+	}
+	if e := recorder.events[len(recorder.events)-1]; len(recorder.events) != 2 || e.pvName != "pv-a" || e.reason != "MaintenanceStarted" {
+		t.Fatalf("expected a MaintenanceStarted event, got %v", recorder.events)
+	}
+	if !ns.publishedVolume("/target/a").frozen {
+		t.Fatal("expected /target/a to be frozen")
+	}
+
+	meta.Maintenance = false
+	ns.checkMaintenance(remount)
+	if remounts["/target/a"] {
+		t.Fatal("expected /target/a to be remounted writable")
+	}
+	if e := recorder.events[len(recorder.events)-1]; len(recorder.events) != 3 || e.reason != "MaintenanceEnded" {
+		t.Fatalf("expected a MaintenanceEnded event, got %v", recorder.events)
+	}
+}
+
+func TestRestorePublishedFrozen(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-restored", srv.Secret())
+	req.Parameters[pvNameKey] = "pv-restored"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	// remounted read-only for the maintenance before the node plugin
+	// restarted, the maintenance has been cleared since
+	target := mountTmpfs(t)
+	if err := remountTarget(target, true); err != nil {
+		t.Skipf("remounting is not permitted: %v", err)
+	}
+
+	ns := &nodeServer{events: &fakeRecorder{}}
+	ns.restorePublished(&csi.NodePublishVolumeRequest{
+		VolumeId:          "pvc-restored",
+		TargetPath:        target,
+		StagingTargetPath: "/staging",
+		Secrets:           srv.Secret(),
+	}, nil, 0)
+	v := ns.publishedVolume(target)
+	if v.volumeID != "pvc-restored" || v.pvName != "pv-restored" || !v.frozen || v.readMeta == nil {
+		t.Fatalf("expected the frozen volume to be restored, got %+v", v)
+	}
+	remounts := map[string]bool{}
+	ns.checkMaintenance(func(targetPath string, readOnly bool) error {
+		remounts[targetPath] = readOnly
+		return nil
+	})
+	if readOnly, ok := remounts[target]; !ok || readOnly {
+		t.Fatalf("expected the target to be remounted writable, got %v", remounts)
+	}
+}
@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// registerMetrics exposes the statistics of the caches of the volumes
+// published on the node. Only rclone mounts report them.
+func (ns *nodeServer) registerMetrics() {
+	metrics.Register("csi_s3_vfs_dirty_bytes", "Size of the files in the cache of a volume which have not been uploaded.", metrics.Gauge,
+		ns.cacheSamples(func(s *mounter.CacheStats) float64 { return float64(s.DirtyBytes) }))
+	metrics.Register("csi_s3_vfs_uploads_queued", "Number of files of a volume waiting for their upload.", metrics.Gauge,
+		ns.cacheSamples(func(s *mounter.CacheStats) float64 { return float64(s.UploadsQueued) }))
+	metrics.Register("csi_s3_vfs_uploads_in_progress", "Number of files of a volume being uploaded.", metrics.Gauge,
+		ns.cacheSamples(func(s *mounter.CacheStats) float64 { return float64(s.UploadsInProgress) }))
+	metrics.Register("csi_s3_volume_pod_info", "Pod a volume is published for, only known with podInfoOnMount.", metrics.Gauge,
+		ns.podSamples)
+	metrics.Register("csi_s3_integrity_errors_total", "Number of blocks of a volume whose checksum did not match, only s3backer reports them.", metrics.Counter,
+		ns.integritySamples)
+	if ns.orphans != nil {
+		metrics.Register("csi_s3_orphaned_mounters_detected_total", "Number of mounter processes detected without their mount.", metrics.Counter,
+			ns.orphanSamples(func(detected, reaped map[string]int) map[string]int { return detected }))
+		metrics.Register("csi_s3_orphaned_mounters_reaped_total", "Number of mounter processes without their mount which have been terminated.", metrics.Counter,
+			ns.orphanSamples(func(detected, reaped map[string]int) map[string]int { return reaped }))
+	}
+}
+
+func (ns *nodeServer) orphanSamples(counts func(detected, reaped map[string]int) map[string]int) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		for mounter, n := range counts(ns.orphans.counts()) {
+			samples = append(samples, metrics.Sample{
+				Labels: map[string]string{"mounter": mounter},
+				Value:  float64(n),
+			})
+		}
+		return samples
+	}
+}
+
+// integritySamples reports the integrity errors of the staged volumes as
+// of the last check
+func (ns *nodeServer) integritySamples() []metrics.Sample {
+	var samples []metrics.Sample
+	seen := make(map[string]bool)
+	for _, v := range ns.publishedTargets() {
+		if seen[v.stagingPath] {
+			continue
+		}
+		seen[v.stagingPath] = true
+		if n := ns.integrityErrorCount(v.stagingPath); n > 0 {
+			samples = append(samples, metrics.Sample{
+				Labels: map[string]string{"volume_id": v.volumeID},
+				Value:  float64(n),
+			})
+		}
+	}
+	return samples
+}
+
+// podSamples maps the target paths of the published volumes to their pods
+func (ns *nodeServer) podSamples() []metrics.Sample {
+	var samples []metrics.Sample
+	for target, v := range ns.publishedTargets() {
+		if !v.pod.known() {
+			continue
+		}
+		samples = append(samples, metrics.Sample{
+			Labels: map[string]string{
+				"volume_id":       v.volumeID,
+				"target_path":     target,
+				"pod_namespace":   v.pod.Namespace,
+				"pod_name":        v.pod.Name,
+				"pod_uid":         v.pod.UID,
+				"service_account": v.pod.ServiceAccount,
+			},
+			Value: 1,
+		})
+	}
+	return samples
+}
+
+func (ns *nodeServer) cacheSamples(value func(*mounter.CacheStats) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		for target, v := range ns.publishedTargets() {
+			stats, err := mounter.GetCacheStats(target)
+			if err != nil {
+				glog.V(4).Infof("Failed to get cache statistics of volume %s: %v", v.volumeID, err)
+				continue
+			}
+			if stats == nil {
+				continue
+			}
+			samples = append(samples, metrics.Sample{
+				Labels: map[string]string{"volume_id": v.volumeID, "target_path": target},
+				Value:  value(stats),
+			})
+		}
+		return samples
+	}
+}
+
+// registerConnectionMetrics exposes the connections of the driver itself
+// to the S3 endpoints, the mounters keep their own connections.
+func registerConnectionMetrics() {
+	metrics.Register("csi_s3_connections_open", "Number of connections of the driver open to an S3 endpoint.", metrics.Gauge,
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for endpoint, open := range s3.OpenConnections() {
+				samples = append(samples, metrics.Sample{
+					Labels: map[string]string{"endpoint": endpoint},
+					Value:  float64(open),
+				})
+			}
+			return samples
+		})
+}
+
+// registerUploadMetrics exposes the multipart upload limit of the node.
+// Only goofys shares the limit, the mounters running as their own process
+// are limited per mount and not counted.
+func registerUploadMetrics() {
+	metrics.Register("csi_s3_multipart_uploads_in_progress", "Number of parts of multipart uploads being sent by the mounters sharing the node limit.", metrics.Gauge,
+		func() []metrics.Sample {
+			inProgress, _ := mounter.MultipartUploadStats()
+			return []metrics.Sample{{Value: float64(inProgress)}}
+		})
+	metrics.Register("csi_s3_multipart_upload_limit_reached_total", "Number of parts of multipart uploads which had to wait for the node limit.", metrics.Counter,
+		func() []metrics.Sample {
+			_, limited := mounter.MultipartUploadStats()
+			return []metrics.Sample{{Value: float64(limited)}}
+		})
+}
@@ -0,0 +1,167 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// metaExport is the file the metadata of all volumes is exported to
+type metaExport struct {
+	// Endpoint is the endpoint the metadata has been read from
+	Endpoint   string       `json:"endpoint"`
+	ExportedAt time.Time    `json:"exportedAt"`
+	Volumes    []*s3.FSMeta `json:"volumes"`
+	// SkippedBuckets could not be read, their volumes are missing
+	SkippedBuckets []string `json:"skippedBuckets,omitempty"`
+}
+
+// MetaImport are the settings of an import of exported metadata
+type MetaImport struct {
+	// Endpoint replaces the endpoint of the default secret, empty keeps it
+	Endpoint string
+	// Buckets maps the buckets of the exported volumes to the buckets they
+	// are imported to, unlisted buckets keep their name
+	Buckets map[string]string
+	// DryRun only reports what would be imported
+	DryRun bool
+}
+
+// ParseBucketMap parses a comma-separated list of old=new bucket names
+func ParseBucketMap(spec string) (map[string]string, error) {
+	buckets := make(map[string]string)
+	if spec == "" {
+		return buckets, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid bucket mapping %q, expected <old>=<new>", entry)
+		}
+		if _, ok := buckets[parts[0]]; ok {
+			return nil, fmt.Errorf("bucket %s is mapped more than once", parts[0])
+		}
+		buckets[parts[0]] = parts[1]
+	}
+	return buckets, nil
+}
+
+// ExportMeta writes the metadata of every volume found in the buckets of
+// the default secret as JSON to w. Buckets which cannot be read, e.g. as
+// they belong to another user of the object store, are reported to out
+// and skipped.
+func (s3 *driver) ExportMeta(w, out io.Writer) error {
+	return exportMeta(defaultSecret(s3.opts.DefaultSecretDir).orDefault(nil), w, out)
+}
+
+func exportMeta(secrets map[string]string, w, out io.Writer) error {
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	buckets, err := client.ListBuckets()
+	if err != nil {
+		return fmt.Errorf("failed to list buckets: %v", err)
+	}
+	export := metaExport{Endpoint: client.Config.Endpoint, ExportedAt: time.Now().UTC(), Volumes: []*s3.FSMeta{}}
+	for _, bucketName := range buckets {
+		metas, err := client.ListFSMeta(bucketName)
+		if err != nil {
+			fmt.Fprintf(out, "Skipping bucket %s, failed to list its volumes: %v\n", bucketName, err)
+			export.SkippedBuckets = append(export.SkippedBuckets, bucketName)
+			continue
+		}
+		export.Volumes = append(export.Volumes, metas...)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&export)
+}
+
+// ImportMeta writes the metadata of an export of ExportMeta to the object
+// store of the default secret and reports the result of every volume to
+// out. Existing metadata is never overwritten.
+func (s3 *driver) ImportMeta(r io.Reader, opts MetaImport, out io.Writer) error {
+	return importMeta(defaultSecret(s3.opts.DefaultSecretDir).orDefault(nil), r, opts, out)
+}
+
+func importMeta(secrets map[string]string, r io.Reader, opts MetaImport, out io.Writer) error {
+	if opts.Endpoint != "" {
+		target := make(map[string]string, len(secrets)+1)
+		for k, v := range secrets {
+			target[k] = v
+		}
+		target["endpoint"] = opts.Endpoint
+		secrets = target
+	}
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	var export metaExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("failed to read exported metadata: %v", err)
+	}
+	fmt.Fprintf(out, "Importing %d volumes of %s to %s\n", len(export.Volumes), export.Endpoint, client.Config.Endpoint)
+	if len(export.SkippedBuckets) > 0 {
+		fmt.Fprintf(out, "The export is missing the volumes of the unreadable buckets %s\n", strings.Join(export.SkippedBuckets, ", "))
+	}
+	failed := 0
+	for _, meta := range export.Volumes {
+		source := path.Join(meta.BucketName, meta.Prefix)
+		if bucketName, ok := opts.Buckets[meta.BucketName]; ok {
+			meta.BucketName = bucketName
+		}
+		volumeID := path.Join(meta.BucketName, meta.Prefix)
+		result, err := importVolumeMeta(client, meta, opts.DryRun)
+		if err != nil {
+			fmt.Fprintf(out, "%s -> %s: FAILED: %v\n", source, volumeID, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s -> %s: %s\n", source, volumeID, result)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to import %d of %d volumes", failed, len(export.Volumes))
+	}
+	return nil
+}
+
+// metaWriter writes the metadata of a volume to a bucket
+type metaWriter interface {
+	BucketExists(bucketName string) (bool, error)
+	GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error)
+	SetFSMeta(meta *s3.FSMeta) error
+}
+
+// importVolumeMeta writes the metadata of a single volume unless the
+// volume already has metadata, and describes what it did
+func importVolumeMeta(client metaWriter, meta *s3.FSMeta, dryRun bool) (string, error) {
+	exists, err := client.BucketExists(meta.BucketName)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("bucket %s does not exist", meta.BucketName)
+	}
+	_, err = client.GetFSMeta(meta.BucketName, meta.Prefix)
+	if err == nil {
+		return "skipped, metadata exists", nil
+	}
+	if !errors.Is(err, s3.ErrObjectNotFound) {
+		return "", err
+	}
+	if dryRun {
+		return "would be imported", nil
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		return "", err
+	}
+	return "imported", nil
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestParseBucketMap(t *testing.T) {
+	buckets, err := ParseBucketMap("old=new, other=renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets["old"] != "new" || buckets["other"] != "renamed" {
+		t.Fatalf("unexpected mapping %v", buckets)
+	}
+	for _, spec := range []string{"old", "old=", "=new", "old=a,old=b"} {
+		if _, err := ParseBucketMap(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestExportImportMeta(t *testing.T) {
+	source := s3test.NewServer()
+	defer source.Close()
+	target := s3test.NewServer()
+	defer target.Close()
+
+	cs := newTestControllerServer()
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-own", source.Secret())); err != nil {
+		t.Fatal(err)
+	}
+	req := createVolumeRequest("pvc-shared", source.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	source.CreateBucket("unrelated")
+	source.PutObject("unrelated", "data/file", []byte("data"))
+
+	// a bucket of another user is reported and skipped
+	source.CreateBucket("foreign")
+	source.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/foreign") {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+
+	export := new(bytes.Buffer)
+	report := new(bytes.Buffer)
+	if err := exportMeta(source.Secret(), export, report); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(export.String(), `"FSPath"`); n != 2 {
+		t.Fatalf("expected the metadata of 2 volumes to be exported, got %d:\n%s", n, export)
+	}
+	if !strings.Contains(report.String(), "Skipping bucket foreign") || !strings.Contains(export.String(), `"skippedBuckets": [
+    "foreign"
+  ]`) {
+		t.Fatalf("expected the unreadable bucket to be reported, got %q:\n%s", report, export)
+	}
+
+	target.CreateBucket("pvc-own")
+	target.CreateBucket("renamed")
+	opts := MetaImport{Buckets: map[string]string{"shared": "renamed"}, DryRun: true}
+	if err := importMeta(target.Secret(), bytes.NewReader(export.Bytes()), opts, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if keys := target.Keys("renamed"); len(keys) != 0 {
+		t.Fatalf("expected a dry run not to write anything, got %v", keys)
+	}
+
+	opts.DryRun = false
+	out := new(bytes.Buffer)
+	if err := importMeta(target.Secret(), bytes.NewReader(export.Bytes()), opts, out); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	client, err := s3.NewClientFromSecret(target.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("renamed", "pvc-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.BucketName != "renamed" || meta.Prefix != "pvc-shared" {
+		t.Fatalf("expected the bucket of the metadata to be rewritten, got %+v", meta)
+	}
+	if _, err := client.GetFSMeta("pvc-own", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// existing metadata is kept, a missing bucket fails the import
+	out.Reset()
+	opts.Buckets = nil
+	err = importMeta(target.Secret(), bytes.NewReader(export.Bytes()), opts, out)
+	if err == nil {
+		t.Fatal("expected the import into the missing bucket shared to fail")
+	}
+	if !strings.Contains(out.String(), "pvc-own -> pvc-own: skipped") {
+		t.Fatalf("expected the existing metadata to be skipped:\n%s", out)
+	}
+}
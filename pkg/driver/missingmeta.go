@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// The policies of DeleteVolume for a volume whose metadata cannot be read
+const (
+	// MissingMetaFail fails the deletion, the provisioner retries it
+	MissingMetaFail = "fail"
+	// MissingMetaSkip leaves the objects of the volume and reports it as
+	// deleted
+	MissingMetaSkip = "skip"
+	// MissingMetaForceRemovePrefix removes the prefix of the volume, its
+	// bucket is never removed
+	MissingMetaForceRemovePrefix = "forceRemovePrefix"
+)
+
+// validateMissingMetaPolicy returns an error if policy is none of the
+// policies for a volume whose metadata cannot be read, empty is fail
+func validateMissingMetaPolicy(policy string) error {
+	switch policy {
+	case "", MissingMetaFail, MissingMetaSkip, MissingMetaForceRemovePrefix:
+		return nil
+	}
+	return fmt.Errorf("invalid policy %s for volumes whose metadata cannot be read, must be %s, %s or %s",
+		policy, MissingMetaFail, MissingMetaSkip, MissingMetaForceRemovePrefix)
+}
+
+type prefixRemover interface {
+	RemovePrefix(bucketName, prefix string) error
+}
+
+// deleteWithoutMeta deletes a volume whose metadata could not be read
+// with readErr as the policy of the controller says. Nothing is known
+// about the volume, a replication rule or the usage of a namespace quota
+// it might have are left as they are. The policy only applies to metadata
+// which is missing or cannot be decoded, other errors like an unavailable
+// endpoint are returned so the provisioner retries the deletion.
+func (cs *controllerServer) deleteWithoutMeta(client prefixRemover, volumeID, bucketName, prefix string, readErr error) (*csi.DeleteVolumeResponse, error) {
+	if !errors.Is(readErr, s3.ErrObjectNotFound) && !errors.Is(readErr, s3.ErrMetadataUnreadable) {
+		return nil, s3Error(readErr, "failed to get metadata of bucket %s", volumeID)
+	}
+	switch cs.missingMetaPolicy {
+	case MissingMetaSkip:
+		glog.Warningf("Failed to get metadata of volume %s, deleting it without removing any of its objects as of policy %s: %v", volumeID, MissingMetaSkip, readErr)
+		return &csi.DeleteVolumeResponse{}, nil
+	case MissingMetaForceRemovePrefix:
+		if prefix == "" {
+			glog.Warningf("Failed to get metadata of volume %s, deleting it without removing any of its objects as of policy %s, bucket %s is never removed: %v", volumeID, MissingMetaForceRemovePrefix, bucketName, readErr)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		glog.Warningf("Failed to get metadata of volume %s, removing prefix %s of bucket %s as of policy %s: %v", volumeID, prefix, bucketName, MissingMetaForceRemovePrefix, readErr)
+		if err := client.RemovePrefix(bucketName, prefix); err != nil {
+			return nil, s3Error(err, "failed to remove prefix %s of bucket %s", prefix, bucketName)
+		}
+		glog.Infof("Removed prefix %s of bucket %s with the data and the control objects of volume %s, the bucket is kept", prefix, bucketName, volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	return nil, s3Error(readErr, "failed to get metadata of bucket %s", volumeID)
+}
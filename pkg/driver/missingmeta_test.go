@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestDeleteVolumeUnreadableMeta(t *testing.T) {
+	tests := []struct {
+		policy      string
+		volumeID    string
+		fails       bool
+		dataRemoved bool
+	}{
+		{policy: "", volumeID: "shared/pvc-a", fails: true},
+		{policy: MissingMetaFail, volumeID: "shared/pvc-a", fails: true},
+		{policy: MissingMetaSkip, volumeID: "shared/pvc-a"},
+		{policy: MissingMetaForceRemovePrefix, volumeID: "shared/pvc-a", dataRemoved: true},
+		// the bucket is never removed
+		{policy: MissingMetaForceRemovePrefix, volumeID: "shared"},
+	}
+	for _, test := range tests {
+		srv := s3test.NewServer()
+		srv.CreateBucket("shared")
+		srv.PutObject("shared", "pvc-a/csi-fs/file", []byte("data"))
+		srv.PutObject("shared", "pvc-a/.metadata.json", []byte("not json"))
+		srv.PutObject("shared", ".metadata.json", []byte("not json"))
+		srv.PutObject("shared", "other/file", []byte("data"))
+
+		cs := newTestControllerServer()
+		cs.missingMetaPolicy = test.policy
+		_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: test.volumeID, Secrets: srv.Secret()})
+		if (err != nil) != test.fails {
+			t.Errorf("%s %s: expected failure %v, got %v", test.policy, test.volumeID, test.fails, err)
+		}
+		if removed := srv.GetObject("shared", "pvc-a/csi-fs/file") == nil; removed != test.dataRemoved {
+			t.Errorf("%s %s: expected the data to be removed: %v", test.policy, test.volumeID, test.dataRemoved)
+		}
+		if test.dataRemoved && srv.GetObject("shared", "pvc-a/.metadata.json") != nil {
+			t.Errorf("%s %s: expected the metadata to be removed", test.policy, test.volumeID)
+		}
+		if !srv.BucketExists("shared") || srv.GetObject("shared", "other/file") == nil {
+			t.Errorf("%s %s: expected the bucket and the other objects to be kept", test.policy, test.volumeID)
+		}
+		srv.Close()
+	}
+}
+
+func TestDeleteVolumeMetaReadError(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.PutObject("shared", "pvc-a/csi-fs/file", []byte("data"))
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".metadata.json") {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+
+	for _, policy := range []string{MissingMetaSkip, MissingMetaForceRemovePrefix} {
+		cs := newTestControllerServer()
+		cs.missingMetaPolicy = policy
+		if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "shared/pvc-a", Secrets: srv.Secret()}); err == nil {
+			t.Errorf("%s: expected the deletion to fail and be retried", policy)
+		}
+		if srv.GetObject("shared", "pvc-a/csi-fs/file") == nil {
+			t.Errorf("%s: expected the data to be kept", policy)
+		}
+	}
+}
+
+func TestValidateMissingMetaPolicy(t *testing.T) {
+	for _, policy := range []string{"", MissingMetaFail, MissingMetaSkip, MissingMetaForceRemovePrefix} {
+		if err := validateMissingMetaPolicy(policy); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+	}
+	if err := validateMissingMetaPolicy("removeBucket"); err == nil {
+		t.Error("expected an invalid policy to be rejected")
+	}
+}
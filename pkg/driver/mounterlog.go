@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+)
+
+// mounterLogTrimInterval is how often the log files of the mounters are
+// trimmed to their limit, which they can exceed in the meantime
+const mounterLogTrimInterval = 10 * time.Second
+
+// runMounterLogTrims trims the log files of the mounters of the published
+// volumes until stop is closed
+func (ns *nodeServer) runMounterLogTrims(stop <-chan struct{}) {
+	ticker := time.NewTicker(mounterLogTrimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ns.trimMounterLogs()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (ns *nodeServer) trimMounterLogs() {
+	for targetPath, v := range ns.publishedTargets() {
+		if err := mounter.TrimOutputLog(targetPath); err != nil {
+			glog.Warningf("Failed to trim the mounter log of volume %s at %s: %v", v.volumeID, targetPath, err)
+		}
+		for _, p := range v.prefixes {
+			if err := mounter.TrimOutputLog(prefixSource(targetPath, p.Name)); err != nil {
+				glog.Warningf("Failed to trim the mounter log of prefix %s of volume %s: %v", p.Prefix, v.volumeID, err)
+			}
+		}
+	}
+}
+
+// failedMounterLogTail is how much of the log of a mounter whose publish
+// failed is logged before the log is removed
+const failedMounterLogTail = 4096
+
+// removeFailedMounterLog logs the end of the log of the mounter of a
+// failed publish at target, which /mounterlog does not serve, and removes
+// it
+func removeFailedMounterLog(volumeID, targetPath string) {
+	tail, err := mounter.OutputLogTail(targetPath, failedMounterLogTail)
+	if err != nil {
+		glog.Warningf("Failed to read the mounter log of volume %s: %v", volumeID, err)
+	} else if tail != "" {
+		glog.Warningf("Output of the mounter of volume %s at %s, whose publish failed:\n%s", volumeID, targetPath, tail)
+	}
+	if err := mounter.RemoveOutputLog(targetPath); err != nil {
+		glog.Warningf("Failed to remove mounter log of volume %s: %v", volumeID, err)
+	}
+}
+
+// handleDebugMounterLog serves the log file of the mounter of the volume
+// published at the target query parameter. Only the logs of published
+// volumes are served, the endpoint does not read arbitrary files.
+func (ns *nodeServer) handleDebugMounterLog(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if _, ok := ns.publishedTargets()[target]; !ok {
+		http.Error(w, "no volume is published at "+target, http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(mounter.OutputLogPath(target))
+	if os.IsNotExist(err) {
+		http.Error(w, "the output of the mounter of "+target+" is not captured", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
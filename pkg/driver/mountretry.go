@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+)
+
+// mountRetry retries mounts which failed because the endpoint could not be
+// reached, so a brief outage does not fail the pod and leave it to the
+// backoff of kubelet. Other failures, e.g. invalid credentials, are
+// returned right away.
+type mountRetry struct {
+	// retries is the number of retries after the first attempt, 0
+	// disables retrying
+	retries int
+	// backoff is the wait before the first retry, it doubles after every
+	// further one
+	backoff time.Duration
+}
+
+// do runs mount until it succeeds, fails with an error which is not
+// retried, the retries are exhausted or ctx is done
+func (r mountRetry) do(ctx context.Context, volumeID string, mount func() error) error {
+	err := mount()
+	backoff := r.backoff
+	for retry := 1; retry <= r.retries && errors.Is(err, mounter.ErrMountUnavailable); retry++ {
+		glog.Warningf("Mount of volume %s failed, retry %d of %d in %v: %v", volumeID, retry, r.retries, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if err = mount(); err == nil {
+			glog.Infof("Mounted volume %s after %d retries", volumeID, retry)
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+func TestMountRetry(t *testing.T) {
+	unavailable := fmt.Errorf("mount failed: %w", mounter.ErrMountUnavailable)
+	denied := fmt.Errorf("mount failed: %w", mounter.ErrMountPermissionDenied)
+	r := mountRetry{retries: 3, backoff: time.Millisecond}
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{"recovered", []error{unavailable, unavailable, nil}, 3, nil},
+		{"exhausted", []error{unavailable, unavailable, unavailable, unavailable, nil}, 4, mounter.ErrMountUnavailable},
+		{"not retried", []error{denied, nil}, 1, mounter.ErrMountPermissionDenied},
+		{"different failure", []error{unavailable, denied, nil}, 2, mounter.ErrMountPermissionDenied},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := r.do(context.Background(), "vol", func() error {
+				attempts++
+				return tc.errs[attempts-1]
+			})
+			if attempts != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, attempts)
+			}
+			if tc.err == nil && err != nil || tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// nothing is retried by default
+	attempts := 0
+	mountRetry{}.do(context.Background(), "vol", func() error { attempts++; return unavailable })
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt, got %d", attempts)
+	}
+	// a cancelled request stops retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	mountRetry{retries: 3, backoff: time.Hour}.do(ctx, "vol", func() error { attempts++; return unavailable })
+	if attempts != 1 {
+		t.Fatalf("expected no retry after cancellation, got %d attempts", attempts)
+	}
+}
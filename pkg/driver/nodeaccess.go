@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"path"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkNodeAccess checks that the node credentials of the provisioner
+// secret, if it holds any, can read what publishing the volume reads: the
+// metadata of the volume, unless it has none, and the objects of its data
+// prefix. The nodes authenticate with the node publish secret, which is
+// never passed to the controller.
+func checkNodeAccess(secrets map[string]string, meta *s3.FSMeta, hasMeta bool) error {
+	nodeSecret, ok := s3.NodeCredentialsSecret(secrets)
+	if !ok {
+		return nil
+	}
+	client, err := s3.NewClientFromSecret(nodeSecret)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid node credentials: %v", err)
+	}
+	volume := path.Join(meta.BucketName, meta.Prefix)
+	if hasMeta {
+		if _, err := client.GetFSMeta(meta.BucketName, meta.Prefix); err != nil {
+			return s3Error(err, "the node credentials cannot read the metadata of volume %s", volume)
+		}
+	}
+	prefix := ""
+	if dataPrefix := meta.DataPrefix(); dataPrefix != "" {
+		prefix = s3.DirPrefix(dataPrefix)
+	}
+	if _, err := client.IsEmpty(meta.BucketName, prefix); err != nil {
+		return s3Error(err, "the node credentials cannot list the data of volume %s", volume)
+	}
+	glog.V(4).Infof("Node credentials can access volume %s", volume)
+	return nil
+}
@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// denyNode denies the requests signed with the node credentials whose path
+// contains denied
+func denyNode(srv *s3test.Server, denied string) {
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		node := strings.Contains(r.Header.Get("Authorization"), "Credential=node-key/")
+		if node && strings.Contains(r.URL.RawQuery+r.URL.Path, denied) {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+}
+
+func TestCreateVolumeChecksNodeAccess(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+
+	secrets := srv.Secret()
+	secrets["nodeAccessKeyID"] = "node-key"
+	secrets["nodeSecretAccessKey"] = "node-secret"
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-node", secrets)
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, denied := range []string{".metadata.json", "prefix=pvc-node%2Fcsi-fs%2F"} {
+		denyNode(srv, denied)
+		req := createVolumeRequest("pvc-node", secrets)
+		req.Parameters["bucket"] = "shared"
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("denied %s: expected PermissionDenied, got %v", denied, err)
+		}
+	}
+
+	// without node credentials nothing is checked
+	req = createVolumeRequest("pvc-node", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferenceVolumeChecksNodeAccess(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("existing")
+	srv.PutObject("existing", "data/file", []byte("data"))
+
+	secrets := srv.Secret()
+	secrets["nodeAccessKeyID"] = "node-key"
+	secrets["nodeSecretAccessKey"] = "node-secret"
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-ref", secrets)
+	req.Parameters["bucket"] = "existing"
+	req.Parameters["prefix"] = "data"
+	req.Parameters["provisioningMode"] = "none"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	denyNode(srv, "prefix=data%2F")
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+}
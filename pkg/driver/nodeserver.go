@@ -17,8 +17,11 @@ limitations under the License.
 package driver
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/ctrox/csi-s3/pkg/mounter"
 	"github.com/ctrox/csi-s3/pkg/s3"
@@ -35,20 +38,54 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	defaultSecret defaultSecret
+	// strictContextCheck refuses to publish volumes whose metadata
+	// conflicts with their volume context
+	strictContextCheck bool
+	// flushTimeout bounds the wait for pending uploads on unpublish
+	flushTimeout time.Duration
+	events       eventRecorder
+
+	mu sync.Mutex
+	// singleWriters maps volumes published with the single writer access
+	// mode to their target path, it serializes concurrent publishes. The
+	// writer is persisted in the metadata by recordSingleWriter.
+	singleWriters map[string]string
+	// published maps target paths to the volumes published there, for
+	// events and metrics. It is not persisted either.
+	published map[string]publishedVolume
+	// probes are the last health checks of the published volumes
+	probes map[string]*healthProbe
+	// integrityErrors are the integrity errors last reported by the
+	// mounters of the staged volumes, by staging path
+	integrityErrors map[string]uint64
+
+	// prefetches warms the caches of mounted volumes in the background
+	prefetches prefetcher
+	// mountLinger is how long the mount of an unpublished volume is kept
+	// by default, for a pod restarting right away
+	mountLinger time.Duration
+	lingering   lingerer
+	// orphans terminates mounters whose mount is gone, nil if disabled
+	orphans *orphanReaper
+	// mountRetry retries mounts failing while the endpoint is unavailable
+	mountRetry mountRetry
+	// readWriteOncePod advertises the single node writer access modes
+	readWriteOncePod bool
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
-	if len(volumeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	bucketName, prefix, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, err
 	}
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target path missing in request")
@@ -57,14 +94,55 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	prefetchOpts, err := parsePrefetch(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	marker, err := readinessMarker(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	linger, err := parseMountLinger(req.GetVolumeContext(), ns.mountLinger)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// written before checking the mount, so republishing refreshes the token
+	identity, err := webIdentity(targetPath, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	notMnt, err := checkMount(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !notMnt {
+		// the node plugin restarted since the volume was published
+		if ns.publishedVolume(targetPath).volumeID == "" {
+			ns.restorePublished(req, identity, linger)
+		}
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	if req.GetVolumeCapability().GetAccessMode().GetMode() == mounter.SingleNodeSingleWriter {
+		if err := ns.claimSingleWriter(volumeID, targetPath); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		defer func() {
+			if err != nil {
+				ns.releaseSingleWriter(volumeID, targetPath)
+			}
+		}()
+	}
+	// kubelet only removes the directory of the target after an unpublish,
+	// which never comes for a publish that failed
+	defer func() {
+		if err != nil {
+			removeFailedMounterLog(volumeID, targetPath)
+		}
+	}()
+
 	deviceID := ""
 	if req.GetPublishContext() != nil {
 		deviceID = req.GetPublishContext()[deviceID]
@@ -79,23 +157,221 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	glog.V(4).Infof("target %v\ndevice %v\nreadonly %v\nvolumeId %v\nattributes %v\nmountflags %v\n",
 		targetPath, deviceID, readOnly, volumeID, attrib, mountFlags)
 
-	s3, err := s3.NewClientFromSecret(req.GetSecrets())
+	// the token of a volume using web identity is removed on unpublish
+	if identity != nil {
+		linger = 0
+	}
+	pod := podInfoFromContext(req.GetVolumeContext())
+	if v, ok := ns.lingering.reuse(volumeID, targetPath, readOnly); ok {
+		v.publishedAt = time.Now()
+		v.pod = pod
+		v.linger = linger
+		ns.trackPublished(targetPath, v)
+		glog.V(4).Infof("s3: volume %s successfuly mounted to %s", volumeID, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	secrets := ns.defaultSecret.orDefault(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(secrets)
+	if identity != nil {
+		client, err = s3.NewClientFromWebIdentity(secrets, identity)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
-	meta, err := s3.GetFSMeta(bucketName, prefix)
+	// the maintenance flag is read after the request is done
+	metaClient := client
+	client = client.WithContext(ctx)
+	var meta *s3.FSMeta
+	// recovered metadata is not written, it is made up from the volume context
+	recovered := false
+	if isReferenceVolume(volumeID) {
+		meta = referenceMeta(volumeID, req.GetVolumeContext())
+	} else {
+		meta, err = getVolumeMeta(ctx, client, volumeID, bucketName, prefix, req.GetVolumeContext())
+	}
+	if errors.Is(err, s3.ErrObjectNotFound) {
+		// validated on creation
+		fsPath, _ := parseFSPath(req.GetVolumeContext()[fsPathKey])
+		meta, err = client.RecoverFSMeta(bucketName, prefix, fsPath)
+		recovered = err == nil
+		if err == nil {
+			glog.Warningf("Metadata of volume %s is missing, recovered it from the existing data", volumeID)
+			meta.Mounter = req.GetVolumeContext()[mounter.TypeKey]
+			meta.CacheMode = req.GetVolumeContext()[mounter.CacheModeKey]
+			meta.SmallFileCacheMB, _ = mounter.ParseSmallFileCache(meta.Mounter, meta.CacheMode, req.GetVolumeContext()[mounter.SmallFileCacheKey])
+			meta.CacheOnlyOnError, _ = mounter.ParseCacheOnlyOnError(meta.Mounter, meta.CacheMode, req.GetVolumeContext()[mounter.CacheOnlyOnErrorKey])
+			meta.Consistency, _ = mounter.ParseConsistency(meta.Mounter, req.GetVolumeContext()[mounter.ConsistencyKey])
+			meta.MimeTypesFile, _ = mounter.ParseMimeTypesFile(meta.Mounter, req.GetVolumeContext()[mounter.MimeTypesFileKey])
+			meta.ChecksumAlgorithm, _ = mounter.ParseChecksumAlgorithm(meta.Mounter, req.GetVolumeContext()[mounter.ChecksumAlgorithmKey])
+			meta.KeyEncoding, _ = mounter.ParseKeyEncoding(meta.Mounter, req.GetVolumeContext()[mounter.KeyEncodingKey])
+			meta.Prefetch = prefetchOpts.prefetchMeta()
+			meta.Prefixes, _ = parsePrefixes(req.GetVolumeContext()[mounter.PrefixesKey])
+			meta.ObjectTags, _ = parseObjectTags(meta.Mounter, req.GetVolumeContext())
+			meta.S3backer, _ = mounter.ParseS3backerOptions(meta.Mounter, req.GetVolumeContext())
+			meta.KMS, _ = mounter.ParseKMSOptions(meta.Mounter, req.GetVolumeContext())
+			meta.Env, _ = mounter.ParseEnv(meta.Mounter, req.GetVolumeContext()[mounter.EnvKey])
+			meta.ClientEncrypted = req.GetVolumeContext()[clientEncryptionKeyRefKey] != ""
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	logVersionSkew(volumeID, meta)
+	if err := resolveVolume(volumeID, meta, req.GetVolumeContext(), ns.strictContextCheck); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if req.GetVolumeCapability().GetAccessMode().GetMode() == mounter.SingleNodeSingleWriter && !isReferenceVolume(volumeID) && !recovered {
+		if err := recordSingleWriter(client, meta, volumeID, targetPath); err != nil {
+			return nil, err
+		}
+	}
+	caps, err := mounter.GetCapabilities(meta.Mounter)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err := mounter.ValidateUnprivileged(mounter.Type(meta, client.Config)); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s cannot be published: %v", volumeID, err)
+	}
+	if identity != nil && !caps.SupportsWebIdentity {
+		return nil, status.Errorf(codes.FailedPrecondition, "mounter %s does not support web identity authentication", meta.Mounter)
+	}
+	if err := caps.Validate(meta.Mounter, req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if readOnly && !caps.SupportsReadOnly {
+		glog.Warningf("Volume %s is requested read-only, but mounter %s does not support read-only mounts", volumeID, meta.Mounter)
+	}
+	if meta.ClientEncrypted && !caps.SupportsClientEncryption {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is client-side encrypted, but mounter %s does not support it", volumeID, meta.Mounter)
+	}
+	if meta.Consistency == mounter.ConsistencyStrict && meta.CacheMode != mounter.CacheModeNone {
+		glog.Warningf("Volume %s is mounted with %s %s, attributes and directory listings are read from S3 again after a second, expect higher latency and request costs", volumeID, mounter.ConsistencyKey, meta.Consistency)
+	}
+	if meta.KMS != nil && !caps.SupportsKMS {
+		glog.Warningf("Volume %s is written with SSE-KMS, but mounter %s uploads its objects with the default encryption of the bucket", volumeID, meta.Mounter)
+	}
+	passphrase, err := clientEncryptionPassphrase(meta, req.GetVolumeContext(), secrets)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	client.Config.ClientEncryptionPassphrase = passphrase
+	remotePath, err := mounter.ParseRemotePath(meta.Mounter, req.GetVolumeContext()[mounter.RemotePathKey])
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	client.Config.RcloneRemotePath = remotePath
+	if meta.MimeTypesFile != "" {
+		if err := mounter.CheckMimeTypesFile(meta.Mounter, meta.MimeTypesFile); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	// a volume in maintenance is mounted writable by the mounter, but its
+	// target is remounted read-only below
+	frozen := meta.Maintenance && !readOnly
+	if frozen {
+		glog.Infof("Volume %s is in maintenance, it is published read-only", volumeID)
+	}
+	// nothing is written to reference volumes, their data is not created by csi-s3
+	if caps.NeedsPrefixPlaceholder && !readOnly && !frozen && !isReferenceVolume(volumeID) {
+		for _, dataPrefix := range placeholderPrefixes(meta) {
+			if created, err := client.WithGrants(meta.Grants()).WithChecksum(meta.ChecksumAlgorithm).WithKMS(meta.KMS).EnsurePrefix(meta.BucketName, dataPrefix); err != nil {
+				glog.Warningf("Failed to check the placeholder of data prefix %s of volume %s: %v", dataPrefix, volumeID, err)
+			} else if created {
+				glog.Infof("Restored the missing placeholder of data prefix %s of volume %s", dataPrefix, volumeID)
+			}
+		}
+	}
 
-	mounter, err := mounter.New(meta, s3.Config)
+	fsMounter, err := mounter.New(meta, client.Config)
 	if err != nil {
 		return nil, err
 	}
-	if err := mounter.Mount(stagingTargetPath, targetPath); err != nil {
-		return nil, err
+	// the metadata might have been written by another version of the
+	// driver, an option the mounter cannot honour must not be ignored
+	if err := fsMounter.Capabilities().ValidateOptions(mounter.Type(meta, client.Config), meta); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s cannot be mounted: %v", volumeID, err)
+	}
+	if len(meta.Prefixes) > 0 {
+		// the tmpfs and the bind mounts of the prefixes need privileges
+		if mounter.Unprivileged() {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s with %s cannot be mounted without privileges", volumeID, mounter.PrefixesKey)
+		}
+		if err := ns.mountPrefixes(ctx, volumeID, stagingTargetPath, targetPath, meta, client.Config, readOnly); err != nil {
+			return nil, err
+		}
+	} else if err := ns.mountRetry.do(ctx, volumeID, func() error { return fsMounter.Mount(stagingTargetPath, targetPath) }); err != nil {
+		return nil, mountError(err, "failed to mount volume %s", volumeID)
+	}
+	if marker != "" {
+		if err := markReady(targetPath, marker, readOnly || frozen); err != nil {
+			// a retry has to mount again instead of finding the mount
+			if umountErr := ns.unmountVolume(volumeID, targetPath); umountErr != nil {
+				glog.Warningf("Failed to unmount %s after failed readiness probe: %v", targetPath, umountErr)
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if req.GetVolumeContext()[exposeVolumeInfoKey] == "true" {
+		// reference volumes might be provisioned with read-only credentials
+		if readOnly || frozen || isReferenceVolume(volumeID) {
+			glog.V(4).Infof("Not writing volume info of %s, it is read-only or a reference volume", volumeID)
+		} else if err := writeVolumeInfo(targetPath, volumeID, meta, mounter.Type(meta, client.Config), client.Config.Endpoint); err != nil {
+			glog.Warningf("Failed to write volume info of %s: %v", volumeID, err)
+		}
+	}
+	if frozen {
+		for _, p := range writablePaths(targetPath, meta.Prefixes) {
+			if err := remountTarget(p, true); err != nil {
+				if umountErr := ns.unmountVolume(volumeID, targetPath); umountErr != nil {
+					glog.Warningf("Failed to unmount %s after failed read-only remount: %v", targetPath, umountErr)
+				}
+				return nil, status.Errorf(codes.Internal, "volume %s is in maintenance, but cannot be remounted read-only: %v", volumeID, err)
+			}
+		}
+	}
+	// the files of the driver are written, nothing else is stored next to
+	// the directories of the prefixes
+	if len(meta.Prefixes) > 0 {
+		if err := remountTarget(targetPath, true); err != nil {
+			if umountErr := ns.unmountVolume(volumeID, targetPath); umountErr != nil {
+				glog.Warningf("Failed to unmount %s after failed read-only remount: %v", targetPath, umountErr)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to remount the directories of the prefixes of volume %s read-only: %v", volumeID, err)
+		}
+		// a parked mount would leave the mounters of the prefixes behind
+		linger = 0
+	}
+	var readMeta func() (*s3.FSMeta, error)
+	if !isReferenceVolume(volumeID) {
+		bucketName, prefix := meta.BucketName, meta.Prefix
+		readMeta = func() (*s3.FSMeta, error) { return metaClient.GetFSMeta(bucketName, prefix) }
+	}
+	// the volume context of volumes created before the options were
+	// stored in the metadata is all there is
+	if meta.Prefetch != nil {
+		prefetchOpts = prefetchFromMeta(meta.Prefetch)
+	}
+	if prefetchOpts != nil {
+		ns.prefetches.start(volumeID, targetPath, prefetchOpts)
+	}
+	ns.trackPublished(targetPath, publishedVolume{
+		volumeID:    volumeID,
+		pvName:      meta.PVName,
+		mounter:     mounter.Type(meta, client.Config),
+		stagingPath: stagingTargetPath,
+		publishedAt: time.Now(),
+		pod:         pod,
+		readOnly:    readOnly,
+		linger:      linger,
+		readMeta:    readMeta,
+		frozen:      frozen,
+		prefixes:    meta.Prefixes,
+	})
+
+	if pod.known() {
+		glog.Infof("Volume %s published to %s for pod %s", volumeID, targetPath, pod)
 	}
-
 	glog.V(4).Infof("s3: volume %s successfuly mounted to %s", volumeID, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -113,8 +389,27 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	if err := mounter.FuseUnmount(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	ns.prefetches.stop(targetPath)
+	ns.flush(volumeID, targetPath)
+	published := ns.publishedVolume(targetPath)
+	if !ns.lingering.park(targetPath, published) {
+		if err := ns.unmountVolume(volumeID, targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	ns.releaseSingleWriter(volumeID, targetPath)
+	pod := published.pod
+	ns.untrackPublished(targetPath)
+	if pod.known() {
+		glog.Infof("Volume %s unpublished from %s for pod %s", volumeID, targetPath, pod)
+	}
+	ns.podUnpublished(targetPath, pod)
+	if err := os.Remove(tokenFile(targetPath)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove token of volume %s: %v", volumeID, err)
+	}
+	// kubelet removes the directory of the target after unpublish
+	if err := mounter.RemoveOutputLog(targetPath); err != nil {
+		glog.Warningf("Failed to remove mounter log of volume %s: %v", volumeID, err)
 	}
 	glog.V(4).Infof("s3: volume %s has been unmounted.", volumeID)
 
@@ -124,11 +419,11 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
 
 	// Check arguments
-	if len(volumeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	bucketName, prefix, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(stagingTargetPath) == 0 {
@@ -146,20 +441,50 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if !notMnt {
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if usesWebIdentity(req.GetVolumeContext()) {
+		// the token is only passed on publish, mounters supporting web
+		// identity do not need to be staged.
+		caps, err := mounter.GetCapabilities(req.GetVolumeContext()[mounter.TypeKey])
+		if err != nil || !caps.SupportsWebIdentity {
+			return nil, status.Errorf(codes.FailedPrecondition, "mounter %s does not support web identity authentication", req.GetVolumeContext()[mounter.TypeKey])
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	client, err := s3.NewClientFromSecret(ns.defaultSecret.orDefault(req.GetSecrets()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
-	meta, err := client.GetFSMeta(bucketName, prefix)
+	client = client.WithContext(ctx)
+	var meta *s3.FSMeta
+	if isReferenceVolume(volumeID) {
+		meta = referenceMeta(volumeID, req.GetVolumeContext())
+	} else {
+		meta, err = getVolumeMeta(ctx, client, volumeID, bucketName, prefix, req.GetVolumeContext())
+	}
+	if errors.Is(err, s3.ErrObjectNotFound) {
+		// validated on creation
+		fsPath, _ := parseFSPath(req.GetVolumeContext()[fsPathKey])
+		meta, err = client.RecoverFSMeta(bucketName, prefix, fsPath)
+		if err == nil {
+			glog.Warningf("Metadata of volume %s is missing, recovered it from the existing data", volumeID)
+			meta.Mounter = req.GetVolumeContext()[mounter.TypeKey]
+			meta.S3backer, _ = mounter.ParseS3backerOptions(meta.Mounter, req.GetVolumeContext())
+			meta.KMS, _ = mounter.ParseKMSOptions(meta.Mounter, req.GetVolumeContext())
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	logVersionSkew(volumeID, meta)
+	if err := mounter.ValidateUnprivileged(mounter.Type(meta, client.Config)); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s cannot be staged: %v", volumeID, err)
+	}
 	mounter, err := mounter.New(meta, client.Config)
 	if err != nil {
 		return nil, err
 	}
-	if err := mounter.Stage(stagingTargetPath); err != nil {
-		return nil, err
+	if err := ns.mountRetry.do(ctx, volumeID, func() error { return mounter.Stage(stagingTargetPath) }); err != nil {
+		return nil, mountError(err, "failed to stage volume %s", volumeID)
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -176,32 +501,188 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	// the volume is not published on the node anymore
+	ns.lingering.cancel(volumeID)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	// currently there is a single NodeServer capability according to the spec
-	nscap := &csi.NodeServiceCapability{
-		Type: &csi.NodeServiceCapability_Rpc{
-			Rpc: &csi.NodeServiceCapability_RPC{
-				Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	types := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	}
+	if ns.readWriteOncePod {
+		types = append(types, nodeSingleNodeMultiWriter)
+	}
+	var capabilities []*csi.NodeServiceCapability
+	for _, c := range types {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: c},
 			},
-		},
+		})
 	}
-
-	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			nscap,
-		},
-	}, nil
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return &csi.NodeExpandVolumeResponse{}, status.Error(codes.Unimplemented, "NodeExpandVolume is not implemented")
 }
 
+// claimSingleWriter records that the volume is published to targetPath.
+// It fails if the volume is published to another target already.
+func (ns *nodeServer) claimSingleWriter(volumeID, targetPath string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if target, ok := ns.singleWriters[volumeID]; ok && target != targetPath {
+		return fmt.Errorf("volume %s with access mode SINGLE_NODE_SINGLE_WRITER is already published to %s", volumeID, target)
+	}
+	if ns.singleWriters == nil {
+		ns.singleWriters = make(map[string]string)
+	}
+	ns.singleWriters[volumeID] = targetPath
+	return nil
+}
+
+// recordSingleWriter records targetPath as the single writer in the
+// metadata of the volume, so its exclusivity survives restarts of the
+// driver. A recorded target which is not mounted anymore is stale, e.g. it
+// has been unpublished while the driver was down or it is on another node,
+// where only the scheduling of Kubernetes guarantees the exclusivity.
+func recordSingleWriter(client metaStore, meta *s3.FSMeta, volumeID, targetPath string) error {
+	if meta.SingleWriter == targetPath {
+		return nil
+	}
+	if meta.SingleWriter != "" {
+		if notMnt, err := mount.New("").IsLikelyNotMountPoint(meta.SingleWriter); err == nil && !notMnt {
+			return status.Errorf(codes.FailedPrecondition, "volume %s with access mode SINGLE_NODE_SINGLE_WRITER is already published to %s", volumeID, meta.SingleWriter)
+		}
+		glog.Infof("Volume %s is not published to %s anymore, replacing it as single writer by %s", volumeID, meta.SingleWriter, targetPath)
+	}
+	meta.SingleWriter = targetPath
+	if err := client.SetFSMeta(meta); err != nil {
+		return s3Error(err, "failed to record the single writer of volume %s", volumeID)
+	}
+	return nil
+}
+
+func (ns *nodeServer) releaseSingleWriter(volumeID, targetPath string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.singleWriters[volumeID] == targetPath {
+		delete(ns.singleWriters, volumeID)
+	}
+}
+
+// flush waits for the mounter of targetPath to upload buffered data before
+// it is unmounted. Unpublishing is never blocked beyond the flush timeout,
+// the pod is gone already and a failing unmount would only be retried.
+func (ns *nodeServer) flush(volumeID, targetPath string) {
+	if ns.flushTimeout <= 0 {
+		return
+	}
+	if notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath); err != nil || notMnt {
+		return
+	}
+	err := mounter.Flush(targetPath, ns.flushTimeout)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, mounter.ErrFlushTimeout) {
+		glog.Errorf("Volume %s is unmounted with data which has not been uploaded, it will be lost: %v", volumeID, err)
+		ns.events.Eventf(ns.publishedVolume(targetPath).pvName, eventTypeWarning, "FlushTimeout",
+			"Unmounted with pending uploads after %s, data written to the volume may be lost: %v", ns.flushTimeout, err)
+		return
+	}
+	glog.Warningf("Failed to flush volume %s before unmounting: %v", volumeID, err)
+}
+
+type publishedVolume struct {
+	volumeID    string
+	pvName      string
+	mounter     string
+	stagingPath string
+	publishedAt time.Time
+	// pod is only known if the CSIDriver sets podInfoOnMount
+	pod      podInfo
+	readOnly bool
+	// linger keeps the mount for this long after it is unpublished
+	linger time.Duration
+	// readMeta reads the metadata of the volume for its maintenance flag
+	readMeta func() (*s3.FSMeta, error)
+	// frozen is set while the target is remounted read-only for the
+	// maintenance of the volume
+	frozen bool
+	// prefixes are mounted as the directories of the target, empty if
+	// the volume is mounted at the target itself
+	prefixes []s3.SubPrefix
+}
+
+func (ns *nodeServer) trackPublished(targetPath string, v publishedVolume) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.published == nil {
+		ns.published = make(map[string]publishedVolume)
+	}
+	ns.published[targetPath] = v
+}
+
+func (ns *nodeServer) untrackPublished(targetPath string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	delete(ns.published, targetPath)
+	delete(ns.probes, targetPath)
+}
+
+func (ns *nodeServer) publishedVolume(targetPath string) publishedVolume {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.published[targetPath]
+}
+
+// publishedTargets returns the target paths of all published volumes
+func (ns *nodeServer) publishedTargets() map[string]publishedVolume {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	targets := make(map[string]publishedVolume, len(ns.published))
+	for k, v := range ns.published {
+		targets[k] = v
+	}
+	return targets
+}
+
+// mountedVolumes maps the mountpoints of the published and lingering
+// volumes to their volume IDs
+func (ns *nodeServer) mountedVolumes() map[string]string {
+	volumes := ns.lingering.parkedVolumes()
+	for target, v := range ns.publishedTargets() {
+		volumes[target] = v.volumeID
+		for _, p := range v.prefixes {
+			volumes[prefixSource(target, p.Name)] = v.volumeID
+		}
+	}
+	return volumes
+}
+
+// mountError maps the kind of a failed mount to the code returned to
+// kubelet, so failures a retry cannot fix are not reported as internal
+// errors
+func mountError(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, mounter.ErrMountPermissionDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, mounter.ErrMountNotFound):
+		code = codes.NotFound
+	case errors.Is(err, mounter.ErrMountPrecondition):
+		code = codes.FailedPrecondition
+	case errors.Is(err, mounter.ErrMountUnavailable):
+		code = codes.Unavailable
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
 func checkMount(targetPath string) (bool, error) {
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
 	if err != nil {
@@ -216,3 +697,12 @@ func checkMount(targetPath string) (bool, error) {
 	}
 	return notMnt, nil
 }
+
+// logVersionSkew warns about metadata written by a newer version of the
+// driver. The node only reads it, fields unknown to this version are
+// ignored.
+func logVersionSkew(volumeID string, meta *s3.FSMeta) {
+	if meta.WrittenByNewerVersion() {
+		glog.Warningf("Metadata of volume %s has been written by csi-s3 %s, this driver is %s", volumeID, meta.LastWrittenByVersion, vendorVersion)
+	}
+}
@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestSingleWriterExclusivity(t *testing.T) {
+	ns := &nodeServer{}
+	if err := ns.claimSingleWriter("volume", "/target/a"); err != nil {
+		t.Fatal(err)
+	}
+	// publishing again to the same target is idempotent
+	if err := ns.claimSingleWriter("volume", "/target/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.claimSingleWriter("volume", "/target/b"); err == nil {
+		t.Fatal("expected a second target to be refused")
+	}
+	if err := ns.claimSingleWriter("other", "/target/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	ns.releaseSingleWriter("volume", "/target/b")
+	if err := ns.claimSingleWriter("volume", "/target/b"); err == nil {
+		t.Fatal("expected a release of another target to keep the claim")
+	}
+	ns.releaseSingleWriter("volume", "/target/a")
+	if err := ns.claimSingleWriter("volume", "/target/b"); err != nil {
+		t.Fatalf("expected the volume to be published after unpublishing: %v", err)
+	}
+}
+
+func TestRecordSingleWriter(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.CreateBucket("bucket")
+	meta := &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-1", Mounter: "s3fs", FSPath: defaultFsPath}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	target := mountTmpfs(t)
+	if err := recordSingleWriter(client, meta, "bucket/pvc-1", target); err != nil {
+		t.Fatal(err)
+	}
+	// a restarted driver only knows the writer from the metadata
+	meta, err = client.GetFSMeta("bucket", "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SingleWriter != target {
+		t.Fatalf("expected %s to be recorded as single writer, got %q", target, meta.SingleWriter)
+	}
+	other := t.TempDir()
+	if err := recordSingleWriter(client, meta, "bucket/pvc-1", other); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition while %s is mounted, got %v", target, err)
+	}
+
+	if err := mount.New("").Unmount(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordSingleWriter(client, meta, "bucket/pvc-1", other); err != nil {
+		t.Fatalf("expected the stale writer to be replaced, got %v", err)
+	}
+	if meta, _ = client.GetFSMeta("bucket", "pvc-1"); meta.SingleWriter != other {
+		t.Fatalf("expected %s to be recorded as single writer, got %q", other, meta.SingleWriter)
+	}
+}
+
+func TestNodeGetCapabilitiesReadWriteOncePod(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ns := &nodeServer{readWriteOncePod: enabled}
+		resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		advertised := false
+		for _, c := range resp.GetCapabilities() {
+			if c.GetRpc().GetType() == nodeSingleNodeMultiWriter {
+				advertised = true
+			}
+		}
+		if advertised != enabled {
+			t.Errorf("enabled %v: expected the single node multi writer capability to be advertised %v", enabled, enabled)
+		}
+	}
+}
+
+func TestNodePublishUnsupportedOption(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.CreateBucket("bucket")
+	// written by a driver which let s3fs cache small files
+	meta := &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-1", Mounter: "s3fs", FSPath: defaultFsPath, SmallFileCacheMB: 64}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{}
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "bucket/pvc-1",
+		StagingTargetPath: t.TempDir(),
+		TargetPath:        t.TempDir(),
+		Secrets:           srv.Secret(),
+		VolumeContext:     map[string]string{mounter.TypeKey: "s3fs"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), mounter.SmallFileCacheKey) {
+		t.Fatalf("expected InvalidArgument naming the option, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+// objectTagVariables are replaced in the values of objectTags with the
+// parameters the external-provisioner passes with --extra-create-metadata,
+// so a single storage class tags the objects with the owner of each volume
+var objectTagVariables = []struct {
+	name string
+	key  string
+}{
+	{"${pvc.namespace}", pvcNamespaceKey},
+	{"${pvc.name}", pvcNameKey},
+	{"${pv.name}", pvNameKey},
+}
+
+// parseObjectTags returns the tags the objects of a volume are uploaded
+// with, with the variables replaced. The volume context of a PV holds the
+// same parameters, so the node resolves the tags of a volume like the
+// controller did.
+func parseObjectTags(mounterType string, params map[string]string) (map[string]string, error) {
+	value := params[mounter.ObjectTagsKey]
+	for _, v := range objectTagVariables {
+		if !strings.Contains(value, v.name) {
+			continue
+		}
+		if params[v.key] == "" {
+			return nil, fmt.Errorf("%s uses %s, which requires the external-provisioner to run with --extra-create-metadata", mounter.ObjectTagsKey, v.name)
+		}
+		value = strings.ReplaceAll(value, v.name, params[v.key])
+	}
+	if strings.Contains(value, "${") {
+		return nil, fmt.Errorf("invalid %s %s, only %s, %s and %s can be used as variables", mounter.ObjectTagsKey, value, objectTagVariables[0].name, objectTagVariables[1].name, objectTagVariables[2].name)
+	}
+	return mounter.ParseObjectTags(mounterType, value)
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseObjectTagsVariables(t *testing.T) {
+	params := map[string]string{
+		mounter.ObjectTagsKey: "namespace=${pvc.namespace},pvc=${pvc.name},pv=${pv.name},team=data",
+		pvcNamespaceKey:       "analytics",
+		pvcNameKey:            "events",
+		pvNameKey:             "pvc-1234",
+	}
+	tags, err := parseObjectTags("rclone", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"namespace": "analytics", "pvc": "events", "pv": "pvc-1234", "team": "data"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+	delete(params, pvcNamespaceKey)
+	if _, err := parseObjectTags("rclone", params); err == nil {
+		t.Fatal("expected an error without the metadata of the provisioner")
+	}
+	if _, err := parseObjectTags("rclone", map[string]string{mounter.ObjectTagsKey: "ns=${namespace}"}); err == nil {
+		t.Fatal("expected an error for an unknown variable")
+	}
+}
+
+func TestCreateVolumeObjectTags(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-tags", srv.Secret())
+	req.Parameters[mounter.ObjectTagsKey] = "namespace=${pvc.namespace}"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected a variable without metadata to be rejected, got %v", err)
+	}
+	req.Parameters[pvcNamespaceKey] = "analytics"
+	req.Parameters[mounter.TypeKey] = "s3backer"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected object tags with s3backer to be rejected, got %v", err)
+	}
+	req.Parameters[mounter.TypeKey] = "s3fs"
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketName, prefix := volumeIDToBucketPrefix(resp.GetVolume().GetVolumeId())
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta.ObjectTags, map[string]string{"namespace": "analytics"}) {
+		t.Fatalf("unexpected object tags %v", meta.ObjectTags)
+	}
+}
@@ -0,0 +1,213 @@
+package driver
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	orphanScanInterval = time.Minute
+	// orphanGracePeriod is how long a mounter has to be without its mount
+	// before it is terminated, it is extended to the longest mount timeout
+	// so mounters which are still starting are not reaped
+	orphanGracePeriod = 5 * time.Minute
+	// orphanKillAfter is how long a terminated mounter has to exit before
+	// it is killed
+	orphanKillAfter = 30 * time.Second
+)
+
+// orphan is a mounter process whose mount is gone
+type orphan struct {
+	process  mounter.Process
+	volumeID string
+	since    time.Time
+	// terminated is when the mounter was sent SIGTERM, zero before
+	terminated time.Time
+}
+
+// orphanReaper terminates mounter processes whose mountpoint is no longer
+// mounted, e.g. after an unmount failed halfway. They would otherwise keep
+// their connections and memory until the node restarts.
+type orphanReaper struct {
+	grace     time.Duration
+	killAfter time.Duration
+	// volumeIDs returns the volumes known to the driver by mountpoint
+	volumeIDs func() map[string]string
+	// processes returns the running mounter processes, mounted returns
+	// the mountpoints of the node
+	processes func() ([]mounter.Process, error)
+	mounted   func() (map[string]bool, error)
+
+	mu sync.Mutex
+	// volumes remembers the volume of a mounter process while its mount
+	// exists, as the driver forgets it once the volume is unpublished
+	volumes map[int]string
+	orphans map[int]*orphan
+	// detected and reaped count the orphans by mounter
+	detected map[string]int
+	reaped   map[string]int
+
+	stopCh chan struct{}
+}
+
+func newOrphanReaper(volumeIDs func() map[string]string) *orphanReaper {
+	grace := orphanGracePeriod
+	if d := mounter.MaxMountTimeout(); d > grace {
+		grace = d
+	}
+	return &orphanReaper{
+		grace:     grace,
+		killAfter: orphanKillAfter,
+		volumeIDs: volumeIDs,
+		processes: mounter.Processes,
+		mounted:   mountpoints,
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// mountpoints returns the paths of all mounts of the node
+func mountpoints() (map[string]bool, error) {
+	mounts, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]bool, len(mounts))
+	for _, m := range mounts {
+		paths[m.Path] = true
+	}
+	return paths, nil
+}
+
+// run scans for orphans until stop is called
+func (r *orphanReaper) run() {
+	glog.Infof("Reaping mounter processes without a mount after %v", r.grace)
+	ticker := time.NewTicker(orphanScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.scan(time.Now())
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+func (r *orphanReaper) stop() {
+	close(r.stopCh)
+}
+
+// scan detects the orphans among the mounter processes and terminates the
+// ones which have been orphaned for longer than the grace period. Orphans
+// which have not exited killAfter after their termination are killed.
+func (r *orphanReaper) scan(now time.Time) {
+	processes, err := r.processes()
+	if err != nil {
+		glog.Errorf("Failed to list mounter processes: %v", err)
+		return
+	}
+	mounted, err := r.mounted()
+	if err != nil {
+		glog.Errorf("Failed to list mounts: %v", err)
+		return
+	}
+	volumeIDs := r.volumeIDs()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.volumes == nil {
+		r.volumes = make(map[int]string)
+		r.orphans = make(map[int]*orphan)
+		r.detected = make(map[string]int)
+		r.reaped = make(map[string]int)
+	}
+	running := make(map[int]bool, len(processes))
+	for _, p := range processes {
+		running[p.Pid] = true
+		if volumeID, ok := volumeIDs[p.Mountpoint]; ok {
+			r.volumes[p.Pid] = volumeID
+		}
+		if mounted[p.Mountpoint] {
+			delete(r.orphans, p.Pid)
+			continue
+		}
+		o, ok := r.orphans[p.Pid]
+		if !ok || o.process != p {
+			// a reused PID is a new process
+			o = &orphan{process: p, volumeID: r.volumes[p.Pid], since: now}
+			r.orphans[p.Pid] = o
+			r.detected[p.Mounter]++
+			glog.V(2).Infof("Detected orphaned %s process %d of volume %s, %s is not mounted", p.Mounter, p.Pid, o.name(), p.Mountpoint)
+			continue
+		}
+		r.reap(o, now)
+	}
+	for pid, o := range r.orphans {
+		if running[pid] {
+			continue
+		}
+		if !o.terminated.IsZero() {
+			r.reaped[o.process.Mounter]++
+			glog.V(2).Infof("Reaped orphaned %s process %d of volume %s after %v", o.process.Mounter, pid, o.name(), now.Sub(o.since).Round(time.Second))
+		}
+		delete(r.orphans, pid)
+	}
+	for pid := range r.volumes {
+		if !running[pid] {
+			delete(r.volumes, pid)
+		}
+	}
+}
+
+// reap terminates the orphan once its grace period is over, and kills it if
+// it does not exit in time
+func (r *orphanReaper) reap(o *orphan, now time.Time) {
+	age := now.Sub(o.since).Round(time.Second)
+	switch {
+	case o.terminated.IsZero() && now.Sub(o.since) >= r.grace:
+		glog.V(2).Infof("Terminating orphaned %s process %d of volume %s, orphaned for %v", o.process.Mounter, o.process.Pid, o.name(), age)
+		o.terminated = now
+		signalProcess(o.process.Pid, syscall.SIGTERM)
+	case !o.terminated.IsZero() && now.Sub(o.terminated) >= r.killAfter:
+		glog.V(2).Infof("Killing orphaned %s process %d of volume %s, it did not exit within %v of its termination", o.process.Mounter, o.process.Pid, o.name(), r.killAfter)
+		signalProcess(o.process.Pid, syscall.SIGKILL)
+	}
+}
+
+func signalProcess(pid int, sig syscall.Signal) {
+	if !mounter.ProcessAlive(pid) {
+		return
+	}
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		glog.Warningf("Failed to send %v to process %d: %v", sig, pid, err)
+	}
+}
+
+// name returns the volume ID of the orphan for logs, the driver may not
+// have known it, e.g. after a restart
+func (o *orphan) name() string {
+	if o.volumeID == "" {
+		return "<unknown>"
+	}
+	return o.volumeID
+}
+
+// counts returns the orphans detected and reaped by mounter
+func (r *orphanReaper) counts() (detected, reaped map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	detected = make(map[string]int, len(r.detected))
+	reaped = make(map[string]int, len(r.reaped))
+	for k, v := range r.detected {
+		detected[k] = v
+	}
+	for k, v := range r.reaped {
+		reaped[k] = v
+	}
+	return detected, reaped
+}
@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+func TestOrphanReaper(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unable to start a process: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer cmd.Process.Kill()
+
+	mounted := map[string]bool{"/target": true, "/other": true}
+	orphaned := mounter.Process{Pid: cmd.Process.Pid, Mounter: "rclone", Mountpoint: "/target"}
+	// beyond the largest PID, so it is never signaled
+	alive := mounter.Process{Pid: 1<<22 + 1, Mounter: "s3fs", Mountpoint: "/other"}
+	processes := []mounter.Process{orphaned, alive}
+	r := &orphanReaper{
+		grace:     time.Minute,
+		killAfter: time.Minute,
+		volumeIDs: func() map[string]string { return map[string]string{"/target": "pvc-1"} },
+		processes: func() ([]mounter.Process, error) { return processes, nil },
+		mounted:   func() (map[string]bool, error) { return mounted, nil },
+	}
+
+	now := time.Now()
+	r.scan(now)
+	mounted = map[string]bool{"/other": true}
+	// the volume has been unpublished, but its mounter kept running
+	r.scan(now.Add(time.Minute))
+	if detected, _ := r.counts(); detected["rclone"] != 1 || detected["s3fs"] != 0 {
+		t.Fatalf("expected the orphan to be detected, got %v", detected)
+	}
+	if r.orphans[orphaned.Pid].volumeID != "pvc-1" {
+		t.Fatalf("expected the volume of the orphan to be remembered, got %q", r.orphans[orphaned.Pid].volumeID)
+	}
+	r.scan(now.Add(time.Minute + 30*time.Second))
+	select {
+	case <-exited:
+		t.Fatal("expected the orphan to be kept during its grace period")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.scan(now.Add(2 * time.Minute))
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the orphan to be terminated")
+	}
+	processes = []mounter.Process{alive}
+	r.scan(now.Add(3 * time.Minute))
+	if _, reaped := r.counts(); reaped["rclone"] != 1 || len(reaped) != 1 {
+		t.Fatalf("expected the orphan to be counted as reaped, got %v", reaped)
+	}
+	if len(r.orphans) != 0 || len(r.volumes) != 0 {
+		t.Fatalf("expected the reaped process to be forgotten, got %v and %v", r.orphans, r.volumes)
+	}
+}
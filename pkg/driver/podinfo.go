@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+)
+
+// The pod a volume is published for is passed by kubelet in the volume
+// context if the CSIDriver sets podInfoOnMount
+const (
+	podNameKey            = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey       = "csi.storage.k8s.io/pod.namespace"
+	podUIDKey             = "csi.storage.k8s.io/pod.uid"
+	serviceAccountNameKey = "csi.storage.k8s.io/serviceAccount.name"
+
+	// kubelet publishes CSI volumes of a pod at
+	// <kubelet dir>/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount
+	kubeletCSIVolumesDir = "kubernetes.io~csi"
+)
+
+// podInfo identifies the pod a volume is published for, it is empty if
+// kubelet does not pass it
+type podInfo struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	UID            string `json:"uid"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+func podInfoFromContext(volumeContext map[string]string) podInfo {
+	return podInfo{
+		Name:           volumeContext[podNameKey],
+		Namespace:      volumeContext[podNamespaceKey],
+		UID:            volumeContext[podUIDKey],
+		ServiceAccount: volumeContext[serviceAccountNameKey],
+	}
+}
+
+func (p podInfo) known() bool {
+	return p.UID != ""
+}
+
+func (p podInfo) String() string {
+	return fmt.Sprintf("%s/%s (%s)", p.Namespace, p.Name, p.UID)
+}
+
+// podVolumesDir returns the directory kubelet keeps the CSI volumes of the
+// pod with the UID in, derived from the target path of one of them. It
+// returns an empty string if the target path is not below the directory
+// of the pod.
+func podVolumesDir(targetPath, uid string) string {
+	dir := filepath.Dir(filepath.Dir(targetPath))
+	if uid == "" || filepath.Base(dir) != kubeletCSIVolumesDir || filepath.Base(filepath.Dir(filepath.Dir(dir))) != uid {
+		return ""
+	}
+	return dir
+}
+
+// podUnpublished cleans up after the volume at targetPath has been
+// unpublished for pod. Once the last volume of the pod on the node is
+// gone, the caches other volumes of the pod have left behind, e.g. after
+// their mounter crashed, are removed. Caches with pending uploads are kept.
+func (ns *nodeServer) podUnpublished(targetPath string, pod podInfo) {
+	if !pod.known() {
+		return
+	}
+	for _, v := range ns.publishedTargets() {
+		if v.pod.UID == pod.UID {
+			return
+		}
+	}
+	dir := podVolumesDir(targetPath, pod.UID)
+	if dir == "" {
+		glog.V(4).Infof("Target path %s is not below the directory of pod %s, not cleaning up its caches", targetPath, pod)
+		return
+	}
+	volumes, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Warningf("Failed to list volumes of pod %s: %v", pod, err)
+		return
+	}
+	for _, v := range volumes {
+		if target := filepath.Join(dir, v.Name(), filepath.Base(targetPath)); v.IsDir() && target != targetPath {
+			mounter.RemoveStaleCache(target)
+		}
+	}
+	glog.V(4).Infof("Cleaned up the caches of pod %s", pod)
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPodVolumesDir(t *testing.T) {
+	target := "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-a/mount"
+	if dir := podVolumesDir(target, "uid-1"); dir != "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi" {
+		t.Errorf("unexpected volumes dir %q", dir)
+	}
+	for _, uid := range []string{"", "uid-2"} {
+		if dir := podVolumesDir(target, uid); dir != "" {
+			t.Errorf("expected no volumes dir for pod %q, got %q", uid, dir)
+		}
+	}
+	if dir := podVolumesDir("/mnt/target", "uid-1"); dir != "" {
+		t.Errorf("expected no volumes dir outside of kubelet, got %q", dir)
+	}
+}
+
+func TestPodUnpublishedRemovesStaleCaches(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pods", "uid-1", "volumes", kubeletCSIVolumesDir)
+	target := func(pv string) string { return filepath.Join(dir, pv, "mount") }
+	cache := func(pv string) string { return filepath.Join(dir, pv, "csi-s3-cache") }
+	for _, pv := range []string{"pv-a", "pv-b", "pv-c"} {
+		if err := os.MkdirAll(target(pv), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pv-b crashed and left its cache behind
+	if err := os.MkdirAll(cache("pv-b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := podInfoFromContext(map[string]string{
+		podNameKey:      "app",
+		podNamespaceKey: "default",
+		podUIDKey:       "uid-1",
+	})
+	ns := &nodeServer{}
+	ns.trackPublished(target("pv-c"), publishedVolume{volumeID: "pv-c", pod: pod})
+
+	// another volume of the pod is still published
+	ns.podUnpublished(target("pv-a"), pod)
+	if _, err := os.Stat(cache("pv-b")); err != nil {
+		t.Fatalf("expected the cache to be kept while the pod has published volumes: %v", err)
+	}
+
+	ns.untrackPublished(target("pv-c"))
+	ns.podUnpublished(target("pv-c"), pod)
+	if _, err := os.Stat(cache("pv-b")); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale cache to be removed, got %v", err)
+	}
+}
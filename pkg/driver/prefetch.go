@@ -0,0 +1,313 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	// prefetchKey warms the cache of the mounter after a volume is mounted
+	prefetchKey = "prefetch"
+	// prefetchMetadata stats every entry of the volume
+	prefetchMetadata = "metadata"
+	// prefetchFull also reads the content of files
+	prefetchFull = "full"
+	// prefetchMaxBytesKey bounds the bytes read by prefetchFull
+	prefetchMaxBytesKey = "prefetchMaxBytes"
+	// prefetchBytesPerSecondKey limits the read rate of prefetchFull
+	prefetchBytesPerSecondKey = "prefetchBytesPerSecond"
+	// prefetchGlobKey limits the files read by prefetchFull to the ones
+	// matching the pattern
+	prefetchGlobKey = "prefetchGlob"
+
+	defaultPrefetchMaxBytes = 1 << 30
+	prefetchChunkSize       = 1 << 20
+)
+
+type prefetchOptions struct {
+	mode           string
+	glob           string
+	maxBytes       int64
+	bytesPerSecond int64
+}
+
+// parsePrefetch returns the prefetch options of the volume context, nil
+// if the volume is not prefetched.
+func parsePrefetch(volumeContext map[string]string) (*prefetchOptions, error) {
+	opts := &prefetchOptions{mode: volumeContext[prefetchKey], glob: volumeContext[prefetchGlobKey], maxBytes: defaultPrefetchMaxBytes}
+	switch opts.mode {
+	case "":
+		return nil, nil
+	case prefetchMetadata, prefetchFull:
+	default:
+		return nil, fmt.Errorf("invalid %s %s, must be %s or %s", prefetchKey, opts.mode, prefetchMetadata, prefetchFull)
+	}
+	if _, err := path.Match(opts.glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", prefetchGlobKey, opts.glob, err)
+	}
+	for key, value := range map[string]*int64{
+		prefetchMaxBytesKey:       &opts.maxBytes,
+		prefetchBytesPerSecondKey: &opts.bytesPerSecond,
+	} {
+		s, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s %s, must be a number of bytes", key, s)
+		}
+		*value = n
+	}
+	return opts, nil
+}
+
+// prefetchMeta returns the options as they are stored in the metadata of
+// the volume, nil if it is not prefetched
+func (opts *prefetchOptions) prefetchMeta() *s3.Prefetch {
+	if opts == nil {
+		return nil
+	}
+	return &s3.Prefetch{Mode: opts.mode, Glob: opts.glob, MaxBytes: opts.maxBytes, BytesPerSecond: opts.bytesPerSecond}
+}
+
+// prefetchFromMeta returns the options stored in the metadata of a volume,
+// nil for volumes which are not prefetched or were created before the
+// options were stored
+func prefetchFromMeta(p *s3.Prefetch) *prefetchOptions {
+	if p == nil {
+		return nil
+	}
+	return &prefetchOptions{mode: p.Mode, glob: p.Glob, maxBytes: p.MaxBytes, bytesPerSecond: p.BytesPerSecond}
+}
+
+// matches returns true if the file at rel, relative to the root of the
+// volume, is read by the prefetch. A pattern without a slash matches the
+// name of the file in any directory.
+func (opts *prefetchOptions) matches(rel string) bool {
+	if opts.glob == "" {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(opts.glob, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(opts.glob, rel)
+	return ok
+}
+
+// prefetchStopTimeout is how long stopping a prefetch waits for it to
+// release the mount
+var prefetchStopTimeout = 10 * time.Second
+
+// prefetcher runs the prefetch of mounted volumes in the background, one
+// per target path. The zero value is ready to use.
+type prefetcher struct {
+	mu      sync.Mutex
+	running map[string]*prefetchRun
+}
+
+type prefetchRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start prefetches the volume mounted at targetPath, replacing a prefetch
+// still running for it.
+func (p *prefetcher) start(volumeID, targetPath string, opts *prefetchOptions) {
+	p.stop(targetPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &prefetchRun{cancel: cancel, done: make(chan struct{})}
+	p.mu.Lock()
+	if p.running == nil {
+		p.running = make(map[string]*prefetchRun)
+	}
+	p.running[targetPath] = run
+	p.mu.Unlock()
+
+	go func() {
+		defer close(run.done)
+		defer p.remove(targetPath, run)
+		start := time.Now()
+		entries, bytes, err := prefetch(ctx, targetPath, opts)
+		if err != nil {
+			glog.Warningf("Prefetch of volume %s stopped after %d entries and %d bytes: %v", volumeID, entries, bytes, err)
+			return
+		}
+		glog.Infof("Prefetch of volume %s completed in %v: %d entries, %d bytes", volumeID, time.Since(start), entries, bytes)
+	}()
+}
+
+// stop cancels the prefetch of targetPath and waits for it to release
+// the files of the volume, so it can be unmounted. It waits at most
+// prefetchStopTimeout for a prefetch stuck on the mount.
+func (p *prefetcher) stop(targetPath string) {
+	p.mu.Lock()
+	run, ok := p.running[targetPath]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	run.cancel()
+	select {
+	case <-run.done:
+	case <-time.After(prefetchStopTimeout):
+		// a read hanging on the mount only returns once it is unmounted
+		glog.Warningf("Prefetch of %s did not stop within %v, unmounting anyway", targetPath, prefetchStopTimeout)
+	}
+}
+
+func (p *prefetcher) remove(targetPath string, run *prefetchRun) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running[targetPath] == run {
+		delete(p.running, targetPath)
+	}
+}
+
+// prefetch walks the tree below root, which stats every entry. In full
+// mode it reads files until the byte budget is used up. It returns the
+// number of entries and the bytes read.
+func prefetch(ctx context.Context, root string, opts *prefetchOptions) (int, int64, error) {
+	var (
+		entries int
+		bytes   int64
+		start   = time.Now()
+	)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// keep warming the rest of the volume
+			glog.V(4).Infof("Prefetch failed to stat %s: %v", p, err)
+			return nil
+		}
+		entries++
+		if info.IsDir() {
+			warnCaseCollisions(root, p)
+		}
+		if opts.mode != prefetchFull || !info.Mode().IsRegular() || bytes >= opts.maxBytes {
+			return nil
+		}
+		if rel, _ := filepath.Rel(root, p); !opts.matches(rel) {
+			return nil
+		}
+		n, err := readFile(ctx, p, opts.maxBytes-bytes, func(n int64) error {
+			bytes += n
+			return throttle(ctx, start, bytes, opts.bytesPerSecond)
+		})
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			glog.V(4).Infof("Prefetch failed to read %s after %d bytes: %v", p, n, err)
+		}
+		return nil
+	})
+	return entries, bytes, err
+}
+
+// warnCaseCollisions warns about entries of dir whose names differ only by
+// case, their keys collide on backends with case-insensitive keys.
+func warnCaseCollisions(root, dir string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return
+	}
+	rel, _ := filepath.Rel(root, dir)
+	for _, collision := range caseCollisions(names) {
+		glog.Warningf("Entries %s in %s of %s differ only by case, they overwrite each other on backends with case-insensitive keys",
+			strings.Join(collision, ", "), rel, root)
+	}
+}
+
+// caseCollisions returns the groups of names which differ only by case
+func caseCollisions(names []string) [][]string {
+	groups := make(map[string][]string)
+	for _, name := range names {
+		folded := strings.ToLower(name)
+		groups[folded] = append(groups[folded], name)
+	}
+	var collisions [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+	return collisions
+}
+
+// readFile reads up to limit bytes of the file in chunks and calls
+// progress after every chunk.
+func readFile(ctx context.Context, name string, limit int64, progress func(n int64) error) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, prefetchChunkSize)
+	var total int64
+	for total < limit {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		if remaining := limit - total; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		n, err := f.Read(buf)
+		total += int64(n)
+		if n > 0 {
+			if err := progress(int64(n)); err != nil {
+				return total, err
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// throttle waits until reading bytes since start stays below the rate
+func throttle(ctx context.Context, start time.Time, bytes, bytesPerSecond int64) error {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	wait := time.Duration(float64(bytes)/float64(bytesPerSecond)*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
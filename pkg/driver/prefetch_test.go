@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writePrefetchTree(t *testing.T) string {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "dir/b", "dir/c"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestParsePrefetch(t *testing.T) {
+	if opts, err := parsePrefetch(map[string]string{}); opts != nil || err != nil {
+		t.Fatalf("expected no prefetch, got %+v, %v", opts, err)
+	}
+	opts, err := parsePrefetch(map[string]string{prefetchKey: prefetchFull, prefetchMaxBytesKey: "2048"})
+	if err != nil || opts.maxBytes != 2048 || opts.bytesPerSecond != 0 {
+		t.Fatalf("unexpected options %+v, %v", opts, err)
+	}
+	for _, ctx := range []map[string]string{
+		{prefetchKey: "everything"},
+		{prefetchKey: prefetchFull, prefetchMaxBytesKey: "1Gi"},
+		{prefetchKey: prefetchMetadata, prefetchBytesPerSecondKey: "-1"},
+		{prefetchKey: prefetchFull, prefetchGlobKey: "[a-"},
+	} {
+		if _, err := parsePrefetch(ctx); err == nil {
+			t.Errorf("expected an error for %v", ctx)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	root := writePrefetchTree(t)
+
+	entries, bytes, err := prefetch(context.Background(), root, &prefetchOptions{mode: prefetchMetadata, maxBytes: defaultPrefetchMaxBytes})
+	if err != nil || entries != 5 || bytes != 0 {
+		t.Fatalf("expected 5 entries to be stat'ed without reads, got %d entries, %d bytes, %v", entries, bytes, err)
+	}
+	entries, bytes, err = prefetch(context.Background(), root, &prefetchOptions{mode: prefetchFull, maxBytes: 2500})
+	if err != nil || entries != 5 || bytes != 2500 {
+		t.Fatalf("expected reads to stop at the budget, got %d entries, %d bytes, %v", entries, bytes, err)
+	}
+
+	// only the files matching the glob are read
+	for glob, expected := range map[string]int64{"b": 1000, "dir/*": 2000, "[ab]": 2000, "*/a": 0} {
+		_, bytes, err = prefetch(context.Background(), root, &prefetchOptions{mode: prefetchFull, glob: glob, maxBytes: defaultPrefetchMaxBytes})
+		if err != nil || bytes != expected {
+			t.Errorf("%s: expected %d bytes to be read, got %d, %v", glob, expected, bytes, err)
+		}
+	}
+
+	// a rate of 1000 bytes per second needs seconds for the tree
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, bytes, err = prefetch(ctx, root, &prefetchOptions{mode: prefetchFull, maxBytes: defaultPrefetchMaxBytes, bytesPerSecond: 1000})
+	if err == nil || bytes >= 3000 {
+		t.Fatalf("expected the throttled prefetch to be canceled, got %d bytes, %v", bytes, err)
+	}
+}
+
+func TestCreateVolumePrefetch(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-prefetch", srv.Secret())
+	req.Parameters[prefetchKey] = prefetchFull
+	req.Parameters[prefetchGlobKey] = "*.parquet"
+	req.Parameters[mounter.CacheModeKey] = mounter.CacheModeNone
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected prefetch without cache to be rejected, got %v", err)
+	}
+	delete(req.Parameters, mounter.CacheModeKey)
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-prefetch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &s3.Prefetch{Mode: prefetchFull, Glob: "*.parquet", MaxBytes: defaultPrefetchMaxBytes}
+	if !reflect.DeepEqual(meta.Prefetch, expected) {
+		t.Fatalf("expected the prefetch to be stored as %+v, got %+v", expected, meta.Prefetch)
+	}
+	if opts := prefetchFromMeta(meta.Prefetch); opts.glob != "*.parquet" || opts.mode != prefetchFull {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+}
+
+func TestPrefetcherStop(t *testing.T) {
+	root := writePrefetchTree(t)
+	var p prefetcher
+
+	p.start("volume", root, &prefetchOptions{mode: prefetchFull, maxBytes: defaultPrefetchMaxBytes, bytesPerSecond: 1})
+	p.stop(root)
+	if len(p.running) != 0 {
+		t.Fatalf("expected the prefetch to be stopped, got %v", p.running)
+	}
+	// stopping a volume without prefetch is a no-op
+	p.stop(root)
+
+	// a prefetch stuck on the mount does not block the unpublish
+	defer func(timeout time.Duration) { prefetchStopTimeout = timeout }(prefetchStopTimeout)
+	prefetchStopTimeout = 10 * time.Millisecond
+	p.running = map[string]*prefetchRun{root: {cancel: func() {}, done: make(chan struct{})}}
+	stopped := make(chan struct{})
+	go func() {
+		p.stop(root)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected stop to give up on the stuck prefetch")
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	collisions := caseCollisions([]string{"readme", "b", "README", "Readme", "a", "B", "c"})
+	expected := [][]string{{"B", "b"}, {"README", "Readme", "readme"}}
+	if !reflect.DeepEqual(collisions, expected) {
+		t.Fatalf("expected collisions %v, got %v", expected, collisions)
+	}
+	if collisions := caseCollisions([]string{"a", "b"}); len(collisions) != 0 {
+		t.Fatalf("expected no collisions, got %v", collisions)
+	}
+}
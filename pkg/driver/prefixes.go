@@ -0,0 +1,381 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// prefixMountsDir is the directory next to the target path the prefixes
+	// of a volume are mounted in, one directory named like the prefix each
+	prefixMountsDir = "prefixes"
+	// prefixTargetOptions are the options of the tmpfs at the target path
+	// which only holds the directories of the prefixes
+	prefixTargetOptions = "size=64k,mode=0755"
+)
+
+// parsePrefixes returns the prefixes of the bucket a volume exposes as its
+// directories, nil if the volume has data of its own. The prefixes are
+// cleaned and must neither overlap each other or the control prefix nor be
+// the root of the bucket, the removal of one would otherwise remove the
+// data of another.
+func parsePrefixes(value string) ([]s3.SubPrefix, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var prefixes []s3.SubPrefix
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&prefixes); err != nil {
+		return nil, fmt.Errorf("invalid %s, must be a JSON list of name, prefix, readOnly and managed: %v", mounter.PrefixesKey, err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("invalid %s, must list at least one prefix", mounter.PrefixesKey)
+	}
+	names := make(map[string]bool, len(prefixes))
+	for i, p := range prefixes {
+		if p.Name == "" || p.Name == "." || p.Name == ".." || strings.Contains(p.Name, "/") {
+			return nil, fmt.Errorf("invalid %s, name %q of prefix %s must be a directory name", mounter.PrefixesKey, p.Name, p.Prefix)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("invalid %s, name %s is used twice", mounter.PrefixesKey, p.Name)
+		}
+		names[p.Name] = true
+		for _, segment := range strings.Split(p.Prefix, "/") {
+			if segment == "." || segment == ".." {
+				return nil, fmt.Errorf("invalid %s, prefix %s of %s must not contain . or ..", mounter.PrefixesKey, p.Prefix, p.Name)
+			}
+		}
+		p.Prefix = s3.CleanPrefix(p.Prefix)
+		if p.Prefix == "" {
+			return nil, fmt.Errorf("invalid %s, prefix of %s must not be the root of the bucket", mounter.PrefixesKey, p.Name)
+		}
+		if s3.OverlapsControlPrefix(p.Prefix) {
+			return nil, fmt.Errorf("invalid %s, prefix %s of %s overlaps the control prefix of the driver", mounter.PrefixesKey, p.Prefix, p.Name)
+		}
+		for _, other := range prefixes[:i] {
+			if prefixesOverlap(p.Prefix, other.Prefix) {
+				return nil, fmt.Errorf("invalid %s, prefix %s of %s overlaps prefix %s of %s", mounter.PrefixesKey, p.Prefix, p.Name, other.Prefix, other.Name)
+			}
+		}
+		prefixes[i] = p
+	}
+	return prefixes, nil
+}
+
+// prefixesOverlap returns true if either prefix contains the other
+func prefixesOverlap(a, b string) bool {
+	a, b = s3.DirPrefix(a), s3.DirPrefix(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// checkPrefixesOfVolume returns an error if one of the prefixes overlaps
+// the prefix of the volume itself, which holds its metadata
+func checkPrefixesOfVolume(prefixes []s3.SubPrefix, volumePrefix string) error {
+	for _, p := range prefixes {
+		if prefixesOverlap(p.Prefix, volumePrefix) {
+			return status.Errorf(codes.InvalidArgument, "invalid %s, prefix %s of %s overlaps the prefix %s of the volume", mounter.PrefixesKey, p.Prefix, p.Name, volumePrefix)
+		}
+	}
+	return nil
+}
+
+// prefixInspector checks the managed prefixes of a new volume
+type prefixInspector interface {
+	IsEmpty(bucketName, prefix string) (bool, error)
+}
+
+// checkManagedPrefixes returns an error if a managed prefix of a new
+// volume already contains data, which would be removed with the volume
+func checkManagedPrefixes(client prefixInspector, bucketName string, prefixes []s3.SubPrefix) error {
+	for _, p := range prefixes {
+		if !p.Managed {
+			continue
+		}
+		empty, err := client.IsEmpty(bucketName, s3.DirPrefix(p.Prefix))
+		if err != nil {
+			return s3Error(err, "failed to check if prefix %s is empty", p.Prefix)
+		}
+		if !empty {
+			return status.Errorf(codes.FailedPrecondition, "managed prefix %s of %s already contains data, it would be removed with the volume", p.Prefix, p.Name)
+		}
+	}
+	return nil
+}
+
+// volumeLister finds the other volumes of the bucket of a new volume
+type volumeLister interface {
+	ListFSMeta(bucketName string) ([]*s3.FSMeta, error)
+}
+
+// checkPrefixesOfBucket returns an error if one of the prefixes overlaps
+// the prefix of another volume of the bucket, or a prefix of another
+// volume while either of them is managed. The data of one volume would
+// otherwise be removed with the other.
+func checkPrefixesOfBucket(client volumeLister, bucketName, volumePrefix string, prefixes []s3.SubPrefix) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	metas, err := client.ListFSMeta(bucketName)
+	if err != nil {
+		return s3Error(err, "failed to list the volumes of bucket %s", bucketName)
+	}
+	for _, meta := range metas {
+		if meta.Prefix == volumePrefix {
+			continue
+		}
+		for _, p := range prefixes {
+			if meta.Prefix == "" || prefixesOverlap(p.Prefix, meta.Prefix) {
+				return status.Errorf(codes.FailedPrecondition, "prefix %s of %s overlaps the volume at %s", p.Prefix, p.Name, path.Join(bucketName, meta.Prefix))
+			}
+			for _, other := range meta.Prefixes {
+				if (p.Managed || other.Managed) && prefixesOverlap(p.Prefix, other.Prefix) {
+					return status.Errorf(codes.FailedPrecondition, "prefix %s of %s overlaps prefix %s of the volume at %s", p.Prefix, p.Name, other.Prefix, path.Join(bucketName, meta.Prefix))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// prefixWriter creates and removes the managed prefixes of a volume
+type prefixWriter interface {
+	CreatePrefix(bucketName, prefix string) error
+	RemovePrefix(bucketName, prefix string) error
+}
+
+// createManagedPrefixes creates the placeholders of the managed prefixes
+// of a volume, a retry creates them again
+func createManagedPrefixes(client prefixWriter, meta *s3.FSMeta) error {
+	for _, p := range meta.Prefixes {
+		if p.Managed {
+			if err := client.CreatePrefix(meta.BucketName, p.Prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeManagedPrefixes removes the managed prefixes of a volume with
+// their data, the other prefixes were there before the volume and are
+// left as they are
+func removeManagedPrefixes(client prefixWriter, meta *s3.FSMeta) error {
+	for _, p := range meta.Prefixes {
+		if !p.Managed {
+			glog.V(4).Infof("Prefix %s of volume %s is not managed by csi-s3, it is retained", p.Prefix, path.Join(meta.BucketName, meta.Prefix))
+			continue
+		}
+		if err := client.RemovePrefix(meta.BucketName, p.Prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixesEqual returns true if both volumes expose the same prefixes
+func prefixesEqual(a, b []s3.SubPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixMeta returns the metadata a prefix of the volume is mounted with,
+// the options of the volume with the prefix as its data
+func prefixMeta(meta *s3.FSMeta, p s3.SubPrefix) *s3.FSMeta {
+	sub := *meta
+	sub.Prefix = p.Prefix
+	sub.FSPath = ""
+	sub.Prefixes = nil
+	return &sub
+}
+
+// prefixMounts returns the directory the prefixes of the volume published
+// at the target path are mounted in
+func prefixMounts(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), prefixMountsDir)
+}
+
+// prefixSource returns where the mounter of a prefix mounts it, next to
+// the target path so its log does not end up in the volume
+func prefixSource(targetPath, name string) string {
+	return filepath.Join(prefixMounts(targetPath), name, "mount")
+}
+
+// hasPrefixMounts returns true if the target path has been published with
+// the prefixes of its volume, the directory of their mounts is the only
+// state kept, so it is also known after a restart of the driver
+func hasPrefixMounts(targetPath string) bool {
+	_, err := os.Stat(prefixMounts(targetPath))
+	return err == nil
+}
+
+// placeholderPrefixes returns the data prefixes of a volume whose
+// placeholder the node restores, only the managed prefixes are written to
+func placeholderPrefixes(meta *s3.FSMeta) []string {
+	if len(meta.Prefixes) == 0 {
+		return []string{meta.DataPrefix()}
+	}
+	var prefixes []string
+	for _, p := range meta.Prefixes {
+		if p.Managed && !p.ReadOnly {
+			prefixes = append(prefixes, p.Prefix)
+		}
+	}
+	return prefixes
+}
+
+// writablePaths returns the mounts of a published volume which are
+// remounted read-only for its maintenance
+func writablePaths(targetPath string, prefixes []s3.SubPrefix) []string {
+	if len(prefixes) == 0 {
+		return []string{targetPath}
+	}
+	var paths []string
+	for _, p := range prefixes {
+		if !p.ReadOnly {
+			paths = append(paths, filepath.Join(targetPath, p.Name))
+		}
+	}
+	return paths
+}
+
+// mountPrefixes publishes a volume with several prefixes. Each prefix is
+// mounted by a mounter of its own next to the target path and bound to a
+// directory of a tmpfs at the target path. The tmpfs is made read-only by
+// NodePublishVolume once the files of the driver are written, nothing
+// else can be stored next to the prefixes. Whatever has been mounted is
+// unmounted again if a prefix fails.
+func (ns *nodeServer) mountPrefixes(ctx context.Context, volumeID, stagingPath, targetPath string, meta *s3.FSMeta, cfg *s3.Config, readOnly bool) (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		if umountErr := ns.unmountPrefixes(volumeID, targetPath); umountErr != nil {
+			glog.Warningf("Failed to unmount the prefixes of volume %s after a failed mount: %v", volumeID, umountErr)
+		}
+	}()
+	if err := os.MkdirAll(prefixMounts(targetPath), 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := syscall.Mount("tmpfs", targetPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, prefixTargetOptions); err != nil {
+		return status.Errorf(codes.Internal, "failed to mount the directories of the prefixes of volume %s: %v", volumeID, err)
+	}
+	for _, p := range meta.Prefixes {
+		source := prefixSource(targetPath, p.Name)
+		if err := os.MkdirAll(source, 0750); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		fsMounter, err := mounter.New(prefixMeta(meta, p), cfg)
+		if err != nil {
+			return err
+		}
+		if err := ns.mountRetry.do(ctx, volumeID, func() error { return fsMounter.Mount(stagingPath, source) }); err != nil {
+			return mountError(err, "failed to mount prefix %s of volume %s", p.Prefix, volumeID)
+		}
+		dir := filepath.Join(targetPath, p.Name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := syscall.Mount(source, dir, "", syscall.MS_BIND, ""); err != nil {
+			return status.Errorf(codes.Internal, "failed to bind prefix %s of volume %s to %s: %v", p.Prefix, volumeID, dir, err)
+		}
+		if p.ReadOnly || readOnly {
+			if err := remountTarget(dir, true); err != nil {
+				return status.Errorf(codes.Internal, "failed to remount prefix %s of volume %s read-only: %v", p.Prefix, volumeID, err)
+			}
+		}
+		glog.V(4).Infof("Mounted prefix %s of volume %s to %s", p.Prefix, volumeID, dir)
+	}
+	return nil
+}
+
+// unmountPrefixes undoes mountPrefixes in reverse: the directories of the
+// prefixes are unbound before the tmpfs at the target path is unmounted,
+// and the mounters are only stopped once nothing refers to their mounts
+// anymore. The prefixes are found in the directory of their mounts, as
+// the driver might have been restarted since the volume was published.
+func (ns *nodeServer) unmountPrefixes(volumeID, targetPath string) error {
+	dir := prefixMounts(targetPath)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := unmountIfMounted(filepath.Join(targetPath, entries[i].Name())); err != nil {
+			return fmt.Errorf("failed to unbind prefix %s of volume %s: %v", entries[i].Name(), volumeID, err)
+		}
+	}
+	if err := unmountIfMounted(targetPath); err != nil {
+		return fmt.Errorf("failed to unmount the directories of the prefixes of volume %s: %v", volumeID, err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		name := entries[i].Name()
+		source := prefixSource(targetPath, name)
+		if isMounted(source) {
+			ns.flush(volumeID, source)
+			if err := mounter.FuseUnmount(source); err != nil {
+				return fmt.Errorf("failed to unmount prefix %s of volume %s: %v", name, volumeID, err)
+			}
+		}
+		if err := mounter.RemoveOutputLog(source); err != nil {
+			glog.Warningf("Failed to remove mounter log of prefix %s of volume %s: %v", name, volumeID, err)
+		}
+		// removed one by one, never recursively next to a mount
+		for _, p := range []string{source, filepath.Dir(source)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// unmountVolume unmounts the volume published at the target path, with the
+// prefixes it has been published with
+func (ns *nodeServer) unmountVolume(volumeID, targetPath string) error {
+	if hasPrefixMounts(targetPath) {
+		return ns.unmountPrefixes(volumeID, targetPath)
+	}
+	return mounter.FuseUnmount(targetPath)
+}
+
+// isMounted returns true if something is mounted at the path, also if the
+// mounter serving it has died
+func isMounted(path string) bool {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(path)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return err != nil || !notMnt
+}
+
+func unmountIfMounted(path string) error {
+	if !isMounted(path) {
+		return nil
+	}
+	return mount.New("").Unmount(path)
+}
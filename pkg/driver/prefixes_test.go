@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes(`[{"name":"raw","prefix":"/datasets/raw/","readOnly":true},{"name":"out","prefix":"results","managed":true}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []s3.SubPrefix{
+		{Name: "raw", Prefix: "datasets/raw", ReadOnly: true},
+		{Name: "out", Prefix: "results", Managed: true},
+	}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, prefixes)
+	}
+	if prefixes, err := parsePrefixes(""); err != nil || prefixes != nil {
+		t.Fatalf("expected no prefixes, got %v, %v", prefixes, err)
+	}
+	for _, value := range []string{
+		`[]`,
+		`{"name":"raw","prefix":"raw"}`,
+		`[{"name":"raw","prefix":"raw","writable":true}]`,
+		`[{"prefix":"raw"}]`,
+		`[{"name":"a/b","prefix":"raw"}]`,
+		`[{"name":"..","prefix":"raw"}]`,
+		`[{"name":"raw","prefix":"/"}]`,
+		`[{"name":"raw","prefix":"data/../raw"}]`,
+		`[{"name":"raw","prefix":"raw"},{"name":"raw","prefix":"other"}]`,
+		`[{"name":"all","prefix":"data"},{"name":"raw","prefix":"data/raw"}]`,
+	} {
+		if _, err := parsePrefixes(value); err == nil {
+			t.Errorf("expected %s to be invalid", value)
+		}
+	}
+	setS3Options(t, s3.Options{ControlPrefix: s3.DefaultControlPrefix})
+	if _, err := parsePrefixes(`[{"name":"control","prefix":".csi-s3/pvc-1"}]`); err == nil {
+		t.Error("expected a prefix within the control prefix to be invalid")
+	}
+	// only a whole directory overlaps
+	if _, err := parsePrefixes(`[{"name":"a","prefix":"data"},{"name":"b","prefix":"data2"}]`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritablePaths(t *testing.T) {
+	target := "/pods/uid/volumes/pv/mount"
+	if paths := writablePaths(target, nil); !reflect.DeepEqual(paths, []string{target}) {
+		t.Fatalf("expected the target itself, got %v", paths)
+	}
+	prefixes := []s3.SubPrefix{{Name: "raw", Prefix: "raw", ReadOnly: true}, {Name: "out", Prefix: "out"}}
+	if paths := writablePaths(target, prefixes); !reflect.DeepEqual(paths, []string{target + "/out"}) {
+		t.Fatalf("expected only the writable prefix, got %v", paths)
+	}
+	if source := prefixSource(target, "out"); source != "/pods/uid/volumes/pv/prefixes/out/mount" {
+		t.Fatalf("unexpected source %s", source)
+	}
+}
+
+func TestCreateVolumePrefixes(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.PutObject("shared", "datasets/raw/file", []byte("data"))
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-prefixes", srv.Secret())
+	req.Parameters[mounter.PrefixesKey] = `[{"name":"raw","prefix":"datasets/raw","readOnly":true},{"name":"out","prefix":"results/pvc-prefixes","managed":true}]`
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected prefixes without bucket to be rejected, got %v", err)
+	}
+	req.Parameters[mounter.BucketKey] = "shared"
+	req.Parameters[mounter.TypeKey] = "s3backer"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected prefixes with s3backer to be rejected, got %v", err)
+	}
+	req.Parameters[mounter.TypeKey] = "s3fs"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("shared", "pvc-prefixes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Prefixes) != 2 || meta.Prefixes[1] != (s3.SubPrefix{Name: "out", Prefix: "results/pvc-prefixes", Managed: true}) {
+		t.Fatalf("unexpected prefixes %+v", meta.Prefixes)
+	}
+	if srv.GetObject("shared", "results/pvc-prefixes/") == nil {
+		t.Fatal("expected the placeholder of the managed prefix to be created")
+	}
+
+	// the prefixes of an existing volume cannot change
+	req.Parameters[mounter.PrefixesKey] = `[{"name":"raw","prefix":"datasets/raw","readOnly":true}]`
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected changed prefixes to be rejected, got %v", err)
+	}
+
+	// only the managed prefix is removed with the volume
+	srv.PutObject("shared", "results/pvc-prefixes/out", []byte("data"))
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "shared/pvc-prefixes", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "results/pvc-prefixes/out") != nil {
+		t.Fatal("expected the data of the managed prefix to be removed")
+	}
+	if srv.GetObject("shared", "datasets/raw/file") == nil {
+		t.Fatal("expected the data of the other prefix to be retained")
+	}
+
+	// a managed prefix must not contain data yet, it would be removed
+	req = createVolumeRequest("pvc-existing", srv.Secret())
+	req.Parameters[mounter.BucketKey] = "shared"
+	req.Parameters[mounter.PrefixesKey] = `[{"name":"raw","prefix":"datasets/raw","managed":true}]`
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected a managed prefix with data to be rejected, got %v", err)
+	}
+	// nor overlap the prefix of the volume
+	req.Parameters[mounter.PrefixesKey] = `[{"name":"self","prefix":"pvc-existing/data"}]`
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected a prefix within the volume to be rejected, got %v", err)
+	}
+	// nor overlap another volume of the bucket
+	plain := createVolumeRequest("pvc-plain", srv.Secret())
+	plain.Parameters[mounter.BucketKey] = "shared"
+	if _, err := cs.CreateVolume(context.Background(), plain); err != nil {
+		t.Fatal(err)
+	}
+	req.Parameters[mounter.PrefixesKey] = `[{"name":"other","prefix":"pvc-plain/data"}]`
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected a prefix within another volume to be rejected, got %v", err)
+	}
+}
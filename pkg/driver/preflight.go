@@ -0,0 +1,395 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/glog"
+)
+
+// DefaultKubeletPodsDir is where kubelet creates the target paths of volumes
+const DefaultKubeletPodsDir = "/var/lib/kubelet/pods"
+
+// the files the preflight checks inspect, replaced in tests
+var (
+	fuseDevicePath      = "/dev/fuse"
+	procFilesystemsPath = "/proc/filesystems"
+	preflightMountInfo  = "/proc/self/mountinfo"
+	fusermountCmds      = []string{"fusermount3", "fusermount"}
+	procUIDMapPath      = "/proc/self/uid_map"
+	procStatusPath      = "/proc/self/status"
+	kernelReleasePath   = "/proc/sys/kernel/osrelease"
+	fuseConfPath        = "/etc/fuse.conf"
+)
+
+// the kernel allows FUSE mounts in user namespaces since 4.18
+const minUserNamespaceFuseKernel = 4*1000 + 18
+
+// preflightCheck is the result of a check of a prerequisite of mounting
+// volumes on the node
+type preflightCheck struct {
+	name   string
+	detail string
+	err    error
+	// hint tells how to fix the failed check
+	hint string
+}
+
+// preflightReport collects the results of the preflight checks
+type preflightReport struct {
+	checks []preflightCheck
+}
+
+func (r *preflightReport) add(name, hint string, fn func() (string, error)) {
+	detail, err := fn()
+	r.checks = append(r.checks, preflightCheck{name: name, detail: detail, err: err, hint: hint})
+}
+
+// failed returns the number of failed checks
+func (r *preflightReport) failed() int {
+	failed := 0
+	for _, c := range r.checks {
+		if c.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// write prints a line per check followed by the hints of the failed ones
+func (r *preflightReport) write(w io.Writer) {
+	for _, c := range r.checks {
+		switch {
+		case c.err != nil:
+			fmt.Fprintf(w, "%-20s FAILED: %v\n", c.name, c.err)
+		case c.detail != "":
+			fmt.Fprintf(w, "%-20s ok (%s)\n", c.name, c.detail)
+		default:
+			fmt.Fprintf(w, "%-20s ok\n", c.name)
+		}
+	}
+	failed := r.failed()
+	if failed == 0 {
+		fmt.Fprintf(w, "All %d checks passed\n", len(r.checks))
+		return
+	}
+	fmt.Fprintf(w, "%d of %d checks failed:\n", failed, len(r.checks))
+	for _, c := range r.checks {
+		if c.err != nil && c.hint != "" {
+			fmt.Fprintf(w, "  %s: %s\n", c.name, c.hint)
+		}
+	}
+}
+
+// runPreflight checks the prerequisites of mounting volumes on the node:
+// the fuse device and filesystem, fusermount, the mount propagation of
+// the kubelet directory and the mounters. Mounters which are not listed
+// are only checked if they are installed, an empty list checks every
+// installed mounter.
+func runPreflight(kubeletDir string, mounters []string, versions map[string]string, unprivileged bool) *preflightReport {
+	r := &preflightReport{}
+	propagationHint := fmt.Sprintf("mount %s into the node plugin with mountPropagation: Bidirectional", kubeletDir)
+	if unprivileged {
+		r.add("fuse device", "request /dev/fuse from a device plugin for the node plugin", checkFuseDevice)
+		r.add("fuse filesystem", "load the fuse kernel module on the node (modprobe fuse)", checkFuseFilesystem)
+		r.add("unprivileged mount", "run the node plugin as root of a user namespace on kernel 4.18 or newer, or install fuse3 with a setuid root fusermount3 and allow privilege escalation", checkUnprivilegedMount)
+		// Kubernetes rejects it for containers which are not privileged
+		propagationHint = fmt.Sprintf("share the mounts below %s with the host, Kubernetes only allows mountPropagation: Bidirectional for privileged containers", kubeletDir)
+	} else {
+		r.add("fuse device", "mount /dev/fuse of the host into the node plugin and run it privileged", checkFuseDevice)
+		r.add("fuse filesystem", "load the fuse kernel module on the node (modprobe fuse)", checkFuseFilesystem)
+		r.add("fusermount", "install fuse or fuse3 in the image of the driver", checkFusermount)
+	}
+	r.add("mount propagation", propagationHint, func() (string, error) {
+		return checkMountPropagation(kubeletDir)
+	})
+
+	required := map[string]bool{}
+	for _, t := range mounters {
+		required[t] = true
+	}
+	for _, t := range mounter.Types() {
+		version := versions[t]
+		if !required[t] && version == mounter.VersionNotInstalled {
+			continue
+		}
+		if c, _ := mounter.GetCapabilities(t); unprivileged && !c.SupportsUnprivileged {
+			r.add("mounter "+t, fmt.Sprintf("use a mounter which can mount without privileges instead of %s", t), func() (string, error) {
+				return "", fmt.Errorf("cannot mount without privileges")
+			})
+			delete(required, t)
+			continue
+		}
+		r.add("mounter "+t, fmt.Sprintf("install a working %s in the image of the driver", t), func() (string, error) {
+			switch version {
+			case mounter.VersionNotInstalled:
+				return "", fmt.Errorf("not installed")
+			case mounter.VersionUnknown:
+				return "", fmt.Errorf("does not run, %s --version printed nothing", t)
+			}
+			return version, nil
+		})
+		delete(required, t)
+	}
+	for t := range required {
+		r.add("mounter "+t, fmt.Sprintf("remove %s from --preflight-mounters", t), func() (string, error) {
+			return "", fmt.Errorf("unknown mounter, must be one of %v", mounter.Types())
+		})
+	}
+	return r
+}
+
+func checkFuseDevice() (string, error) {
+	f, err := os.OpenFile(fuseDevicePath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return fuseDevicePath, nil
+}
+
+func checkFuseFilesystem() (string, error) {
+	b, err := ioutil.ReadFile(procFilesystemsPath)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "fuse" {
+			return "", nil
+		}
+	}
+	return "", fmt.Errorf("the kernel does not support fuse")
+}
+
+func checkFusermount() (string, error) {
+	for _, cmd := range fusermountCmds {
+		if path, err := exec.LookPath(cmd); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %v found in PATH", fusermountCmds)
+}
+
+// checkUnprivilegedMount returns an error if the node plugin can neither
+// mount FUSE filesystems as root of its user namespace nor through a
+// setuid fusermount
+func checkUnprivilegedMount() (string, error) {
+	userNamespace, err := inUserNamespace()
+	if err != nil {
+		return "", err
+	}
+	if userNamespace && os.Geteuid() == 0 {
+		release, err := ioutil.ReadFile(kernelReleasePath)
+		if err != nil {
+			return "", err
+		}
+		if kernelVersion(string(release)) < minUserNamespaceFuseKernel {
+			return "", fmt.Errorf("kernel %s does not allow FUSE mounts in user namespaces", strings.TrimSpace(string(release)))
+		}
+		return "user namespace", nil
+	}
+	var path string
+	for _, cmd := range fusermountCmds {
+		if p, err := exec.LookPath(cmd); err == nil {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		return "", fmt.Errorf("not in a user namespace and none of %v found in PATH", fusermountCmds)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); info.Mode()&os.ModeSetuid == 0 || !ok || st.Uid != 0 {
+		return "", fmt.Errorf("%s is not setuid root", path)
+	}
+	noNewPrivs, err := procStatusField("NoNewPrivs")
+	if err != nil {
+		return "", err
+	}
+	if noNewPrivs != "0" {
+		return "", fmt.Errorf("%s cannot gain privileges, the node plugin runs with allowPrivilegeEscalation: false", path)
+	}
+	// the mounters share their mounts with kubelet and the pods
+	conf, err := ioutil.ReadFile(fuseConfPath)
+	if err != nil || !hasLine(string(conf), "user_allow_other") {
+		return "", fmt.Errorf("%s does not set user_allow_other, mounts would not be accessible to the pods", fuseConfPath)
+	}
+	return path, nil
+}
+
+// inUserNamespace returns true unless the user IDs of the process are the
+// ones of the host
+func inUserNamespace() (bool, error) {
+	b, err := ioutil.ReadFile(procUIDMapPath)
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(b))
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295"), nil
+}
+
+// kernelVersion returns major*1000+minor of a kernel release, 0 if it
+// cannot be parsed
+func kernelVersion(release string) int {
+	parts := strings.SplitN(strings.TrimSpace(release), ".", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	minor, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return 0
+	}
+	return major*1000 + minor
+}
+
+// procStatusField returns the value of a field of the status of the
+// process
+func procStatusField(name string) (string, error) {
+	b, err := ioutil.ReadFile(procStatusPath)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, name+":")), nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", name, procStatusPath)
+}
+
+// hasLine returns true if a line of content, ignoring surrounding space
+// and comments, is line
+func hasLine(content, line string) bool {
+	for _, l := range strings.Split(content, "\n") {
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMountPropagation returns an error unless the mount holding dir
+// propagates mounts to the host. A mount with Bidirectional propagation is
+// a shared mount, it is tagged shared:<group> in the mount table.
+func checkMountPropagation(dir string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("%s is not mounted into the node plugin: %v", dir, err)
+	}
+	f, err := os.Open(preflightMountInfo)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// dir belongs to the mount with the longest mount point containing it
+	var mountPoint string
+	var shared bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		mp := fields[4]
+		if !isPathWithin(dir, mp) || len(mp) < len(mountPoint) {
+			continue
+		}
+		mountPoint = mp
+		shared = false
+		// the optional fields end with a single hyphen
+		for _, tag := range fields[6:] {
+			if tag == "-" {
+				break
+			}
+			if strings.HasPrefix(tag, "shared:") {
+				shared = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		return "", fmt.Errorf("no mount of %s found in %s", dir, preflightMountInfo)
+	}
+	if !shared {
+		return "", fmt.Errorf("mount %s of %s does not propagate mounts to the host", mountPoint, dir)
+	}
+	return dir, nil
+}
+
+// isPathWithin returns true if path is dir or below dir
+func isPathWithin(path, dir string) bool {
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// Preflight checks the prerequisites of mounting volumes on the node and
+// writes the report to out. It returns an error if any check failed.
+func (s3 *driver) Preflight(out io.Writer) error {
+	r := runPreflight(s3.preflightKubeletDir(), s3.opts.PreflightMounters, mounter.DetectVersions(), s3.opts.Unprivileged)
+	r.write(out)
+	if failed := r.failed(); failed > 0 {
+		return fmt.Errorf("%d preflight checks failed", failed)
+	}
+	return nil
+}
+
+func (s3 *driver) preflightKubeletDir() string {
+	if s3.opts.PreflightKubeletDir != "" {
+		return s3.opts.PreflightKubeletDir
+	}
+	return DefaultKubeletPodsDir
+}
+
+// servesNode returns true if the driver runs as the node plugin. The
+// controller runs the same binary with the same flags, the node plugin is
+// told apart by the kubelet directory mounted into it.
+func (s3 *driver) servesNode() bool {
+	info, err := os.Stat(s3.preflightKubeletDir())
+	return err == nil && info.IsDir()
+}
+
+// preflightOnStartEnabled returns true if the preflight checks run on
+// startup. --unprivileged implies them for the node plugin only, as it is
+// passed to the controller as well, which does not mount volumes.
+func (s3 *driver) preflightOnStartEnabled() bool {
+	if s3.opts.PreflightOnStart {
+		return true
+	}
+	return s3.opts.Unprivileged && s3.servesNode()
+}
+
+// preflightOnStart runs the preflight checks on startup of the node
+// plugin, the identity server reports the plugin as not ready if any
+// check failed
+func (s3 *driver) preflightOnStart() {
+	r := runPreflight(s3.preflightKubeletDir(), s3.opts.PreflightMounters, s3.ids.mounterVersions, s3.opts.Unprivileged)
+	var report strings.Builder
+	r.write(&report)
+	if r.failed() > 0 {
+		glog.Errorf("Preflight checks failed, the node plugin is not ready:\n%s", report.String())
+		s3.ids.preflightFailed = true
+		return
+	}
+	glog.Infof("Preflight checks:\n%s", report.String())
+}
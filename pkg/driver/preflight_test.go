@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckMountPropagation(t *testing.T) {
+	defer func(path string) { preflightMountInfo = path }(preflightMountInfo)
+	dir := t.TempDir()
+	kubeletDir := filepath.Join(dir, "kubelet", "pods")
+	if err := os.MkdirAll(kubeletDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	preflightMountInfo = filepath.Join(dir, "mountinfo")
+
+	root := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"
+	for _, tc := range []struct {
+		mountInfo string
+		ok        bool
+	}{
+		// Bidirectional
+		{root + "40 22 8:1 /var/lib/kubelet/pods " + kubeletDir + " rw,relatime shared:5 - ext4 /dev/sda1 rw\n", true},
+		// HostToContainer only receives mounts of the host
+		{root + "40 22 8:1 /var/lib/kubelet/pods " + kubeletDir + " rw,relatime master:5 - ext4 /dev/sda1 rw\n", false},
+		// None, the shared root does not propagate to the host
+		{root + "40 22 8:1 /var/lib/kubelet/pods " + kubeletDir + " rw,relatime - ext4 /dev/sda1 rw\n", false},
+		// a mount of a sibling does not count
+		{"22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n40 22 8:1 / " + kubeletDir + "-other rw shared:5 - ext4 /dev/sda1 rw\n", false},
+	} {
+		writeFile(t, preflightMountInfo, tc.mountInfo)
+		if _, err := checkMountPropagation(kubeletDir); (err == nil) != tc.ok {
+			t.Errorf("%q: expected ok=%v, got %v", tc.mountInfo, tc.ok, err)
+		}
+	}
+	if _, err := checkMountPropagation(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected a missing directory to fail")
+	}
+}
+
+func TestPreflightReport(t *testing.T) {
+	defer func(device, filesystems, mountInfo string, cmds []string) {
+		fuseDevicePath, procFilesystemsPath, preflightMountInfo, fusermountCmds = device, filesystems, mountInfo, cmds
+	}(fuseDevicePath, procFilesystemsPath, preflightMountInfo, fusermountCmds)
+	dir := t.TempDir()
+	fuseDevicePath = filepath.Join(dir, "fuse")
+	procFilesystemsPath = filepath.Join(dir, "filesystems")
+	preflightMountInfo = filepath.Join(dir, "mountinfo")
+	fusermountCmds = []string{filepath.Join(dir, "fusermount")}
+	writeFile(t, fuseDevicePath, "")
+	writeFile(t, procFilesystemsPath, "nodev\tsysfs\n\text4\nnodev\tfuse\n")
+	writeFile(t, preflightMountInfo, "22 1 8:1 / / rw shared:1 - ext4 /dev/sda1 rw\n")
+	if err := ioutil.WriteFile(fusermountCmds[0], []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := map[string]string{}
+	for _, m := range mounter.Types() {
+		versions[m] = mounter.VersionNotInstalled
+	}
+	versions["rclone"] = "rclone v1.53.3"
+	r := runPreflight(dir, nil, versions, false)
+	var out bytes.Buffer
+	r.write(&out)
+	if r.failed() != 0 {
+		t.Fatalf("expected all checks to pass, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "mounter rclone       ok (rclone v1.53.3)") || strings.Contains(out.String(), "mounter s3fs") {
+		t.Fatalf("expected only the installed mounter to be checked, got:\n%s", out.String())
+	}
+
+	// every failure is part of the one report
+	os.Remove(fuseDevicePath)
+	writeFile(t, procFilesystemsPath, "nodev\tsysfs\n")
+	versions["rclone"] = mounter.VersionUnknown
+	r = runPreflight(dir, []string{"s3fs", "unknown"}, versions, false)
+	out.Reset()
+	r.write(&out)
+	if r.failed() != 5 {
+		t.Fatalf("expected 5 failed checks, got:\n%s", out.String())
+	}
+	for _, expected := range []string{"fuse device          FAILED", "fuse filesystem      FAILED", "mounter rclone       FAILED", "mounter s3fs         FAILED: not installed", "mounter unknown      FAILED", "5 of 7 checks failed", "modprobe fuse"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the report to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestProbeAfterFailedPreflight(t *testing.T) {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	ids := &identityServer{DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d)}
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil || resp.GetReady() != nil && !resp.GetReady().GetValue() {
+		t.Fatalf("expected the plugin to be ready, got %v, %v", resp, err)
+	}
+	ids.preflightFailed = true
+	resp, err = ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil || resp.GetReady() == nil || resp.GetReady().GetValue() {
+		t.Fatalf("expected the plugin not to be ready, got %v, %v", resp, err)
+	}
+}
+
+func TestPreflightOnStartEnabled(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		opts     Options
+		expected bool
+	}{
+		{Options{}, false},
+		{Options{PreflightOnStart: true, PreflightKubeletDir: filepath.Join(dir, "missing")}, true},
+		// the node plugin has the kubelet directory, the controller not
+		{Options{Unprivileged: true, PreflightKubeletDir: dir}, true},
+		{Options{Unprivileged: true, PreflightKubeletDir: filepath.Join(dir, "missing")}, false},
+	} {
+		if enabled := (&driver{opts: c.opts}).preflightOnStartEnabled(); enabled != c.expected {
+			t.Errorf("expected the preflight on start of %+v to be %v, got %v", c.opts, c.expected, enabled)
+		}
+	}
+}
+
+func TestCheckUnprivilegedMount(t *testing.T) {
+	defer func(uidMap, status, release, conf string, cmds []string) {
+		procUIDMapPath, procStatusPath, kernelReleasePath, fuseConfPath, fusermountCmds = uidMap, status, release, conf, cmds
+	}(procUIDMapPath, procStatusPath, kernelReleasePath, fuseConfPath, fusermountCmds)
+	dir := t.TempDir()
+	procUIDMapPath = filepath.Join(dir, "uid_map")
+	procStatusPath = filepath.Join(dir, "status")
+	kernelReleasePath = filepath.Join(dir, "osrelease")
+	fuseConfPath = filepath.Join(dir, "fuse.conf")
+	fusermountCmds = []string{filepath.Join(dir, "fusermount3")}
+	writeFile(t, procStatusPath, "Name:\ts3driver\nNoNewPrivs:\t1\n")
+	writeFile(t, fuseConfPath, "# mount_max = 1000\nuser_allow_other\n")
+	if err := ioutil.WriteFile(fusermountCmds[0], []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fusermount which is not setuid root does not help
+	writeFile(t, procUIDMapPath, "         0          0 4294967295\n")
+	if _, err := checkUnprivilegedMount(); err == nil || !strings.Contains(err.Error(), "not setuid root") {
+		t.Fatalf("expected fusermount to be rejected, got %v", err)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("the user namespace checks need to run as root")
+	}
+	writeFile(t, procUIDMapPath, "         0     100000      65536\n")
+	writeFile(t, kernelReleasePath, "4.15.0-213-generic\n")
+	if _, err := checkUnprivilegedMount(); err == nil || !strings.Contains(err.Error(), "4.15.0-213-generic") {
+		t.Fatalf("expected the kernel to be rejected, got %v", err)
+	}
+	writeFile(t, kernelReleasePath, "5.15.0-91-generic\n")
+	if detail, err := checkUnprivilegedMount(); err != nil || detail != "user namespace" {
+		t.Fatalf("expected the user namespace to be used, got %q, %v", detail, err)
+	}
+}
+
+func TestKernelVersion(t *testing.T) {
+	for release, expected := range map[string]int{
+		"4.18.0-553.el8_10.x86_64": 4018,
+		"6.1.55+\n":                6001,
+		"5.4":                      5004,
+		"unknown":                  0,
+	} {
+		if v := kernelVersion(release); v != expected {
+			t.Errorf("%q: expected %d, got %d", release, expected, v)
+		}
+	}
+}
+
+func TestPreflightUnprivileged(t *testing.T) {
+	defer func(device string) { fuseDevicePath = device }(fuseDevicePath)
+	dir := t.TempDir()
+	fuseDevicePath = filepath.Join(dir, "fuse")
+	versions := map[string]string{}
+	for _, m := range mounter.Types() {
+		versions[m] = mounter.VersionNotInstalled
+	}
+	versions["s3backer"] = "s3backer version 1.5.4"
+	var out bytes.Buffer
+	runPreflight(dir, nil, versions, true).write(&out)
+	for _, expected := range []string{"unprivileged mount", "mounter s3backer     FAILED: cannot mount without privileges", "fuse device: request /dev/fuse from a device plugin", "mount without privileges instead of s3backer"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the report to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
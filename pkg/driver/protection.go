@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// ClearDeleteProtection allows the deletion of a volume created with
+// deleteProtection again, using the default secret of the driver
+func (s3 *driver) ClearDeleteProtection(volumeID string) error {
+	return clearDeleteProtection(defaultSecret(s3.opts.DefaultSecretDir).orDefault(nil), volumeID)
+}
+
+func clearDeleteProtection(secrets map[string]string, volumeID string) error {
+	bucketName, prefix, err := parseVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	if isReferenceVolume(volumeID) {
+		return fmt.Errorf("volume %s is a reference volume, its data is never deleted", volumeID)
+	}
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of volume %s: %v", volumeID, err)
+	}
+	if !meta.DeleteProtection {
+		glog.Infof("Volume %s is not protected from deletion", volumeID)
+		return nil
+	}
+	meta.DeleteProtection = false
+	if err := client.SetFSMeta(meta); err != nil {
+		return fmt.Errorf("failed to update metadata of volume %s: %v", volumeID, err)
+	}
+	glog.Infof("Cleared the delete protection of volume %s", volumeID)
+	return nil
+}
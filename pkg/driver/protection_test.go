@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeleteProtection(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-protected", srv.Secret())
+	req.Parameters[deleteProtectionKey] = "true"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("pvc-protected", "csi-fs/file", []byte("data"))
+
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: "pvc-protected", Secrets: srv.Secret()}
+	if _, err := cs.DeleteVolume(context.Background(), deleteReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	if srv.GetObject("pvc-protected", "csi-fs/file") == nil {
+		t.Fatal("expected the data of the protected volume to be kept")
+	}
+
+	// creating the volume again without the parameter keeps the protection
+	req.Parameters = map[string]string{"mounter": "s3fs"}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), deleteReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected protection to be kept, got %v", err)
+	}
+
+	if err := clearDeleteProtection(srv.Secret(), "pvc-protected"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-protected", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DeleteProtection {
+		t.Fatal("expected the protection to be cleared")
+	}
+	if _, err := cs.DeleteVolume(context.Background(), deleteReq); err != nil {
+		t.Fatalf("expected unprotected volume to be deleted, got %v", err)
+	}
+	if srv.GetObject("pvc-protected", "csi-fs/file") != nil {
+		t.Fatal("expected the data to be removed")
+	}
+}
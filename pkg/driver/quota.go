@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// pvcNamespaceKey and pvcNameKey are passed by the external-provisioner
+	// with --extra-create-metadata
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	// defaultQuotaNamespace is the quota of the namespaces without one of
+	// their own
+	defaultQuotaNamespace = "*"
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// byteSuffixes are the suffixes of quantities of Kubernetes
+var byteSuffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40}, {"Pi", 1 << 50},
+	{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"P", 1e15},
+}
+
+// parseBytes parses a whole number of bytes with an optional suffix of
+// Kubernetes quantities, e.g. 100Gi or 500G
+func parseBytes(value string) (int64, error) {
+	multiplier := int64(1)
+	number := value
+	for _, s := range byteSuffixes {
+		if strings.HasSuffix(value, s.suffix) {
+			multiplier = s.multiplier
+			number = strings.TrimSuffix(value, s.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q, must be a whole number of bytes optionally followed by Ki, Mi, Gi, Ti, Pi, k, M, G, T or P", value)
+	}
+	return n * multiplier, nil
+}
+
+// ParseNamespaceQuotas parses a comma separated list of
+// <namespace>=<size> pairs, e.g. team-a=100Gi,*=10Gi. The quota of * applies
+// to the namespaces which are not listed.
+func ParseNamespaceQuotas(spec string) (map[string]int64, error) {
+	quotas := map[string]int64{}
+	if spec == "" {
+		return quotas, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid namespace quota %q, must be <namespace>=<size>", pair)
+		}
+		if kv[0] != defaultQuotaNamespace && !namespacePattern.MatchString(kv[0]) {
+			return nil, fmt.Errorf("invalid namespace %q of quota %q", kv[0], pair)
+		}
+		size, err := parseBytes(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota of namespace %s: %v", kv[0], err)
+		}
+		quotas[kv[0]] = size
+	}
+	return quotas, nil
+}
+
+// usageStore keeps the usage of the namespaces
+type usageStore interface {
+	GetNamespaceUsage(bucketName, namespace string) (*s3.NamespaceUsage, error)
+	SetNamespaceUsage(bucketName, namespace string, usage *s3.NamespaceUsage) error
+}
+
+// namespaceQuotas limits the total capacity of the volumes provisioned for
+// the PVCs of a namespace. The usage of each namespace is kept in an
+// object of the quota bucket. The updates are serialized by the controller,
+// so only a single controller may enforce quotas.
+type namespaceQuotas struct {
+	// bucket keeps the usage of the namespaces, empty if quotas are not
+	// enforced
+	bucket string
+	limits map[string]int64
+
+	mu sync.Mutex
+}
+
+// newNamespaceQuotas returns the quotas kept in bucket, nil if there are
+// none
+func newNamespaceQuotas(bucket string, limits map[string]int64) *namespaceQuotas {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &namespaceQuotas{bucket: bucket, limits: limits}
+}
+
+func (q *namespaceQuotas) enabled() bool {
+	return q != nil && q.bucket != ""
+}
+
+// limit returns the quota of a namespace, false if it has none
+func (q *namespaceQuotas) limit(namespace string) (int64, bool) {
+	if limit, ok := q.limits[namespace]; ok {
+		return limit, true
+	}
+	limit, ok := q.limits[defaultQuotaNamespace]
+	return limit, ok
+}
+
+// reserve records the capacity of a new volume in the usage of its
+// namespace. It returns ResourceExhausted if the volume would exceed the
+// quota. A volume which is already recorded is not counted twice, and not
+// reported as reserved, so a failed retry does not release it.
+func (q *namespaceQuotas) reserve(store usageStore, namespace, volumeName string, capacityBytes int64) (bool, error) {
+	if !namespacePattern.MatchString(namespace) {
+		return false, status.Errorf(codes.FailedPrecondition, "namespace quotas require the namespace of the PVC, run the external-provisioner with --extra-create-metadata")
+	}
+	limit, ok := q.limit(namespace)
+	if !ok {
+		return false, nil
+	}
+	if capacityBytes == 0 {
+		return false, status.Errorf(codes.InvalidArgument, "volume %s has no capacity, it cannot count against the quota of namespace %s", volumeName, namespace)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage, err := store.GetNamespaceUsage(q.bucket, namespace)
+	if err != nil {
+		return false, s3Error(err, "failed to read the usage of namespace %s", namespace)
+	}
+	if _, ok := usage.Volumes[volumeName]; ok {
+		return false, nil
+	}
+	if total := usage.Total(); total+capacityBytes > limit {
+		return false, status.Errorf(codes.ResourceExhausted, "volume %s of %d bytes exceeds the quota of namespace %s, %d of %d bytes are used", volumeName, capacityBytes, namespace, total, limit)
+	}
+	usage.Volumes[volumeName] = capacityBytes
+	if err := store.SetNamespaceUsage(q.bucket, namespace, usage); err != nil {
+		return false, s3Error(err, "failed to write the usage of namespace %s", namespace)
+	}
+	return true, nil
+}
+
+// resize records the new capacity of a volume in the usage of its
+// namespace. It returns ResourceExhausted if the volume would exceed the
+// quota, false if the namespace has no quota.
+func (q *namespaceQuotas) resize(store usageStore, namespace, volumeName string, capacityBytes int64) (bool, error) {
+	limit, ok := q.limit(namespace)
+	if !ok {
+		return false, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage, err := store.GetNamespaceUsage(q.bucket, namespace)
+	if err != nil {
+		return false, s3Error(err, "failed to read the usage of namespace %s", namespace)
+	}
+	if usage.Volumes[volumeName] == capacityBytes {
+		return true, nil
+	}
+	if total := usage.Total() - usage.Volumes[volumeName]; total+capacityBytes > limit {
+		return false, status.Errorf(codes.ResourceExhausted, "volume %s of %d bytes exceeds the quota of namespace %s, %d of %d bytes are used by the other volumes", volumeName, capacityBytes, namespace, total, limit)
+	}
+	usage.Volumes[volumeName] = capacityBytes
+	if err := store.SetNamespaceUsage(q.bucket, namespace, usage); err != nil {
+		return false, s3Error(err, "failed to write the usage of namespace %s", namespace)
+	}
+	return true, nil
+}
+
+// release removes a volume from the usage of its namespace
+func (q *namespaceQuotas) release(store usageStore, namespace, volumeName string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage, err := store.GetNamespaceUsage(q.bucket, namespace)
+	if err != nil {
+		return s3Error(err, "failed to read the usage of namespace %s", namespace)
+	}
+	if _, ok := usage.Volumes[volumeName]; !ok {
+		return nil
+	}
+	delete(usage.Volumes, volumeName)
+	if err := store.SetNamespaceUsage(q.bucket, namespace, usage); err != nil {
+		return s3Error(err, "failed to write the usage of namespace %s", namespace)
+	}
+	glog.V(4).Infof("Released %s from the quota of namespace %s", volumeName, namespace)
+	return nil
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseNamespaceQuotas(t *testing.T) {
+	quotas, err := ParseNamespaceQuotas("team-a=100Gi,team-b=1T,*=1048576")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"team-a": 100 << 30, "team-b": 1e12, "*": 1 << 20}
+	if !reflect.DeepEqual(quotas, expected) {
+		t.Fatalf("expected %v, got %v", expected, quotas)
+	}
+	for _, spec := range []string{"team-a", "team-a=", "team-a=1.5Gi", "team-a=-1", "Team_A=1Gi", "team-a=9999999Pi"} {
+		if _, err := ParseNamespaceQuotas(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestCreateVolumeNamespaceQuota(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("quotas")
+
+	cs := newTestControllerServer()
+	cs.quotas = newNamespaceQuotas("quotas", map[string]int64{"team-a": 3 << 30})
+	create := func(name, namespace string, capacity int64) error {
+		req := createVolumeRequest(name, srv.Secret())
+		req.CapacityRange = &csi.CapacityRange{RequiredBytes: capacity}
+		if namespace != "" {
+			req.Parameters[pvcNamespaceKey] = namespace
+		}
+		_, err := cs.CreateVolume(context.Background(), req)
+		return err
+	}
+	if err := create("pvc-a", "team-a", 2<<30); err != nil {
+		t.Fatal(err)
+	}
+	// a retry is not counted twice
+	if err := create("pvc-a", "team-a", 2<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("pvc-b", "team-a", 2<<30); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if srv.BucketExists("pvc-b") {
+		t.Fatal("expected nothing to be created for the volume exceeding the quota")
+	}
+	// namespaces without a quota are not limited
+	if err := create("pvc-c", "team-b", 10<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("pvc-d", "", 1<<30); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition without the namespace, got %v", err)
+	}
+	if !strings.HasSuffix(s3.NamespaceUsageKey("team-a"), "namespaces/team-a.json") || srv.GetObject("quotas", s3.NamespaceUsageKey("team-a")) == nil {
+		t.Fatalf("expected the usage to be stored at %s, got %v", s3.NamespaceUsageKey("team-a"), srv.Keys("quotas"))
+	}
+
+	// a failed creation releases its capacity
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/pvc-e") && r.Method == http.MethodPut {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+	if err := create("pvc-e", "team-a", 1<<30); err == nil {
+		t.Fatal("expected the creation to fail")
+	}
+	srv.Intercept = nil
+
+	// the deletion releases the capacity of the volume
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-a", Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("pvc-b", "team-a", 3<<30); err != nil {
+		t.Fatalf("expected the released capacity to be available, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// readinessMarkerKey makes the node server create a marker file at the
+	// root of the volume once the mount serves data
+	readinessMarkerKey = "readinessMarker"
+	// readinessMarkerPathKey sets the path of the readiness marker relative
+	// to the root of the volume, setting it enables the marker
+	readinessMarkerPathKey = "readinessMarkerPath"
+)
+
+// readinessMarker returns the path of the readiness marker relative to the
+// root of the volume, empty if the volume context does not enable it. The
+// marker has to be inside of the volume, as nothing else of the node is
+// visible to the pod.
+func readinessMarker(volumeContext map[string]string) (string, error) {
+	marker, ok := volumeContext[readinessMarkerPathKey]
+	if !ok {
+		if volumeContext[readinessMarkerKey] != "true" {
+			return "", nil
+		}
+		return s3.ReadyMarkerName, nil
+	}
+	cleaned := path.Clean(marker)
+	if marker == "" || path.IsAbs(marker) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid %s %q, must be a file path relative to the root of the volume", readinessMarkerPathKey, marker)
+	}
+	return cleaned, nil
+}
+
+// markReady probes the mount at targetPath and creates the readiness
+// marker. The marker is part of the volume, so it is only visible while
+// the mount is up and vanishes together with it, e.g. while a crashed
+// mounter is being replaced. The volume is written by its users, so the
+// marker and its directories are opened relative to each other without
+// following symlinks, which could point the driver running as root to
+// any file of the node.
+func markReady(targetPath, marker string, readOnly bool) error {
+	if _, err := ioutil.ReadDir(targetPath); err != nil {
+		return fmt.Errorf("mount at %s does not serve data: %v", targetPath, err)
+	}
+	dir, err := unix.Open(targetPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", targetPath, err)
+	}
+	defer func() { unix.Close(dir) }()
+	names := strings.Split(marker, "/")
+	for _, name := range names[:len(names)-1] {
+		fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT {
+			if readOnly {
+				glog.Warningf("Volume at %s is mounted read-only, unable to create readiness marker", targetPath)
+				return nil
+			}
+			if err := unix.Mkdirat(dir, name, 0755); err != nil && err != unix.EEXIST {
+				return fmt.Errorf("failed to create directory %s of readiness marker %s: %v", name, marker, err)
+			}
+			fd, err = unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		}
+		if err == unix.ELOOP || err == unix.ENOTDIR {
+			return fmt.Errorf("%s of readiness marker %s is not a directory, symlinks are not followed", name, marker)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open directory %s of readiness marker %s: %v", name, marker, err)
+		}
+		unix.Close(dir)
+		dir = fd
+	}
+	name := names[len(names)-1]
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		if st.Mode&unix.S_IFMT != unix.S_IFREG {
+			return fmt.Errorf("readiness marker %s exists, but is not a regular file", marker)
+		}
+		return nil
+	}
+	if readOnly {
+		glog.Warningf("Volume at %s is mounted read-only, unable to create readiness marker", targetPath)
+		return nil
+	}
+	fd, err := unix.Openat(dir, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err == unix.EEXIST {
+		// created concurrently, it is checked on the next publish
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create readiness marker %s: %v", marker, err)
+	}
+	return unix.Close(fd)
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestMarkReady(t *testing.T) {
+	target := t.TempDir()
+	marker := filepath.Join(target, s3.ReadyMarkerName)
+
+	if err := markReady(target, s3.ReadyMarkerName, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("expected no marker on a read-only mount, got %v", err)
+	}
+	if err := markReady(target, s3.ReadyMarkerName, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected marker to be created: %v", err)
+	}
+	// the marker of an earlier mount is kept
+	if err := markReady(target, s3.ReadyMarkerName, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := markReady(target, "status/ready", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "status", "ready")); err != nil {
+		t.Fatalf("expected marker in a sub directory to be created: %v", err)
+	}
+
+	if err := markReady(filepath.Join(target, "missing"), s3.ReadyMarkerName, false); err == nil {
+		t.Fatal("expected an error for a target which is not served")
+	}
+
+	// symlinks written by the users of the volume are never followed
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(target, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "file"), filepath.Join(target, "ready-link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []string{"link/ready", "ready-link", "link"} {
+		if err := markReady(target, marker, false); err == nil {
+			t.Errorf("expected the symlink of marker %s to be refused", marker)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) > 0 {
+		t.Fatalf("expected nothing to be created outside of the volume, got %v", entries)
+	}
+}
+
+func TestReadinessMarker(t *testing.T) {
+	tests := []struct {
+		volumeContext map[string]string
+		marker        string
+		invalid       bool
+	}{
+		{volumeContext: map[string]string{}},
+		{volumeContext: map[string]string{readinessMarkerKey: "true"}, marker: s3.ReadyMarkerName},
+		{volumeContext: map[string]string{readinessMarkerPathKey: "status/ready"}, marker: "status/ready"},
+		{volumeContext: map[string]string{readinessMarkerKey: "true", readinessMarkerPathKey: "./ready"}, marker: "ready"},
+		{volumeContext: map[string]string{readinessMarkerPathKey: ""}, invalid: true},
+		{volumeContext: map[string]string{readinessMarkerPathKey: "/ready"}, invalid: true},
+		{volumeContext: map[string]string{readinessMarkerPathKey: "status/.."}, invalid: true},
+		{volumeContext: map[string]string{readinessMarkerPathKey: "../ready"}, invalid: true},
+	}
+	for _, test := range tests {
+		marker, err := readinessMarker(test.volumeContext)
+		if (err != nil) != test.invalid {
+			t.Errorf("%v: expected invalid %v, got %v", test.volumeContext, test.invalid, err)
+		}
+		if marker != test.marker {
+			t.Errorf("%v: expected marker %q, got %q", test.volumeContext, test.marker, marker)
+		}
+	}
+}
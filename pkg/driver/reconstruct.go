@@ -0,0 +1,246 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// MetaReconstruction are the settings of a reconstruction of lost metadata
+type MetaReconstruction struct {
+	// Bucket is the bucket whose volumes get their metadata back
+	Bucket string
+	// Apply writes the metadata, otherwise it is only reported
+	Apply bool
+	// Mounter is the mounter of the volumes found without a PV list,
+	// which is required then
+	Mounter string
+}
+
+// pvList is the part of the output of kubectl get pv -o json the metadata
+// is reconstructed from
+type pvList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			Capacity map[string]string `json:"capacity"`
+			CSI      *struct {
+				Driver           string            `json:"driver"`
+				VolumeHandle     string            `json:"volumeHandle"`
+				VolumeAttributes map[string]string `json:"volumeAttributes"`
+			} `json:"csi"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// reconstructedVolume is a volume whose metadata is reconstructed, with
+// what is known about it from its PV
+type reconstructedVolume struct {
+	prefix        string
+	pvName        string
+	capacityBytes int64
+	volumeContext map[string]string
+}
+
+// metaReconstructor reads the data of a bucket and writes the metadata of
+// its volumes
+type metaReconstructor interface {
+	GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error)
+	SetFSMeta(meta *s3.FSMeta) error
+	IsEmpty(bucketName, prefix string) (bool, error)
+	FindDataPrefixes(bucketName, fsPath string) ([]string, error)
+}
+
+// ReconstructMeta writes the metadata of the volumes of a bucket whose
+// metadata has been lost and reports what it did to out. The volumes are
+// the ones of the PVs of pvs, the output of kubectl get pv -o json, or if
+// pvs is nil the prefixes of the bucket with a csi-fs directory, which get
+// the mounter of opts. Existing metadata is never overwritten.
+func (s3 *driver) ReconstructMeta(pvs io.Reader, opts MetaReconstruction, out io.Writer) error {
+	return reconstructMeta(defaultSecret(s3.opts.DefaultSecretDir).orDefault(nil), pvs, opts, out)
+}
+
+func reconstructMeta(secrets map[string]string, pvs io.Reader, opts MetaReconstruction, out io.Writer) error {
+	// a volume whose mounter is not known would silently get the default
+	if pvs == nil && opts.Mounter == "" {
+		return errors.New("the mounter of volumes found without a PV list is unknown, pass --pvs or --mounter")
+	}
+	if opts.Mounter != "" {
+		if _, err := mounter.GetCapabilities(opts.Mounter); err != nil {
+			return err
+		}
+	}
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	exists, err := client.BucketExists(opts.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", opts.Bucket)
+	}
+	var volumes []reconstructedVolume
+	if pvs != nil {
+		if volumes, err = pvVolumes(pvs, opts.Bucket); err != nil {
+			return err
+		}
+	} else {
+		prefixes, err := client.FindDataPrefixes(opts.Bucket, defaultFsPath)
+		if err != nil {
+			return fmt.Errorf("failed to list the data of bucket %s: %v", opts.Bucket, err)
+		}
+		for _, prefix := range prefixes {
+			volumes = append(volumes, reconstructedVolume{
+				prefix:        prefix,
+				volumeContext: map[string]string{mounter.TypeKey: opts.Mounter},
+			})
+		}
+	}
+	mode := "dry run, pass --apply to write the metadata"
+	if opts.Apply {
+		mode = "writing the metadata"
+	}
+	fmt.Fprintf(out, "Reconstructing the metadata of %d volumes of bucket %s, %s\n", len(volumes), opts.Bucket, mode)
+	failed := 0
+	for _, v := range volumes {
+		volumeID := path.Join(opts.Bucket, v.prefix)
+		result, err := reconstructVolumeMeta(client, opts.Bucket, v, opts.Apply)
+		if err != nil {
+			fmt.Fprintf(out, "%s: FAILED: %v\n", volumeID, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s: %s\n", volumeID, result)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to reconstruct the metadata of %d of %d volumes", failed, len(volumes))
+	}
+	return nil
+}
+
+// pvVolumes returns the volumes of the PVs of the driver in bucket
+func pvVolumes(r io.Reader, bucketName string) ([]reconstructedVolume, error) {
+	var list pvList
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to read the PV list: %v", err)
+	}
+	var volumes []reconstructedVolume
+	for _, pv := range list.Items {
+		csi := pv.Spec.CSI
+		// reference volumes never had metadata
+		if csi == nil || csi.Driver != driverName || isReferenceVolume(csi.VolumeHandle) {
+			continue
+		}
+		bucket, prefix := volumeIDToBucketPrefix(csi.VolumeHandle)
+		if bucket != bucketName {
+			continue
+		}
+		// a capacity which is not a whole number of bytes leaves the
+		// volume unbounded
+		capacity, _ := parseBytes(pv.Spec.Capacity["storage"])
+		volumes = append(volumes, reconstructedVolume{
+			prefix:        prefix,
+			pvName:        pv.Metadata.Name,
+			capacityBytes: capacity,
+			volumeContext: csi.VolumeAttributes,
+		})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].prefix < volumes[j].prefix })
+	return volumes, nil
+}
+
+// reconstructVolumeMeta writes the metadata of a volume unless it has
+// metadata, even metadata which cannot be read, and describes what it did
+func reconstructVolumeMeta(client metaReconstructor, bucketName string, v reconstructedVolume, apply bool) (string, error) {
+	_, err := client.GetFSMeta(bucketName, v.prefix)
+	if err == nil {
+		return "skipped, metadata exists", nil
+	}
+	if !errors.Is(err, s3.ErrObjectNotFound) {
+		return "", fmt.Errorf("metadata exists, but cannot be read, it is left as it is: %v", err)
+	}
+	fsPath, err := detectFSPath(client, bucketName, v.prefix, v.volumeContext[fsPathKey])
+	if err != nil {
+		return "", err
+	}
+	// nothing is known about who created the data, it is retained on
+	// deletion
+	prefixCreated := false
+	meta := &s3.FSMeta{
+		BucketName:         bucketName,
+		Prefix:             v.prefix,
+		FSPath:             fsPath,
+		CapacityBytes:      v.capacityBytes,
+		PVName:             v.pvName,
+		PrefixCreatedByCsi: &prefixCreated,
+	}
+	applyVolumeContext(meta, v.volumeContext)
+	b, err := json.MarshalIndent(meta, "+ ", "  ")
+	if err != nil {
+		return "", err
+	}
+	result := "would be written"
+	if apply {
+		if err := client.SetFSMeta(meta); err != nil {
+			return "", err
+		}
+		result = "written"
+	}
+	return fmt.Sprintf("%s\n+ %s", result, b), nil
+}
+
+// detectFSPath returns the data directory of the volume at prefix: csi-fs
+// if it exists, otherwise the fsPath of its PV, otherwise the prefix
+// itself if it contains data. An empty volume gets the default.
+func detectFSPath(client metaReconstructor, bucketName, prefix, value string) (string, error) {
+	empty, err := client.IsEmpty(bucketName, s3.DirPrefix(prefix, defaultFsPath))
+	if err != nil {
+		return "", err
+	}
+	if !empty {
+		return defaultFsPath, nil
+	}
+	if value != "" {
+		return parseFSPath(value)
+	}
+	if empty, err = client.IsEmpty(bucketName, s3.DirPrefix(prefix)); err != nil {
+		return "", err
+	}
+	if !empty {
+		return "", nil
+	}
+	return defaultFsPath, nil
+}
+
+// applyVolumeContext sets the options of the volume attributes of a PV,
+// the parameters of its storage class, on reconstructed metadata. Invalid
+// values are ignored like on recovery by the node.
+func applyVolumeContext(meta *s3.FSMeta, volumeContext map[string]string) {
+	meta.Mounter = volumeContext[mounter.TypeKey]
+	meta.CacheMode = volumeContext[mounter.CacheModeKey]
+	meta.SmallFileCacheMB, _ = mounter.ParseSmallFileCache(meta.Mounter, meta.CacheMode, volumeContext[mounter.SmallFileCacheKey])
+	meta.CacheOnlyOnError, _ = mounter.ParseCacheOnlyOnError(meta.Mounter, meta.CacheMode, volumeContext[mounter.CacheOnlyOnErrorKey])
+	meta.Consistency, _ = mounter.ParseConsistency(meta.Mounter, volumeContext[mounter.ConsistencyKey])
+	meta.MimeTypesFile, _ = mounter.ParseMimeTypesFile(meta.Mounter, volumeContext[mounter.MimeTypesFileKey])
+	meta.ChecksumAlgorithm, _ = mounter.ParseChecksumAlgorithm(meta.Mounter, volumeContext[mounter.ChecksumAlgorithmKey])
+	meta.KeyEncoding, _ = mounter.ParseKeyEncoding(meta.Mounter, volumeContext[mounter.KeyEncodingKey])
+	prefetchOpts, _ := parsePrefetch(volumeContext)
+	meta.Prefetch = prefetchOpts.prefetchMeta()
+	meta.Prefixes, _ = parsePrefixes(volumeContext[mounter.PrefixesKey])
+	meta.ObjectTags, _ = parseObjectTags(meta.Mounter, volumeContext)
+	meta.S3backer, _ = mounter.ParseS3backerOptions(meta.Mounter, volumeContext)
+	meta.KMS, _ = mounter.ParseKMSOptions(meta.Mounter, volumeContext)
+	meta.Env, _ = mounter.ParseEnv(meta.Mounter, volumeContext[mounter.EnvKey])
+	meta.ClientEncrypted = volumeContext[clientEncryptionKeyRefKey] != ""
+	meta.DeleteProtection = volumeContext[deleteProtectionKey] == "true"
+}
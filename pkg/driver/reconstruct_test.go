@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+const testPVList = `{
+  "kind": "List",
+  "items": [
+    {
+      "metadata": {"name": "pv-rclone"},
+      "spec": {
+        "capacity": {"storage": "5Gi"},
+        "csi": {
+          "driver": "ch.ctrox.csi.s3-driver",
+          "volumeHandle": "shared/pvc-rclone",
+          "volumeAttributes": {"mounter": "rclone", "cacheMode": "none", "deleteProtection": "true"}
+        }
+      }
+    },
+    {
+      "metadata": {"name": "pv-flat"},
+      "spec": {
+        "capacity": {"storage": "1Gi"},
+        "csi": {
+          "driver": "ch.ctrox.csi.s3-driver",
+          "volumeHandle": "shared/pvc-flat",
+          "volumeAttributes": {"mounter": "s3fs", "fsPath": "/"}
+        }
+      }
+    },
+    {
+      "metadata": {"name": "pv-other-bucket"},
+      "spec": {"csi": {"driver": "ch.ctrox.csi.s3-driver", "volumeHandle": "other/pvc-other"}}
+    },
+    {
+      "metadata": {"name": "pv-other-driver"},
+      "spec": {"csi": {"driver": "ebs.csi.aws.com", "volumeHandle": "shared/vol-1234"}}
+    }
+  ]
+}`
+
+func TestReconstructMeta(t *testing.T) {
+	setS3Options(t, s3.Options{ControlPrefix: s3.DefaultControlPrefix})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.CreateBucket("shared")
+	srv.PutObject("shared", "pvc-rclone/csi-fs/file", []byte("data"))
+	srv.PutObject("shared", "pvc-flat/file", []byte("data"))
+	srv.PutObject("shared", "pvc-intact/csi-fs/file", []byte("data"))
+	intact := &s3.FSMeta{BucketName: "shared", Prefix: "pvc-intact", FSPath: "csi-fs", Mounter: "goofys", CreatedByCsi: true}
+	if err := client.SetFSMeta(intact); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mounter of volumes without PV is not guessed
+	out := new(bytes.Buffer)
+	if err := reconstructMeta(srv.Secret(), nil, MetaReconstruction{Bucket: "shared"}, out); err == nil {
+		t.Fatal("expected the mounter to be required without a PV list")
+	}
+	if err := reconstructMeta(srv.Secret(), nil, MetaReconstruction{Bucket: "shared", Mounter: "fuse"}, out); err == nil {
+		t.Fatal("expected an unknown mounter to be rejected")
+	}
+
+	// the volumes are found by their csi-fs directory
+	if err := reconstructMeta(srv.Secret(), nil, MetaReconstruction{Bucket: "shared", Mounter: "rclone"}, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"shared/pvc-intact: skipped, metadata exists", "shared/pvc-rclone: would be written", `+   "FSPath": "csi-fs",`, `+   "Mounter": "rclone",`} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in the report:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out.String(), "pvc-flat") {
+		t.Errorf("expected the volume without csi-fs not to be found:\n%s", out)
+	}
+	if _, err := client.GetFSMeta("shared", "pvc-rclone"); err == nil {
+		t.Fatal("expected a dry run not to write the metadata")
+	}
+
+	out.Reset()
+	opts := MetaReconstruction{Bucket: "shared", Apply: true}
+	if err := reconstructMeta(srv.Secret(), strings.NewReader(testPVList), opts, out); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	meta, err := client.GetFSMeta("shared", "pvc-rclone")
+	if err != nil {
+		t.Fatalf("expected the metadata to be written: %v\n%s", err, out)
+	}
+	if meta.Mounter != "rclone" || meta.FSPath != "csi-fs" || meta.PVName != "pv-rclone" || meta.CapacityBytes != 5<<30 ||
+		meta.CacheMode != "none" || !meta.DeleteProtection || meta.OwnsPrefix() {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if meta, err = client.GetFSMeta("shared", "pvc-flat"); err != nil || meta.FSPath != "" || meta.Mounter != "s3fs" {
+		t.Fatalf("expected the data of pvc-flat in its prefix, got %+v, %v", meta, err)
+	}
+	if meta, err = client.GetFSMeta("shared", "pvc-intact"); err != nil || meta.Mounter != "goofys" {
+		t.Fatalf("expected the existing metadata to be kept, got %+v, %v", meta, err)
+	}
+	if strings.Contains(out.String(), "pvc-other") || strings.Contains(out.String(), "vol-1234") {
+		t.Errorf("expected only the PVs of the driver in the bucket to be reconstructed:\n%s", out)
+	}
+
+	// metadata which cannot be read is never overwritten
+	srv.PutObject("shared", ".csi-s3/pvc-broken/.metadata.json", []byte("not json"))
+	srv.PutObject("shared", "pvc-broken/csi-fs/file", []byte("data"))
+	out.Reset()
+	opts.Mounter = "rclone"
+	if err := reconstructMeta(srv.Secret(), nil, opts, out); err == nil || !strings.Contains(out.String(), "shared/pvc-broken: FAILED") {
+		t.Fatalf("expected unreadable metadata to be reported, got %v:\n%s", err, out)
+	}
+	if o := srv.GetObject("shared", ".csi-s3/pvc-broken/.metadata.json"); string(o.Data) != "not json" {
+		t.Fatalf("expected the unreadable metadata to be kept, got %s", o.Data)
+	}
+}
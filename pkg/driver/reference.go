@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	provisioningModeKey = "provisioningMode"
+	// provisioningModeNone provisions references to existing data without
+	// any writes to the object store
+	provisioningModeNone = "none"
+	// referencePrefixKey selects the data of a reference volume in its bucket
+	referencePrefixKey = "prefix"
+	// referenceVolumePrefix marks the IDs of reference volumes, it cannot be
+	// part of a bucket name so these IDs never match a provisioned volume.
+	referenceVolumePrefix = "ref:"
+)
+
+// writeParameters cannot be combined with provisioningMode none
+var writeParameters = []string{
+	replicationTargetArnKey,
+	replicationRoleKey,
+	objectOwnershipKey,
+	metadataPolicyKey,
+	grantReadKey,
+	grantWriteKey,
+	// the data of a reference volume is at its prefix
+	fsPathKey,
+}
+
+func isReferenceVolume(volumeID string) bool {
+	return strings.HasPrefix(volumeID, referenceVolumePrefix)
+}
+
+// referenceVolumeBucket returns the bucket of a reference volume ID
+func referenceVolumeBucket(volumeID string) string {
+	return strings.SplitN(strings.TrimPrefix(volumeID, referenceVolumePrefix), "/", 2)[0]
+}
+
+// referenceMeta builds the metadata of a reference volume, which is never
+// stored in the bucket.
+func referenceMeta(volumeID string, volumeContext map[string]string) *s3.FSMeta {
+	meta := &s3.FSMeta{
+		BucketName: referenceVolumeBucket(volumeID),
+		Prefix:     s3.CleanPrefix(volumeContext[referencePrefixKey]),
+		Mounter:    volumeContext[mounter.TypeKey],
+		CacheMode:  volumeContext[mounter.CacheModeKey],
+		// the bucket is never written, so the parameter is all there is
+		ClientEncrypted: volumeContext[clientEncryptionKeyRefKey] != "",
+	}
+	// validated on creation
+	meta.SmallFileCacheMB, _ = mounter.ParseSmallFileCache(meta.Mounter, meta.CacheMode, volumeContext[mounter.SmallFileCacheKey])
+	meta.CacheOnlyOnError, _ = mounter.ParseCacheOnlyOnError(meta.Mounter, meta.CacheMode, volumeContext[mounter.CacheOnlyOnErrorKey])
+	meta.Consistency, _ = mounter.ParseConsistency(meta.Mounter, volumeContext[mounter.ConsistencyKey])
+	meta.MimeTypesFile, _ = mounter.ParseMimeTypesFile(meta.Mounter, volumeContext[mounter.MimeTypesFileKey])
+	meta.ChecksumAlgorithm, _ = mounter.ParseChecksumAlgorithm(meta.Mounter, volumeContext[mounter.ChecksumAlgorithmKey])
+	meta.KeyEncoding, _ = mounter.ParseKeyEncoding(meta.Mounter, volumeContext[mounter.KeyEncodingKey])
+	prefetchOpts, _ := parsePrefetch(volumeContext)
+	meta.Prefetch = prefetchOpts.prefetchMeta()
+	meta.ObjectTags, _ = parseObjectTags(meta.Mounter, volumeContext)
+	meta.S3backer, _ = mounter.ParseS3backerOptions(meta.Mounter, volumeContext)
+	meta.KMS, _ = mounter.ParseKMSOptions(meta.Mounter, volumeContext)
+	meta.Env, _ = mounter.ParseEnv(meta.Mounter, volumeContext[mounter.EnvKey])
+	return meta
+}
+
+// createReferenceVolume provisions a volume which refers to the data of an
+// existing bucket. Only the existence of the bucket is checked, so read
+// credentials are sufficient.
+func (cs *controllerServer) createReferenceVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	params := req.GetParameters()
+	bucketName := params[mounter.BucketKey]
+	if bucketName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s requires the %s parameter", provisioningModeKey, provisioningModeNone, mounter.BucketKey)
+	}
+	for _, key := range writeParameters {
+		if params[key] != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with %s %s", key, provisioningModeKey, provisioningModeNone)
+		}
+	}
+	if err := cs.checkPrefixDepth(params[referencePrefixKey]); err != nil {
+		return nil, err
+	}
+
+	secrets := cs.defaultSecret.orDefault(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	client = client.WithContext(ctx)
+	exists, err := client.BucketExists(bucketName)
+	if err != nil {
+		return nil, s3Error(err, "failed to check if bucket %s exists", bucketName)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "bucket %s of reference volume does not exist", bucketName)
+	}
+	prefix := s3.CleanPrefix(params[referencePrefixKey])
+	if err := checkExpectedData(client, params, bucketName, prefix, prefix); err != nil {
+		return nil, err
+	}
+
+	volumeID := referenceVolumePrefix + path.Join(bucketName, sanitizeVolumeID(req.GetName()))
+	volumeContext := withLocation(params, client.Config.Location(bucketName, prefix))
+	if err := checkNodeAccess(secrets, referenceMeta(volumeID, volumeContext), false); err != nil {
+		return nil, err
+	}
+	cs.events.Eventf(params[pvNameKey], eventTypeNormal, "Provisioned", "Volume %s refers to %s", volumeID, volumeContext[locationKey])
+	glog.V(4).Infof("create reference volume %s", volumeID)
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: cs.volumeCapacity(req.GetCapacityRange()),
+			VolumeContext: volumeContext,
+		},
+	}, nil
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReferenceVolumeNeverWrites(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.PutObject("data", "file", []byte("data"))
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-ref", srv.Secret())
+	req.Parameters["bucket"] = "data"
+	req.Parameters[provisioningModeKey] = provisioningModeNone
+	// the node mounts a remote of the rclone config of its secret
+	req.Parameters["mounter"] = "rclone"
+	req.Parameters["remotePath"] = "crypted:data"
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	if !isReferenceVolume(volumeID) || referenceVolumeBucket(volumeID) != "data" {
+		t.Fatalf("unexpected volume ID %s", volumeID)
+	}
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: srv.Secret()}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("data", "file") == nil {
+		t.Fatal("expected data of the reference volume to be kept")
+	}
+}
+
+func TestReferenceVolumeInvalidParameters(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("data")
+
+	cs := newTestControllerServer()
+	for _, params := range []map[string]string{
+		{provisioningModeKey: provisioningModeNone},
+		{provisioningModeKey: provisioningModeNone, "bucket": "missing"},
+		{provisioningModeKey: provisioningModeNone, "bucket": "data", objectOwnershipKey: "BucketOwnerEnforced"},
+		{provisioningModeKey: "some", "bucket": "data"},
+		{provisioningModeKey: provisioningModeNone, "bucket": "data", "mounter": "s3fs", "remotePath": "crypted:data"},
+		{provisioningModeKey: provisioningModeNone, "bucket": "data", "mounter": "rclone", "remotePath": ":s3:data"},
+	} {
+		req := createVolumeRequest("pvc-ref", srv.Secret())
+		for k, v := range params {
+			req.Parameters[k] = v
+		}
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument && status.Code(err) != codes.NotFound {
+			t.Errorf("%v: expected the request to be rejected, got %v", params, err)
+		}
+	}
+}
+
+func TestReferenceVolumePrefixDepth(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("data")
+
+	cs := newTestControllerServer()
+	cs.maxPrefixDepth = 2
+	req := createVolumeRequest("pvc-ref", srv.Secret())
+	req.Parameters["bucket"] = "data"
+	req.Parameters[provisioningModeKey] = provisioningModeNone
+	req.Parameters[referencePrefixKey] = "tenant/team/app/data"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a prefix exceeding the depth, got %v", err)
+	}
+	// trailing and repeated slashes do not count
+	req.Parameters[referencePrefixKey] = "tenant//team/app/"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	cs.maxPrefixDepth = 0
+	req.Parameters[referencePrefixKey] = "a/b/c/d/e/f/g/h"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("expected the depth not to be limited, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// defaultSecret is a directory containing the secret used when a request
+// does not carry any secrets. It follows the layout of a Kubernetes secret
+// volume where every key is a file.
+type defaultSecret string
+
+// orDefault returns the secrets of the request or the default secret if the
+// request has none. Request secrets are never merged with the default one.
+func (dir defaultSecret) orDefault(secrets map[string]string) map[string]string {
+	if len(secrets) != 0 || dir == "" {
+		return secrets
+	}
+	def, err := readSecretDir(string(dir))
+	if err != nil {
+		glog.Errorf("Failed to read default secret from %s: %v", dir, err)
+		return secrets
+	}
+	return def
+}
+
+func readSecretDir(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string)
+	for _, f := range files {
+		// skip the ..data and timestamped directories of secret volumes
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(dir, f.Name())
+		// keys of secret volumes are symlinks, stat the target
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		value, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		secrets[f.Name()] = string(value)
+	}
+	return secrets, nil
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// seedFromKey initializes the data of a new volume with a copy of the
+// objects below a bucket or a prefix, e.g. bucket/templates/app
+const seedFromKey = "seedFrom"
+
+// parseSeedFrom returns the bucket and the prefix a volume is seeded from
+func parseSeedFrom(value string) (string, string, error) {
+	if strings.HasPrefix(value, referenceVolumePrefix) {
+		return "", "", fmt.Errorf("invalid %s %s, must be a bucket optionally followed by a prefix", seedFromKey, value)
+	}
+	bucket, prefix, err := parseVolumeID(value)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid %s %s, must be a bucket optionally followed by a prefix", seedFromKey, value)
+	}
+	return bucket, prefix, nil
+}
+
+// seedSource lists the objects a volume is seeded from
+type seedSource interface {
+	BucketExists(bucketName string) (bool, error)
+	IsEmpty(bucketName, prefix string) (bool, error)
+}
+
+// checkSeedSource verifies that the objects a volume is seeded from can be
+// listed before anything is written for the volume
+func checkSeedSource(client seedSource, bucketName, prefix string) error {
+	source := path.Join(bucketName, prefix)
+	exists, err := client.BucketExists(bucketName)
+	if err != nil {
+		return s3Error(err, "failed to check if bucket %s of %s %s exists", bucketName, seedFromKey, source)
+	}
+	if !exists {
+		return status.Errorf(codes.InvalidArgument, "bucket %s of %s %s does not exist", bucketName, seedFromKey, source)
+	}
+	empty, err := client.IsEmpty(bucketName, s3.DirPrefix(prefix))
+	if err != nil {
+		return s3Error(err, "failed to list the objects of %s %s", seedFromKey, source)
+	}
+	if empty {
+		return status.Errorf(codes.InvalidArgument, "%s %s contains no objects", seedFromKey, source)
+	}
+	return nil
+}
+
+// seeder copies the objects a volume is seeded from
+type seeder interface {
+	CopyPrefix(srcBucket, srcPrefix, dstBucket, dstPrefix string) (int, error)
+	SetFSMeta(meta *s3.FSMeta) error
+}
+
+// seedVolume copies the objects of the seed source of a new volume into
+// its data prefix and records it in the metadata. A failed copy is
+// repeated by the next attempt to create the volume.
+func seedVolume(client seeder, meta *s3.FSMeta) error {
+	bucketName, prefix, err := parseSeedFrom(meta.SeedFrom)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	count, err := client.CopyPrefix(bucketName, prefix, meta.BucketName, meta.DataPrefix())
+	if err != nil {
+		return s3Error(err, "failed to copy %s %s into volume %s", seedFromKey, meta.SeedFrom, path.Join(meta.BucketName, meta.Prefix))
+	}
+	glog.V(4).Infof("Seeded volume %s with %d objects of %s", path.Join(meta.BucketName, meta.Prefix), count, meta.SeedFrom)
+	meta.Seeded = true
+	if err := client.SetFSMeta(meta); err != nil {
+		return s3Error(err, "error setting bucket metadata")
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeSeedFrom(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.PutObject("templates", "app/config.yaml", []byte("config"))
+	srv.PutObject("templates", "app/schema/v1.sql", []byte("schema"))
+	srv.PutObject("templates", "other/file", []byte("other"))
+
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-seed", srv.Secret())
+	req.Parameters[seedFromKey] = "templates//app/"
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.GetFSMeta("pvc-seed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SeedFrom != "templates/app" || !meta.Seeded {
+		t.Fatalf("expected the seed to be recorded, got %q, %v", meta.SeedFrom, meta.Seeded)
+	}
+	var data []string
+	for _, key := range srv.Keys("pvc-seed") {
+		if strings.HasPrefix(key, defaultFsPath+"/") {
+			data = append(data, key)
+		}
+	}
+	want := []string{"csi-fs/", "csi-fs/config.yaml", "csi-fs/schema/v1.sql"}
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("expected %v, got %v", want, data)
+	}
+
+	// a seeded volume is not seeded again
+	srv.PutObject("pvc-seed", "csi-fs/config.yaml", []byte("changed"))
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if o := srv.GetObject("pvc-seed", "csi-fs/config.yaml"); string(o.Data) != "changed" {
+		t.Fatalf("expected the data of the volume to be kept, got %q", o.Data)
+	}
+
+	// nor is its source checked again, which may be gone by then
+	srv.DeleteObject("templates", "app/config.yaml")
+	srv.DeleteObject("templates", "app/schema/v1.sql")
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("expected the seeded volume to be created without its source, got %v", err)
+	}
+	req.Parameters[seedFromKey] = "templates/other"
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists for a different seed, got %v", err)
+	}
+}
+
+func TestCreateVolumeSeedFromRetried(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	srv.PutObject("templates", "app/config.yaml", []byte("config"))
+
+	failCopy := true
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if failCopy && r.Header.Get("X-Amz-Copy-Source") != "" {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+	cs := newTestControllerServer()
+	req := createVolumeRequest("pvc-seed", srv.Secret())
+	req.Parameters["bucket"] = "shared"
+	req.Parameters[seedFromKey] = "templates/app"
+	if _, err := cs.CreateVolume(context.Background(), req); err == nil {
+		t.Fatal("expected the failed copy to fail the creation")
+	}
+	failCopy = false
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("shared", "pvc-seed/csi-fs/config.yaml") == nil {
+		t.Fatal("expected the retry to seed the volume")
+	}
+}
+
+func TestCreateVolumeSeedFromRejected(t *testing.T) {
+	setS3Options(t, s3.Options{})
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.PutObject("templates", "app/config.yaml", []byte("config"))
+	srv.CreateBucket("private")
+	srv.PutObject("shared", "pvc-data/csi-fs/file", []byte("data"))
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/private") && r.Method == http.MethodGet {
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+
+	cs := newTestControllerServer()
+	for _, tc := range []struct {
+		name     string
+		seedFrom string
+		bucket   string
+		code     codes.Code
+	}{
+		{"invalid", "configmap:templates", "", codes.InvalidArgument},
+		{"reference", "ref:templates/app", "", codes.InvalidArgument},
+		{"traversal", "templates/../app", "", codes.InvalidArgument},
+		{"missing bucket", "missing/app", "", codes.InvalidArgument},
+		{"empty", "templates/missing", "", codes.InvalidArgument},
+		{"denied", "private/app", "", codes.PermissionDenied},
+		{"existing data", "templates/app", "shared", codes.FailedPrecondition},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := "pvc-seed"
+			if tc.bucket != "" {
+				name = "pvc-data"
+			}
+			req := createVolumeRequest(name, srv.Secret())
+			req.Parameters[seedFromKey] = tc.seedFrom
+			if tc.bucket != "" {
+				req.Parameters["bucket"] = tc.bucket
+			}
+			if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != tc.code {
+				t.Fatalf("expected %v, got %v", tc.code, err)
+			}
+			if srv.BucketExists("pvc-seed") {
+				t.Fatal("expected nothing to be written for the volume")
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+const (
+	selfTestFile     = "csi-s3-self-test"
+	selfTestCapacity = 1 << 30
+)
+
+// selfTest runs the steps of a self test and reports their results
+type selfTest struct {
+	out    io.Writer
+	failed bool
+}
+
+func (t *selfTest) step(name string, fn func() error) bool {
+	start := time.Now()
+	if err := fn(); err != nil {
+		fmt.Fprintf(t.out, "%-10s FAILED (%v): %v\n", name, time.Since(start).Round(time.Millisecond), err)
+		t.failed = true
+		return false
+	}
+	fmt.Fprintf(t.out, "%-10s ok (%v)\n", name, time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// SelfTest provisions a volume with the storage class parameters, mounts
+// it, writes and reads back a file and removes everything again. It uses
+// the default secret and performs real writes against the object store.
+func (s3 *driver) SelfTest(parameters map[string]string, out io.Writer) error {
+	s3.setup()
+	mounterType := parameters[mounter.TypeKey]
+	if mounterType == "" {
+		mounterType = "default"
+	}
+	fmt.Fprintf(out, "Running self test with %s mounter\n", mounterType)
+
+	t := &selfTest{out: out}
+	if err := s3.runSelfTest(t, parameters); err != nil {
+		return err
+	}
+	if t.failed {
+		return fmt.Errorf("self test failed")
+	}
+	return nil
+}
+
+// runSelfTest runs every step whose preconditions succeeded, the cleanup
+// of a step is deferred so it runs even if a later step fails.
+func (s3 *driver) runSelfTest(t *selfTest, parameters map[string]string) error {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "csi-s3-self-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	var volume *csi.Volume
+	if !t.step("create", func() error {
+		resp, err := s3.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               fmt.Sprintf("csi-s3-self-test-%d", time.Now().Unix()),
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: selfTestCapacity},
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			Parameters:         parameters,
+		})
+		volume = resp.GetVolume()
+		return err
+	}) {
+		return nil
+	}
+	defer t.step("delete", func() error {
+		_, err := s3.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		return err
+	})
+
+	staged := t.step("stage", func() error {
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
+			return err
+		}
+		_, err := s3.ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+			VolumeContext:     volume.GetVolumeContext(),
+		})
+		return err
+	})
+	if staged {
+		defer t.step("unstage", func() error {
+			_, err := s3.ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          volume.GetVolumeId(),
+				StagingTargetPath: stagingPath,
+			})
+			return err
+		})
+	}
+
+	published := staged && t.step("publish", func() error {
+		_, err := s3.ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+			VolumeContext:     volume.GetVolumeContext(),
+		})
+		return err
+	})
+	if published {
+		defer t.step("unpublish", func() error {
+			_, err := s3.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   volume.GetVolumeId(),
+				TargetPath: targetPath,
+			})
+			return err
+		})
+	}
+
+	content := []byte(fmt.Sprintf("written by csi-s3 %s at %s\n", vendorVersion, time.Now().UTC()))
+	written := published && t.step("write", func() error {
+		return ioutil.WriteFile(filepath.Join(targetPath, selfTestFile), content, 0644)
+	})
+	if !written {
+		return nil
+	}
+	t.step("read", func() error {
+		b, err := ioutil.ReadFile(filepath.Join(targetPath, selfTestFile))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, content) {
+			return fmt.Errorf("read %q, expected %q", b, content)
+		}
+		return nil
+	})
+	return nil
+}
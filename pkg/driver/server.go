@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/ctrox/csi-s3/pkg/tracing"
+	"github.com/golang/glog"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// parseEndpoint splits a unix:// or tcp:// endpoint into network and address.
+// For backwards compatibility a unix path is always treated as absolute, so
+// unix://tmp/csi.sock and unix:///tmp/csi.sock are the same socket.
+func parseEndpoint(endpoint string) (string, string, error) {
+	s := strings.SplitN(endpoint, "://", 2)
+	if len(s) != 2 || s[1] == "" {
+		return "", "", fmt.Errorf("invalid endpoint %q, must be unix://<path> or tcp://<host>:<port>", endpoint)
+	}
+	switch proto := strings.ToLower(s[0]); proto {
+	case "unix":
+		return proto, "/" + strings.TrimLeft(s[1], "/"), nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(s[1]); err != nil {
+			return "", "", fmt.Errorf("invalid tcp endpoint %q: %v", endpoint, err)
+		}
+		return proto, s[1], nil
+	default:
+		return "", "", fmt.Errorf("unsupported protocol %q in endpoint %q", s[0], endpoint)
+	}
+}
+
+// umaskMu serializes the sockets created with a umask of their own, the
+// umask is shared by the whole process
+var umaskMu sync.Mutex
+
+// listen opens the endpoint. A unix socket is created with the given
+// permissions and group, a socket left over by a previous run is removed.
+func listen(endpoint string, mode os.FileMode, gid int) (net.Listener, error) {
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := listenWithMode(proto, addr, mode)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "unix" {
+		if gid != 0 {
+			if err := os.Chown(addr, -1, gid); err != nil {
+				listener.Close()
+				return nil, fmt.Errorf("failed to set group of socket %s: %v", addr, err)
+			}
+		}
+	}
+	return listener, nil
+}
+
+// listenWithMode opens addr, a unix socket is created with mode by setting
+// the umask while it is bound, so it is never accessible with the default
+// permissions. Files created by other goroutines meanwhile get the same
+// umask.
+func listenWithMode(proto, addr string, mode os.FileMode) (net.Listener, error) {
+	if proto != "unix" || mode == 0 {
+		return net.Listen(proto, addr)
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	defer syscall.Umask(old)
+	return net.Listen(proto, addr)
+}
+
+// removeStaleSocket removes the socket at addr, refusing to touch anything
+// which is not a socket or a socket which is still served by another process.
+func removeStaleSocket(addr string) error {
+	info, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket, refusing to remove it", addr)
+	}
+	if conn, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", addr)
+	}
+	glog.V(4).Infof("Removing stale socket %s", addr)
+	return os.Remove(addr)
+}
+
+// logGRPC logs every call and traces it if tracing is enabled. The
+// changes done for calls on a volume are audited with its ID.
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := tracing.Start(ctx, tracing.KindServer, strings.TrimPrefix(info.FullMethod, "/"))
+	span.SetAttribute("rpc.system", "grpc")
+	defer span.End(&err)
+	if r, ok := req.(interface{ GetVolumeId() string }); ok {
+		ctx = audit.WithIdentity(ctx, audit.Identity{VolumeID: r.GetVolumeId()})
+	}
+
+	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	glog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	resp, err = handler(ctx, req)
+	if err != nil {
+		glog.Errorf("GRPC error: %v", err)
+	} else {
+		glog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+func newGRPCServer(ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	csi.RegisterIdentityServer(server, ids)
+	csi.RegisterControllerServer(server, cs)
+	csi.RegisterNodeServer(server, ns)
+	return server
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		proto    string
+		addr     string
+		invalid  bool
+	}{
+		{endpoint: "unix:///csi/csi.sock", proto: "unix", addr: "/csi/csi.sock"},
+		{endpoint: "unix://tmp/csi.sock", proto: "unix", addr: "/tmp/csi.sock"},
+		{endpoint: "UNIX:///tmp/csi.sock", proto: "unix", addr: "/tmp/csi.sock"},
+		{endpoint: "tcp://127.0.0.1:10000", proto: "tcp", addr: "127.0.0.1:10000"},
+		{endpoint: "tcp://127.0.0.1", invalid: true},
+		{endpoint: "udp://127.0.0.1:10000", invalid: true},
+		{endpoint: "/tmp/csi.sock", invalid: true},
+		{endpoint: "unix://", invalid: true},
+	}
+	for _, test := range tests {
+		proto, addr, err := parseEndpoint(test.endpoint)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.endpoint, err)
+			continue
+		}
+		if proto != test.proto || addr != test.addr {
+			t.Errorf("%s: expected %s %s, got %s %s", test.endpoint, test.proto, test.addr, proto, addr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+
+	// leave a stale socket behind like a crashed driver would
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	umask := syscall.Umask(022)
+	defer syscall.Umask(umask)
+	listener, err := listen("unix://"+socket, 0600, 0)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced: %v", err)
+	}
+	defer listener.Close()
+	if restored := syscall.Umask(022); restored != 022 {
+		t.Fatalf("expected the umask to be restored, got %o", restored)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected socket mode 0600, got %o", perm)
+	}
+
+	if _, err := listen("unix://"+socket, 0600, 0); err == nil {
+		t.Fatal("expected an error for a socket in use")
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "csi.sock")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix://"+file, 0, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("expected file to be untouched: %v", err)
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	listener, err := listen("tcp://127.0.0.1:0", 0600, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
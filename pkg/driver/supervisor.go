@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+)
+
+// unitSuperviseInterval is how often the systemd units of the mounters are
+// checked for failures
+const unitSuperviseInterval = 5 * time.Second
+
+// runUnitSupervisor restarts the failed systemd units of the mounters
+// until stop is closed
+func (ns *nodeServer) runUnitSupervisor(stop <-chan struct{}) {
+	ticker := time.NewTicker(unitSuperviseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ns.reportUnitEvents(mounter.SuperviseSystemdUnits(time.Now()))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reportUnitEvents emits an event on the PV of each failed unit. The
+// vendored CSI spec predates volume conditions, a poisoned volume is not
+// reported to Kubernetes as abnormal.
+func (ns *nodeServer) reportUnitEvents(events []mounter.UnitEvent) {
+	for _, e := range events {
+		switch e.Reason {
+		case mounter.UnitPoisoned:
+			ns.events.Eventf(e.PVName, eventTypeWarning, e.Reason, "mounter of volume %s at %s failed %d times and is not restarted until the volume is published again or it is reset", e.VolumeID, e.Target, e.Failures)
+		default:
+			ns.events.Eventf(e.PVName, eventTypeWarning, e.Reason, "mounter of volume %s at %s failed %d times, restarting it in %v", e.VolumeID, e.Target, e.Failures, e.RestartIn)
+		}
+	}
+}
+
+// handleDebugResetUnit forgets the failures of the systemd unit mounting
+// the target query parameter, which restarts a poisoned unit
+func handleDebugResetUnit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "resetting a unit requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := mounter.ResetSystemdUnit(r.URL.Query().Get("target")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerUnitMetrics exposes the failures of the systemd units of the
+// mounters. A transient volume is restarted after a backoff, a poisoned
+// one is left failed.
+func registerUnitMetrics() {
+	metrics.Register("csi_s3_mounter_unit_failures", "Number of failures of the systemd unit of a volume since it was published, by state transient or poisoned.", metrics.Gauge,
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, f := range mounter.SystemdUnitFailures() {
+				state := "transient"
+				if f.Poisoned {
+					state = "poisoned"
+				}
+				samples = append(samples, metrics.Sample{
+					Labels: map[string]string{"volume_id": f.VolumeID, "target_path": f.Target, "state": state},
+					Value:  float64(f.Failures),
+				})
+			}
+			return samples
+		})
+	metrics.Register("csi_s3_mounter_unit_restarts_total", "Number of failed systemd units of mounters restarted by the node plugin.", metrics.Counter,
+		func() []metrics.Sample {
+			restarts, _ := mounter.UnitRestartStats()
+			return []metrics.Sample{{Value: float64(restarts)}}
+		})
+	metrics.Register("csi_s3_mounter_unit_resets_total", "Number of systemd units of mounters whose failures were reset on the debug endpoint.", metrics.Counter,
+		func() []metrics.Sample {
+			_, resets := mounter.UnitRestartStats()
+			return []metrics.Sample{{Value: float64(resets)}}
+		})
+}
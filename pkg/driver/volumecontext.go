@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+)
+
+// resolveVolume decides how a volume is mounted when its metadata and the
+// volume context of the PV disagree, e.g. because the PV was edited. The
+// metadata wins for the layout of the data: bucket, prefix, mounter and
+// cache mode. The volume context wins for tunables which only concern the
+// node, like prefetch or the readiness marker, those are never stored in
+// the metadata. Conflicts are logged, with strict set they are returned
+// as an error instead.
+func resolveVolume(volumeID string, meta *s3.FSMeta, volumeContext map[string]string, strict bool) error {
+	var conflicts []string
+	conflict := func(field, metaValue, contextValue string) {
+		if metaValue != contextValue {
+			conflicts = append(conflicts, fmt.Sprintf("%s is %q in the metadata but %q in the volume context", field, metaValue, contextValue))
+		}
+	}
+	if !isReferenceVolume(volumeID) {
+		bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+		conflict("bucket of the volume ID", meta.BucketName, bucketName)
+		conflict("prefix of the volume ID", meta.Prefix, prefix)
+		if bucket, ok := volumeContext[mounter.BucketKey]; ok {
+			conflict(mounter.BucketKey, meta.BucketName, bucket)
+		}
+	}
+	conflict(mounter.TypeKey, meta.Mounter, volumeContext[mounter.TypeKey])
+	conflict(mounter.CacheModeKey, meta.CacheMode, volumeContext[mounter.CacheModeKey])
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("metadata of volume %s conflicts with its volume context: %s", volumeID, strings.Join(conflicts, ", "))
+	}
+	for _, c := range conflicts {
+		glog.V(2).Infof("Volume %s: %s, using the metadata", volumeID, c)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestResolveVolume(t *testing.T) {
+	meta := &s3.FSMeta{BucketName: "shared", Prefix: "pvc-a", Mounter: "rclone", FSPath: defaultFsPath}
+	volumeContext := map[string]string{"mounter": "rclone", "bucket": "shared", prefetchKey: prefetchFull}
+
+	if err := resolveVolume("shared/pvc-a", meta, volumeContext, true); err != nil {
+		t.Fatalf("expected node tunables not to conflict: %v", err)
+	}
+
+	// an edited PV
+	volumeContext["mounter"] = "s3fs"
+	if err := resolveVolume("shared/pvc-a", meta, volumeContext, false); err != nil {
+		t.Fatalf("expected conflicts to be tolerated: %v", err)
+	}
+	if meta.Mounter != "rclone" {
+		t.Fatalf("expected the metadata to win, got mounter %s", meta.Mounter)
+	}
+	if err := resolveVolume("shared/pvc-a", meta, volumeContext, true); err == nil {
+		t.Fatal("expected a conflicting mounter to be refused")
+	}
+
+	volumeContext["mounter"] = "rclone"
+	meta.Prefix = "pvc-b"
+	if err := resolveVolume("shared/pvc-a", meta, volumeContext, true); err == nil {
+		t.Fatal("expected metadata of another prefix to be refused")
+	}
+
+	// reference volumes have no stored metadata to conflict with
+	ref := referenceMeta("ref:shared/pvc-c", map[string]string{"mounter": "rclone", "prefix": "data"})
+	if err := resolveVolume("ref:shared/pvc-c", ref, map[string]string{"mounter": "rclone", "prefix": "data"}, true); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// urlEncoded matches a percent-encoded byte, which is never decoded in a
+// volume ID, so %2F would end up literally in the keys of the volume
+var urlEncoded = regexp.MustCompile(`%[0-9a-fA-F]{2}`)
+
+// parseVolumeID validates a volume ID of a request and splits it into the
+// bucket and the prefix of the volume. Repeated slashes are collapsed, IDs
+// with control characters, URL-encoded characters, an invalid bucket name
+// or path traversal in the prefix are rejected with InvalidArgument. The
+// bucket of a reference volume is the one it refers to.
+func parseVolumeID(volumeID string) (string, string, error) {
+	if volumeID == "" {
+		return "", "", status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	for _, r := range volumeID {
+		if unicode.IsControl(r) {
+			return "", "", status.Errorf(codes.InvalidArgument, "volume ID %q contains a control character", volumeID)
+		}
+	}
+	if urlEncoded.MatchString(volumeID) {
+		return "", "", status.Errorf(codes.InvalidArgument, "volume ID %q contains URL-encoded characters", volumeID)
+	}
+	split := strings.SplitN(strings.TrimPrefix(volumeID, referenceVolumePrefix), "/", 2)
+	if err := s3utils.CheckValidBucketName(split[0]); err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "volume ID %q does not start with a valid bucket name: %v", volumeID, err)
+	}
+	if len(split) == 1 {
+		return split[0], "", nil
+	}
+	var segments []string
+	for _, segment := range strings.Split(split[1], "/") {
+		switch segment {
+		case "":
+		case ".", "..":
+			return "", "", status.Errorf(codes.InvalidArgument, "volume ID %q contains a relative path element", volumeID)
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	return split[0], strings.Join(segments, "/"), nil
+}
+
+// checkLegacyVolumeID returns a FailedPrecondition error instead of err if
+// the metadata of a volume with a nested prefix is missing, but the first
+// segment of the prefix has metadata. Before nested prefixes, everything
+// after the second slash of a volume ID was ignored, so a static PV with
+// the handle bucket/pvc-1/data meant the volume at pvc-1, which would now
+// be mounted empty at pvc-1/data. Other errors are returned unchanged.
+func checkLegacyVolumeID(client metaReader, volumeID, bucketName, prefix string, err error) error {
+	if !errors.Is(err, s3.ErrObjectNotFound) || !strings.Contains(prefix, "/") {
+		return err
+	}
+	legacy := strings.SplitN(prefix, "/", 2)[0]
+	if _, legacyErr := client.GetFSMeta(bucketName, legacy); legacyErr != nil {
+		return err
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume ID %s is ambiguous: it has no metadata at prefix %s, but older versions of the driver used the volume at %s, set the volumeHandle to %s/%s to keep using it",
+		volumeID, prefix, legacy, bucketName, legacy)
+}
@@ -0,0 +1,150 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseVolumeID(t *testing.T) {
+	for volumeID, expected := range map[string][2]string{
+		"pvc-1":                   {"pvc-1", ""},
+		"bucket/pvc-1":            {"bucket", "pvc-1"},
+		"bucket//pvc-1/":          {"bucket", "pvc-1"},
+		"bucket/team///pvc-1":     {"bucket", "team/pvc-1"},
+		"bucket/":                 {"bucket", ""},
+		"bucket/some prefix":      {"bucket", "some prefix"},
+		"bucket/100%":             {"bucket", "100%"},
+		"ref:bucket/pvc-1":        {"bucket", "pvc-1"},
+		"my.bucket/pvc-1...":      {"my.bucket", "pvc-1..."},
+		"Legacy_Bucket/pvc-1":     {"Legacy_Bucket", "pvc-1"},
+		"bucket/..hidden/pvc-1..": {"bucket", "..hidden/pvc-1.."},
+	} {
+		bucketName, prefix, err := parseVolumeID(volumeID)
+		if err != nil || bucketName != expected[0] || prefix != expected[1] {
+			t.Errorf("%q: expected %v, got %q, %q, %v", volumeID, expected, bucketName, prefix, err)
+			continue
+		}
+		// the canonical ID parses to the same volume
+		canonical := bucketName
+		if prefix != "" {
+			canonical += "/" + prefix
+		}
+		if b, p, err := parseVolumeID(canonical); err != nil || b != bucketName || p != prefix {
+			t.Errorf("%q: expected the canonical ID %q to round-trip, got %q, %q, %v", volumeID, canonical, b, p, err)
+		}
+		if b, p := volumeIDToBucketPrefix(canonical); b != bucketName || p != prefix {
+			t.Errorf("%q: expected the canonical ID %q to split into %v, got %q, %q", volumeID, canonical, expected, b, p)
+		}
+	}
+	for _, volumeID := range []string{
+		"",
+		"/pvc-1",
+		"//bucket/pvc-1",
+		"bucket%2Fpvc-1",
+		"bucket/pvc%2f1",
+		"bucket/pvc%201",
+		"my bucket/pvc-1",
+		" bucket/pvc-1",
+		"bucket/pvc-1\n",
+		"bucket/pvc\x00-1",
+		"bucket/\x1b[2Jpvc-1",
+		"bucket/../other/pvc-1",
+		"bucket/pvc-1/..",
+		"bucket/./pvc-1",
+		"bucket\\pvc-1",
+		"b",
+		"ref:",
+		"ref:/pvc-1",
+		"127.0.0.1/pvc-1",
+	} {
+		if _, _, err := parseVolumeID(volumeID); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%q: expected InvalidArgument, got %v", volumeID, err)
+		}
+	}
+}
+
+func TestMalformedVolumeIDs(t *testing.T) {
+	cs := newTestControllerServer()
+	ns := &nodeServer{}
+	volumeID := "bucket/../pvc-1"
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	for name, rpc := range map[string]func() error{
+		"DeleteVolume": func() error {
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			return err
+		},
+		"ValidateVolumeCapabilities": func() error {
+			_, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{capability},
+			})
+			return err
+		},
+		"ControllerExpandVolume": func() error {
+			_, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{VolumeId: volumeID})
+			return err
+		},
+		"ControllerPublishVolume": func() error {
+			_, err := cs.ControllerPublishVolume(context.Background(), publishRequest(volumeID, "node-a", nil))
+			return err
+		},
+		"NodeStageVolume": func() error {
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: t.TempDir(),
+				VolumeCapability:  capability,
+			})
+			return err
+		},
+		"NodePublishVolume": func() error {
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: t.TempDir(),
+				TargetPath:        t.TempDir(),
+				VolumeCapability:  capability,
+			})
+			return err
+		},
+	} {
+		if status.Code(rpc()) != codes.InvalidArgument {
+			t.Errorf("%s: expected a malformed volume ID to be rejected", name)
+		}
+	}
+}
+
+func TestCheckLegacyVolumeID(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("shared")
+	client, err := s3.NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFSMeta(&s3.FSMeta{BucketName: "shared", Prefix: "pvc-1", FSPath: "csi-fs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// older versions mapped the handle to the volume at pvc-1
+	err = checkLegacyVolumeID(client, "shared/pvc-1/data", "shared", "pvc-1/data", s3.ErrObjectNotFound)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the ambiguous volume ID to fail with FailedPrecondition, got %v", err)
+	}
+	for _, prefix := range []string{"pvc-2/data", "pvc-2"} {
+		if err := checkLegacyVolumeID(client, "shared/"+prefix, "shared", prefix, s3.ErrObjectNotFound); !errors.Is(err, s3.ErrObjectNotFound) {
+			t.Errorf("%s: expected the missing metadata to be returned, got %v", prefix, err)
+		}
+	}
+	if err := checkLegacyVolumeID(client, "shared/pvc-1/data", "shared", "pvc-1/data", nil); err != nil {
+		t.Errorf("expected found metadata not to be checked, got %v", err)
+	}
+}
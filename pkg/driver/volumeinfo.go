@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// exposeVolumeInfoKey makes the node server write a file at the root of the
+// volume describing what backs it, for debugging from within the pod
+const exposeVolumeInfoKey = "exposeVolumeInfo"
+
+// volumeInfo is the content of the volume info file. It must never contain
+// credentials, every user of the volume can read it.
+type volumeInfo struct {
+	VolumeID      string `json:"volumeID"`
+	Bucket        string `json:"bucket"`
+	Prefix        string `json:"prefix"`
+	Mounter       string `json:"mounter"`
+	EndpointHost  string `json:"endpointHost"`
+	DriverVersion string `json:"driverVersion"`
+}
+
+// writeVolumeInfo replaces the volume info file of the mount at targetPath
+func writeVolumeInfo(targetPath, volumeID string, meta *s3.FSMeta, mounterType, endpoint string) error {
+	info := volumeInfo{
+		VolumeID:      volumeID,
+		Bucket:        meta.BucketName,
+		Prefix:        meta.Prefix,
+		Mounter:       mounterType,
+		DriverVersion: vendorVersion,
+	}
+	// only the host, the URL could carry user info
+	if u, err := url.Parse(endpoint); err == nil {
+		info.EndpointHost = u.Host
+	}
+	b, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(targetPath, s3.VolumeInfoName)
+	// the file is read-only, it is replaced instead of overwritten
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(file, append(b, '\n'), 0444)
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+const (
+	// serviceAccountTokensKey is set by kubelet if the CSIDriver requests tokens
+	serviceAccountTokensKey = "csi.storage.k8s.io/serviceAccount.tokens"
+	// roleArnKey enables authentication with the service account token of the pod
+	roleArnKey       = "roleArn"
+	stsEndpointKey   = "stsEndpoint"
+	tokenAudienceKey = "tokenAudience"
+	tokenFileName    = "csi-s3-token"
+)
+
+type serviceAccountToken struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+func usesWebIdentity(volumeContext map[string]string) bool {
+	return volumeContext[roleArnKey] != ""
+}
+
+// tokenFile is next to the target path, in the directory kubelet keeps
+// for the volume of the pod.
+func tokenFile(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), tokenFileName)
+}
+
+// webIdentity writes the service account token of the pod to the token
+// file of the volume. It is called on every NodePublishVolume, so the
+// token of a long-lived mount is refreshed when kubelet republishes it.
+// It returns nil if the volume does not use web identity.
+func webIdentity(targetPath string, volumeContext map[string]string) (*s3.WebIdentity, error) {
+	if !usesWebIdentity(volumeContext) {
+		return nil, nil
+	}
+	raw, ok := volumeContext[serviceAccountTokensKey]
+	if !ok {
+		return nil, fmt.Errorf("%s is set but no service account token was passed, the CSIDriver has to request tokenRequests", roleArnKey)
+	}
+	var tokens map[string]serviceAccountToken
+	if err := json.Unmarshal([]byte(raw), &tokens); err != nil {
+		return nil, fmt.Errorf("invalid service account tokens: %v", err)
+	}
+	token, err := selectToken(tokens, volumeContext[tokenAudienceKey])
+	if err != nil {
+		return nil, err
+	}
+
+	file := tokenFile(targetPath)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(token), 0600); err != nil {
+		return nil, err
+	}
+	// replace the token atomically, the mounter might read it at any time
+	if err := os.Rename(tmp, file); err != nil {
+		return nil, err
+	}
+	return &s3.WebIdentity{
+		RoleArn:     volumeContext[roleArnKey],
+		TokenFile:   file,
+		STSEndpoint: volumeContext[stsEndpointKey],
+	}, nil
+}
+
+// selectToken returns the token of the audience, the audience may be left
+// out if there is only a single token.
+func selectToken(tokens map[string]serviceAccountToken, audience string) (string, error) {
+	if audience == "" && len(tokens) == 1 {
+		for _, t := range tokens {
+			return t.Token, nil
+		}
+	}
+	t, ok := tokens[audience]
+	if !ok || t.Token == "" {
+		return "", fmt.Errorf("no service account token for audience %q, set %s", audience, tokenAudienceKey)
+	}
+	return t.Token, nil
+}
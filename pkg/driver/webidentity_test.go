@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebIdentityWritesToken(t *testing.T) {
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	volumeContext := map[string]string{
+		roleArnKey:              "arn:aws:iam::123456789012:role/app",
+		serviceAccountTokensKey: `{"sts.amazonaws.com":{"token":"first","expirationTimestamp":"2026-10-14T12:00:00Z"}}`,
+	}
+	identity, err := webIdentity(targetPath, volumeContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.RoleArn != volumeContext[roleArnKey] || identity.TokenFile != tokenFile(targetPath) {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	// republishing refreshes the token
+	volumeContext[serviceAccountTokensKey] = `{"sts.amazonaws.com":{"token":"second"}}`
+	if _, err := webIdentity(targetPath, volumeContext); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(identity.TokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "second" {
+		t.Fatalf("expected token to be refreshed, got %q", b)
+	}
+}
+
+func TestWebIdentityTokenSelection(t *testing.T) {
+	tests := []struct {
+		tokens   string
+		audience string
+		invalid  bool
+	}{
+		{tokens: `{"sts.amazonaws.com":{"token":"t"}}`},
+		{tokens: `{"a":{"token":"t"},"b":{"token":"t"}}`, audience: "b"},
+		{tokens: `{"a":{"token":"t"},"b":{"token":"t"}}`, invalid: true},
+		{tokens: `{"a":{"token":"t"}}`, audience: "b", invalid: true},
+		{tokens: `not json`, invalid: true},
+		{invalid: true},
+	}
+	for _, test := range tests {
+		volumeContext := map[string]string{roleArnKey: "arn:aws:iam::123456789012:role/app", tokenAudienceKey: test.audience}
+		if test.tokens != "" {
+			volumeContext[serviceAccountTokensKey] = test.tokens
+		}
+		_, err := webIdentity(filepath.Join(t.TempDir(), "mount"), volumeContext)
+		if test.invalid != (err != nil) {
+			t.Errorf("tokens %s, audience %q: unexpected result %v", test.tokens, test.audience, err)
+		}
+	}
+
+	if identity, err := webIdentity("/nonexistent/mount", map[string]string{}); identity != nil || err != nil {
+		t.Errorf("expected volumes without role to not use web identity, got %v, %v", identity, err)
+	}
+}
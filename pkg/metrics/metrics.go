@@ -0,0 +1,109 @@
+// Package metrics serves metrics of the driver in the Prometheus text
+// exposition format. Metrics are collected when they are scraped, by the
+// collect functions of the registered families.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Type is the Prometheus type of a metric family
+type Type string
+
+const (
+	// Gauge is a value which can go up and down
+	Gauge Type = "gauge"
+	// Counter is a value which only increases
+	Counter Type = "counter"
+)
+
+// Sample is a value of a family with its labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     Type
+	collect func() []Sample
+}
+
+var (
+	mu       sync.Mutex
+	families = map[string]*family{}
+)
+
+// Register adds a metric family, collect returns its samples on every
+// scrape. Registering a name again replaces the family.
+func Register(name, help string, typ Type, collect func() []Sample) {
+	mu.Lock()
+	defer mu.Unlock()
+	families[name] = &family{name: name, help: help, typ: typ, collect: collect}
+}
+
+// Serve serves the metrics at /metrics of addr in the background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		glog.Infof("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("Failed to serve metrics: %v", err)
+		}
+	}()
+}
+
+// Handler writes all registered families
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+// Write writes all registered families sorted by name
+func Write(w io.Writer) {
+	mu.Lock()
+	var fs []*family
+	for _, f := range families {
+		fs = append(fs, f)
+	}
+	mu.Unlock()
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+
+	for _, f := range fs {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.collect() {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels(s.Labels), strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(l map[string]string) string {
+	if len(l) == 0 {
+		return ""
+	}
+	var keys []string
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, labelEscaper.Replace(l[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
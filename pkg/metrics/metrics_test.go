@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	Register("csi_s3_test_bytes", "Bytes of the test.", Gauge, func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"volume_id": "b", "node": `a"1`}, Value: 1.5},
+			{Value: 2},
+		}
+	})
+	Register("csi_s3_test_a_total", "Total of the test.", Counter, func() []Sample { return nil })
+
+	var buf bytes.Buffer
+	Write(&buf)
+	expected := `# HELP csi_s3_test_a_total Total of the test.
+# TYPE csi_s3_test_a_total counter
+# HELP csi_s3_test_bytes Bytes of the test.
+# TYPE csi_s3_test_bytes gauge
+csi_s3_test_bytes{node="a\"1",volume_id="b"} 1.5
+csi_s3_test_bytes 2
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
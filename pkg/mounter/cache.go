@@ -0,0 +1,130 @@
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	cacheDirName = "csi-s3-cache"
+	// smallFileMaxSize is the largest object considered small
+	smallFileMaxSize = "1M"
+)
+
+// cacheDir is next to the target path, in the directory kubelet keeps for
+// the volume of the pod. It is visible on the host, so mounters running as
+// systemd units can use it as well.
+func cacheDir(target string) string {
+	return filepath.Join(filepath.Dir(origin(target)), cacheDirName)
+}
+
+// mountSmallFileCache mounts a tmpfs of sizeMB for the cache of the volume
+// mounted at target. The tmpfs bounds the memory used by the cache. The
+// cache of an earlier mount which has not been removed is reused.
+func mountSmallFileCache(target string, sizeMB int) (string, error) {
+	dir := cacheDir(target)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(dir)
+	if err != nil {
+		return "", err
+	}
+	if !notMnt {
+		return dir, nil
+	}
+	opts := []string{fmt.Sprintf("size=%dm", sizeMB), "mode=0700"}
+	if err := mount.New("").Mount("tmpfs", dir, "tmpfs", opts); err != nil {
+		return "", fmt.Errorf("failed to mount cache of %s: %v", target, err)
+	}
+	return dir, nil
+}
+
+// removeCacheDir removes the cache of target, if any. A cache on disk
+// which still holds data that has not been uploaded is kept, so the data
+// can be recovered by hand. A tmpfs is always released.
+func removeCacheDir(target string) {
+	dir := cacheDir(target)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	dirty, _, err := dirtyCacheEntries(dir)
+	if err != nil {
+		glog.Warningf("Failed to check cache of %s for pending uploads: %v", target, err)
+	}
+	if notMnt, err := mount.New("").IsLikelyNotMountPoint(dir); err == nil && !notMnt {
+		if err := mount.New("").Unmount(dir); err != nil {
+			glog.Warningf("Failed to unmount cache of %s: %v", target, err)
+			return
+		}
+	} else if dirty > 0 {
+		glog.Warningf("Keeping cache %s of %s, it holds %d files which have not been uploaded", dir, target, dirty)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		glog.Warningf("Failed to remove cache of %s: %v", target, err)
+	}
+}
+
+// RemoveStaleCache removes the cache of a volume which is no longer
+// mounted at target, e.g. because its mounter crashed. Like on unmount,
+// a cache holding data which has not been uploaded is kept.
+func RemoveStaleCache(target string) {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(target)
+	if os.IsNotExist(err) {
+		notMnt, err = true, nil
+	}
+	// the mount has been parked and still uses its cache
+	if err != nil || !notMnt || parkedOrigin(target) {
+		return
+	}
+	removeCacheDir(target)
+}
+
+// dirtyCacheEntries counts the files in the rclone cache dir which have
+// been written but not yet uploaded, and their size. rclone keeps the
+// state of every cached file as JSON in its vfsMeta directory.
+func dirtyCacheEntries(dir string) (int, int64, error) {
+	dirty := 0
+	var size int64
+	err := filepath.Walk(filepath.Join(dir, "vfsMeta"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// uploaded and evicted meanwhile
+				return nil
+			}
+			return err
+		}
+		var item struct {
+			Size  int64
+			Dirty bool
+		}
+		if err := json.Unmarshal(b, &item); err != nil {
+			// rclone might be rewriting the file
+			glog.V(4).Infof("Unable to decode cache state %s: %v", path, err)
+			return nil
+		}
+		if item.Dirty {
+			dirty++
+			size += item.Size
+		}
+		return nil
+	})
+	return dirty, size, err
+}
@@ -0,0 +1,122 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// credentialEnvPrefixes are the variables configuring the credentials or
+// the configuration files of the mounters, the credentials of a volume
+// always come from its secret
+var credentialEnvPrefixes = []string{
+	"AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_SECURITY_TOKEN",
+	"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_", "AWS_PROFILE", "AWS_DEFAULT_PROFILE",
+	"AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE", "AWS_CREDENTIAL_FILE", "AWS_CONTAINER_",
+	"AWSACCESSKEYID", "AWSSECRETACCESSKEY", "AWSSESSIONTOKEN",
+	"RCLONE_CONFIG", "RCLONE_S3_ACCESS_KEY_ID", "RCLONE_S3_SECRET_ACCESS_KEY", "RCLONE_S3_SESSION_TOKEN",
+	"RCLONE_S3_ENV_AUTH", "RCLONE_CRYPT_", "RCLONE_RC_",
+}
+
+// allowedEnvKeys are the variables the env of a volume may set besides the
+// ones starting with allowedEnvPrefix, matched regardless of case. Anything
+// else, e.g. LD_PRELOAD or PATH, could change what the mounter runs.
+var allowedEnvKeys = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "SSL_CERT_FILE", "SSL_CERT_DIR",
+	"GOGC", "GOMAXPROCS", "GOMEMLIMIT", "TZ",
+}
+
+// allowedEnvPrefix tunes rclone, whose options can all be set in its
+// environment
+const allowedEnvPrefix = "RCLONE_"
+
+func envKeyAllowed(key string) bool {
+	if strings.HasPrefix(key, allowedEnvPrefix) {
+		return true
+	}
+	for _, k := range allowedEnvKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEnv parses the env parameter of a volume, a comma separated list of
+// KEY=value. It returns an error for malformed keys, for variables which
+// configure credentials or are not allowed, and for mounters which do not
+// run in a process of their own.
+func ParseEnv(mounterType, value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	env := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || !envKeyPattern.MatchString(kv[0]) {
+			return nil, fmt.Errorf("invalid %s entry %q, must be KEY=value with a key of letters, digits and underscores", EnvKey, entry)
+		}
+		key := strings.ToUpper(kv[0])
+		for _, prefix := range credentialEnvPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return nil, fmt.Errorf("%s must not set %s, the credentials of the mounter are taken from the secret of the volume", EnvKey, kv[0])
+			}
+		}
+		if !envKeyAllowed(key) {
+			return nil, fmt.Errorf("%s must not set %s, only %s* and %s are allowed", EnvKey, kv[0], allowedEnvPrefix, strings.Join(allowedEnvKeys, ", "))
+		}
+		if _, ok := env[kv[0]]; ok {
+			return nil, fmt.Errorf("%s sets %s more than once", EnvKey, kv[0])
+		}
+		env[kv[0]] = kv[1]
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return nil, err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsEnv {
+		return nil, fmt.Errorf("mounter %s does not support %s", mounterType, EnvKey)
+	}
+	return env, nil
+}
+
+// commandEnv returns the environment of a mounter process, the one of the
+// driver with the env of the volume and the credentials of the mounter
+// added. The credentials are added last, so they win. Credentials set for
+// goofys in the environment of the driver are never passed on.
+func commandEnv(volumeEnv, credentials map[string]string) []string {
+	var environ []string
+	for _, kv := range os.Environ() {
+		if !isMountEnvKey(strings.SplitN(kv, "=", 2)[0]) {
+			environ = append(environ, kv)
+		}
+	}
+	for _, env := range []map[string]string{volumeEnv, credentials} {
+		var keys []string
+		for k := range env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			environ = append(environ, k+"="+env[k])
+		}
+	}
+	return environ
+}
+
+func isMountEnvKey(key string) bool {
+	for _, k := range mountEnvKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package mounter
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	for value, expected := range map[string]map[string]string{
+		"":                        nil,
+		"GOGC=50":                 {"GOGC": "50"},
+		" GOGC=50 , http_proxy= ": {"GOGC": "50", "http_proxy": ""},
+		"RCLONE_S3_CHUNK_SIZE=16M,RCLONE_BUFFER_SIZE=a=b": {"RCLONE_S3_CHUNK_SIZE": "16M", "RCLONE_BUFFER_SIZE": "a=b"},
+	} {
+		env, err := ParseEnv(rcloneMounterType, value)
+		if err != nil || !reflect.DeepEqual(env, expected) {
+			t.Errorf("%q: expected %v, got %v, %v", value, expected, env, err)
+		}
+	}
+	for _, value := range []string{
+		"GOGC", "=50", "1GOGC=50", "GO-GC=50", "GOGC=50,,", "GOGC=50,GOGC=100",
+		"AWS_ACCESS_KEY_ID=key", "aws_secret_access_key=secret", "AWS_PROFILE=other", "AWS_ROLE_ARN=arn",
+		"AWSACCESSKEYID=key", "RCLONE_CONFIG=/tmp/rclone.conf", "RCLONE_S3_SECRET_ACCESS_KEY=secret",
+		"RCLONE_CRYPT_PASSWORD=secret", "RCLONE_RC_PASS=secret",
+		"LD_PRELOAD=/tmp/hook.so", "LD_LIBRARY_PATH=/tmp", "PATH=/tmp", "HOME=/tmp",
+	} {
+		if _, err := ParseEnv(rcloneMounterType, value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+	// goofys shares the environment of the driver
+	if _, err := ParseEnv(goofysMounterType, "GOGC=50"); err == nil {
+		t.Error("expected env to be rejected for goofys")
+	}
+	if env, err := ParseEnv(goofysMounterType, ""); err != nil || env != nil {
+		t.Errorf("expected goofys to accept an empty env, got %v, %v", env, err)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	defer setMountEnv(nil)
+	// set for a goofys mount in the driver
+	setMountEnv(map[string]string{"AWS_ACCESS_KEY_ID": "goofys"})
+	env := commandEnv(map[string]string{"CSI_S3_TEST_TUNING": "1"}, map[string]string{"AWS_SECRET_ACCESS_KEY": "secret"})
+	for _, kv := range env {
+		if kv == "AWS_ACCESS_KEY_ID=goofys" {
+			t.Error("expected the credentials of goofys not to be passed on")
+		}
+	}
+	if n := len(env); n < 2 || env[n-2] != "CSI_S3_TEST_TUNING=1" || env[n-1] != "AWS_SECRET_ACCESS_KEY=secret" {
+		t.Errorf("expected the env of the volume and the credentials to be added, got %v", env)
+	}
+	if _, ok := os.LookupEnv("CSI_S3_TEST_TUNING"); ok {
+		t.Error("expected the env of the volume not to be set in the driver")
+	}
+}
@@ -0,0 +1,111 @@
+package mounter
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrMountPermissionDenied is returned if the mounter was refused access
+	// to the bucket, e.g. because of invalid credentials
+	ErrMountPermissionDenied = errors.New("permission denied")
+	// ErrMountNotFound is returned if the bucket or prefix of the volume
+	// does not exist
+	ErrMountNotFound = errors.New("bucket or prefix not found")
+	// ErrMountPrecondition is returned if the mounter cannot run on the
+	// node, e.g. because its binary or the fuse device is missing
+	ErrMountPrecondition = errors.New("mounter cannot run on the node")
+	// ErrMountUnavailable is returned if the endpoint could not be reached
+	ErrMountUnavailable = errors.New("endpoint unavailable")
+)
+
+// mountFailure keeps the error of a failed mount while matching the kind
+// of failure with errors.Is
+type mountFailure struct {
+	kind error
+	err  error
+}
+
+func (e *mountFailure) Error() string {
+	return e.err.Error()
+}
+
+func (e *mountFailure) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *mountFailure) Unwrap() error {
+	return e.err
+}
+
+// failurePattern maps the output or the exit code of a failed mounter to
+// the kind of failure. The first matching pattern wins, the failures of
+// the mounter are matched before the common ones.
+type failurePattern struct {
+	kind error
+	// output are substrings of the output, matched ignoring case
+	output []string
+	// exitCodes are the exit codes of the mounter command
+	exitCodes []int
+}
+
+// commonFailures are reported alike by every mounter, they are matched
+// after the failures of the mounter
+var commonFailures = []failurePattern{
+	{kind: ErrMountPrecondition, output: []string{
+		"fuse: device not found",
+		"fuse device not found",
+		"/dev/fuse",
+		"executable file not found",
+	}},
+	{kind: ErrMountPermissionDenied, output: []string{
+		"AccessDenied",
+		"InvalidAccessKeyId",
+		"SignatureDoesNotMatch",
+		"403 Forbidden",
+	}},
+	{kind: ErrMountNotFound, output: []string{
+		"NoSuchBucket",
+	}},
+	{kind: ErrMountUnavailable, output: []string{
+		"no such host",
+		"connection refused",
+		"i/o timeout",
+		"network is unreachable",
+		"connection timed out",
+		"no route to host",
+	}},
+}
+
+// classifyFailure wraps err of a failed mount with the kind of failure
+// the output or the exit code of the mounter indicate. runErr is the error
+// of running the command, if any. Unknown failures are returned unchanged.
+func classifyFailure(mounterType string, out []byte, runErr error, err error) error {
+	if errors.Is(runErr, exec.ErrNotFound) {
+		return &mountFailure{kind: ErrMountPrecondition, err: err}
+	}
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	output := strings.ToLower(string(out))
+	patterns := append(append([]failurePattern{}, registry[mounterType].failures...), commonFailures...)
+	// the output tells more than the exit code
+	for _, p := range patterns {
+		for _, o := range p.output {
+			if strings.Contains(output, strings.ToLower(o)) {
+				return &mountFailure{kind: p.kind, err: err}
+			}
+		}
+	}
+	for _, p := range patterns {
+		for _, c := range p.exitCodes {
+			if c == exitCode {
+				return &mountFailure{kind: p.kind, err: err}
+			}
+		}
+	}
+	return err
+}
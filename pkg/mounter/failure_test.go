@@ -0,0 +1,77 @@
+package mounter
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		mounter string
+		output  string
+		kind    error
+	}{
+		{rcloneMounterType, `2021/03/01 10:00:00 Fatal error: failed to mount FUSE fs: fusermount: exec: "fusermount": executable file not found in $PATH`, ErrMountPrecondition},
+		{rcloneMounterType, `2021/03/01 10:00:00 mount helper error: fusermount: fuse device not found, try 'modprobe fuse' first`, ErrMountPrecondition},
+		{rcloneMounterType, `2021/03/01 10:00:00 Failed to create file system for "s3:bucket/pvc-1": AccessDenied: Access Denied
+	status code: 403, request id: 1668A2B7C2F2C1A5, host id: `, ErrMountPermissionDenied},
+		{rcloneMounterType, `2021/03/01 10:00:00 Fatal error: directory not found`, ErrMountNotFound},
+		{rcloneMounterType, `2021/03/01 10:00:00 Failed to create file system for "s3:bucket": RequestError: send request failed
+caused by: Get "https://minio.example.com/bucket?delimiter=%2F&max-keys=1000&prefix=": dial tcp: lookup minio.example.com on 10.96.0.10:53: no such host`, ErrMountUnavailable},
+		{s3fsMounterType, `s3fs: invalid credentials(host=https://minio.example.com) - result of checking service.`, ErrMountPermissionDenied},
+		{s3fsMounterType, `s3fs: bucket not found(host=https://minio.example.com) - result of checking service.`, ErrMountNotFound},
+		{s3fsMounterType, `s3fs: unable to connect(host=https://minio.example.com) - result of checking service.`, ErrMountUnavailable},
+		{s3fsMounterType, `fuse: device not found, try 'modprobe fuse' first`, ErrMountPrecondition},
+		{goofysMounterType, `Unable to access 'bucket': bucket bucket does not exist`, ErrMountNotFound},
+		{goofysMounterType, `Unable to access 'bucket': InvalidAccessKeyId: The Access Key Id you provided does not exist in our records.
+	status code: 403, request id: 1668A2B7C2F2C1A5`, ErrMountPermissionDenied},
+		{goofysMounterType, `Unable to access 'bucket': RequestError: send request failed
+caused by: Head "http://10.0.0.1:9000/bucket": dial tcp 10.0.0.1:9000: connect: connection refused`, ErrMountUnavailable},
+		{s3backerMounterType, `s3backer: auto-detecting block size and total file size...
+s3backer: HEAD https://minio.example.com/bucket/pvc-1/csi-fs/00000000: rec'd 403 response: Forbidden`, ErrMountPermissionDenied},
+		{s3backerMounterType, `s3backer: listing non-zero blocks...
+s3backer: operation failed: Couldn't resolve host name (will retry)`, ErrMountUnavailable},
+		{s3backerMounterType, `s3backer: listing non-zero blocks...
+s3backer: GET https://minio.example.com/bucket?prefix=pvc-1%2Fcsi-fs%2F: rec'd 404 response: Not Found`, ErrMountNotFound},
+		{s3fsMounterType, `s3fs: MOUNTPOINT directory /var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount is not empty.`, nil},
+	}
+	cause := errors.New("mount failed")
+	for _, test := range tests {
+		err := classifyFailure(test.mounter, []byte(test.output), nil, cause)
+		if test.kind == nil {
+			if err != cause {
+				t.Errorf("%s: expected %q to stay unclassified, got %v", test.mounter, test.output, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%s: expected %q to be classified as %v", test.mounter, test.output, test.kind)
+		}
+		if err.Error() != cause.Error() {
+			t.Errorf("expected the original error to be kept, got %v", err)
+		}
+	}
+}
+
+func TestClassifyFailureOfCommand(t *testing.T) {
+	cause := errors.New("mount failed")
+	_, runErr := exec.Command("csi-s3-missing-mounter").CombinedOutput()
+	if err := classifyFailure(rcloneMounterType, nil, runErr, cause); !errors.Is(err, ErrMountPrecondition) {
+		t.Errorf("expected a missing binary to be a precondition failure, got %v", err)
+	}
+
+	// a temporary error of rclone
+	_, runErr = exec.Command("sh", "-c", "exit 5").CombinedOutput()
+	if err := classifyFailure(rcloneMounterType, nil, runErr, cause); !errors.Is(err, ErrMountUnavailable) {
+		t.Errorf("expected exit code 5 of rclone to be a temporary failure, got %v", err)
+	}
+	if err := classifyFailure(s3fsMounterType, nil, runErr, cause); err != cause {
+		t.Errorf("expected exit code 5 of s3fs to stay unclassified, got %v", err)
+	}
+	// the output takes precedence over the exit code
+	out := []byte("AccessDenied: Access Denied")
+	if err := classifyFailure(rcloneMounterType, out, runErr, cause); !errors.Is(err, ErrMountPermissionDenied) {
+		t.Errorf("expected the output to decide, got %v", err)
+	}
+}
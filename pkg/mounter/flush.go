@@ -0,0 +1,89 @@
+package mounter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrFlushTimeout is returned by Flush if the mounter still holds written
+// data which has not been uploaded
+var ErrFlushTimeout = errors.New("timeout waiting for pending uploads")
+
+const flushPollInterval = time.Second
+
+// Flush writes the data buffered for the mount at target to the object
+// store, before it is unmounted. It syncs the filesystem, so the kernel
+// and mounters uploading on fsync, like s3fs and goofys, have written all
+// data. For rclone it then waits until its VFS cache holds no files which
+// have not been uploaded yet. The upload queue is queried through the
+// remote control endpoint of the mount if it has one. Flush returns
+// ErrFlushTimeout once timeout has passed, also if the sync still hangs.
+func Flush(target string, timeout time.Duration) error {
+	return flush(target, timeout, syncfs)
+}
+
+// flush implements Flush, syncing the filesystem with sync
+func flush(target string, timeout time.Duration, sync func(string) error) error {
+	deadline := time.Now().Add(timeout)
+	if err := syncWithin(target, timeout, sync); err != nil {
+		return err
+	}
+	rc, err := readRCState(target)
+	if err != nil {
+		return err
+	}
+	dir := cacheDir(target)
+	for {
+		var dirty int
+		if rc != nil {
+			queued, inProgress, err := rc.vfsStats()
+			if err != nil {
+				return err
+			}
+			dirty = queued + inProgress
+		} else if dirty, _, err = dirtyCacheEntries(dir); err != nil {
+			return err
+		}
+		if dirty == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %d files of %s", ErrFlushTimeout, dirty, target)
+		}
+		time.Sleep(flushPollInterval)
+	}
+}
+
+// syncWithin syncs the filesystem at target with sync, at most for timeout. A mounter
+// which uploads on fsync blocks the sync until the upload is done, or
+// forever if the object store can't be reached. The sync is then left
+// behind, it returns once the filesystem is unmounted.
+func syncWithin(target string, timeout time.Duration, sync func(string) error) error {
+	done := make(chan error, 1)
+	go func() { done <- sync(target) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %v", target, err)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: sync of %s did not finish", ErrFlushTimeout, target)
+	}
+}
+
+// syncfs syncs the filesystem containing target
+func syncfs(target string) error {
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
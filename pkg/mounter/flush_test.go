@@ -0,0 +1,68 @@
+package mounter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCacheState(t *testing.T, target, name, state string) string {
+	path := filepath.Join(cacheDir(target), "vfsMeta", "s3", "bucket", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFlush(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "mount")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flush(target, time.Second); err != nil {
+		t.Fatalf("expected flush without cache to succeed, got %v", err)
+	}
+
+	writeCacheState(t, target, "clean", `{"Size":3,"Dirty":false}`)
+	dirty := writeCacheState(t, target, "dirty", `{"Size":3,"Dirty":true}`)
+	if err := Flush(target, 0); !errors.Is(err, ErrFlushTimeout) {
+		t.Fatalf("expected ErrFlushTimeout, got %v", err)
+	}
+
+	// the upload finishes while flushing
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ioutil.WriteFile(dirty, []byte(`{"Size":3,"Dirty":false}`), 0600)
+	}()
+	if err := Flush(target, 5*time.Second); err != nil {
+		t.Fatalf("expected flush to wait for the upload, got %v", err)
+	}
+
+	// a sync hanging on an unreachable object store is abandoned
+	hang := make(chan struct{})
+	defer close(hang)
+	sync := func(string) error {
+		<-hang
+		return nil
+	}
+	if err := flush(target, 100*time.Millisecond, sync); !errors.Is(err, ErrFlushTimeout) {
+		t.Fatalf("expected a hanging sync to time out, got %v", err)
+	}
+
+	writeCacheState(t, target, "dirty", `{"Size":3,"Dirty":true}`)
+	removeCacheDir(target)
+	if _, err := os.Stat(dirty); err != nil {
+		t.Fatalf("expected cache with pending uploads to be kept, got %v", err)
+	}
+	writeCacheState(t, target, "dirty", `{"Size":3,"Dirty":false}`)
+	removeCacheDir(target)
+	if _, err := os.Stat(cacheDir(target)); !os.IsNotExist(err) {
+		t.Fatalf("expected cache to be removed, got %v", err)
+	}
+}
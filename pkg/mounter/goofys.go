@@ -2,8 +2,7 @@ package mounter
 
 import (
 	"fmt"
-	"os"
-	"path"
+	"sync"
 
 	"context"
 
@@ -16,27 +15,34 @@ const (
 	defaultRegion = "us-east-1"
 )
 
+// goofysFailures classify the errors of the AWS SDK returned by goofys
+// when it checks the bucket before mounting
+var goofysFailures = []failurePattern{
+	// the message of an invalid access key claims it does not exist
+	{kind: ErrMountPermissionDenied, output: []string{"status code: 403"}},
+	{kind: ErrMountNotFound, output: []string{"does not exist"}},
+	{kind: ErrMountUnavailable, output: []string{"send request failed"}},
+}
+
 // Implements Mounter
 type goofysMounter struct {
-	meta            *s3.FSMeta
-	endpoint        string
-	region          string
-	accessKeyID     string
-	secretAccessKey string
+	meta     *s3.FSMeta
+	endpoint string
+	region   string
+	env      map[string]string
 }
 
 func newGoofysMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
-	region := cfg.Region
+	region := cfg.SignatureRegion()
 	// if endpoint is set we need a default region
 	if region == "" && cfg.Endpoint != "" {
 		region = defaultRegion
 	}
 	return &goofysMounter{
-		meta:            meta,
-		endpoint:        cfg.Endpoint,
-		region:          region,
-		accessKeyID:     cfg.AccessKeyID,
-		secretAccessKey: cfg.SecretAccessKey,
+		meta:     meta,
+		endpoint: cfg.Endpoint,
+		region:   region,
+		env:      awsEnv(cfg),
 	}, nil
 }
 
@@ -48,6 +54,14 @@ func (goofys *goofysMounter) Unstage(stageTarget string) error {
 	return nil
 }
 
+func (goofys *goofysMounter) Capabilities() *Capabilities {
+	return capabilities(goofysMounterType)
+}
+
+// goofysMountMu serializes the mounts of goofys, which share the
+// environment and the default HTTP client of the driver
+var goofysMountMu sync.Mutex
+
 func (goofys *goofysMounter) Mount(source string, target string) error {
 	goofysCfg := &goofysApi.Config{
 		MountPoint: target,
@@ -60,14 +74,23 @@ func (goofys *goofysMounter) Mount(source string, target string) error {
 		},
 	}
 
-	os.Setenv("AWS_ACCESS_KEY_ID", goofys.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", goofys.secretAccessKey)
-	fullPath := fmt.Sprintf("%s:%s", goofys.meta.BucketName, path.Join(goofys.meta.Prefix, goofys.meta.FSPath))
+	// the credentials are read from the environment of the driver and the
+	// HTTP client is taken from the default client while the mount is set
+	// up
+	goofysMountMu.Lock()
+	defer goofysMountMu.Unlock()
+	setMountEnv(goofys.env)
+	defer useGoofysHTTPClient()()
+	fullPath := goofys.meta.BucketName
+	// goofys turns an empty prefix into "/"
+	if dataPrefix := goofys.meta.DataPrefix(); dataPrefix != "" {
+		fullPath = fmt.Sprintf("%s:%s", fullPath, dataPrefix)
+	}
 
 	_, _, err := goofysApi.Mount(context.Background(), fullPath, goofysCfg)
 
 	if err != nil {
-		return fmt.Errorf("Error mounting via goofys: %s", err)
+		return classifyFailure(goofysMounterType, []byte(err.Error()), nil, fmt.Errorf("Error mounting via goofys: %s", err))
 	}
 	return nil
 }
@@ -0,0 +1,75 @@
+package mounter
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+const (
+	// KMSKeyIDKey writes the objects of a volume with SSE-KMS and this key,
+	// the AWS managed key is used if only the other KMS options are set
+	KMSKeyIDKey = "kmsKeyId"
+	// KMSEncryptionContextKey is the encryption context of the objects, a
+	// JSON object of strings asserting the identity of the volume
+	KMSEncryptionContextKey = "kmsEncryptionContext"
+	// KMSBucketKeyKey encrypts the objects with the S3 Bucket Key
+	KMSBucketKeyKey = "kmsBucketKey"
+	// KMSContextRequiredKey refuses mounters which cannot write the
+	// objects with the encryption context
+	KMSContextRequiredKey = "kmsContextRequired"
+)
+
+// ParseKMSOptions returns the SSE-KMS options of a volume, nil if none of
+// them is set. It returns an error if a value is invalid or the context is
+// required and the mounter type cannot write it.
+func ParseKMSOptions(mounterType string, params map[string]string) (*s3.KMSOptions, error) {
+	keyID, context, bucketKey, required := params[KMSKeyIDKey], params[KMSEncryptionContextKey], params[KMSBucketKeyKey], params[KMSContextRequiredKey]
+	if keyID == "" && context == "" && bucketKey == "" && required == "" {
+		return nil, nil
+	}
+	o := &s3.KMSOptions{KeyID: keyID}
+	var err error
+	if o.Context, err = s3.ParseKMSContext(context); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", KMSEncryptionContextKey, err)
+	}
+	if bucketKey != "" {
+		if o.BucketKey, err = strconv.ParseBool(bucketKey); err != nil {
+			return nil, fmt.Errorf("invalid %s %s, must be true or false", KMSBucketKeyKey, bucketKey)
+		}
+	}
+	if required != "" {
+		if o.ContextRequired, err = strconv.ParseBool(required); err != nil {
+			return nil, fmt.Errorf("invalid %s %s, must be true or false", KMSContextRequiredKey, required)
+		}
+	}
+	if o.ContextRequired && o.Context == nil {
+		return nil, fmt.Errorf("%s requires %s", KMSContextRequiredKey, KMSEncryptionContextKey)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return nil, err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if o.ContextRequired && !c.SupportsKMSContext {
+		return nil, fmt.Errorf("mounter %s cannot write objects with the encryption context, but %s is set", mounterType, KMSContextRequiredKey)
+	}
+	return o, nil
+}
+
+// rcloneKMSArgs returns the flags of rclone writing the objects of a volume
+// with SSE-KMS. rclone has no flags for the encryption context or the
+// bucket key, the objects it uploads are written without them.
+func rcloneKMSArgs(o *s3.KMSOptions) []string {
+	if o == nil {
+		return nil
+	}
+	args := []string{"--s3-server-side-encryption=aws:kms"}
+	if o.KeyID != "" {
+		args = append(args, "--s3-sse-kms-key-id="+o.KeyID)
+	}
+	return args
+}
@@ -0,0 +1,54 @@
+package mounter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestParseKMSOptions(t *testing.T) {
+	for _, tc := range []struct {
+		mounterType string
+		params      map[string]string
+		expected    *s3.KMSOptions
+		valid       bool
+	}{
+		{rcloneMounterType, map[string]string{}, nil, true},
+		{rcloneMounterType, map[string]string{KMSKeyIDKey: "alias/volumes"}, &s3.KMSOptions{KeyID: "alias/volumes"}, true},
+		{s3fsMounterType, map[string]string{KMSEncryptionContextKey: `{"volume":"pvc-1"}`, KMSBucketKeyKey: "true"},
+			&s3.KMSOptions{Context: map[string]string{"volume": "pvc-1"}, BucketKey: true}, true},
+		{rcloneMounterType, map[string]string{KMSEncryptionContextKey: "volume=pvc-1"}, nil, false},
+		{rcloneMounterType, map[string]string{KMSBucketKeyKey: "yes"}, nil, false},
+		{rcloneMounterType, map[string]string{KMSContextRequiredKey: "true"}, nil, false},
+		// none of the mounters writes the context
+		{rcloneMounterType, map[string]string{KMSEncryptionContextKey: `{"volume":"pvc-1"}`, KMSContextRequiredKey: "true"}, nil, false},
+		{"unknown", map[string]string{KMSKeyIDKey: "alias/volumes"}, nil, false},
+	} {
+		o, err := ParseKMSOptions(tc.mounterType, tc.params)
+		if tc.valid != (err == nil) {
+			t.Errorf("%s %v: unexpected error %v", tc.mounterType, tc.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, tc.expected) {
+			t.Errorf("%s %v: expected %+v, got %+v", tc.mounterType, tc.params, tc.expected, o)
+		}
+	}
+}
+
+func TestRcloneKMSArgs(t *testing.T) {
+	for _, tc := range []struct {
+		options  *s3.KMSOptions
+		expected []string
+	}{
+		{nil, nil},
+		{&s3.KMSOptions{BucketKey: true}, []string{"--s3-server-side-encryption=aws:kms"}},
+		{&s3.KMSOptions{KeyID: "alias/volumes", Context: map[string]string{"volume": "pvc-1"}}, []string{
+			"--s3-server-side-encryption=aws:kms", "--s3-sse-kms-key-id=alias/volumes",
+		}},
+	} {
+		if args := rcloneKMSArgs(tc.options); !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("%+v: expected %v, got %v", tc.options, tc.expected, args)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package mounter
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -22,6 +21,8 @@ type Mounter interface {
 	Stage(stagePath string) error
 	Unstage(stagePath string) error
 	Mount(source string, target string) error
+	// Capabilities returns what the mounter is able to provide
+	Capabilities() *Capabilities
 }
 
 const (
@@ -31,52 +32,115 @@ const (
 	rcloneMounterType   = "rclone"
 	TypeKey             = "mounter"
 	BucketKey           = "bucket"
+	CacheModeKey        = "cacheMode"
+	// CacheModeNone disables caching of data and metadata by the mounter
+	CacheModeNone = "none"
+	// SmallFileCacheKey sets the size of the in-memory cache of a volume in MiB
+	SmallFileCacheKey = "smallFileCacheMB"
+	// CacheOnlyOnErrorKey serves reads from the cache of a volume while the
+	// endpoint cannot be reached
+	CacheOnlyOnErrorKey = "cacheOnlyOnError"
+	// MimeTypesFileKey is the path of a file on the nodes mapping file
+	// extensions to the Content-Type of uploaded objects
+	MimeTypesFileKey = "mimeTypesFile"
+	// ChecksumAlgorithmKey verifies the objects written and read by the
+	// driver with this checksum, and makes the mounter verify its uploads
+	ChecksumAlgorithmKey = "checksumAlgorithm"
+	// KeyEncodingKey makes the mounter escape the characters of file names
+	// which strict backends reject in keys
+	KeyEncodingKey = "keyEncoding"
+	// KeyEncodingEscape replaces these characters with their fullwidth
+	// Unicode equivalents, see rcloneEscapeEncoding
+	KeyEncodingEscape = "escape"
+	// ConsistencyKey set to ConsistencyStrict keeps the caches of attributes
+	// and directory listings of the mounter minimal, so files written on
+	// another node show up within a second
+	ConsistencyKey     = "consistency"
+	ConsistencyStrict  = "strict"
+	ConsistencyDefault = "default"
+	// PrefixesKey exposes several prefixes of the bucket of a volume as its
+	// directories, each mounted by its own mounter
+	PrefixesKey = "prefixes"
+	// EnvKey adds environment variables to the mounter process of a volume,
+	// a comma separated list of KEY=value
+	EnvKey = "env"
+	// RemotePathKey mounts a remote of the rclone config of the secret
+	// instead of the bucket of the volume, e.g. encrypted:data
+	RemotePathKey = "remotePath"
+	// S3backerMD5CheckKey makes s3backer reject stale versions of the blocks
+	// it has written recently, true by default for new s3backer volumes
+	S3backerMD5CheckKey = "s3backerMD5Check"
+	// S3backerRetryCountKey is how often s3backer retries a failed request
+	// before the read or write of a block fails with EIO
+	S3backerRetryCountKey = "s3backerRetryCount"
+	// S3backerTimeoutKey bounds each request of s3backer, e.g. 30s
+	S3backerTimeoutKey = "s3backerTimeout"
 )
 
 // New returns a new mounter depending on the mounterType parameter
 func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	mounterType := Type(meta, cfg)
+	if err := ValidateEndpoint(mounterType, cfg); err != nil {
+		return nil, err
+	}
+	// volumes provisioned before the backend was marked case-insensitive
+	// are still mounted
+	if err := ValidateKeyCaseSensitivity(mounterType, cfg); err != nil {
+		glog.Warningf("Mounting volume %s/%s: %v", meta.BucketName, meta.Prefix, err)
+	}
+	return registry[mounterType].new(meta, cfg)
+}
+
+// Type returns the type of the mounter New returns for meta and cfg
+func Type(meta *s3.FSMeta, cfg *s3.Config) string {
 	mounter := meta.Mounter
 	// Fall back to mounterType in cfg
 	if len(meta.Mounter) == 0 {
 		mounter = cfg.Mounter
 	}
-	switch mounter {
-	case s3fsMounterType:
-		return newS3fsMounter(meta, cfg)
-
-	case goofysMounterType:
-		return newGoofysMounter(meta, cfg)
-
-	case s3backerMounterType:
-		return newS3backerMounter(meta, cfg)
-
-	case rcloneMounterType:
-		return newRcloneMounter(meta, cfg)
-
-	default:
+	if _, ok := registry[mounter]; !ok {
 		// default to s3backer
-		return newS3backerMounter(meta, cfg)
+		return defaultMounterType
 	}
+	return mounter
 }
 
-func fuseMount(path string, command string, args []string) error {
+// fuseMount runs the mounter command with the env of the volume and its
+// credentials, which are only passed to this process
+func fuseMount(path string, command string, args []string, volumeEnv, credentials map[string]string) error {
 	cmd := exec.Command(command, args...)
+	cmd.Env = commandEnv(volumeEnv, credentials)
 	glog.V(3).Infof("Mounting fuse with command: %s and args: %s", command, args)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput: %s", command, args, out)
+		// the mounter types are named after their commands
+		return classifyFailure(command, out, err, fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput: %s", command, args, out))
 	}
 
-	return waitForMount(path, 10*time.Second)
+	return waitForMount(path, command, mountTimeout(command), daemonAlive(path, command, out))
 }
 
 func FuseUnmount(path string) error {
-	if err := mount.New("").Unmount(path); err != nil {
+	if unprivileged {
+		if err := fusermountUnmount(path); err != nil {
+			return err
+		}
+	} else if err := mount.New("").Unmount(path); err != nil {
+		return err
+	}
+	// a mount moved with Park or Unpark is known by its original target
+	target := origin(path)
+	forgetOrigin(path)
+	// the cache is released once the mounter is gone
+	defer removeCacheDir(target)
+	defer removeRcloneConfig(target)
+	defer removeObjectTagsConfig(target)
+	if managed, err := systemdUnmount(target); managed {
 		return err
 	}
 	// as fuse quits immediately, we will try to wait until the process is done
-	process, err := findFuseMountProcess(path)
+	process, err := findFuseMountProcess(target)
 	if err != nil {
 		glog.Errorf("Error getting PID of fuse mount: %s", err)
 		return nil
@@ -89,25 +153,6 @@ func FuseUnmount(path string) error {
 	return waitForProcess(process, 1)
 }
 
-func waitForMount(path string, timeout time.Duration) error {
-	var elapsed time.Duration
-	var interval = 10 * time.Millisecond
-	for {
-		notMount, err := mount.New("").IsNotMountPoint(path)
-		if err != nil {
-			return err
-		}
-		if !notMount {
-			return nil
-		}
-		time.Sleep(interval)
-		elapsed = elapsed + interval
-		if elapsed >= timeout {
-			return errors.New("Timeout waiting for mount")
-		}
-	}
-}
-
 func findFuseMountProcess(path string) (*os.Process, error) {
 	processes, err := ps.Processes()
 	if err != nil {
@@ -161,6 +206,17 @@ func getCmdLine(pid int) (string, error) {
 	return string(cmdLine), nil
 }
 
+// removeArg returns args without any occurrence of arg
+func removeArg(args []string, arg string) []string {
+	var filtered []string
+	for _, a := range args {
+		if a != arg {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
 func createLoopDevice(device string) error {
 	if _, err := os.Stat(device); !os.IsNotExist(err) {
 		return nil
@@ -177,3 +233,36 @@ func createLoopDevice(device string) error {
 	}
 	return nil
 }
+
+// awsEnv returns the environment which configures the credentials of
+// mounters based on an AWS SDK
+func awsEnv(cfg *s3.Config) map[string]string {
+	if cfg.WebIdentity != nil {
+		return map[string]string{
+			"AWS_WEB_IDENTITY_TOKEN_FILE": cfg.WebIdentity.TokenFile,
+			"AWS_ROLE_ARN":                cfg.WebIdentity.RoleArn,
+		}
+	}
+	return map[string]string{
+		"AWS_ACCESS_KEY_ID":     cfg.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": cfg.SecretAccessKey,
+	}
+}
+
+// mountEnvKeys are the credentials goofys reads from the environment of
+// the driver, as it mounts inside of the driver process
+var mountEnvKeys = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN",
+}
+
+// setMountEnv sets the credentials of env in the environment of the
+// driver, credentials of a previous mount are removed.
+func setMountEnv(env map[string]string) {
+	for _, k := range mountEnvKeys {
+		if v, ok := env[k]; ok {
+			os.Setenv(k, v)
+		} else {
+			os.Unsetenv(k)
+		}
+	}
+}
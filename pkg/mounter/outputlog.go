@@ -0,0 +1,177 @@
+package mounter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// outputLogName is the file the output of a mounter is written to, next to
+// the target of its mount. kubelet keeps the metadata of the volume in the
+// same directory, which is removed together with the log on unpublish.
+const outputLogName = "mounter.log"
+
+var outputLog struct {
+	mu    sync.Mutex
+	limit int64
+}
+
+// SetOutputLogLimit captures the output of the mounters in a log file next
+// to their mount, whose last limit/2 bytes are rotated out once it grows
+// past limit. 0 does not capture the output.
+func SetOutputLogLimit(limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid mounter log size %d, must not be negative", limit)
+	}
+	outputLog.mu.Lock()
+	defer outputLog.mu.Unlock()
+	outputLog.limit = limit
+	return nil
+}
+
+// OutputLogLimit returns the size the log files of the mounters are
+// trimmed at, 0 if their output is not captured
+func OutputLogLimit() int64 {
+	outputLog.mu.Lock()
+	defer outputLog.mu.Unlock()
+	return outputLog.limit
+}
+
+// OutputLogPath returns the log file of the mounter of the mount at target
+func OutputLogPath(target string) string {
+	return path.Join(path.Dir(target), outputLogName)
+}
+
+// outputLogArgs returns the arguments making the mounter write its log to
+// the log file of target, none if the output is not captured. s3backer
+// only logs to syslog and goofys to the log of the driver.
+func outputLogArgs(command, target string) []string {
+	if OutputLogLimit() == 0 {
+		return nil
+	}
+	switch command {
+	case rcloneCmd:
+		return []string{"--log-file=" + OutputLogPath(target)}
+	case s3fsCmd:
+		return []string{"-o", "logfile=" + OutputLogPath(target)}
+	}
+	return nil
+}
+
+// rotatedOutputLogSuffix is appended to the log file of a mounter for the
+// file keeping the end of the log before it was last trimmed
+const rotatedOutputLogSuffix = ".1"
+
+// TrimOutputLog rotates the log file of target once it has grown past the
+// limit: its last limit/2 bytes are copied to the rotated log and the file
+// is truncated. The mounters keep the file open and append to it, so it
+// cannot be renamed, and they keep writing to its start once it is
+// truncated. The copy is repeated until the file stops growing, only lines
+// written between the last copy and the truncate are lost.
+func TrimOutputLog(target string) error {
+	limit := OutputLogLimit()
+	if limit == 0 {
+		return nil
+	}
+	p := OutputLogPath(target)
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() <= limit {
+		return err
+	}
+	var tail []byte
+	for size := info.Size(); ; {
+		tail, err = readTail(f, size, limit/2)
+		if err != nil {
+			return err
+		}
+		now, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if now.Size() == size {
+			break
+		}
+		size = now.Size()
+	}
+	if err := ioutil.WriteFile(p+rotatedOutputLogSuffix, tail, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return f.Truncate(0)
+}
+
+// readTail reads the last n bytes of the first size bytes of f
+func readTail(f *os.File, size, n int64) ([]byte, error) {
+	if n > size {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := f.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return tail, nil
+}
+
+// OutputLogTail returns the last n bytes of the log file of target, which
+// continue the rotated log if the file holds less, empty if the output is
+// not captured
+func OutputLogTail(target string, n int64) (string, error) {
+	p := OutputLogPath(target)
+	b, err := fileTail(p, n)
+	if err != nil || int64(len(b)) >= n {
+		return string(b), err
+	}
+	rotated, err := fileTail(p+rotatedOutputLogSuffix, n-int64(len(b)))
+	return string(rotated) + string(b), err
+}
+
+// fileTail returns the last n bytes of the file at p, none if it does not
+// exist
+func fileTail(p string, n int64) ([]byte, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > n {
+		if _, err := f.Seek(info.Size()-n, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(io.LimitReader(f, n))
+}
+
+// RemoveOutputLog removes the log file of target and its rotated log. A
+// mounter which keeps running, e.g. of a lingering mount, would keep
+// writing to the removed file, which is emptied first so it does not take
+// up space.
+func RemoveOutputLog(target string) error {
+	p := OutputLogPath(target)
+	if err := os.Remove(p + rotatedOutputLogSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Truncate(p, 0); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Remove(p)
+}
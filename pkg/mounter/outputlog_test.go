@@ -0,0 +1,105 @@
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOutputLogArgs(t *testing.T) {
+	defer SetOutputLogLimit(0)
+	target := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount"
+	if args := outputLogArgs(rcloneCmd, target); args != nil {
+		t.Fatalf("expected no arguments without a limit, got %v", args)
+	}
+	if err := SetOutputLogLimit(-1); err == nil {
+		t.Fatal("expected a negative limit to be rejected")
+	}
+	if err := SetOutputLogLimit(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	logFile := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mounter.log"
+	if args := outputLogArgs(rcloneCmd, target); !reflect.DeepEqual(args, []string{"--log-file=" + logFile}) {
+		t.Errorf("unexpected arguments of rclone %v", args)
+	}
+	if args := outputLogArgs(s3fsCmd, target); !reflect.DeepEqual(args, []string{"-o", "logfile=" + logFile}) {
+		t.Errorf("unexpected arguments of s3fs %v", args)
+	}
+	if args := outputLogArgs(s3backerCmd, target); args != nil {
+		t.Errorf("expected no arguments for s3backer, got %v", args)
+	}
+}
+
+func TestTrimOutputLog(t *testing.T) {
+	defer SetOutputLogLimit(0)
+	if err := SetOutputLogLimit(10); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "mount")
+	// a mounter which has not logged anything yet
+	if err := TrimOutputLog(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(OutputLogPath(target), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := TrimOutputLog(target); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(OutputLogPath(target)); string(b) != "0123456789" {
+		t.Fatalf("expected a log within the limit to be kept, got %q", b)
+	}
+
+	f, err := os.OpenFile(OutputLogPath(target), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("abcdef")
+	if err := TrimOutputLog(target); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(OutputLogPath(target) + rotatedOutputLogSuffix); !bytes.Equal(b, []byte("bcdef")) {
+		t.Fatalf("expected the last half of the limit to be rotated, got %q", b)
+	}
+	// the mounter keeps appending to the truncated log
+	f.WriteString("g")
+	if b, _ := ioutil.ReadFile(OutputLogPath(target)); !bytes.Equal(b, []byte("g")) {
+		t.Fatalf("expected the log to continue in the truncated file, got %q", b)
+	}
+	if tail, err := OutputLogTail(target, 4); err != nil || tail != "defg" {
+		t.Fatalf("expected the tail to continue the rotated log, got %q, %v", tail, err)
+	}
+
+	if err := RemoveOutputLog(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(OutputLogPath(target)); !os.IsNotExist(err) {
+		t.Fatalf("expected the log to be removed, got %v", err)
+	}
+	if _, err := os.Stat(OutputLogPath(target) + rotatedOutputLogSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected the rotated log to be removed, got %v", err)
+	}
+	if err := RemoveOutputLog(target); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutputLogTail(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "mount")
+	if tail, err := OutputLogTail(target, 4); err != nil || tail != "" {
+		t.Fatalf("expected no output without a log, got %q, %v", tail, err)
+	}
+	if err := ioutil.WriteFile(OutputLogPath(target), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if tail, err := OutputLogTail(target, 4); err != nil || tail != "6789" {
+		t.Fatalf("expected the end of the log, got %q, %v", tail, err)
+	}
+	if tail, err := OutputLogTail(target, 20); err != nil || tail != "0123456789" {
+		t.Fatalf("expected the whole log, got %q, %v", tail, err)
+	}
+}
@@ -0,0 +1,106 @@
+package mounter
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// origins maps the paths mounts have been moved to with Park and Unpark to
+// the target they have originally been mounted at. The cache, the remote
+// control endpoint and the systemd unit of a mount stay with its original
+// target.
+var (
+	originsMu sync.Mutex
+	origins   = map[string]string{}
+)
+
+// origin returns the target the mount at path has been mounted at
+func origin(path string) string {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	if o, ok := origins[path]; ok {
+		return o
+	}
+	return path
+}
+
+// parkedOrigin returns true if a mount originally mounted at target has
+// been moved elsewhere
+func parkedOrigin(target string) bool {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	for path, o := range origins {
+		if o == target && path != target {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the path the mount originally mounted at target has been
+// moved to, target if it has not been moved
+func current(target string) string {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	for path, o := range origins {
+		if o == target {
+			return path
+		}
+	}
+	return target
+}
+
+// move bind mounts the mount at from to to and then unmounts from. The
+// mounter keeps serving the mount, as the kernel only ends its connection
+// once the last mount of it is gone.
+func move(from, to string) error {
+	m := mount.New("")
+	if err := m.Mount(from, to, "", []string{"bind"}); err != nil {
+		return fmt.Errorf("failed to move mount %s to %s: %v", from, to, err)
+	}
+	if err := m.Unmount(from); err != nil {
+		if umountErr := m.Unmount(to); umountErr != nil {
+			return fmt.Errorf("failed to unmount %s: %v, its mount is left at %s as well: %v", from, err, to, umountErr)
+		}
+		return fmt.Errorf("failed to unmount %s: %v", from, err)
+	}
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	o, ok := origins[from]
+	if !ok {
+		o = from
+	}
+	delete(origins, from)
+	origins[to] = o
+	return nil
+}
+
+// Park moves the mount at target to parked, e.g. to keep the mounter and
+// its cache alive after the volume has been unpublished. The parked mount
+// is either moved to a target again with Unpark or unmounted with
+// FuseUnmount.
+func Park(target, parked string) error {
+	return move(target, parked)
+}
+
+// Unpark moves the mount parked with Park to target
+func Unpark(parked, target string) error {
+	return move(parked, target)
+}
+
+// RestoreParked records that the mount at parked has been moved there from
+// target with Park by an earlier run of the driver
+func RestoreParked(target, parked string) {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	origins[parked] = target
+}
+
+// forgetOrigin drops the origin of a mount at path once it is unmounted
+func forgetOrigin(path string) {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	delete(origins, path)
+}
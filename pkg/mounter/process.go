@@ -0,0 +1,85 @@
+package mounter
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/go-ps"
+)
+
+// Process is a running mounter
+type Process struct {
+	Pid     int
+	Mounter string
+	// Mountpoint is where the mount of the mounter is, which is not the
+	// target of its command line if the mount has been parked
+	Mountpoint string
+}
+
+// mountpointArg is the position of the mountpoint among the arguments of
+// the mounters which run as their own process, not counting options. goofys
+// serves its mounts from within the driver.
+var mountpointArg = map[string]int{
+	s3fsCmd:     1,
+	rcloneCmd:   2,
+	s3backerCmd: 1,
+}
+
+// Processes returns the running mounter processes, whether or not their
+// mount still exists
+func Processes() ([]Process, error) {
+	processes, err := ps.Processes()
+	if err != nil {
+		return nil, err
+	}
+	var mounters []Process
+	for _, p := range processes {
+		if _, ok := mountpointArg[p.Executable()]; !ok {
+			continue
+		}
+		cmdLine, err := getCmdLine(p.Pid())
+		if err != nil {
+			// the process exited in the meantime
+			glog.V(4).Infof("Unable to get cmdline of PID %v: %s", p.Pid(), err)
+			continue
+		}
+		if mountpoint := parseMountpoint(p.Executable(), cmdLine); mountpoint != "" {
+			mounters = append(mounters, Process{Pid: p.Pid(), Mounter: p.Executable(), Mountpoint: current(mountpoint)})
+		}
+	}
+	return mounters, nil
+}
+
+// parseMountpoint returns the mountpoint of the NUL separated command line
+// of a mounter, empty if the command does not mount, e.g. rclone obscure
+func parseMountpoint(mounter, cmdLine string) string {
+	args := strings.Split(strings.TrimRight(cmdLine, "\x00"), "\x00")
+	if len(args) < 2 || (mounter == rcloneCmd && args[1] != "mount") {
+		return ""
+	}
+	var positional []string
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+		}
+	}
+	if i := mountpointArg[mounter]; i < len(positional) {
+		return positional[i]
+	}
+	return ""
+}
+
+// ProcessAlive returns true if the process is running, defunct processes
+// which have not been waited for yet are not
+func ProcessAlive(pid int) bool {
+	if cmdLine, err := getCmdLine(pid); err != nil || cmdLine == "" {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
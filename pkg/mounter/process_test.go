@@ -0,0 +1,21 @@
+package mounter
+
+import "testing"
+
+func TestParseMountpoint(t *testing.T) {
+	for _, tc := range []struct {
+		mounter  string
+		cmdLine  string
+		expected string
+	}{
+		{s3fsCmd, "s3fs\x00bucket:/vol/csi-fs\x00/var/lib/kubelet/pods/uid/mount\x00-o\x00use_path_request_style\x00-o\x00mime=/etc/mime.types\x00", "/var/lib/kubelet/pods/uid/mount"},
+		{rcloneCmd, "rclone\x00mount\x00:s3:bucket/vol\x00/staging\x00--daemon\x00--cache-dir=/cache\x00", "/staging"},
+		{rcloneCmd, "rclone\x00obscure\x00-\x00", ""},
+		{s3backerCmd, "s3backer\x00--blockSize=4k\x00--prefix=vol/\x00--listBlocks\x00bucket\x00/staging/fuse\x00--ssl\x00", "/staging/fuse"},
+		{s3fsCmd, "s3fs\x00--version\x00", ""},
+	} {
+		if mountpoint := parseMountpoint(tc.mounter, tc.cmdLine); mountpoint != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.cmdLine, tc.expected, mountpoint)
+		}
+	}
+}
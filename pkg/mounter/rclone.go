@@ -3,31 +3,63 @@ package mounter
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/ctrox/csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type rcloneMounter struct {
-	meta            *s3.FSMeta
-	url             string
-	region          string
-	accessKeyID     string
-	secretAccessKey string
+	meta       *s3.FSMeta
+	url        string
+	region     string
+	env        map[string]string
+	passphrase string
+	// caseInsensitive matches file names case-insensitively
+	caseInsensitive bool
+	// config and remotePath mount a remote of an rclone config instead
+	// of the bucket of the volume
+	config     string
+	remotePath string
 }
 
 const (
 	rcloneCmd = "rclone"
+	// rcloneOfflineCacheTime is how long listings and cached data are kept
+	// with cacheOnlyOnError, bounding both the outages reads survive and
+	// how late changes of other clients are seen
+	rcloneOfflineCacheTime = "1h"
 )
 
+// rcloneEscapeEncoding is the encoding of keys of volumes with keyEncoding
+// escape. rclone replaces these characters of file names with their
+// fullwidth Unicode equivalents in keys, e.g. : with U+FF1A, and quotes
+// fullwidth characters which are part of a name with U+201B, so the
+// names are restored when the keys are listed. The first three are the
+// default of rclone for S3.
+const rcloneEscapeEncoding = "Slash,InvalidUtf8,Dot,Colon,Asterisk,Question,Pipe,LtGt,DoubleQuote,BackSlash,Del,Ctl"
+
+// rcloneFailures classify the errors rclone reports when a mount fails,
+// its exit codes are documented in the rclone docs
+var rcloneFailures = []failurePattern{
+	{kind: ErrMountNotFound, output: []string{"directory not found"}, exitCodes: []int{3}},
+	{kind: ErrMountPermissionDenied, output: []string{"status code: 403"}},
+	// exit code 5 is a temporary error, which a retry might resolve
+	{kind: ErrMountUnavailable, output: []string{"send request failed"}, exitCodes: []int{5}},
+}
+
 func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &rcloneMounter{
 		meta:            meta,
 		url:             cfg.Endpoint,
-		region:          cfg.Region,
-		accessKeyID:     cfg.AccessKeyID,
-		secretAccessKey: cfg.SecretAccessKey,
+		region:          cfg.SignatureRegion(),
+		env:             awsEnv(cfg),
+		passphrase:      cfg.ClientEncryptionPassphrase,
+		caseInsensitive: cfg.CaseInsensitiveKeys,
+		config:          cfg.RcloneConfig,
+		remotePath:      cfg.RcloneRemotePath,
 	}, nil
 }
 
@@ -39,21 +71,194 @@ func (rclone *rcloneMounter) Unstage(stageTarget string) error {
 	return nil
 }
 
+func (rclone *rcloneMounter) Capabilities() *Capabilities {
+	return capabilities(rcloneMounterType)
+}
+
 func (rclone *rcloneMounter) Mount(source string, target string) error {
+	var remote string
+	var env map[string]string
+	var remoteArgs []string
+	if rclone.remotePath != "" {
+		// the remote is configured entirely by the config of the secret
+		configFile, err := writeRcloneConfig(target, rclone.config, rclone.remotePath)
+		if err != nil {
+			return err
+		}
+		remote = rclone.remotePath
+		remoteArgs = []string{"--config=" + configFile}
+	} else {
+		var err error
+		if remote, env, remoteArgs, err = rclone.s3Remote(); err != nil {
+			return err
+		}
+	}
 	args := []string{
 		"mount",
-		fmt.Sprintf(":s3:%s", path.Join(rclone.meta.BucketName, rclone.meta.Prefix, rclone.meta.FSPath)),
+		remote,
 		fmt.Sprintf("%s", target),
 		"--daemon",
+	}
+	args = append(args, remoteArgs...)
+	args = append(args, "--allow-other")
+	switch {
+	case rclone.meta.CacheMode == CacheModeNone:
+		// files can only be written sequentially without the vfs cache
+		args = append(args, "--vfs-cache-mode=off", "--dir-cache-time=0s", "--attr-timeout=0s")
+	case rclone.meta.Consistency == ConsistencyStrict:
+		// the vfs cache would serve files other nodes have replaced, so
+		// there is no cache dir on the node either
+		args = append(args, "--vfs-cache-mode=off", "--dir-cache-time=1s", "--attr-timeout=1s")
+	case rclone.meta.SmallFileCacheMB > 0:
+		dir, err := mountSmallFileCache(target, rclone.meta.SmallFileCacheMB)
+		if err != nil {
+			return err
+		}
+		// rclone exceeds the limit until its next poll, the rest of the
+		// tmpfs is left as headroom
+		args = append(args,
+			"--vfs-cache-mode=full",
+			"--cache-dir="+dir,
+			fmt.Sprintf("--vfs-cache-max-size=%dM", rcloneCacheMaxSize(rclone.meta.SmallFileCacheMB)),
+			"--vfs-cache-poll-interval=10s",
+			// objects up to this size are read with a single request
+			// and cached as a whole, larger ones only in the ranges read
+			"--vfs-read-chunk-size="+smallFileMaxSize,
+		)
+	default:
+		// a cache dir of its own lets Flush find the pending uploads
+		dir := cacheDir(target)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		mode := "writes"
+		if rclone.meta.CacheOnlyOnError {
+			// reads are only served from the cache in full mode
+			mode = "full"
+		}
+		args = append(args, "--vfs-cache-mode="+mode, "--cache-dir="+dir)
+	}
+	if rclone.meta.CacheOnlyOnError && rclone.meta.CacheMode != CacheModeNone {
+		// a cached file is opened without a request as long as the listing
+		// of its directory is cached, writes stay queued in the cache and
+		// their uploads are retried
+		args = append(args,
+			"--dir-cache-time="+rcloneOfflineCacheTime,
+			"--vfs-cache-max-age="+rcloneOfflineCacheTime,
+		)
+	}
+	rc, err := newRCState(target)
+	if err != nil {
+		return err
+	}
+	args = append(args, "--rc", "--rc-addr="+rc.Addr)
+	// the credentials are passed in the environment to keep them out of
+	// the process list, a systemd unit reads them from its EnvironmentFile
+	rcEnv := map[string]string{
+		"RCLONE_RC_USER": rc.User,
+		"RCLONE_RC_PASS": rc.Pass,
+	}
+	for k, v := range env {
+		rcEnv[k] = v
+	}
+	env = rcEnv
+	if rclone.remotePath == "" {
+		args = append(args, rclone.s3Args()...)
+	}
+	args = append(args, outputLogArgs(rcloneCmd, target)...)
+	if systemdEnabled() {
+		// systemd tracks the foreground process
+		return systemdMount(rclone.meta, target, rcloneCmd, removeArg(args, "--daemon"), env)
+	}
+	return fuseMount(target, rcloneCmd, args, rclone.meta.Env, env)
+}
+
+// s3Remote returns the remote of the bucket of the volume, with its
+// environment and the arguments configuring it
+func (rclone *rcloneMounter) s3Remote() (string, map[string]string, []string, error) {
+	remote := fmt.Sprintf(":s3:%s", path.Join(rclone.meta.BucketName, rclone.meta.DataPrefix()))
+	env := rclone.env
+	if rclone.meta.ClientEncrypted {
+		if rclone.passphrase == "" {
+			return "", nil, nil, fmt.Errorf("volume is client-side encrypted, but no passphrase is set")
+		}
+		password, err := obscure(rclone.passphrase)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		// the crypt backend wraps the s3 remote, it is configured through
+		// the environment to keep the password out of the arguments, a
+		// systemd unit reads it from its EnvironmentFile
+		env = map[string]string{
+			"RCLONE_CRYPT_REMOTE":   remote,
+			"RCLONE_CRYPT_PASSWORD": password,
+		}
+		for k, v := range rclone.env {
+			env[k] = v
+		}
+		remote = ":crypt:"
+	}
+	return remote, env, []string{
 		"--s3-provider=AWS",
 		"--s3-env-auth=true",
 		fmt.Sprintf("--s3-region=%s", rclone.region),
 		fmt.Sprintf("--s3-endpoint=%s", rclone.url),
-		"--allow-other",
-		// TODO: make this configurable
-		"--vfs-cache-mode=writes",
+	}, nil
+}
+
+// s3Args returns the arguments tuning the s3 remote of the volume
+func (rclone *rcloneMounter) s3Args() []string {
+	var args []string
+	if rclone.caseInsensitive {
+		// opening a file with a name differing from an existing one only
+		// by case opens the existing one instead of creating a new key
+		args = append(args, "--vfs-case-insensitive")
+	}
+	if rclone.meta.ObjectOwnership == s3.OwnershipBucketOwnerEnforced {
+		// ACLs are disabled, requests setting one are rejected
+		args = append(args, "--s3-acl=")
+	}
+	if limit := MultipartUploadLimit(); limit > 0 {
+		// every file uploaded at the same time sends its own parts
+		transfers := uploadConcurrency(rcloneDefaultTransfers)
+		workers := limit / transfers
+		if workers > rcloneDefaultUploadWorkers {
+			workers = rcloneDefaultUploadWorkers
+		}
+		args = append(args, fmt.Sprintf("--transfers=%d", transfers), fmt.Sprintf("--s3-upload-concurrency=%d", workers))
+	}
+	args = append(args, rcloneKMSArgs(rclone.meta.KMS)...)
+	if rclone.meta.ChecksumAlgorithm != "" {
+		// rclone only knows MD5, it is stored with every upload and
+		// compared after transfers, even if the environment disables it
+		args = append(args, "--s3-disable-checksum=false")
+	}
+	if rclone.meta.KeyEncoding == KeyEncodingEscape {
+		args = append(args, "--s3-encoding="+rcloneEscapeEncoding)
+	}
+	if len(rclone.meta.ObjectTags) > 0 {
+		// sent with every upload, including the start of multipart ones
+		args = append(args, "--header-upload=X-Amz-Tagging: "+objectTagsHeader(rclone.meta.ObjectTags))
+	}
+	return args
+}
+
+// rcloneCacheMaxSize returns the limit of the vfs cache in a tmpfs of sizeMB
+func rcloneCacheMaxSize(sizeMB int) int {
+	if max := sizeMB * 3 / 4; max > 0 {
+		return max
+	}
+	return 1
+}
+
+// obscure returns the passphrase obscured as rclone expects passwords in
+// its configuration
+func obscure(passphrase string) (string, error) {
+	cmd := exec.Command(rcloneCmd, "obscure", "-")
+	cmd.Stdin = strings.NewReader(passphrase)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error obscuring passphrase with %s: %v", rcloneCmd, err)
 	}
-	os.Setenv("AWS_ACCESS_KEY_ID", rclone.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", rclone.secretAccessKey)
-	return fuseMount(target, rcloneCmd, args)
+	return strings.TrimSpace(string(out)), nil
 }
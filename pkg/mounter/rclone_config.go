@@ -0,0 +1,118 @@
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const rcloneConfigName = "rclone.conf"
+
+// remoteNamePattern matches the names rclone allows for remotes, they must
+// not start with a hyphen or a space. A path starting with a colon would
+// configure a remote on the fly, outside of the config.
+var remoteNamePattern = regexp.MustCompile(`^[\w.+@][\w.+@ -]*$`)
+
+// rcloneConfigFile is next to the target path, like the cache dir, so
+// mounters running as systemd units can read it as well
+func rcloneConfigFile(target string) string {
+	return filepath.Join(filepath.Dir(origin(target)), rcloneConfigName)
+}
+
+// remoteName returns the name of the remote of remote:path, empty if it
+// does not refer to a remote by name
+func remoteName(remotePath string) string {
+	i := strings.Index(remotePath, ":")
+	if i < 0 {
+		return ""
+	}
+	name := remotePath[:i]
+	if !remoteNamePattern.MatchString(name) || strings.HasSuffix(name, " ") {
+		return ""
+	}
+	return name
+}
+
+// ParseRemotePath returns the remote path a volume is mounted from, empty
+// if it is not set. It returns an error if the path does not refer to a
+// remote by name or the mounter type cannot mount remotes of a config.
+func ParseRemotePath(mounterType, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if remoteName(value) == "" {
+		return "", fmt.Errorf("invalid %s %s, must be remote:path with a remote of the rclone config", RemotePathKey, value)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return "", err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsRemotePath {
+		return "", fmt.Errorf("mounter %s does not support %s", mounterType, RemotePathKey)
+	}
+	return value, nil
+}
+
+// writeRcloneConfig writes the config for the mount at target, readable
+// only by the driver, and checks that it defines the remote of remotePath.
+// The config holds credentials, it is never logged.
+func writeRcloneConfig(target, config, remotePath string) (string, error) {
+	if config == "" {
+		return "", fmt.Errorf("%w: %s %s requires an rclone config in the secret of the volume", ErrMountPrecondition, RemotePathKey, remotePath)
+	}
+	file := rcloneConfigFile(target)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+		return "", err
+	}
+	// an existing file keeps its mode
+	if err := os.Chmod(file, 0600); err != nil {
+		return "", err
+	}
+	remotes, err := rcloneRemotes(file)
+	if err != nil {
+		return "", err
+	}
+	name := remoteName(remotePath)
+	if !remotes[name] {
+		return "", fmt.Errorf("%w: remote %s of %s is not defined in the rclone config", ErrMountPrecondition, name, RemotePathKey)
+	}
+	return file, nil
+}
+
+// rcloneRemotes returns the names of the remotes defined in a config file
+func rcloneRemotes(file string) (map[string]bool, error) {
+	// the dump contains the credentials, only the error is reported
+	out, err := exec.Command(rcloneCmd, "config", "dump", "--config="+file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read the rclone config: %v", ErrMountPrecondition, err)
+	}
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse the rclone config: %v", ErrMountPrecondition, err)
+	}
+	remotes := make(map[string]bool, len(dump))
+	for name := range dump {
+		remotes[name] = true
+	}
+	return remotes, nil
+}
+
+// removeRcloneConfig removes the config of the mount at target, if any
+func removeRcloneConfig(target string) {
+	if err := os.Remove(rcloneConfigFile(target)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove rclone config of %s: %v", target, err)
+	}
+}
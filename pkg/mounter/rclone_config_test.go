@@ -0,0 +1,65 @@
+package mounter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRemotePath(t *testing.T) {
+	for _, value := range []string{"", "crypted:", "crypted:data/dir", "my remote:bucket", "s3.eu-1:bucket"} {
+		if v, err := ParseRemotePath(rcloneMounterType, value); err != nil || v != value {
+			t.Errorf("%q: expected it to be accepted, got %q, %v", value, v, err)
+		}
+	}
+	for _, value := range []string{"bucket/data", ":s3:bucket", ":s3,access_key_id=key:bucket", "-remote:data", "remote :data"} {
+		if _, err := ParseRemotePath(rcloneMounterType, value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+	if _, err := ParseRemotePath(s3fsMounterType, "crypted:data"); err == nil {
+		t.Error("expected s3fs to be rejected")
+	}
+}
+
+func TestWriteRcloneConfig(t *testing.T) {
+	// rclone config dump prints the remotes of the config as JSON
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho '{\"crypted\":{\"type\":\"crypt\",\"password\":\"secret\"},\"s3\":{\"type\":\"s3\"}}'\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, rcloneCmd), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin)
+
+	target := filepath.Join(t.TempDir(), "mount")
+	config := "[s3]\ntype = s3\n\n[crypted]\ntype = crypt\nremote = s3:bucket\npassword = secret\n"
+	file, err := writeRcloneConfig(target, config, "crypted:data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || filepath.Dir(file) != filepath.Dir(target) {
+		t.Errorf("expected a private config next to the target, got %s with mode %v", file, info.Mode())
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != config {
+		t.Errorf("expected the config to be written, got %q", b)
+	}
+
+	if _, err := writeRcloneConfig(target, config, "missing:data"); !errors.Is(err, ErrMountPrecondition) {
+		t.Errorf("expected a missing remote to fail, got %v", err)
+	}
+	if _, err := writeRcloneConfig(target, "", "crypted:data"); !errors.Is(err, ErrMountPrecondition) {
+		t.Errorf("expected a missing config to fail, got %v", err)
+	}
+
+	removeRcloneConfig(target)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected the config to be removed, got %v", err)
+	}
+}
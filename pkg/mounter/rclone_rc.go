@@ -0,0 +1,172 @@
+package mounter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rcStateFile records the remote control endpoint of an rclone mount in
+// its cache dir
+const rcStateFile = "rc.json"
+
+var rcClient = &http.Client{Timeout: 10 * time.Second}
+
+// rcState is the remote control endpoint of an rclone mount. It is bound
+// to localhost on a free port and protected with generated credentials.
+type rcState struct {
+	Addr string `json:"addr"`
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// CacheStats are the statistics of the VFS cache of a mount
+type CacheStats struct {
+	// DirtyBytes is the size of the files which have not been uploaded
+	DirtyBytes int64
+	// UploadsQueued is the number of files waiting for their upload
+	UploadsQueued int
+	// UploadsInProgress is the number of files being uploaded
+	UploadsInProgress int
+}
+
+func newRCState(target string) (*rcState, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+	user, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	state := &rcState{Addr: addr, User: user, Pass: pass}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	dir := cacheDir(target)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, rcStateFile), b, 0600); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// readRCState returns the remote control endpoint of the mount at target,
+// nil if it has none
+func readRCState(target string) (*rcState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cacheDir(target), rcStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &rcState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// call invokes an rc command of rclone and decodes its result into out
+func (rc *rcState) call(command string, params map[string]string, out interface{}) error {
+	if params == nil {
+		params = map[string]string{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/%s", rc.Addr, command), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(rc.User, rc.Pass)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rclone rc %s failed: %s: %s", command, resp.Status, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// vfsStats returns the upload queue of the VFS cache
+func (rc *rcState) vfsStats() (queued, inProgress int, err error) {
+	var stats struct {
+		DiskCache struct {
+			UploadsQueued     int `json:"uploadsQueued"`
+			UploadsInProgress int `json:"uploadsInProgress"`
+		} `json:"diskCache"`
+	}
+	if err := rc.call("vfs/stats", nil, &stats); err != nil {
+		return 0, 0, err
+	}
+	return stats.DiskCache.UploadsQueued, stats.DiskCache.UploadsInProgress, nil
+}
+
+// GetCacheStats returns the statistics of the VFS cache of the mount at
+// target, nil if the mount has no remote control endpoint.
+func GetCacheStats(target string) (*CacheStats, error) {
+	rc, err := readRCState(target)
+	if err != nil || rc == nil {
+		return nil, err
+	}
+	stats := &CacheStats{}
+	stats.UploadsQueued, stats.UploadsInProgress, err = rc.vfsStats()
+	if err != nil {
+		return nil, err
+	}
+	// rclone does not report the size of written files
+	_, stats.DirtyBytes, err = dirtyCacheEntries(cacheDir(target))
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ForgetCache drops the cached directory listings and attributes of the
+// mount at target, so changes made by other clients become visible. It
+// does nothing if the mount has no remote control endpoint.
+func ForgetCache(target string) error {
+	rc, err := readRCState(target)
+	if err != nil || rc == nil {
+		return err
+	}
+	return rc.call("vfs/forget", nil, nil)
+}
@@ -0,0 +1,111 @@
+package mounter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRC serves the rc commands of rclone used by the driver
+type fakeRC struct {
+	mu       sync.Mutex
+	queued   int
+	commands []string
+}
+
+func (f *fakeRC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, r.URL.Path)
+	switch r.URL.Path {
+	case "/vfs/stats":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"diskCache": map[string]int{"uploadsQueued": f.queued, "uploadsInProgress": 1},
+		})
+		if f.queued > 0 {
+			f.queued--
+		}
+	case "/vfs/forget":
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func startFakeRC(t *testing.T, target string, rc *fakeRC) {
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	if err := os.MkdirAll(cacheDir(target), 0700); err != nil {
+		t.Fatal(err)
+	}
+	state := rcState{Addr: strings.TrimPrefix(srv.URL, "http://"), User: "user", Pass: "pass"}
+	b, _ := json.Marshal(state)
+	if err := ioutil.WriteFile(filepath.Join(cacheDir(target), rcStateFile), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRCState(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "mount")
+	state, err := newRCState(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(state.Addr, "127.0.0.1:") || state.User == "" || state.Pass == "" {
+		t.Fatalf("unexpected rc state %+v", state)
+	}
+	read, err := readRCState(target)
+	if err != nil || *read != *state {
+		t.Fatalf("expected to read %+v, got %+v, %v", state, read, err)
+	}
+	if stats, err := GetCacheStats(filepath.Join(t.TempDir(), "other")); stats != nil || err != nil {
+		t.Fatalf("expected no stats without rc, got %+v, %v", stats, err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "mount")
+	rc := &fakeRC{queued: 2}
+	startFakeRC(t, target, rc)
+	writeCacheState(t, target, "dirty", `{"Size":300,"Dirty":true}`)
+	writeCacheState(t, target, "clean", `{"Size":5,"Dirty":false}`)
+
+	stats, err := GetCacheStats(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CacheStats{DirtyBytes: 300, UploadsQueued: 2, UploadsInProgress: 1}
+	if *stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *stats)
+	}
+	if err := ForgetCache(target); err != nil {
+		t.Fatal(err)
+	}
+	if rc.commands[len(rc.commands)-1] != "/vfs/forget" {
+		t.Fatalf("expected vfs/forget, got %v", rc.commands)
+	}
+}
+
+func TestFlushRC(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "mount")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the upload in progress never finishes
+	startFakeRC(t, target, &fakeRC{queued: 1})
+	if err := Flush(target, 1500*time.Millisecond); !errors.Is(err, ErrFlushTimeout) {
+		t.Fatalf("expected ErrFlushTimeout, got %v", err)
+	}
+}
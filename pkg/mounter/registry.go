@@ -0,0 +1,650 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// Capabilities describes what a mounter is able to provide
+type Capabilities struct {
+	// AccessModes lists the access modes the mounter can safely serve
+	AccessModes []csi.VolumeCapability_AccessMode_Mode
+	// SupportsReadOnly is set if the mounter can mount a volume read-only
+	SupportsReadOnly bool
+	// SupportsBlock is set if the mounter can provide raw block volumes
+	SupportsBlock bool
+	// SupportsOnlineExpand is set if a mounted volume can grow without remounting
+	SupportsOnlineExpand bool
+	// AllowedOptions are the mount flags which are accepted for this mounter,
+	// a mounter without a list accepts any flag
+	AllowedOptions []string
+	// SupportsSystemd is set if the mounter can run as a transient systemd unit
+	SupportsSystemd bool
+	// SupportsWebIdentity is set if the mounter can authenticate with a web identity token file
+	SupportsWebIdentity bool
+	// SupportsUncached is set if the mounter can serve cacheMode none
+	SupportsUncached bool
+	// SupportsClientEncryption is set if the mounter can encrypt data before upload
+	SupportsClientEncryption bool
+	// SupportsSmallFileCache is set if the mounter can keep read objects in memory
+	SupportsSmallFileCache bool
+	// SupportsCacheOnlyOnError is set if the mounter can serve reads from
+	// its cache while the endpoint is down
+	SupportsCacheOnlyOnError bool
+	// SupportsMimeTypesFile is set if the mounter can read the Content-Type
+	// of uploaded objects from a custom MIME types file
+	SupportsMimeTypesFile bool
+	// SupportsChecksums is set if the mounter can have the backend verify
+	// the checksums of its uploads
+	SupportsChecksums bool
+	// SupportsKeyEncoding is set if the mounter can escape the characters
+	// of file names which strict backends reject in keys
+	SupportsKeyEncoding bool
+	// SupportsEndpointPath is set if the mounter can reach S3 below a base
+	// path of the endpoint, e.g. behind an ingress
+	SupportsEndpointPath bool
+	// SupportsCaseInsensitiveKeys is set if the mounter can avoid creating
+	// keys which differ from existing ones only by case
+	SupportsCaseInsensitiveKeys bool
+	// SupportsRemotePath is set if the mounter can mount a remote of its
+	// own configuration instead of the bucket of the volume
+	SupportsRemotePath bool
+	// SupportsUnprivileged is set if the mounter can mount through
+	// fusermount or in a user namespace, without a privileged node plugin
+	SupportsUnprivileged bool
+	// SupportsKMS is set if the mounter can upload objects with the SSE-KMS
+	// key of the volume
+	SupportsKMS bool
+	// SupportsKMSContext is set if the mounter can upload objects with the
+	// encryption context of the volume, none of them can yet
+	SupportsKMSContext bool
+	// ReportsIntegrityErrors is set if the mounter counts the blocks whose
+	// checksum does not match, read with IntegrityErrors
+	ReportsIntegrityErrors bool
+	// FixedCapacity is set if the capacity of a volume is the size of the
+	// filesystem of the mounter, which cannot grow once it is created.
+	// The capacity of the other mounters is advisory.
+	FixedCapacity bool
+	// NeedsPrefixPlaceholder is set if the mounter only serves the data
+	// prefix of a volume if its placeholder object exists
+	NeedsPrefixPlaceholder bool
+	// SupportsStrictConsistency is set if the mounter can limit the caches
+	// of attributes and directory listings to a second
+	SupportsStrictConsistency bool
+	// SupportsPrefixes is set if the mounter can mount a prefix of the
+	// volume as one of its directories, which rules out a filesystem
+	// stored in the objects
+	SupportsPrefixes bool
+	// SupportsObjectTags is set if the mounter can upload objects with the
+	// tags of the volume
+	SupportsObjectTags bool
+	// SupportsEnv is set if the mounter runs in a process of its own,
+	// which the env of the volume is passed to
+	SupportsEnv bool
+}
+
+type registration struct {
+	capabilities Capabilities
+	new          func(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error)
+	version      func() string
+	// binary is the command the mounter runs, empty if it runs inside of
+	// the driver process
+	binary string
+	// mountTimeout bounds the wait for the mount, zero for the default
+	mountTimeout time.Duration
+	// failures classify the errors of the mounter
+	failures []failurePattern
+}
+
+const defaultMounterType = s3backerMounterType
+
+// The single node writer modes of CSI spec v1.5 are not named by the
+// vendored spec yet, these are their values on the wire.
+const (
+	// SingleNodeSingleWriter is the ReadWriteOncePod access mode
+	SingleNodeSingleWriter = csi.VolumeCapability_AccessMode_Mode(6)
+	// SingleNodeMultiWriter is sent for ReadWriteOnce once the driver
+	// advertises support for SingleNodeSingleWriter
+	SingleNodeMultiWriter = csi.VolumeCapability_AccessMode_Mode(7)
+)
+
+var (
+	singleNodeModes = []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		SingleNodeSingleWriter,
+		SingleNodeMultiWriter,
+	}
+	multiNodeModes = append([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	}, singleNodeModes...)
+)
+
+// registry holds every available mounter, adding a mounter only
+// requires an entry here next to its implementation.
+var registry = map[string]registration{
+	s3fsMounterType: {
+		capabilities: Capabilities{
+			AccessModes:           multiNodeModes,
+			SupportsSystemd:       true,
+			SupportsUncached:      true,
+			SupportsMimeTypesFile: true,
+			SupportsChecksums:     true,
+			SupportsUnprivileged:  true,
+			SupportsPrefixes:      true,
+			// the stat cache expires after a second
+			SupportsStrictConsistency: true,
+			// with a tagging header in its ahbe_conf
+			SupportsObjectTags: true,
+			SupportsEnv:        true,
+		},
+		new:      newS3fsMounter,
+		version:  binaryVersion(s3fsCmd),
+		binary:   s3fsCmd,
+		failures: s3fsFailures,
+	},
+	// goofys runs inside of the driver process and never caches metadata,
+	// the env of a volume would change the environment of the driver
+	goofysMounterType: {
+		capabilities: Capabilities{
+			AccessModes:         multiNodeModes,
+			SupportsWebIdentity: true,
+			SupportsUncached:    true,
+			// jacobsa/fuse mounts through fusermount
+			SupportsUnprivileged: true,
+			// a fresh volume without it is mounted empty until an object
+			// is written to it out of band
+			NeedsPrefixPlaceholder: true,
+			SupportsPrefixes:       true,
+			// it never caches metadata in the first place
+			SupportsStrictConsistency: true,
+		},
+		new:      newGoofysMounter,
+		version:  moduleVersion("github.com/kahing/goofys"),
+		failures: goofysFailures,
+	},
+	rcloneMounterType: {
+		capabilities: Capabilities{
+			AccessModes:              multiNodeModes,
+			SupportsSystemd:          true,
+			SupportsWebIdentity:      true,
+			SupportsUncached:         true,
+			SupportsClientEncryption: true,
+			SupportsSmallFileCache:   true,
+			SupportsCacheOnlyOnError: true,
+			SupportsChecksums:        true,
+			SupportsKeyEncoding:      true,
+			SupportsRemotePath:       true,
+			SupportsUnprivileged:     true,
+			SupportsKMS:              true,
+			// opening a missing file finds an existing one differing by case
+			SupportsCaseInsensitiveKeys: true,
+			SupportsPrefixes:            true,
+			SupportsStrictConsistency:   true,
+			SupportsObjectTags:          true,
+			SupportsEnv:                 true,
+		},
+		new:      newRcloneMounter,
+		version:  binaryVersion(rcloneCmd),
+		binary:   rcloneCmd,
+		failures: rcloneFailures,
+	},
+	// s3backer provides a block device formatted with a regular
+	// filesystem which must never be mounted on more than one node.
+	// The filesystem always caches in the page cache of the node.
+	s3backerMounterType: {
+		// the loop device and the filesystem on top of it need privileges
+		capabilities: Capabilities{
+			AccessModes:            singleNodeModes,
+			ReportsIntegrityErrors: true,
+			FixedCapacity:          true,
+			SupportsEnv:            true,
+		},
+		new:     newS3backerMounter,
+		version: binaryVersion(s3backerCmd),
+		binary:  s3backerCmd,
+		// listing the blocks of a large volume on first mount takes minutes
+		mountTimeout: 5 * time.Minute,
+		failures:     s3backerFailures,
+	},
+}
+
+// Types returns the names of all registered mounters
+func Types() []string {
+	var types []string
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// GetCapabilities returns the capabilities of the mounter type. An empty
+// type stands for the default mounter.
+func GetCapabilities(mounterType string) (*Capabilities, error) {
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	r, ok := registry[mounterType]
+	if !ok {
+		return nil, fmt.Errorf("unknown mounter %s, must be one of %v", mounterType, Types())
+	}
+	return &r.capabilities, nil
+}
+
+// capabilities returns a copy of the capabilities of a registered mounter
+func capabilities(mounterType string) *Capabilities {
+	c := registry[mounterType].capabilities
+	return &c
+}
+
+// AccessModes returns all access modes supported by at least one mounter
+func AccessModes() []csi.VolumeCapability_AccessMode_Mode {
+	seen := make(map[csi.VolumeCapability_AccessMode_Mode]bool)
+	var modes []csi.VolumeCapability_AccessMode_Mode
+	for _, t := range Types() {
+		for _, m := range registry[t].capabilities.AccessModes {
+			if !seen[m] {
+				seen[m] = true
+				modes = append(modes, m)
+			}
+		}
+	}
+	return modes
+}
+
+// SupportsAccessMode returns true if the mounter can serve the access mode
+func (c *Capabilities) SupportsAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range c.AccessModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// SingleNode returns true if the mounter must never serve a volume on more
+// than one node at a time
+func (c *Capabilities) SingleNode() bool {
+	for _, m := range c.AccessModes {
+		switch m {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns an error describing why the mounter type cannot
+// satisfy the given volume capability.
+func (c *Capabilities) Validate(mounterType string, capability *csi.VolumeCapability) error {
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if capability.GetBlock() != nil && !c.SupportsBlock {
+		return fmt.Errorf("mounter %s does not support block volumes", mounterType)
+	}
+	if mode := capability.GetAccessMode().GetMode(); !c.SupportsAccessMode(mode) {
+		return fmt.Errorf("mounter %s does not support access mode %s, supported modes are %v", mounterType, mode, c.AccessModes)
+	}
+	for _, flag := range capability.GetMount().GetMountFlags() {
+		if !c.allowsOption(flag) {
+			return fmt.Errorf("mounter %s does not support option %s", mounterType, flag)
+		}
+	}
+	return nil
+}
+
+// ValidateCacheMode returns an error if the mounter type cannot mount
+// volumes with the given cache mode.
+func ValidateCacheMode(mounterType string, cacheMode string) error {
+	if cacheMode == "" {
+		return nil
+	}
+	if cacheMode != CacheModeNone {
+		return fmt.Errorf("invalid %s %s", CacheModeKey, cacheMode)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsUncached {
+		return fmt.Errorf("mounter %s does not support %s %s", mounterType, CacheModeKey, cacheMode)
+	}
+	return nil
+}
+
+// ParseSmallFileCache returns the size of the small file cache in MiB, 0
+// if it is not set. It returns an error if the mounter type cannot cache
+// small files in memory with the given cache mode.
+func ParseSmallFileCache(mounterType, cacheMode, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid %s %s, must be a positive number of MiB", SmallFileCacheKey, value)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return 0, err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsSmallFileCache {
+		return 0, fmt.Errorf("mounter %s does not support %s", mounterType, SmallFileCacheKey)
+	}
+	if cacheMode == CacheModeNone {
+		return 0, fmt.Errorf("%s cannot be used with %s %s", SmallFileCacheKey, CacheModeKey, cacheMode)
+	}
+	return size, nil
+}
+
+// ParseMimeTypesFile returns the path of the MIME types file of a volume,
+// empty if it is not set. It returns an error if the path is not absolute
+// or the mounter type cannot read a MIME types file.
+func ParseMimeTypesFile(mounterType, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+		return "", fmt.Errorf("invalid %s %s, must be a clean absolute path", MimeTypesFileKey, value)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return "", err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsMimeTypesFile {
+		return "", fmt.Errorf("mounter %s does not support %s", mounterType, MimeTypesFileKey)
+	}
+	return value, nil
+}
+
+// ParseChecksumAlgorithm returns the checksum algorithm of a volume, empty
+// if it is not set. It returns an error if the algorithm is unknown or the
+// mounter type cannot have its uploads verified.
+func ParseChecksumAlgorithm(mounterType, value string) (string, error) {
+	algorithm, err := s3.ParseChecksumAlgorithm(value)
+	if err != nil || algorithm == "" {
+		return "", err
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return "", err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsChecksums {
+		return "", fmt.Errorf("mounter %s does not support %s", mounterType, ChecksumAlgorithmKey)
+	}
+	return algorithm, nil
+}
+
+// ParseKeyEncoding returns the key encoding of a volume, empty if it is
+// not set. It returns an error if the encoding is unknown or the mounter
+// type cannot escape file names.
+func ParseKeyEncoding(mounterType, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if value != KeyEncodingEscape {
+		return "", fmt.Errorf("invalid %s %s, must be %s", KeyEncodingKey, value, KeyEncodingEscape)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return "", err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsKeyEncoding {
+		return "", fmt.Errorf("mounter %s does not support %s", mounterType, KeyEncodingKey)
+	}
+	return value, nil
+}
+
+// CheckMimeTypesFile returns an error if the MIME types file of a volume
+// is not a regular file on the node. A mounter running as a systemd unit
+// reads the file on the host, which the node plugin cannot see, it is not
+// checked then.
+func CheckMimeTypesFile(mounterType, path string) error {
+	if c, _ := GetCapabilities(mounterType); c.SupportsSystemd && systemdEnabled() {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s of the volume is not available on the node: %v", MimeTypesFileKey, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s %s of the volume is not a regular file", MimeTypesFileKey, path)
+	}
+	return nil
+}
+
+// ParseCacheOnlyOnError returns true if reads of the volume are served
+// from the cache while the endpoint is down. It returns an error if the
+// mounter type cannot serve reads from its cache with the given cache mode.
+func ParseCacheOnlyOnError(mounterType, cacheMode, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %s, must be true or false", CacheOnlyOnErrorKey, value)
+	}
+	if !enabled {
+		return false, nil
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return false, err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsCacheOnlyOnError {
+		return false, fmt.Errorf("mounter %s does not support %s", mounterType, CacheOnlyOnErrorKey)
+	}
+	if cacheMode == CacheModeNone {
+		return false, fmt.Errorf("%s cannot be used with %s %s", CacheOnlyOnErrorKey, CacheModeKey, cacheMode)
+	}
+	return true, nil
+}
+
+// ParseConsistency returns ConsistencyStrict if the mounter of a volume
+// keeps its caches of attributes and directory listings minimal, empty for
+// the default caching of the mounter. It returns an error if the mounter
+// type cannot limit its caches.
+func ParseConsistency(mounterType, value string) (string, error) {
+	switch value {
+	case "", ConsistencyDefault:
+		return "", nil
+	case ConsistencyStrict:
+	default:
+		return "", fmt.Errorf("invalid %s %s, must be %s or %s", ConsistencyKey, value, ConsistencyStrict, ConsistencyDefault)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return "", err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsStrictConsistency {
+		return "", fmt.Errorf("mounter %s does not support %s %s", mounterType, ConsistencyKey, value)
+	}
+	return value, nil
+}
+
+// ValidateClientEncryption returns an error if the mounter type cannot
+// mount client-side encrypted volumes.
+func ValidateClientEncryption(mounterType string) error {
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsClientEncryption {
+		return fmt.Errorf("mounter %s does not support client-side encryption", mounterType)
+	}
+	return nil
+}
+
+// ValidatePrefixes returns an error if the mounter type cannot mount the
+// prefixes of a volume as its directories
+func ValidatePrefixes(mounterType string) error {
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsPrefixes {
+		return fmt.Errorf("mounter %s does not support %s", mounterType, PrefixesKey)
+	}
+	return nil
+}
+
+// ValidateEndpoint returns an error if the mounter type cannot use the
+// endpoint of cfg
+func ValidateEndpoint(mounterType string, cfg *s3.Config) error {
+	basePath := cfg.EndpointPath()
+	if basePath == "" {
+		return nil
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsEndpointPath {
+		return fmt.Errorf("endpoint %s has the base path %s, which is not supported by mounter %s", cfg.Endpoint, basePath, mounterType)
+	}
+	return nil
+}
+
+// ValidateKeyCaseSensitivity returns an error if the mounter type might
+// create keys colliding on the case-insensitive backend of cfg
+func ValidateKeyCaseSensitivity(mounterType string, cfg *s3.Config) error {
+	if !cfg.CaseInsensitiveKeys {
+		return nil
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsCaseInsensitiveKeys {
+		return fmt.Errorf("mounter %s might create keys differing only by case, which collide on a backend with case-insensitive keys", mounterType)
+	}
+	return nil
+}
+
+// ValidateOptions returns an error naming the first option recorded in the
+// metadata of a volume which the mounter type cannot honour, instead of
+// mounting the volume without it
+func (c *Capabilities) ValidateOptions(mounterType string, meta *s3.FSMeta) error {
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	for _, o := range []struct {
+		name      string
+		requested bool
+		supported bool
+	}{
+		{CacheModeKey + " " + CacheModeNone, meta.CacheMode == CacheModeNone, c.SupportsUncached},
+		{SmallFileCacheKey, meta.SmallFileCacheMB > 0, c.SupportsSmallFileCache},
+		{CacheOnlyOnErrorKey, meta.CacheOnlyOnError, c.SupportsCacheOnlyOnError},
+		{MimeTypesFileKey, meta.MimeTypesFile != "", c.SupportsMimeTypesFile},
+		{ChecksumAlgorithmKey, meta.ChecksumAlgorithm != "", c.SupportsChecksums},
+		{KeyEncodingKey, meta.KeyEncoding != "", c.SupportsKeyEncoding},
+		{"client-side encryption", meta.ClientEncrypted, c.SupportsClientEncryption},
+		{KMSContextRequiredKey, meta.KMS != nil && meta.KMS.ContextRequired, c.SupportsKMSContext},
+		{PrefixesKey, len(meta.Prefixes) > 0, c.SupportsPrefixes},
+		{ConsistencyKey + " " + ConsistencyStrict, meta.Consistency == ConsistencyStrict, c.SupportsStrictConsistency},
+		{ObjectTagsKey, len(meta.ObjectTags) > 0, c.SupportsObjectTags},
+		{EnvKey, len(meta.Env) > 0, c.SupportsEnv},
+	} {
+		if o.requested && !o.supported {
+			return fmt.Errorf("mounter %s does not support %s", mounterType, o.name)
+		}
+	}
+	return nil
+}
+
+// Features returns the names of the optional features of the mounter, the
+// parameters of a volume if they are set with one
+func (c *Capabilities) Features() []string {
+	var features []string
+	for _, f := range []struct {
+		name      string
+		supported bool
+	}{
+		{"readOnly", c.SupportsReadOnly},
+		{"block", c.SupportsBlock},
+		{"onlineExpand", c.SupportsOnlineExpand},
+		{"systemd", c.SupportsSystemd},
+		{"webIdentity", c.SupportsWebIdentity},
+		{CacheModeKey + "=" + CacheModeNone, c.SupportsUncached},
+		{"clientEncryption", c.SupportsClientEncryption},
+		{SmallFileCacheKey, c.SupportsSmallFileCache},
+		{CacheOnlyOnErrorKey, c.SupportsCacheOnlyOnError},
+		{MimeTypesFileKey, c.SupportsMimeTypesFile},
+		{ChecksumAlgorithmKey, c.SupportsChecksums},
+		{KeyEncodingKey, c.SupportsKeyEncoding},
+		{"endpointPath", c.SupportsEndpointPath},
+		{"caseInsensitiveKeys", c.SupportsCaseInsensitiveKeys},
+		{RemotePathKey, c.SupportsRemotePath},
+		{"kms", c.SupportsKMS},
+		{"kmsContext", c.SupportsKMSContext},
+		{"integrityErrors", c.ReportsIntegrityErrors},
+		{"unprivileged", c.SupportsUnprivileged},
+		{PrefixesKey, c.SupportsPrefixes},
+		{ConsistencyKey + "=" + ConsistencyStrict, c.SupportsStrictConsistency},
+		{ObjectTagsKey, c.SupportsObjectTags},
+		{EnvKey, c.SupportsEnv},
+	} {
+		if f.supported {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+func (c *Capabilities) allowsOption(option string) bool {
+	if len(c.AllowedOptions) == 0 {
+		return true
+	}
+	for _, o := range c.AllowedOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package mounter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestMounterCapabilities(t *testing.T) {
+	for _, mounterType := range Types() {
+		m, err := registry[mounterType].new(&s3.FSMeta{BucketName: "bucket"}, &s3.Config{Endpoint: "http://localhost:9000"})
+		if err != nil {
+			t.Fatalf("%s: %v", mounterType, err)
+		}
+		if c := m.Capabilities(); !reflect.DeepEqual(*c, registry[mounterType].capabilities) {
+			t.Errorf("%s: expected the capabilities of the registry, got %+v", mounterType, c)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	for _, tc := range []struct {
+		mounterType string
+		meta        s3.FSMeta
+		unsupported string
+	}{
+		{rcloneMounterType, s3.FSMeta{CacheMode: CacheModeNone, ChecksumAlgorithm: "SHA256", ClientEncrypted: true}, ""},
+		{s3fsMounterType, s3.FSMeta{MimeTypesFile: "/etc/mime.types"}, ""},
+		{s3fsMounterType, s3.FSMeta{SmallFileCacheMB: 64}, SmallFileCacheKey},
+		{goofysMounterType, s3.FSMeta{CacheOnlyOnError: true}, CacheOnlyOnErrorKey},
+		{rcloneMounterType, s3.FSMeta{MimeTypesFile: "/etc/mime.types"}, MimeTypesFileKey},
+		{s3backerMounterType, s3.FSMeta{CacheMode: CacheModeNone}, CacheModeKey},
+		{"", s3.FSMeta{ClientEncrypted: true}, "client-side encryption"},
+		{rcloneMounterType, s3.FSMeta{KeyEncoding: KeyEncodingEscape}, ""},
+		{s3fsMounterType, s3.FSMeta{KeyEncoding: KeyEncodingEscape}, KeyEncodingKey},
+		{goofysMounterType, s3.FSMeta{Consistency: ConsistencyStrict}, ""},
+		{s3backerMounterType, s3.FSMeta{Consistency: ConsistencyStrict}, ConsistencyKey},
+	} {
+		c, err := GetCapabilities(tc.mounterType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.ValidateOptions(tc.mounterType, &tc.meta)
+		if tc.unsupported == "" && err != nil {
+			t.Errorf("%s %+v: %v", tc.mounterType, tc.meta, err)
+		}
+		if tc.unsupported != "" && (err == nil || !strings.Contains(err.Error(), tc.unsupported)) {
+			t.Errorf("%s %+v: expected %s to be rejected, got %v", tc.mounterType, tc.meta, tc.unsupported, err)
+		}
+	}
+}
+
+func TestValidateMountFlags(t *testing.T) {
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"ro"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	c := &Capabilities{AccessModes: []csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}
+	if err := c.Validate(s3fsMounterType, capability); err != nil {
+		t.Errorf("expected flags to be accepted without an allowlist, got %v", err)
+	}
+	c.AllowedOptions = []string{"allow_other"}
+	if err := c.Validate(s3fsMounterType, capability); err == nil || !strings.Contains(err.Error(), "ro") {
+		t.Errorf("expected ro to be rejected, got %v", err)
+	}
+}
+
+func TestParseKeyEncoding(t *testing.T) {
+	if encoding, err := ParseKeyEncoding(rcloneMounterType, ""); err != nil || encoding != "" {
+		t.Fatalf("expected no encoding, got %q, %v", encoding, err)
+	}
+	if encoding, err := ParseKeyEncoding(rcloneMounterType, KeyEncodingEscape); err != nil || encoding != KeyEncodingEscape {
+		t.Fatalf("expected %s, got %q, %v", KeyEncodingEscape, encoding, err)
+	}
+	if _, err := ParseKeyEncoding(rcloneMounterType, "base64"); err == nil {
+		t.Error("expected an unknown encoding to be rejected")
+	}
+	for _, mounterType := range []string{s3fsMounterType, goofysMounterType, ""} {
+		if _, err := ParseKeyEncoding(mounterType, KeyEncodingEscape); err == nil || !strings.Contains(err.Error(), "does not support") {
+			t.Errorf("%s: expected the encoding to be rejected, got %v", mounterType, err)
+		}
+	}
+	rclone, err := newRcloneMounter(&s3.FSMeta{BucketName: "bucket", KeyEncoding: KeyEncodingEscape}, &s3.Config{Endpoint: "http://localhost:9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := rclone.(*rcloneMounter).s3Args(); !strings.Contains(strings.Join(args, " "), "--s3-encoding="+rcloneEscapeEncoding) {
+		t.Fatalf("expected rclone to escape the keys, got %v", args)
+	}
+}
+
+func TestParseConsistency(t *testing.T) {
+	for _, value := range []string{"", ConsistencyDefault} {
+		if consistency, err := ParseConsistency(s3backerMounterType, value); err != nil || consistency != "" {
+			t.Fatalf("%q: expected the default consistency, got %q, %v", value, consistency, err)
+		}
+	}
+	for _, mounterType := range []string{s3fsMounterType, goofysMounterType, rcloneMounterType} {
+		if consistency, err := ParseConsistency(mounterType, ConsistencyStrict); err != nil || consistency != ConsistencyStrict {
+			t.Errorf("%s: expected %s, got %q, %v", mounterType, ConsistencyStrict, consistency, err)
+		}
+	}
+	if _, err := ParseConsistency("", ConsistencyStrict); err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("expected s3backer to be rejected, got %v", err)
+	}
+	if _, err := ParseConsistency(rcloneMounterType, "eventual"); err == nil {
+		t.Error("expected an unknown consistency to be rejected")
+	}
+}
+
+func TestValidateUnprivileged(t *testing.T) {
+	defer SetUnprivileged(false)
+	if err := ValidateUnprivileged(s3backerMounterType); err != nil {
+		t.Fatalf("expected every mounter to be allowed with privileges, got %v", err)
+	}
+	SetUnprivileged(true)
+	for _, mounterType := range []string{s3fsMounterType, goofysMounterType, rcloneMounterType} {
+		if err := ValidateUnprivileged(mounterType); err != nil {
+			t.Errorf("%s: %v", mounterType, err)
+		}
+	}
+	// the default mounter needs privileges
+	for _, mounterType := range []string{s3backerMounterType, ""} {
+		if err := ValidateUnprivileged(mounterType); err == nil || !strings.Contains(err.Error(), "s3backer") {
+			t.Errorf("%q: expected s3backer to be rejected, got %v", mounterType, err)
+		}
+	}
+}
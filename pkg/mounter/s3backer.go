@@ -33,20 +33,28 @@ const (
 	S3backerLoopDevice = "/dev/loop0"
 )
 
+// s3backerFailures classify the HTTP and libcurl errors s3backer reports
+// while it lists the blocks of the volume before mounting
+var s3backerFailures = []failurePattern{
+	{kind: ErrMountPermissionDenied, output: []string{"rec'd 403 response", "rec'd 401 response"}},
+	{kind: ErrMountNotFound, output: []string{"rec'd 404 response"}},
+	{kind: ErrMountUnavailable, output: []string{"couldn't resolve host", "couldn't connect to server", "timeout was reached"}},
+}
+
 func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	url, err := url.Parse(cfg.Endpoint)
 	if err != nil {
 		return nil, err
 	}
 	url.Path = path.Join(url.Path, meta.BucketName, meta.Prefix, meta.FSPath)
-	// s3backer cannot work with 0 size volumes
-	if meta.CapacityBytes == 0 {
+	// the block device of an unbounded volume needs a size
+	if meta.Unbounded() {
 		meta.CapacityBytes = s3backerDefaultSize
 	}
 	s3backer := &s3backerMounter{
 		meta:            meta,
 		url:             cfg.Endpoint,
-		region:          cfg.Region,
+		region:          cfg.SignatureRegion(),
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
 		ssl:             url.Scheme == "https",
@@ -82,6 +90,10 @@ func (s3backer *s3backerMounter) Unstage(stageTarget string) error {
 	return FuseUnmount(stageTarget)
 }
 
+func (s3backer *s3backerMounter) Capabilities() *Capabilities {
+	return capabilities(s3backerMounterType)
+}
+
 func (s3backer *s3backerMounter) Mount(source string, target string) error {
 	device := path.Join(source, s3backerDevice)
 	// second mount will mount the 'file' as a filesystem
@@ -98,7 +110,7 @@ func (s3backer *s3backerMounter) mountInit(p string) error {
 	args := []string{
 		fmt.Sprintf("--blockSize=%s", s3backerBlockSize),
 		fmt.Sprintf("--size=%v", s3backer.meta.CapacityBytes),
-		fmt.Sprintf("--prefix=%s/", path.Join(s3backer.meta.Prefix, s3backer.meta.FSPath)),
+		fmt.Sprintf("--prefix=%s", s3.DirPrefix(s3backer.meta.DataPrefix())),
 		"--listBlocks",
 		s3backer.meta.BucketName,
 		p,
@@ -113,8 +125,9 @@ func (s3backer *s3backerMounter) mountInit(p string) error {
 	if s3backer.ssl {
 		args = append(args, "--ssl")
 	}
+	args = append(args, s3backerIntegrityArgs(s3backer.meta.S3backer)...)
 
-	return fuseMount(p, s3backerCmd, args)
+	return fuseMount(p, s3backerCmd, args, s3backer.meta.Env, nil)
 }
 
 func (s3backer *s3backerMounter) writePasswd() error {
@@ -0,0 +1,137 @@
+package mounter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+const (
+	// s3backerStatsFile is the file at the root of the FUSE mount of
+	// s3backer with its counters
+	s3backerStatsFile = "stats"
+	// s3backerMismatchStat counts the blocks whose MD5 did not match the
+	// ETag of the object, reads of them fail with EIO
+	s3backerMismatchStat = "http_mismatch"
+	// s3backerMD5CacheSize and s3backerMD5CacheTime are the defaults of
+	// s3backer, set explicitly as the flags have changed between versions
+	s3backerMD5CacheSize = 1000
+	s3backerMD5CacheTime = 10000
+	// s3backerInitialRetryPause is the default pause in milliseconds before
+	// the first retry, doubled for every further retry
+	s3backerInitialRetryPause = 200
+	s3backerMaxRetryCount     = 16
+)
+
+// ParseS3backerOptions returns the integrity options of an s3backer volume,
+// nil if none of them is set. It returns an error if a value is invalid or
+// the mounter type is not s3backer.
+func ParseS3backerOptions(mounterType string, params map[string]string) (*s3.S3backerOptions, error) {
+	md5Check, retryCount, timeout := params[S3backerMD5CheckKey], params[S3backerRetryCountKey], params[S3backerTimeoutKey]
+	if md5Check == "" && retryCount == "" && timeout == "" {
+		return nil, nil
+	}
+	if _, err := GetCapabilities(mounterType); err != nil {
+		return nil, err
+	}
+	if mounterType != "" && mounterType != s3backerMounterType {
+		return nil, fmt.Errorf("mounter %s does not support the s3backer options", mounterType)
+	}
+	o := DefaultS3backerOptions(mounterType)
+	if md5Check != "" {
+		enabled, err := strconv.ParseBool(md5Check)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s, must be true or false", S3backerMD5CheckKey, md5Check)
+		}
+		o.MD5Check = enabled
+	}
+	if retryCount != "" {
+		n, err := strconv.Atoi(retryCount)
+		if err != nil || n < 0 || n > s3backerMaxRetryCount {
+			return nil, fmt.Errorf("invalid %s %s, must be a number between 0 and %d", S3backerRetryCountKey, retryCount, s3backerMaxRetryCount)
+		}
+		o.RetryCount = n
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("invalid %s %s, must be a duration of whole seconds, e.g. 30s", S3backerTimeoutKey, timeout)
+		}
+		o.TimeoutSeconds = int(d / time.Second)
+	}
+	return o, nil
+}
+
+// DefaultS3backerOptions returns the integrity options of a new volume of
+// the mounter type, nil if it is not s3backer. Volumes created before the
+// options existed have none and keep the defaults of s3backer.
+func DefaultS3backerOptions(mounterType string) *s3.S3backerOptions {
+	if mounterType != "" && mounterType != s3backerMounterType {
+		return nil
+	}
+	return &s3.S3backerOptions{MD5Check: true}
+}
+
+// s3backerIntegrityArgs returns the flags of s3backer for the integrity
+// options of a volume
+func s3backerIntegrityArgs(o *s3.S3backerOptions) []string {
+	if o == nil {
+		return nil
+	}
+	var args []string
+	if o.MD5Check {
+		args = append(args,
+			fmt.Sprintf("--md5CacheSize=%d", s3backerMD5CacheSize),
+			fmt.Sprintf("--md5CacheTime=%d", s3backerMD5CacheTime))
+	} else {
+		args = append(args, "--md5CacheSize=0")
+	}
+	if o.RetryCount > 0 {
+		// s3backer retries until the pauses add up to maxRetryPause
+		pause := s3backerInitialRetryPause * (1<<uint(o.RetryCount) - 1)
+		args = append(args,
+			fmt.Sprintf("--initialRetryPause=%d", s3backerInitialRetryPause),
+			fmt.Sprintf("--maxRetryPause=%d", pause))
+	}
+	if o.TimeoutSeconds > 0 {
+		args = append(args, fmt.Sprintf("--timeout=%d", o.TimeoutSeconds))
+	}
+	return args
+}
+
+// IntegrityErrors returns the number of blocks whose MD5 did not match
+// since s3backer mounted the volume staged at stagingPath, the only mounter
+// which reports them. s3backer runs as a daemon logging to syslog, so its
+// counters are all the driver can see of the failures.
+func IntegrityErrors(stagingPath string) (uint64, error) {
+	f, err := os.Open(path.Join(stagingPath, s3backerStatsFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseS3backerStat(f, s3backerMismatchStat)
+}
+
+// parseS3backerStat returns the value of a counter of the stats file of
+// s3backer, which has one counter per line followed by its value
+func parseS3backerStat(r io.Reader, name string) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != name {
+			continue
+		}
+		return strconv.ParseUint(fields[1], 10, 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in the s3backer stats", name)
+}
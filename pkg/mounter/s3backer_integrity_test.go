@@ -0,0 +1,78 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestParseS3backerOptions(t *testing.T) {
+	for _, tc := range []struct {
+		mounterType string
+		params      map[string]string
+		expected    *s3.S3backerOptions
+		valid       bool
+	}{
+		{"", map[string]string{}, nil, true},
+		{rcloneMounterType, map[string]string{}, nil, true},
+		{"", map[string]string{S3backerMD5CheckKey: "false"}, &s3.S3backerOptions{}, true},
+		{s3backerMounterType, map[string]string{S3backerRetryCountKey: "3", S3backerTimeoutKey: "90s"}, &s3.S3backerOptions{MD5Check: true, RetryCount: 3, TimeoutSeconds: 90}, true},
+		{s3backerMounterType, map[string]string{S3backerMD5CheckKey: "maybe"}, nil, false},
+		{s3backerMounterType, map[string]string{S3backerRetryCountKey: "17"}, nil, false},
+		{s3backerMounterType, map[string]string{S3backerTimeoutKey: "30"}, nil, false},
+		{s3backerMounterType, map[string]string{S3backerTimeoutKey: "1500ms"}, nil, false},
+		{goofysMounterType, map[string]string{S3backerMD5CheckKey: "true"}, nil, false},
+	} {
+		o, err := ParseS3backerOptions(tc.mounterType, tc.params)
+		if tc.valid != (err == nil) {
+			t.Errorf("%s %v: unexpected error %v", tc.mounterType, tc.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, tc.expected) {
+			t.Errorf("%s %v: expected %+v, got %+v", tc.mounterType, tc.params, tc.expected, o)
+		}
+	}
+}
+
+func TestS3backerIntegrityArgs(t *testing.T) {
+	for _, tc := range []struct {
+		options  *s3.S3backerOptions
+		expected []string
+	}{
+		{nil, nil},
+		{&s3.S3backerOptions{}, []string{"--md5CacheSize=0"}},
+		{&s3.S3backerOptions{MD5Check: true, RetryCount: 3, TimeoutSeconds: 30}, []string{
+			"--md5CacheSize=1000", "--md5CacheTime=10000", "--initialRetryPause=200", "--maxRetryPause=1400", "--timeout=30",
+		}},
+	} {
+		if args := s3backerIntegrityArgs(tc.options); !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("%+v: expected %v, got %v", tc.options, tc.expected, args)
+		}
+	}
+}
+
+func TestIntegrityErrors(t *testing.T) {
+	dir := t.TempDir()
+	stats := `http_normal_fetches           4
+http_zero_fetches             0
+http_mismatch                 2
+http_verified                 3
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, s3backerStatsFile), []byte(stats), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := IntegrityErrors(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 integrity errors, got %d", n)
+	}
+	if _, err := parseS3backerStat(strings.NewReader("http_verified 3\n"), s3backerMismatchStat); err == nil {
+		t.Fatal("expected a missing counter to fail")
+	}
+}
@@ -3,29 +3,71 @@ package mounter
 import (
 	"fmt"
 	"os"
-	"path"
+	"regexp"
+	"strconv"
+	"sync"
 
 	"github.com/ctrox/csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type s3fsMounter struct {
-	meta          *s3.FSMeta
-	url           string
-	region        string
-	pwFileContent string
+	meta            *s3.FSMeta
+	url             string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
 }
 
 const (
 	s3fsCmd = "s3fs"
 )
 
+// s3fsFailures classify the errors s3fs reports when it checks the bucket
+// before mounting
+var s3fsFailures = []failurePattern{
+	{kind: ErrMountPermissionDenied, output: []string{"invalid credentials", "could not determine how to establish security credentials"}},
+	{kind: ErrMountNotFound, output: []string{"bucket not found"}},
+	{kind: ErrMountUnavailable, output: []string{"unable to connect"}},
+}
+
+var (
+	s3fsVersionPattern = regexp.MustCompile(`V(\d+)\.(\d+)`)
+
+	s3fsNoobjCacheOnce sync.Once
+	s3fsNoobjCache     bool
+)
+
+// s3fsCachesMissingObjects returns true if the s3fs of version, as printed
+// by s3fs --version, caches objects found missing by default, which it
+// does since 1.87. Older versions reject disable_noobj_cache. An unknown
+// version is taken to be a recent one.
+func s3fsCachesMissingObjects(version string) bool {
+	m := s3fsVersionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return true
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 1 || major == 1 && minor >= 87
+}
+
+// s3fsNoobjCacheDefault runs s3fs --version once to tell if it caches
+// objects found missing by default
+func s3fsNoobjCacheDefault() bool {
+	s3fsNoobjCacheOnce.Do(func() {
+		s3fsNoobjCache = s3fsCachesMissingObjects(binaryVersion(s3fsCmd)())
+	})
+	return s3fsNoobjCache
+}
+
 func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &s3fsMounter{
-		meta:          meta,
-		url:           cfg.Endpoint,
-		region:        cfg.Region,
-		pwFileContent: cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
+		meta:            meta,
+		url:             cfg.Endpoint,
+		region:          cfg.SignatureRegion(),
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
 	}, nil
 }
 
@@ -37,12 +79,13 @@ func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
 	return nil
 }
 
-func (s3fs *s3fsMounter) Mount(source string, target string) error {
-	if err := writes3fsPass(s3fs.pwFileContent); err != nil {
-		return err
-	}
+func (s3fs *s3fsMounter) Capabilities() *Capabilities {
+	return capabilities(s3fsMounterType)
+}
+
+func (s3fs *s3fsMounter) Mount(source string, target string) (err error) {
 	args := []string{
-		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, path.Join(s3fs.meta.Prefix, s3fs.meta.FSPath)),
+		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, s3fs.meta.DataPrefix()),
 		target,
 		"-o", "use_path_request_style",
 		"-o", fmt.Sprintf("url=%s", s3fs.url),
@@ -50,7 +93,56 @@ func (s3fs *s3fsMounter) Mount(source string, target string) error {
 		"-o", "allow_other",
 		"-o", "mp_umask=000",
 	}
-	return fuseMount(target, s3fsCmd, args)
+	if s3fs.meta.CacheMode == CacheModeNone {
+		// bypass the page cache and always stat objects again
+		args = append(args, "-o", "direct_io", "-o", "max_stat_cache_size=0")
+	} else if s3fs.meta.Consistency == ConsistencyStrict {
+		// objects are stat'ed again after a second, objects found missing
+		// are not cached as that would hide the files created on other
+		// nodes
+		args = append(args, "-o", "stat_cache_expire=1")
+		if s3fsNoobjCacheDefault() {
+			args = append(args, "-o", "disable_noobj_cache")
+		}
+	}
+	if s3fs.meta.MimeTypesFile != "" {
+		// instead of /etc/mime.types
+		args = append(args, "-o", "mime="+s3fs.meta.MimeTypesFile)
+	}
+	if MultipartUploadLimit() > 0 {
+		// the parts of a single upload sent at the same time
+		args = append(args, "-o", fmt.Sprintf("parallel_count=%d", uploadConcurrency(s3fsDefaultParallelCount)))
+	}
+	if s3fs.meta.ChecksumAlgorithm != "" {
+		// s3fs only knows MD5, the backend rejects corrupted uploads
+		args = append(args, "-o", "enable_content_md5")
+	}
+	if len(s3fs.meta.ObjectTags) > 0 {
+		var file string
+		if file, err = writeObjectTagsConfig(target, s3fs.meta.ObjectTags); err != nil {
+			return err
+		}
+		// only removed by the unmount of a mount which came up
+		defer func() {
+			if err != nil {
+				removeObjectTagsConfig(target)
+			}
+		}()
+		args = append(args, "-o", "ahbe_conf="+file)
+	}
+	args = append(args, outputLogArgs(s3fsCmd, target)...)
+	if systemdEnabled() {
+		// the passwd file of the driver is not visible to the unit, s3fs
+		// also reads the credentials from its environment.
+		return systemdMount(s3fs.meta, target, s3fsCmd, append(args, "-f"), map[string]string{
+			"AWSACCESSKEYID":     s3fs.accessKeyID,
+			"AWSSECRETACCESSKEY": s3fs.secretAccessKey,
+		})
+	}
+	if err := writes3fsPass(s3fs.accessKeyID + ":" + s3fs.secretAccessKey); err != nil {
+		return err
+	}
+	return fuseMount(target, s3fsCmd, args, s3fs.meta.Env, nil)
 }
 
 func writes3fsPass(pwFileContent string) error {
@@ -0,0 +1,274 @@
+package mounter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	systemdRunCmd     = "systemd-run"
+	systemctlCmd      = "systemctl"
+	systemdUnitPrefix = "csi-s3-"
+)
+
+// systemdStateDir is set if fuse mounters should be run as transient
+// systemd units. The directory keeps track of the units started by the
+// driver and has to survive restarts of the driver.
+var systemdStateDir string
+
+// unitState is persisted for every unit started by the driver
+type unitState struct {
+	Unit   string     `json:"Unit"`
+	Target string     `json:"Target"`
+	Meta   *s3.FSMeta `json:"Meta"`
+	// StartedAt is when the unit was last started
+	StartedAt time.Time `json:"StartedAt"`
+	// Failures counts the failures of the unit since it was last
+	// published, reset or active for unitStableAfter
+	Failures int `json:"Failures,omitempty"`
+	// RestartAt is when the failed unit is restarted, zero until its
+	// failure has been noticed
+	RestartAt time.Time `json:"RestartAt"`
+	// Poisoned is set once the unit failed more often than the restart
+	// limit, it is not restarted anymore
+	Poisoned bool `json:"Poisoned,omitempty"`
+}
+
+// EnableSystemd makes mounters which support it run as transient systemd
+// units, so their mounts survive restarts of the driver.
+func EnableSystemd(stateDir string) error {
+	if _, err := exec.LookPath(systemdRunCmd); err != nil {
+		return fmt.Errorf("systemd mounts enabled but %s is not available: %v", systemdRunCmd, err)
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	systemdStateDir = stateDir
+	return nil
+}
+
+func systemdEnabled() bool {
+	return systemdStateDir != ""
+}
+
+func unitName(target string) string {
+	h := sha1.New()
+	h.Write([]byte(target))
+	return systemdUnitPrefix + hex.EncodeToString(h.Sum(nil))[:16] + ".service"
+}
+
+func unitStatePath(unit string) string {
+	return filepath.Join(systemdStateDir, unit+".json")
+}
+
+// systemdMount runs the mounter in the foreground inside a transient unit,
+// which is not bound to the driver process. The node plugin restarts it on
+// failure, see SuperviseSystemdUnits.
+func systemdMount(meta *s3.FSMeta, target string, command string, args []string, env map[string]string) error {
+	unit := unitName(target)
+	cmdPath, err := exec.LookPath(command)
+	if err != nil {
+		return err
+	}
+	runArgs := []string{
+		"--unit=" + unit,
+		fmt.Sprintf("--description=csi-s3 mount of %s", target),
+	}
+	// the env of the volume never overrides the credentials
+	unitEnv := map[string]string{}
+	for k, v := range meta.Env {
+		unitEnv[k] = v
+	}
+	for k, v := range env {
+		unitEnv[k] = v
+	}
+	runArgs = append(runArgs, "--", cmdPath)
+	runArgs = append(runArgs, args...)
+
+	glog.V(3).Infof("Mounting fuse with command: %s and args: %s in systemd unit %s", command, args, unit)
+	unitStateMu.Lock()
+	// a failed unit stays loaded until it is reset, publishing the volume
+	// again starts it from scratch
+	resetFailedUnit(unit)
+	// the credentials are read from a file only root can read, arguments
+	// of systemd-run are visible in the process list and the unit
+	envFile, err := writeUnitEnv(unit, unitEnv)
+	if err != nil {
+		unitStateMu.Unlock()
+		return err
+	}
+	runArgs = append([]string{"--property=EnvironmentFile=" + envFile}, runArgs...)
+	out, err := exec.Command(systemdRunCmd, runArgs...).CombinedOutput()
+	if err != nil {
+		os.Remove(envFile)
+		unitStateMu.Unlock()
+		return fmt.Errorf("Error starting systemd unit %s for command: %s\nargs: %s\noutput: %s", unit, command, args, out)
+	}
+	err = writeUnitState(&unitState{Unit: unit, Target: target, Meta: meta, StartedAt: time.Now()})
+	unitStateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = waitForMount(target, command, mountTimeout(command), func() error {
+		if unitStatus(unit) == unitFailed {
+			return fmt.Errorf("%s exited before mounting %s, see journalctl -u %s", command, target, unit)
+		}
+		return nil
+	})
+	if err != nil {
+		// the failed publish is retried by kubelet, not by the supervisor
+		if _, stopErr := systemdUnmount(target); stopErr != nil {
+			glog.Warningf("Failed to stop systemd unit %s after failed mount: %v", unit, stopErr)
+		}
+	}
+	return err
+}
+
+// systemdUnmount stops the unit serving path. It returns false if the
+// mount at path is not managed by systemd.
+func systemdUnmount(path string) (bool, error) {
+	if !systemdEnabled() {
+		return false, nil
+	}
+	unit := unitName(path)
+	unitStateMu.Lock()
+	defer unitStateMu.Unlock()
+	if _, err := os.Stat(unitStatePath(unit)); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := stopUnit(unit); err != nil {
+		return true, err
+	}
+	removeUnitEnv(unit)
+	return true, os.Remove(unitStatePath(unit))
+}
+
+func stopUnit(unit string) error {
+	out, err := exec.Command(systemctlCmd, "stop", unit).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "not loaded") {
+		return fmt.Errorf("Error stopping systemd unit %s: %s", unit, out)
+	}
+	resetFailedUnit(unit)
+	return nil
+}
+
+// resetFailedUnit unloads a failed unit, units which are not loaded or
+// have not failed are left alone
+func resetFailedUnit(unit string) {
+	exec.Command(systemctlCmd, "reset-failed", unit).Run()
+}
+
+// unitStatus returns the state of a unit as of systemctl is-active
+var unitStatus = func(unit string) string {
+	out, _ := exec.Command(systemctlCmd, "is-active", unit).Output()
+	return strings.TrimSpace(string(out))
+}
+
+func unitActive(unit string) bool {
+	state := unitStatus(unit)
+	return state == "active" || state == "activating" || state == "reloading"
+}
+
+func unitEnvPath(unit string) string {
+	return filepath.Join(systemdStateDir, unit+".env")
+}
+
+// writeUnitEnv writes env to the EnvironmentFile of the unit, readable
+// only by root. It is kept while the unit exists, the supervisor restarts
+// the unit with it.
+func writeUnitEnv(unit string, env map[string]string) (string, error) {
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := new(strings.Builder)
+	for _, k := range keys {
+		if strings.ContainsAny(env[k], "\n\r") {
+			return "", fmt.Errorf("environment variable %s of systemd unit %s contains a line break", k, unit)
+		}
+		fmt.Fprintf(b, "%s=\"%s\"\n", k, envFileEscaper.Replace(env[k]))
+	}
+	path := unitEnvPath(unit)
+	// an existing file keeps its mode with WriteFile
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return "", fmt.Errorf("failed to write environment of systemd unit %s: %v", unit, err)
+	}
+	return path, nil
+}
+
+// envFileEscaper escapes the characters systemd interprets in the double
+// quoted values of an EnvironmentFile
+var envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+func removeUnitEnv(unit string) {
+	if err := os.Remove(unitEnvPath(unit)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove environment of systemd unit %s: %v", unit, err)
+	}
+}
+
+func writeUnitState(state *unitState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(unitStatePath(state.Unit), b, 0600)
+}
+
+// ReconcileSystemdUnits is run on startup of the driver. Mount units
+// which are still active are kept, failed ones are left to the supervisor
+// and the state of units which are gone is cleaned up together with their
+// stale mount points.
+func ReconcileSystemdUnits() error {
+	files, err := filepath.Glob(filepath.Join(systemdStateDir, systemdUnitPrefix+"*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var state unitState
+		if err := json.Unmarshal(b, &state); err != nil {
+			glog.Warningf("Removing unreadable systemd unit state %s: %v", f, err)
+			os.Remove(f)
+			continue
+		}
+		volume := ""
+		if state.Meta != nil {
+			volume = filepath.Join(state.Meta.BucketName, state.Meta.Prefix)
+		}
+		if unitActive(state.Unit) {
+			glog.V(2).Infof("Volume %s is still mounted at %s by systemd unit %s", volume, state.Target, state.Unit)
+			continue
+		}
+		if unitStatus(state.Unit) == unitFailed {
+			glog.Warningf("Systemd unit %s of volume %s at %s has failed, it is restarted by the supervisor", state.Unit, volume, state.Target)
+			continue
+		}
+		glog.Warningf("Systemd unit %s of volume %s is gone, cleaning up mount %s", state.Unit, volume, state.Target)
+		if err := mount.New("").Unmount(state.Target); err != nil {
+			glog.V(4).Infof("Unable to unmount %s: %v", state.Target, err)
+		}
+		removeUnitEnv(state.Unit)
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
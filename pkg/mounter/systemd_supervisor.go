@@ -0,0 +1,301 @@
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// unitFailed is the state of a unit whose mounter exited with an error
+	unitFailed = "failed"
+	// unitRestartBackoff is the wait before the first restart of a failed
+	// unit, it doubles with every further failure up to
+	// unitRestartMaxBackoff
+	unitRestartBackoff    = 5 * time.Second
+	unitRestartMaxBackoff = 5 * time.Minute
+	// unitStableAfter is how long a restarted unit has to stay active
+	// until its failures are forgotten
+	unitStableAfter = 10 * time.Minute
+	// DefaultUnitRestartLimit is how often a failed unit is restarted
+	// before it is poisoned
+	DefaultUnitRestartLimit = 8
+)
+
+// The events of SuperviseSystemdUnits
+const (
+	// UnitFailed is a failed unit which is restarted after a backoff
+	UnitFailed = "MounterFailed"
+	// UnitPoisoned is a unit which failed more often than the restart
+	// limit and is not restarted anymore
+	UnitPoisoned = "MounterPoisoned"
+)
+
+// unitStateMu serializes the changes of the state files of the units
+var unitStateMu sync.Mutex
+
+var unitSupervisor = struct {
+	mu       sync.Mutex
+	limit    int
+	restarts int64
+	resets   int64
+}{limit: DefaultUnitRestartLimit}
+
+// startUnit starts a failed unit again
+var startUnit = func(unit string) error {
+	out, err := exec.Command(systemctlCmd, "start", unit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error starting systemd unit %s: %s", unit, out)
+	}
+	return nil
+}
+
+// unmountStale removes the mount a failed mounter left behind, the new
+// mounter cannot mount over it
+var unmountStale = func(target string) error {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(target)
+	if err == nil && notMnt {
+		return nil
+	}
+	return mount.New("").Unmount(target)
+}
+
+// UnitEvent is a failure of a unit noticed by SuperviseSystemdUnits
+type UnitEvent struct {
+	// Reason is UnitFailed or UnitPoisoned
+	Reason   string
+	Target   string
+	VolumeID string
+	PVName   string
+	Failures int
+	// RestartIn is the backoff until the unit of a UnitFailed event is
+	// restarted
+	RestartIn time.Duration
+}
+
+// UnitFailures is a unit which failed since it was published, as reported
+// in the metrics
+type UnitFailures struct {
+	Target   string
+	VolumeID string
+	Failures int
+	Poisoned bool
+}
+
+// SetUnitRestartLimit sets how often a failed unit is restarted before it
+// is poisoned, 0 poisons it on its first failure
+func SetUnitRestartLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid systemd restart limit %d, must not be negative", limit)
+	}
+	unitSupervisor.mu.Lock()
+	defer unitSupervisor.mu.Unlock()
+	unitSupervisor.limit = limit
+	return nil
+}
+
+func unitRestartLimit() int {
+	unitSupervisor.mu.Lock()
+	defer unitSupervisor.mu.Unlock()
+	return unitSupervisor.limit
+}
+
+// UnitRestartStats returns how often failed units have been restarted and
+// poisoned units have been reset since the driver started
+func UnitRestartStats() (restarts, resets int64) {
+	unitSupervisor.mu.Lock()
+	defer unitSupervisor.mu.Unlock()
+	return unitSupervisor.restarts, unitSupervisor.resets
+}
+
+// unitRestartDelay returns the backoff after the given number of failures
+func unitRestartDelay(failures int) time.Duration {
+	delay := unitRestartBackoff
+	for i := 1; i < failures && delay < unitRestartMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > unitRestartMaxBackoff {
+		return unitRestartMaxBackoff
+	}
+	return delay
+}
+
+// SuperviseSystemdUnits restarts the failed units of the driver with an
+// exponential backoff and returns the failures it noticed. A unit failing
+// more often than the restart limit is poisoned, it is left failed until
+// the volume is published again or the unit is reset with
+// ResetSystemdUnit. The failures are kept in the state of the units, so
+// the backoff survives restarts of the driver.
+func SuperviseSystemdUnits(now time.Time) []UnitEvent {
+	var events []UnitEvent
+	for _, state := range readUnitStates() {
+		if e := superviseUnit(state.Unit, now); e != nil {
+			events = append(events, *e)
+		}
+	}
+	return events
+}
+
+func superviseUnit(unit string, now time.Time) *UnitEvent {
+	unitStateMu.Lock()
+	defer unitStateMu.Unlock()
+	state, err := readUnitState(unit)
+	if err != nil {
+		// the volume has been unpublished in the meantime
+		return nil
+	}
+	switch status := unitStatus(unit); {
+	case status == "active":
+		if !state.RestartAt.IsZero() {
+			// started by someone else, e.g. with systemctl
+			state.RestartAt = time.Time{}
+			writeUnitStateOrWarn(state)
+		}
+		if state.Failures > 0 && now.Sub(state.StartedAt) >= unitStableAfter {
+			glog.Infof("Systemd unit %s of %s is active again for %v, forgetting its %d failures", unit, state.Target, unitStableAfter, state.Failures)
+			state.Failures = 0
+			writeUnitStateOrWarn(state)
+		}
+		return nil
+	case status != unitFailed || state.Poisoned:
+		return nil
+	}
+	if state.RestartAt.IsZero() {
+		return unitFailure(state, now)
+	}
+	if now.Before(state.RestartAt) {
+		return nil
+	}
+	if err := unmountStale(state.Target); err != nil {
+		glog.Warningf("Failed to unmount %s of failed systemd unit %s: %v", state.Target, unit, err)
+	}
+	state.StartedAt = now
+	state.RestartAt = time.Time{}
+	if err := startUnit(unit); err != nil {
+		glog.Errorf("Failed to restart systemd unit %s of %s: %v", unit, state.Target, err)
+		return unitFailure(state, now)
+	}
+	unitSupervisor.mu.Lock()
+	unitSupervisor.restarts++
+	unitSupervisor.mu.Unlock()
+	glog.Infof("Restarted systemd unit %s of %s after %d failures", unit, state.Target, state.Failures)
+	writeUnitStateOrWarn(state)
+	return nil
+}
+
+// unitFailure counts a failure of the unit and schedules its restart or
+// poisons it
+func unitFailure(state *unitState, now time.Time) *UnitEvent {
+	state.Failures++
+	e := &UnitEvent{Reason: UnitFailed, Target: state.Target, Failures: state.Failures}
+	if state.Meta != nil {
+		e.VolumeID = filepath.Join(state.Meta.BucketName, state.Meta.Prefix)
+		e.PVName = state.Meta.PVName
+	}
+	if state.Failures > unitRestartLimit() {
+		state.Poisoned = true
+		e.Reason = UnitPoisoned
+		glog.Errorf("Systemd unit %s of %s failed %d times, it is not restarted until the volume is published again or the unit is reset", state.Unit, state.Target, state.Failures)
+	} else {
+		e.RestartIn = unitRestartDelay(state.Failures)
+		state.RestartAt = now.Add(e.RestartIn)
+		glog.Warningf("Systemd unit %s of %s failed %d times, restarting it in %v", state.Unit, state.Target, state.Failures, e.RestartIn)
+	}
+	writeUnitStateOrWarn(state)
+	return e
+}
+
+// ResetSystemdUnit forgets the failures of the unit mounting target, so
+// the supervisor restarts a poisoned unit right away
+func ResetSystemdUnit(target string) error {
+	unitStateMu.Lock()
+	defer unitStateMu.Unlock()
+	state, err := readUnitState(unitName(target))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not mounted by a systemd unit", target)
+	}
+	if err != nil {
+		return err
+	}
+	glog.Infof("Resetting the %d failures of systemd unit %s of %s", state.Failures, state.Unit, target)
+	if state.Poisoned {
+		// the restart is due with the next check
+		state.RestartAt = time.Now()
+	}
+	state.Failures = 0
+	state.Poisoned = false
+	if err := writeUnitState(state); err != nil {
+		return err
+	}
+	unitSupervisor.mu.Lock()
+	unitSupervisor.resets++
+	unitSupervisor.mu.Unlock()
+	return nil
+}
+
+// SystemdUnitFailures returns the units which have failed since they
+// were published
+func SystemdUnitFailures() []UnitFailures {
+	var failures []UnitFailures
+	for _, state := range readUnitStates() {
+		if state.Failures == 0 {
+			continue
+		}
+		f := UnitFailures{Target: state.Target, Failures: state.Failures, Poisoned: state.Poisoned}
+		if state.Meta != nil {
+			f.VolumeID = filepath.Join(state.Meta.BucketName, state.Meta.Prefix)
+		}
+		failures = append(failures, f)
+	}
+	return failures
+}
+
+func readUnitState(unit string) (*unitState, error) {
+	b, err := ioutil.ReadFile(unitStatePath(unit))
+	if err != nil {
+		return nil, err
+	}
+	var state unitState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// readUnitStates returns the states of the units of the driver, unreadable
+// ones are left to ReconcileSystemdUnits
+func readUnitStates() []*unitState {
+	if !systemdEnabled() {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(systemdStateDir, systemdUnitPrefix+"*.json"))
+	if err != nil {
+		return nil
+	}
+	var states []*unitState
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var state unitState
+		if err := json.Unmarshal(b, &state); err == nil {
+			states = append(states, &state)
+		}
+	}
+	return states
+}
+
+func writeUnitStateOrWarn(state *unitState) {
+	if err := writeUnitState(state); err != nil {
+		glog.Warningf("Failed to write the state of systemd unit %s: %v", state.Unit, err)
+	}
+}
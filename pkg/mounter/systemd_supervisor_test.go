@@ -0,0 +1,122 @@
+package mounter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestUnitRestartDelay(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:  5 * time.Second,
+		2:  10 * time.Second,
+		4:  40 * time.Second,
+		7:  unitRestartMaxBackoff,
+		30: unitRestartMaxBackoff,
+	} {
+		if delay := unitRestartDelay(failures); delay != expected {
+			t.Errorf("%d failures: expected %v, got %v", failures, expected, delay)
+		}
+	}
+}
+
+func TestSuperviseSystemdUnits(t *testing.T) {
+	defer func(dir string, status func(string) string, start func(string) error, unmount func(string) error) {
+		systemdStateDir, unitStatus, startUnit, unmountStale = dir, status, start, unmount
+		SetUnitRestartLimit(DefaultUnitRestartLimit)
+	}(systemdStateDir, unitStatus, startUnit, unmountStale)
+	systemdStateDir = t.TempDir()
+	if err := SetUnitRestartLimit(2); err != nil {
+		t.Fatal(err)
+	}
+
+	status := "failed"
+	var started int
+	var startErr error
+	unitStatus = func(unit string) string { return status }
+	startUnit = func(unit string) error {
+		started++
+		return startErr
+	}
+	unmountStale = func(target string) error { return nil }
+
+	target := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount"
+	unit := unitName(target)
+	now := time.Now()
+	meta := &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-a", PVName: "pv-a"}
+	if err := writeUnitState(&unitState{Unit: unit, Target: target, Meta: meta, StartedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	restarts, _ := UnitRestartStats()
+
+	events := SuperviseSystemdUnits(now)
+	if len(events) != 1 || events[0].Reason != UnitFailed || events[0].Failures != 1 ||
+		events[0].RestartIn != unitRestartBackoff || events[0].VolumeID != "bucket/pvc-a" || events[0].PVName != "pv-a" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	// the backoff is kept in the state, not in the supervisor
+	if events := SuperviseSystemdUnits(now.Add(time.Second)); len(events) != 0 || started != 0 {
+		t.Fatalf("expected the unit to wait for its backoff, got %+v and %d starts", events, started)
+	}
+	SuperviseSystemdUnits(now.Add(unitRestartBackoff))
+	if n, _ := UnitRestartStats(); started != 1 || n != restarts+1 {
+		t.Fatalf("expected the unit to be restarted once, got %d", started)
+	}
+
+	// the restarted unit fails again
+	events = SuperviseSystemdUnits(now.Add(2 * unitRestartBackoff))
+	if len(events) != 1 || events[0].Failures != 2 || events[0].RestartIn != 2*unitRestartBackoff {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	// a restart which fails counts as a failure
+	startErr = errors.New("unit not loaded")
+	events = SuperviseSystemdUnits(now.Add(4 * unitRestartBackoff))
+	if len(events) != 1 || events[0].Reason != UnitPoisoned || events[0].Failures != 3 {
+		t.Fatalf("expected the unit to be poisoned, got %+v", events)
+	}
+	if events := SuperviseSystemdUnits(now.Add(5 * unitRestartBackoff)); len(events) != 0 {
+		t.Fatalf("expected the poisoned unit to be reported once, got %+v", events)
+	}
+	if failures := SystemdUnitFailures(); len(failures) != 1 || !failures[0].Poisoned || failures[0].Failures != 3 {
+		t.Fatalf("expected the unit to be poisoned after 3 failures, got %+v", failures)
+	}
+	started = 0
+	if events := SuperviseSystemdUnits(now.Add(time.Hour)); len(events) != 0 || started != 0 {
+		t.Fatalf("expected a poisoned unit not to be restarted, got %+v and %d starts", events, started)
+	}
+
+	// a reset restarts the poisoned unit with the next check
+	if err := ResetSystemdUnit(target); err != nil {
+		t.Fatal(err)
+	}
+	startErr = nil
+	SuperviseSystemdUnits(time.Now().Add(time.Second))
+	if started != 1 || len(SystemdUnitFailures()) != 0 {
+		t.Fatalf("expected the reset unit to be restarted, got %d starts and %+v", started, SystemdUnitFailures())
+	}
+	if _, resets := UnitRestartStats(); resets == 0 {
+		t.Fatal("expected the reset to be counted")
+	}
+	if err := ResetSystemdUnit("/other"); err == nil {
+		t.Fatal("expected an error for a target without a unit")
+	}
+
+	// a unit which stays active long enough forgets its failures
+	status = "failed"
+	SuperviseSystemdUnits(time.Now())
+	status = "active"
+	SuperviseSystemdUnits(time.Now().Add(unitStableAfter))
+	if failures := SystemdUnitFailures(); len(failures) != 1 {
+		t.Fatalf("expected the failure to be kept until the unit is stable, got %+v", failures)
+	}
+	state, err := readUnitState(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SuperviseSystemdUnits(state.StartedAt.Add(unitStableAfter))
+	if failures := SystemdUnitFailures(); len(failures) != 0 {
+		t.Fatalf("expected the failures of a stable unit to be forgotten, got %+v", failures)
+	}
+}
@@ -0,0 +1,130 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// fakeSystemd replaces systemd-run and systemctl with scripts. systemd-run
+// records its arguments in args and a copy of the EnvironmentFile of the
+// unit in env of the returned directory, the unit always fails.
+func fakeSystemd(t *testing.T) string {
+	dir := t.TempDir()
+	bin := t.TempDir()
+	scripts := map[string]string{
+		systemdRunCmd: "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+			"for a in \"$@\"; do case \"$a\" in --property=EnvironmentFile=*) cp \"${a#--property=EnvironmentFile=}\" " + filepath.Join(dir, "env") + ";; esac; done\n",
+		systemctlCmd: "#!/bin/sh\n",
+		rcloneCmd:    "#!/bin/sh\necho obscured\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	dir0, status := systemdStateDir, unitStatus
+	systemdStateDir = t.TempDir()
+	unitStatus = func(unit string) string { return unitFailed }
+	t.Cleanup(func() { systemdStateDir, unitStatus = dir0, status })
+	return dir
+}
+
+func TestWriteUnitEnv(t *testing.T) {
+	defer func(dir string) { systemdStateDir = dir }(systemdStateDir)
+	systemdStateDir = t.TempDir()
+
+	unit := unitName("/target")
+	path, err := writeUnitEnv(unit, map[string]string{
+		"AWS_SECRET_ACCESS_KEY": `se"cr$et\`,
+		"AWS_ACCESS_KEY_ID":     "key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the environment to be readable only by root, got %v", info.Mode())
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "AWS_ACCESS_KEY_ID=\"key\"\nAWS_SECRET_ACCESS_KEY=\"se\\\"cr\\$et\\\\\"\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, b)
+	}
+
+	if _, err := writeUnitEnv(unit, map[string]string{"VAR": "a\nB=b"}); err == nil {
+		t.Error("expected a value with a line break to be rejected")
+	}
+	removeUnitEnv(unit)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the environment to be removed, got %v", err)
+	}
+}
+
+func TestRcloneSystemdEnv(t *testing.T) {
+	dir := fakeSystemd(t)
+	meta := &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-a", Mounter: rcloneMounterType, ClientEncrypted: true}
+	m, err := newRcloneMounter(meta, &s3.Config{Endpoint: "http://localhost:9000", AccessKeyID: "key", SecretAccessKey: "secret", ClientEncryptionPassphrase: "passphrase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "mount")
+	if err := os.MkdirAll(target, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount("", target); err == nil {
+		t.Fatal("expected the failed unit to fail the mount")
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := readRCState(target)
+	if err != nil || rc == nil {
+		t.Fatalf("expected the remote control state to be written, got %v", err)
+	}
+	for _, v := range []string{`RCLONE_CRYPT_PASSWORD="obscured"`, `AWS_SECRET_ACCESS_KEY="secret"`,
+		`RCLONE_RC_USER="` + rc.User + `"`, `RCLONE_RC_PASS="` + rc.Pass + `"`} {
+		if !strings.Contains(string(env), v) {
+			t.Errorf("expected %s in the environment of the unit, got %q", v, env)
+		}
+	}
+	for _, v := range []string{"obscured", "secret", rc.User, rc.Pass} {
+		if strings.Contains(string(args), v) {
+			t.Errorf("expected no credentials in the arguments of systemd-run, got %q", args)
+		}
+	}
+	if _, err := os.Stat(unitEnvPath(unitName(target))); !os.IsNotExist(err) {
+		t.Errorf("expected the environment of the failed unit to be removed, got %v", err)
+	}
+}
+
+func TestCheckMimeTypesFileOfUnit(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "mime.types")
+	if err := CheckMimeTypesFile(s3fsMounterType, missing); err == nil {
+		t.Fatal("expected a missing file to be refused")
+	}
+	fakeSystemd(t)
+	if err := CheckMimeTypesFile(s3fsMounterType, missing); err != nil {
+		t.Fatalf("expected the file of a unit on the host not to be checked, got %v", err)
+	}
+}
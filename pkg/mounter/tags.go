@@ -0,0 +1,122 @@
+package mounter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// ObjectTagsKey tags every object the mounter of a volume uploads, a
+	// comma separated list of key=value
+	ObjectTagsKey = "objectTags"
+	// maxObjectTags is the number of tags S3 allows on an object
+	maxObjectTags = 10
+	// objectTagsConfigName is the ahbe_conf of s3fs adding the tags to its
+	// uploads
+	objectTagsConfigName = "s3fs-tags.conf"
+)
+
+// tagPattern matches the characters S3 allows in the keys and values of tags
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// ParseObjectTags returns the tags the objects of a volume are uploaded
+// with, nil if value is empty. It returns an error if a tag is invalid for
+// S3 or the mounter type cannot tag its uploads.
+func ParseObjectTags(mounterType, value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid %s entry %q, must be key=value", ObjectTagsKey, entry)
+		}
+		key, val := kv[0], kv[1]
+		switch {
+		case key == "" || utf8.RuneCountInString(key) > 128:
+			return nil, fmt.Errorf("invalid %s key %q, must have 1 to 128 characters", ObjectTagsKey, key)
+		case utf8.RuneCountInString(val) > 256:
+			return nil, fmt.Errorf("invalid %s value of %s, must not have more than 256 characters", ObjectTagsKey, key)
+		case !tagPattern.MatchString(key) || !tagPattern.MatchString(val):
+			return nil, fmt.Errorf("invalid %s entry %q, only letters, digits, spaces and _ . : / = + - @ are allowed", ObjectTagsKey, entry)
+		case strings.HasPrefix(strings.ToLower(key), "aws:"):
+			return nil, fmt.Errorf("invalid %s key %s, the prefix aws: is reserved", ObjectTagsKey, key)
+		}
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("%s sets %s more than once", ObjectTagsKey, key)
+		}
+		tags[key] = val
+	}
+	if len(tags) > maxObjectTags {
+		return nil, fmt.Errorf("%s sets %d tags, S3 allows at most %d on an object", ObjectTagsKey, len(tags), maxObjectTags)
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return nil, err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsObjectTags {
+		return nil, fmt.Errorf("mounter %s does not support %s", mounterType, ObjectTagsKey)
+	}
+	return tags, nil
+}
+
+// objectTagsHeader returns the value of the x-amz-tagging header of the
+// tags, encoded like a query string with spaces as %20
+func objectTagsHeader(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	escape := func(s string) string {
+		return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	}
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, escape(k)+"="+escape(tags[k]))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// objectTagsConfigFile is next to the target path, like the rclone config,
+// so s3fs running as a systemd unit can read it as well
+func objectTagsConfigFile(target string) string {
+	return filepath.Join(filepath.Dir(origin(target)), objectTagsConfigName)
+}
+
+// writeObjectTagsConfig writes the ahbe_conf of s3fs which adds the tagging
+// header to the uploads of every file of the mount at target
+func writeObjectTagsConfig(target string, tags map[string]string) (string, error) {
+	file := objectTagsConfigFile(target)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return "", err
+	}
+	// a key starting with reg: is a regular expression matched against
+	// the path of a file, any other key is a suffix of its name
+	config := fmt.Sprintf("reg:.* x-amz-tagging %s\n", objectTagsHeader(tags))
+	if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// removeObjectTagsConfig removes the tags config of the mount at target,
+// if any
+func removeObjectTagsConfig(target string) {
+	if err := os.Remove(objectTagsConfigFile(target)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove object tags config of %s: %v", target, err)
+	}
+}
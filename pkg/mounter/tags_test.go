@@ -0,0 +1,132 @@
+package mounter
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestParseObjectTags(t *testing.T) {
+	tags, err := ParseObjectTags(s3fsMounterType, "team=data, cost-center=42,owner=a b@example.com,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"team": "data", "cost-center": "42", "owner": "a b@example.com", "empty": ""}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+	if tags, err := ParseObjectTags(s3fsMounterType, ""); tags != nil || err != nil {
+		t.Fatalf("expected no tags, got %v, %v", tags, err)
+	}
+	for _, value := range []string{
+		"team",
+		"=data",
+		"team=data,team=other",
+		"team=data&other",
+		"team=data;",
+		"aws:createdBy=me",
+		strings.Repeat("k", 129) + "=v",
+		"k=" + strings.Repeat("v", 257),
+		"a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11",
+	} {
+		if _, err := ParseObjectTags(s3fsMounterType, value); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+	if _, err := ParseObjectTags(s3backerMounterType, "team=data"); err == nil {
+		t.Fatal("expected s3backer to be rejected")
+	}
+	if _, err := ParseObjectTags(rcloneMounterType, "team=data"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectTagsConfig(t *testing.T) {
+	tags := map[string]string{"team": "data", "owner": "a b/c"}
+	if header := objectTagsHeader(tags); header != "owner=a%20b%2Fc&team=data" {
+		t.Fatalf("unexpected header %s", header)
+	}
+	target := filepath.Join(t.TempDir(), "pv", "mount")
+	file, err := writeObjectTagsConfig(target, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "reg:.* x-amz-tagging owner=a%20b%2Fc&team=data\n" {
+		t.Fatalf("unexpected config %q", b)
+	}
+	for _, p := range []string{"/file", "/dir/file.txt", "/.hidden"} {
+		if headers := ahbeHeaders(t, string(b), p); !reflect.DeepEqual(headers, map[string]string{"x-amz-tagging": "owner=a%20b%2Fc&team=data"}) {
+			t.Errorf("expected the tagging header for %s, got %v", p, headers)
+		}
+	}
+	removeObjectTagsConfig(target)
+	if _, err := ioutil.ReadFile(file); err == nil {
+		t.Fatal("expected the config to be removed")
+	}
+}
+
+// ahbeHeaders returns the headers s3fs adds to the upload of the file at
+// path with the ahbe_conf config, parsed like s3fs does: each line is a
+// key, a header and a value separated by whitespace, a key starting with
+// reg: is a regular expression matched against the path, any other key a
+// suffix of it.
+func ahbeHeaders(t *testing.T, config, path string) map[string]string {
+	headers := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			t.Fatalf("invalid line %q", line)
+		}
+		key, value := fields[0], ""
+		if len(fields) == 3 {
+			value = fields[2]
+		}
+		if strings.HasPrefix(strings.ToLower(key), "reg:") {
+			re, err := regexp.Compile(key[len("reg:"):])
+			if err != nil {
+				t.Fatalf("invalid regular expression in %q: %v", line, err)
+			}
+			if re.MatchString(path) {
+				headers[fields[1]] = value
+			}
+		} else if strings.HasSuffix(path, key) {
+			headers[fields[1]] = value
+		}
+	}
+	return headers
+}
+
+func TestObjectTagsConfigRemovedOnFailedMount(t *testing.T) {
+	fakeSystemd(t)
+	meta := &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-a", Mounter: s3fsMounterType, ObjectTags: map[string]string{"team": "data"}}
+	m, err := newS3fsMounter(meta, &s3.Config{Endpoint: "http://localhost:9000", AccessKeyID: "key", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "mount")
+	if err := os.MkdirAll(target, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount("", target); err == nil {
+		t.Fatal("expected the failed unit to fail the mount")
+	}
+	if _, err := os.Stat(objectTagsConfigFile(target)); !os.IsNotExist(err) {
+		t.Fatalf("expected the config of the failed mount to be removed, got %v", err)
+	}
+}
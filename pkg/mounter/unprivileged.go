@@ -0,0 +1,63 @@
+package mounter
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/golang/glog"
+)
+
+// fusermountCmds are the helpers unprivileged FUSE mounts are made and
+// removed with, in the order they are tried
+var fusermountCmds = []string{"fusermount3", "fusermount"}
+
+// unprivileged is set if the node plugin runs without privileges. The
+// mounters then mount through fusermount or in the user namespace of the
+// plugin, and /dev/fuse is provided by a device plugin.
+var unprivileged bool
+
+// SetUnprivileged makes the driver only use the mounters which can mount
+// without privileges and unmount through fusermount
+func SetUnprivileged(enabled bool) {
+	unprivileged = enabled
+}
+
+// Unprivileged returns true if the node plugin runs without privileges
+func Unprivileged() bool {
+	return unprivileged
+}
+
+// ValidateUnprivileged returns an error if the driver runs without
+// privileges and the mounter type needs them
+func ValidateUnprivileged(mounterType string) error {
+	if !unprivileged {
+		return nil
+	}
+	c, err := GetCapabilities(mounterType)
+	if err != nil {
+		return err
+	}
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	if !c.SupportsUnprivileged {
+		return fmt.Errorf("mounter %s cannot mount without privileges, the driver runs with --unprivileged", mounterType)
+	}
+	return nil
+}
+
+// fusermountUnmount removes the FUSE mount at path with fusermount, which
+// does not need privileges for mounts of the same user
+func fusermountUnmount(path string) error {
+	for _, cmd := range fusermountCmds {
+		if _, err := exec.LookPath(cmd); err != nil {
+			continue
+		}
+		glog.V(4).Infof("Unmounting %s with %s", path, cmd)
+		if out, err := exec.Command(cmd, "-u", path).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s -u %s failed: %v: %s", cmd, path, err, out)
+		}
+		return nil
+	}
+	return fmt.Errorf("none of %v found in PATH, cannot unmount %s without privileges", fusermountCmds, path)
+}
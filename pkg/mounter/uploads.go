@@ -0,0 +1,141 @@
+package mounter
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// the number of parts the mounters upload at the same time by default
+	s3fsDefaultParallelCount   = 5
+	rcloneDefaultTransfers     = 4
+	rcloneDefaultUploadWorkers = 4
+)
+
+// partUploads limits the multipart upload requests sent at the same time
+// on the node. Only goofys runs inside of the driver and can share the
+// limit, the mounters running as their own process get the limit as the
+// maximum of a single mount.
+var partUploads = &uploadLimiter{}
+
+// goofysHTTPClient sends the requests of goofys mounts through a transport
+// of their own, which holds back the part uploads beyond the limit
+var goofysHTTPClient = &http.Client{Transport: &limitedTransport{next: newGoofysTransport(), limiter: partUploads}}
+
+// newGoofysTransport returns a transport like the default one, with the
+// idle connections per host goofys sets on the default transport
+func newGoofysTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = 1000
+	return tr
+}
+
+// useGoofysHTTPClient makes the AWS SDK sessions goofys creates while a
+// mount is set up send their requests with goofysHTTPClient. goofys does
+// not take a client, the SDK takes http.DefaultClient when a session is
+// created, so it is replaced until the returned function restores it. The
+// caller has to serialize the mounts of goofys.
+func useGoofysHTTPClient() func() {
+	defaultClient := http.DefaultClient
+	http.DefaultClient = goofysHTTPClient
+	return func() { http.DefaultClient = defaultClient }
+}
+
+type uploadLimiter struct {
+	mu    sync.Mutex
+	limit int
+	slots chan struct{}
+	// limited counts the part uploads which had to wait for a slot
+	limited int64
+}
+
+// SetMultipartUploadLimit caps the parts uploaded at the same time on the
+// node, 0 does not limit them
+func SetMultipartUploadLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid multipart upload limit %d, must not be negative", limit)
+	}
+	partUploads.mu.Lock()
+	defer partUploads.mu.Unlock()
+	partUploads.limit = limit
+	partUploads.slots = nil
+	if limit > 0 {
+		partUploads.slots = make(chan struct{}, limit)
+	}
+	return nil
+}
+
+// MultipartUploadLimit returns the limit of parts uploaded at the same
+// time on the node, 0 if they are not limited
+func MultipartUploadLimit() int {
+	partUploads.mu.Lock()
+	defer partUploads.mu.Unlock()
+	return partUploads.limit
+}
+
+// MultipartUploadStats returns the parts being uploaded by goofys and how
+// often an upload had to wait for the limit
+func MultipartUploadStats() (inProgress int, limited int64) {
+	partUploads.mu.Lock()
+	defer partUploads.mu.Unlock()
+	return len(partUploads.slots), partUploads.limited
+}
+
+// acquire waits for a slot to upload a part, the returned function
+// releases it
+func (l *uploadLimiter) acquire(r *http.Request) (func(), error) {
+	l.mu.Lock()
+	slots := l.slots
+	l.mu.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		l.mu.Lock()
+		l.limited++
+		l.mu.Unlock()
+		select {
+		case slots <- struct{}{}:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+// limitedTransport holds back the part uploads beyond the limit, all other
+// requests are sent right away
+type limitedTransport struct {
+	next    http.RoundTripper
+	limiter *uploadLimiter
+}
+
+func (t *limitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !isPartUpload(r) {
+		return t.next.RoundTrip(r)
+	}
+	release, err := t.limiter.acquire(r)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return t.next.RoundTrip(r)
+}
+
+// isPartUpload returns true for the UploadPart requests of a multipart
+// upload, each of them sends a part buffered by the mounter
+func isPartUpload(r *http.Request) bool {
+	q := r.URL.Query()
+	return r.Method == http.MethodPut && q.Get("uploadId") != "" && q.Get("partNumber") != ""
+}
+
+// uploadConcurrency returns def capped by the multipart upload limit
+func uploadConcurrency(def int) int {
+	if limit := MultipartUploadLimit(); limit > 0 && limit < def {
+		return limit
+	}
+	return def
+}
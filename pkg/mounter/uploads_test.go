@@ -0,0 +1,88 @@
+package mounter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMultipartUploadLimit(t *testing.T) {
+	defer SetMultipartUploadLimit(0)
+	if err := SetMultipartUploadLimit(2); err != nil {
+		t.Fatal(err)
+	}
+	if SetMultipartUploadLimit(-1) == nil {
+		t.Fatal("expected a negative limit to be rejected")
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Fatal("expected the default client of the driver to be left alone")
+	}
+	restore := useGoofysHTTPClient()
+	if http.DefaultClient != goofysHTTPClient {
+		t.Fatal("expected goofys to get its own client while it mounts")
+	}
+	restore()
+	if http.DefaultClient == goofysHTTPClient {
+		t.Fatal("expected the default client to be restored")
+	}
+
+	var running, peak int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "" {
+			return
+		}
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&peak)
+			if n <= m || atomic.CompareAndSwapInt32(&peak, m, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer srv.Close()
+
+	put := func(query string) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/bucket/key?"+query, strings.NewReader("part"))
+		resp, err := goofysHTTPClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+	_, before := MultipartUploadStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			put("uploadId=1&partNumber=1")
+		}()
+	}
+	for {
+		if _, limited := MultipartUploadStats(); limited == before+1 && atomic.LoadInt32(&running) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// other requests are never held back
+	put("")
+	close(release)
+	wg.Wait()
+	if peak != 2 {
+		t.Fatalf("expected at most 2 parts to be uploaded at the same time, got %d", peak)
+	}
+	if inProgress, _ := MultipartUploadStats(); inProgress != 0 {
+		t.Fatalf("expected all slots to be released, %d are taken", inProgress)
+	}
+	if n := uploadConcurrency(s3fsDefaultParallelCount); n != 2 {
+		t.Fatalf("expected the concurrency of a mount to be capped, got %d", n)
+	}
+}
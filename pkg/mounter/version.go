@@ -0,0 +1,93 @@
+package mounter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	// VersionNotInstalled is reported for mounters whose binary is missing
+	VersionNotInstalled = "not installed"
+	// VersionUnknown is reported if the version could not be detected
+	VersionUnknown = "unknown"
+
+	versionTimeout = 5 * time.Second
+)
+
+// DetectVersions returns the version of every registered mounter. Mounter
+// binaries are invoked with --version, so the result should be cached.
+func DetectVersions() map[string]string {
+	versions := make(map[string]string)
+	for _, t := range Types() {
+		versions[t] = registry[t].version()
+	}
+	return versions
+}
+
+// binaryVersion returns the first line printed by command --version
+func binaryVersion(command string) func() string {
+	return func() string {
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return VersionNotInstalled
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+		defer cancel()
+		// some mounters print their version to stderr or exit with an
+		// error after printing it, only the output matters
+		out, _ := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+		line := strings.TrimSpace(string(bytes.SplitN(bytes.TrimSpace(out), []byte("\n"), 2)[0]))
+		if line == "" {
+			return VersionUnknown
+		}
+		return line
+	}
+}
+
+// CheckBinary returns an error naming the binary of the mounter if it is
+// missing or not executable. Mounters running inside of the driver
+// process, like goofys, have no binary.
+func CheckBinary(mounterType string) error {
+	if mounterType == "" {
+		mounterType = defaultMounterType
+	}
+	reg, ok := registry[mounterType]
+	if !ok {
+		return fmt.Errorf("unknown mounter %s, must be one of %v", mounterType, Types())
+	}
+	if reg.binary == "" {
+		return nil
+	}
+	return checkBinary(mounterType, reg.binary)
+}
+
+func checkBinary(mounterType, command string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("binary %s of mounter %s is not usable: %v", command, mounterType, err)
+	}
+	return nil
+}
+
+// moduleVersion returns the version of a Go module linked into the driver
+func moduleVersion(module string) func() string {
+	return func() string {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return VersionUnknown
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == module {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				return module + " " + dep.Version
+			}
+		}
+		return VersionUnknown
+	}
+}
@@ -0,0 +1,65 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBinaryVersion(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "fake-mounter")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'fake-mounter v1.2.3\nbuilt with go' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if v := binaryVersion(script)(); v != "fake-mounter v1.2.3" {
+		t.Errorf("expected the first line of the output, got %q", v)
+	}
+	if v := binaryVersion(filepath.Join(dir, "missing"))(); v != VersionNotInstalled {
+		t.Errorf("expected %q, got %q", VersionNotInstalled, v)
+	}
+	if versions := DetectVersions(); len(versions) != len(Types()) {
+		t.Errorf("expected a version of every mounter, got %v", versions)
+	}
+}
+
+func TestCheckBinary(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "executable")
+	if err := ioutil.WriteFile(executable, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain")
+	if err := ioutil.WriteFile(plain, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBinary("fake", executable); err != nil {
+		t.Errorf("expected an executable binary to pass, got %v", err)
+	}
+	for _, command := range []string{plain, filepath.Join(dir, "missing")} {
+		if err := checkBinary("fake", command); err == nil || !strings.Contains(err.Error(), command) {
+			t.Errorf("expected an error naming %s, got %v", command, err)
+		}
+	}
+	// goofys is linked into the driver
+	if err := CheckBinary(goofysMounterType); err != nil {
+		t.Errorf("expected goofys to have no binary, got %v", err)
+	}
+	if err := CheckBinary("unknown"); err == nil {
+		t.Error("expected an unknown mounter to fail")
+	}
+}
+
+func TestS3fsCachesMissingObjects(t *testing.T) {
+	for version, expected := range map[string]bool{
+		"Amazon Simple Storage Service File System V1.84(commit:unknown) with GnuTLS(gcrypt)": false,
+		"Amazon Simple Storage Service File System V1.87 (commit:194262c) with OpenSSL":       true,
+		"Amazon Simple Storage Service File System V1.93 (commit:unknown) with OpenSSL":       true,
+		VersionUnknown: true,
+	} {
+		if caches := s3fsCachesMissingObjects(version); caches != expected {
+			t.Errorf("%q: expected %v, got %v", version, expected, caches)
+		}
+	}
+}
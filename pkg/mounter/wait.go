@@ -0,0 +1,250 @@
+package mounter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// defaultMountTimeout bounds the wait for mounters without a timeout of
+	// their own
+	defaultMountTimeout = 10 * time.Second
+	// the interval of checking the mount table grows up to
+	// maxMountPollInterval while no change of the mount table is signalled
+	minMountPollInterval = 10 * time.Millisecond
+	maxMountPollInterval = time.Second
+	// mountProgressInterval is the interval of logging that a mounter is
+	// still starting
+	mountProgressInterval = 10 * time.Second
+)
+
+var mountInfoPath = "/proc/self/mountinfo"
+
+var (
+	mountTimeoutsMu sync.Mutex
+	// mountTimeouts overrides the mount timeouts of the registry by
+	// mounter type
+	mountTimeouts = map[string]time.Duration{}
+)
+
+// ParseMountTimeouts parses a comma separated list of <mounter>=<duration>
+// pairs, e.g. s3backer=10m,rclone=30s
+func ParseMountTimeouts(spec string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if spec == "" {
+		return timeouts, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid mount timeout %q, must be <mounter>=<duration>", pair)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount timeout of mounter %s: %v", kv[0], err)
+		}
+		timeouts[kv[0]] = d
+	}
+	return timeouts, nil
+}
+
+// SetMountTimeouts sets the maximum time to wait for the mounters of the
+// given types to serve their mount, other mounters keep their default
+func SetMountTimeouts(timeouts map[string]time.Duration) error {
+	for t, d := range timeouts {
+		if _, ok := registry[t]; !ok {
+			return fmt.Errorf("unknown mounter %s, must be one of %v", t, Types())
+		}
+		if d <= 0 {
+			return fmt.Errorf("mount timeout of mounter %s must be positive", t)
+		}
+	}
+	mountTimeoutsMu.Lock()
+	defer mountTimeoutsMu.Unlock()
+	mountTimeouts = make(map[string]time.Duration, len(timeouts))
+	for t, d := range timeouts {
+		mountTimeouts[t] = d
+	}
+	return nil
+}
+
+// mountTimeout returns the maximum time to wait for the mounter of the
+// type to serve its mount. The mounter commands are named after their
+// types.
+func mountTimeout(mounterType string) time.Duration {
+	mountTimeoutsMu.Lock()
+	defer mountTimeoutsMu.Unlock()
+	if d, ok := mountTimeouts[mounterType]; ok {
+		return d
+	}
+	if d := registry[mounterType].mountTimeout; d > 0 {
+		return d
+	}
+	return defaultMountTimeout
+}
+
+// MountTimeouts returns the mount timeout of every mounter type, for
+// logging
+func MountTimeouts() []string {
+	var timeouts []string
+	for _, t := range Types() {
+		timeouts = append(timeouts, fmt.Sprintf("%s=%v", t, mountTimeout(t)))
+	}
+	return timeouts
+}
+
+// MaxMountTimeout returns the longest time the driver waits for a mounter
+// to serve its mount
+func MaxMountTimeout() time.Duration {
+	var max time.Duration
+	for _, t := range Types() {
+		if d := mountTimeout(t); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// mountWatcher signals changes of the mount table. The kernel flags
+// mountinfo with POLLPRI whenever a filesystem is mounted or unmounted.
+type mountWatcher struct {
+	f *os.File
+}
+
+// watchMounts returns a watcher of the mount table or nil if changes can
+// not be watched, the caller then has to poll on its own.
+func watchMounts() *mountWatcher {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		glog.V(4).Infof("Unable to watch the mount table: %v", err)
+		return nil
+	}
+	w := &mountWatcher{f: f}
+	// an event is only signalled for changes after the last read
+	if err := w.drain(); err != nil {
+		glog.V(4).Infof("Unable to watch the mount table: %v", err)
+		f.Close()
+		return nil
+	}
+	return w
+}
+
+func (w *mountWatcher) drain() error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(ioutil.Discard, w.f)
+	return err
+}
+
+// wait returns once the mount table changed or d passed. Without a
+// watcher it sleeps for d.
+func (w *mountWatcher) wait(d time.Duration) {
+	if w == nil {
+		time.Sleep(d)
+		return
+	}
+	fds := []unix.PollFd{{Fd: int32(w.f.Fd()), Events: unix.POLLPRI}}
+	n, err := unix.Poll(fds, int(d/time.Millisecond))
+	if err != nil && err != unix.EINTR {
+		// spinning on a broken watcher must not replace the backoff
+		time.Sleep(d)
+		return
+	}
+	if n > 0 {
+		if err := w.drain(); err != nil {
+			time.Sleep(d)
+		}
+	}
+}
+
+func (w *mountWatcher) close() {
+	if w != nil {
+		w.f.Close()
+	}
+}
+
+// waitForMount waits up to timeout until path is a mount point. It wakes
+// up on every change of the mount table and falls back to polling with a
+// growing interval if the mount table cannot be watched. alive is called
+// between the checks, an error ends the wait immediately, e.g. once the
+// mounter process exited. A nil alive only waits for the timeout.
+func waitForMount(path string, command string, timeout time.Duration, alive func() error) error {
+	watcher := watchMounts()
+	defer watcher.close()
+
+	start := time.Now()
+	nextProgress := start.Add(mountProgressInterval)
+	interval := minMountPollInterval
+	for {
+		notMount, err := mount.New("").IsNotMountPoint(path)
+		if err != nil {
+			return err
+		}
+		if !notMount {
+			glog.V(4).Infof("%s mounted %s after %v", command, path, time.Since(start))
+			return nil
+		}
+		if alive != nil {
+			if err := alive(); err != nil {
+				return err
+			}
+		}
+		elapsed := time.Since(start)
+		if elapsed >= timeout {
+			return fmt.Errorf("Timeout waiting for mount of %s by %s after %v", path, command, timeout)
+		}
+		if now := time.Now(); now.After(nextProgress) {
+			glog.Infof("Still waiting for %s to mount %s after %v of %v%s", command, path, elapsed.Round(time.Second), timeout, mountProgressHint(command))
+			nextProgress = now.Add(mountProgressInterval)
+		}
+		if remaining := timeout - elapsed; interval > remaining {
+			interval = remaining
+		}
+		watcher.wait(interval)
+		if interval *= 2; interval > maxMountPollInterval {
+			interval = maxMountPollInterval
+		}
+	}
+}
+
+// mountProgressHint explains why the mounter might take long to start
+func mountProgressHint(command string) string {
+	if command == s3backerCmd {
+		return ", s3backer lists the blocks of the volume before mounting, which takes minutes for large volumes"
+	}
+	return ""
+}
+
+// daemonAlive returns a check whether the daemon the command forked to
+// serve path still runs. If the daemon is gone, the check fails with the
+// output of the command, as nothing is going to mount path anymore.
+func daemonAlive(path string, command string, out []byte) func() error {
+	var daemon *os.Process
+	return func() error {
+		if daemon == nil {
+			p, err := findFuseMountProcess(path)
+			if err != nil || p == nil {
+				// the daemon cannot be told apart from a missing one yet
+				return nil
+			}
+			daemon = p
+		}
+		if cmdLine, err := getCmdLine(daemon.Pid); err == nil && cmdLine != "" {
+			if err := daemon.Signal(syscall.Signal(0)); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s exited before mounting %s\noutput: %s", command, path, out)
+	}
+}
@@ -0,0 +1,90 @@
+package mounter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMountTimeouts(t *testing.T) {
+	defer SetMountTimeouts(nil)
+
+	if d := mountTimeout(s3fsMounterType); d != defaultMountTimeout {
+		t.Errorf("expected the default timeout for s3fs, got %v", d)
+	}
+	if d := mountTimeout(s3backerMounterType); d != 5*time.Minute {
+		t.Errorf("expected the registered timeout for s3backer, got %v", d)
+	}
+
+	timeouts, err := ParseMountTimeouts("s3backer=10m,rclone=30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMountTimeouts(timeouts); err != nil {
+		t.Fatal(err)
+	}
+	if d := mountTimeout(s3backerMounterType); d != 10*time.Minute {
+		t.Errorf("expected the configured timeout for s3backer, got %v", d)
+	}
+	if d := mountTimeout(rcloneMounterType); d != 30*time.Second {
+		t.Errorf("expected the configured timeout for rclone, got %v", d)
+	}
+	if d := mountTimeout(s3fsMounterType); d != defaultMountTimeout {
+		t.Errorf("expected s3fs to keep the default timeout, got %v", d)
+	}
+
+	for _, spec := range []string{"s3backer", "s3backer=forever"} {
+		if _, err := ParseMountTimeouts(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+	if err := SetMountTimeouts(map[string]time.Duration{"fuse": time.Minute}); err == nil {
+		t.Error("expected an unknown mounter to be rejected")
+	}
+	if err := SetMountTimeouts(map[string]time.Duration{s3fsMounterType: 0}); err == nil {
+		t.Error("expected a zero timeout to be rejected")
+	}
+}
+
+func TestWaitForMount(t *testing.T) {
+	dir := t.TempDir()
+
+	start := time.Now()
+	err := waitForMount(dir, s3fsCmd, 100*time.Millisecond, nil)
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait to end after the timeout, took %v", elapsed)
+	}
+
+	exited := errors.New("s3backer exited")
+	checks := 0
+	start = time.Now()
+	err = waitForMount(dir, s3backerCmd, time.Minute, func() error {
+		if checks++; checks == 3 {
+			return exited
+		}
+		return nil
+	})
+	if err != exited {
+		t.Fatalf("expected the exit of the mounter, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait to end once the mounter exited, took %v", elapsed)
+	}
+
+	// the root is a mount point
+	if err := waitForMount("/", s3fsCmd, time.Second, nil); err != nil {
+		t.Errorf("expected / to be mounted: %v", err)
+	}
+}
+
+func TestDaemonAlive(t *testing.T) {
+	// no process serves the path, the daemon might not be found yet
+	alive := daemonAlive(t.TempDir(), s3backerCmd, []byte("listing blocks"))
+	if err := alive(); err != nil {
+		t.Errorf("expected a missing daemon to be tolerated, got %v", err)
+	}
+}
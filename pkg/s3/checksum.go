@@ -0,0 +1,93 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// ChecksumCRC32C and ChecksumSHA256 are the algorithms the objects of
+	// a volume can be verified with
+	ChecksumCRC32C = "CRC32C"
+	ChecksumSHA256 = "SHA256"
+
+	// checksumMetaPrefix is the user metadata the checksum of an object is
+	// stored in, followed by the algorithm
+	checksumMetaPrefix = "csi-s3-checksum-"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumCRC32C: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	ChecksumSHA256: sha256.New,
+}
+
+// ParseChecksumAlgorithm returns the checksum algorithm of a volume in upper
+// case, empty if the objects are not verified
+func ParseChecksumAlgorithm(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	algorithm := strings.ToUpper(value)
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm %s, must be %s or %s", value, ChecksumCRC32C, ChecksumSHA256)
+	}
+	return algorithm, nil
+}
+
+// checksum returns the base64 encoded checksum of data
+func checksum(algorithm string, data []byte) string {
+	h := checksumAlgorithms[algorithm]()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WithChecksum returns a client which stores the checksum of the objects
+// of the driver it writes, they are verified whenever they are read. The
+// uploads are also sent with their MD5, so the backend rejects corrupted
+// writes.
+func (client *s3Client) WithChecksum(algorithm string) *s3Client {
+	c := *client
+	c.checksumAlgorithm = algorithm
+	return &c
+}
+
+// addChecksum adds the checksum of data to the options of its upload
+func (client *s3Client) addChecksum(opts *minio.PutObjectOptions, data []byte) {
+	if client.checksumAlgorithm == "" {
+		return
+	}
+	opts.SendContentMd5 = true
+	if opts.UserMetadata == nil {
+		opts.UserMetadata = map[string]string{}
+	}
+	opts.UserMetadata[checksumMetaPrefix+strings.ToLower(client.checksumAlgorithm)] = checksum(client.checksumAlgorithm, data)
+}
+
+// verifyChecksum compares data with the checksums stored with the object
+// it has been read from. Objects written without a checksum are not
+// verified, a mismatch is never ignored.
+func verifyChecksum(bucketName, key string, metadata http.Header, data []byte) error {
+	for algorithm := range checksumAlgorithms {
+		expected := metadata.Get("X-Amz-Meta-" + checksumMetaPrefix + strings.ToLower(algorithm))
+		if expected == "" {
+			continue
+		}
+		if actual := checksum(algorithm, data); actual != expected {
+			err := &providerError{
+				kind: ErrChecksumMismatch,
+				err:  fmt.Errorf("%s checksum of %s/%s is %s, expected %s", algorithm, bucketName, key, actual, expected),
+			}
+			glog.Errorf("Read corrupted object: %v", err)
+			return err
+		}
+	}
+	return nil
+}
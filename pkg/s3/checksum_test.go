@@ -0,0 +1,61 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseChecksumAlgorithm(t *testing.T) {
+	for value, expected := range map[string]string{"": "", "crc32c": ChecksumCRC32C, "SHA256": ChecksumSHA256} {
+		if algorithm, err := ParseChecksumAlgorithm(value); err != nil || algorithm != expected {
+			t.Errorf("%q: expected %q, got %q, %v", value, expected, algorithm, err)
+		}
+	}
+	for _, value := range []string{"MD5", "CRC32", "sha-256"} {
+		if _, err := ParseChecksumAlgorithm(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestChecksumVerification(t *testing.T) {
+	for _, algorithm := range []string{ChecksumCRC32C, ChecksumSHA256} {
+		client, srv := newFakeClient(t)
+		srv.CreateBucket("bucket")
+		var digests int
+		srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodPut && r.Header.Get("Content-Md5") != "" {
+				digests++
+			}
+			return false
+		}
+		meta := &FSMeta{BucketName: "bucket", Prefix: "vol", ChecksumAlgorithm: algorithm}
+		if err := client.SetFSMeta(meta); err != nil {
+			t.Fatal(err)
+		}
+		key := controlKey("vol", metadataName)
+		if digests != 1 {
+			t.Fatalf("%s: expected the upload to be verified by the backend", algorithm)
+		}
+		if srv.GetObject("bucket", key).Metadata.Get("X-Amz-Meta-Csi-S3-Checksum-"+algorithm) == "" {
+			t.Fatalf("%s: expected the checksum to be stored with the metadata", algorithm)
+		}
+		if _, err := client.GetFSMeta("bucket", "vol"); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+
+		// a bit flipped on the way from the backend
+		srv.GetObject("bucket", key).Data[0] ^= 1
+		if _, err := client.GetFSMeta("bucket", "vol"); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%s: expected the corruption to be detected, got %v", algorithm, err)
+		}
+	}
+
+	// objects written without a checksum are read as before
+	client, srv := newFakeClient(t)
+	srv.PutObject("bucket", controlKey("vol", metadataName), []byte(`{"Name":"bucket","Prefix":"vol"}`))
+	if _, err := client.GetFSMeta("bucket", "vol"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,24 +4,166 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/ctrox/csi-s3/pkg/tracing"
 	"github.com/golang/glog"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 const (
-	metadataName = ".metadata.json"
+	metadataName       = ".metadata.json"
+	retainedMarkerName = ".csi-s3-retained"
+	// removeBatchSize is the maximum number of keys of a multi-object delete
+	removeBatchSize = 1000
+	// InternalTagKey tags every object written by the driver itself, so
+	// lifecycle rules can exclude them
+	InternalTagKey = "csi-s3:internal"
+	// DefaultControlPrefix is the suggested reserved prefix of the objects
+	// managed by the driver, control objects are kept next to the data
+	// unless a control prefix is set
+	DefaultControlPrefix = ".csi-s3"
+	// ReadyMarkerName is created at the root of a mounted volume once it
+	// serves data
+	ReadyMarkerName = ".csi-s3-ready"
+	// keyCaseSensitivityKey of the secret tells if the backend treats keys
+	// case-sensitively
+	keyCaseSensitivityKey = "keyCaseSensitivity"
+	// KeyCaseSensitive keys differing only by case are different objects
+	KeyCaseSensitive = "sensitive"
+	// KeyCaseInsensitive keys differing only by case are the same object
+	KeyCaseInsensitive = "insensitive"
+	// VolumeInfoName is written at the root of a mounted volume to show
+	// what backs it
+	VolumeInfoName = ".csi-s3-info.json"
+	// MaxListPageSize is the most objects AWS returns with a page of a
+	// listing
+	MaxListPageSize = 1000
+	// rcloneConfigKey of the secret is a complete rclone.conf, for volumes
+	// mounting one of its remotes
+	rcloneConfigKey = "rcloneConfig"
 )
 
+// isMarkerObject reports if key is a file the node plugin creates in a
+// mounted volume, which is not data of the volume
+func isMarkerObject(key string) bool {
+	name := path.Base(key)
+	return name == ReadyMarkerName || name == VolumeInfoName
+}
+
+// Options are settings of the driver which apply to every client
+type Options struct {
+	// RemoveWorkers is the number of batches removed in parallel
+	RemoveWorkers int
+	// DisableObjectTagging stops tagging internal objects, for providers
+	// which do not implement object tagging
+	DisableObjectTagging bool
+	// ControlPrefix is the reserved prefix of the bucket below which the
+	// objects managed by the driver are kept, separated from the data.
+	// If empty, they are kept next to the data of each volume.
+	ControlPrefix string
+	// ReadAfterWriteTimeout bounds the wait until the metadata and prefix
+	// objects written by the driver can be read back. 0 disables the
+	// check, for backends with read-after-write consistency.
+	ReadAfterWriteTimeout time.Duration
+	// MaxIdleConns is the number of idle connections kept open to each
+	// endpoint, 0 keeps the default of 16
+	MaxIdleConns int
+	// MaxConnsPerHost limits the connections to each endpoint, requests
+	// beyond it wait for a connection. 0 does not limit them.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes connections which have been idle for this
+	// long, 0 keeps the default of a minute
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives closes the connection after every request
+	DisableKeepAlives bool
+	// DNSCacheTTL keeps the resolved addresses of an endpoint for this
+	// long, 0 resolves it for every new connection
+	DNSCacheTTL time.Duration
+	// DNSServer is the host:port of the DNS server endpoints are resolved
+	// with, empty uses the resolver of the system
+	DNSServer string
+	// DriverVersion is recorded in the metadata written by the driver
+	DriverVersion string
+	// AllowMetadataDowngrade allows writing metadata which has last been
+	// written by a newer major version of the driver
+	AllowMetadataDowngrade bool
+	// ListPageSize is the number of objects requested with each page of a
+	// listing, 0 keeps the default of the provider, which is 1000 for AWS
+	ListPageSize int
+	// AccessKeyIDKeys and SecretAccessKeyKeys are the keys of a secret
+	// the credentials are read from, the first key set in the secret wins.
+	// Empty for DefaultAccessKeyIDKeys and DefaultSecretAccessKeyKeys.
+	AccessKeyIDKeys     []string
+	SecretAccessKeyKeys []string
+	// RecoveredMetaOwnsBucket has volumes without prefix claim their bucket
+	// when their metadata is recovered, so it is removed with the volume
+	RecoveredMetaOwnsBucket bool
+}
+
+var options = Options{
+	RemoveWorkers: 4,
+}
+
+// SetOptions sets the options used by all clients
+func SetOptions(opts Options) {
+	opts.ControlPrefix = strings.Trim(opts.ControlPrefix, "/")
+	options = opts
+	resetTransports()
+}
+
+// controlKey returns the key of the object name managed by the driver for
+// the volume at prefix
+func controlKey(prefix, name string) string {
+	return path.Join(options.ControlPrefix, prefix, name)
+}
+
+// legacyControlKey returns the key used before control objects were moved
+// below the control prefix
+func legacyControlKey(prefix, name string) string {
+	return path.Join(prefix, name)
+}
+
+// isControlObject returns true if key is below the control prefix
+func isControlObject(key string) bool {
+	return options.ControlPrefix != "" && strings.HasPrefix(key, options.ControlPrefix+"/")
+}
+
+// OverlapsControlPrefix returns true if prefix is below the control
+// prefix or contains it
+func OverlapsControlPrefix(prefix string) bool {
+	if options.ControlPrefix == "" {
+		return false
+	}
+	a, b := DirPrefix(prefix), DirPrefix(options.ControlPrefix)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
 type s3Client struct {
 	Config *Config
 	minio  *minio.Client
-	ctx    context.Context
+	// transport is the transport of minio, for requests minio-go does not
+	// support
+	transport http.RoundTripper
+	ctx       context.Context
+	grants    Grants
+	// checksumAlgorithm is the checksum the objects of the driver are
+	// written with, empty to write them without one
+	checksumAlgorithm string
+	// kms is the SSE-KMS the objects of the driver are written with, nil
+	// for the default encryption of the bucket
+	kms *KMSOptions
 }
 
 // Config holds values to configure the driver
@@ -31,6 +173,26 @@ type Config struct {
 	Region          string
 	Endpoint        string
 	Mounter         string
+	// SigningRegion is the region requests are signed for, if the endpoint
+	// expects a different one than the region of the data
+	SigningRegion string
+	// MetaEncryptionKeys encrypt the metadata of volumes if set, the
+	// first key is used for writing
+	MetaEncryptionKeys []string
+	// SessionToken is set for temporary credentials
+	SessionToken string
+	// WebIdentity is set if the mounters authenticate with a web identity token
+	WebIdentity *WebIdentity
+	// ClientEncryptionPassphrase is passed to mounters of client-side
+	// encrypted volumes
+	ClientEncryptionPassphrase string
+	// CaseInsensitiveKeys is set if the backend treats keys differing only
+	// by case as the same object
+	CaseInsensitiveKeys bool
+	// RcloneConfig is an rclone.conf, whose remote RcloneRemotePath is
+	// mounted by rclone instead of the bucket of the volume
+	RcloneConfig     string
+	RcloneRemotePath string
 }
 
 type FSMeta struct {
@@ -40,6 +202,187 @@ type FSMeta struct {
 	FSPath        string `json:"FSPath"`
 	CapacityBytes int64  `json:"CapacityBytes"`
 	CreatedByCsi  bool   `json:"CreatedByCsi"`
+	PVName        string `json:"PVName"`
+	// VolumeName is the name the volume was requested with, before it was
+	// sanitized into the volume ID. It is missing in older metadata.
+	VolumeName string `json:"VolumeName,omitempty"`
+	// Recovered is set if the metadata has been rebuilt from the data of
+	// the volume, or written for a bucket named after the volume which
+	// existed without it. Whether csi-s3 created the bucket is not known.
+	Recovered bool `json:"Recovered,omitempty"`
+	// ReplicationRuleID is the replication rule added for the volume
+	ReplicationRuleID string `json:"ReplicationRuleID"`
+	// BucketReplication is the replication of the whole bucket the volume
+	// has been provisioned with, the bucket is versioned
+	BucketReplication *ReplicationTarget `json:"BucketReplication,omitempty"`
+	// ObjectOwnership is the object ownership of the bucket, if known
+	ObjectOwnership string `json:"ObjectOwnership"`
+	// CacheMode is the cacheMode the volume is mounted with
+	CacheMode string `json:"CacheMode"`
+	// ClientEncrypted is set if the data is encrypted by the mounter
+	ClientEncrypted bool `json:"ClientEncrypted"`
+	// SmallFileCacheMB is the size of the in-memory cache of read objects
+	SmallFileCacheMB int `json:"SmallFileCacheMB,omitempty"`
+	// CacheOnlyOnError serves reads from the cache of the mounter while the
+	// endpoint cannot be reached
+	CacheOnlyOnError bool `json:"CacheOnlyOnError,omitempty"`
+	// Consistency is strict if the mounter keeps its caches of attributes
+	// and directory listings minimal, empty for its default caching
+	Consistency string `json:"Consistency,omitempty"`
+	// ObjectTags are the tags the mounter uploads the objects of the
+	// volume with
+	ObjectTags map[string]string `json:"ObjectTags,omitempty"`
+	// MimeTypesFile is the path of the MIME types file on the nodes which
+	// sets the Content-Type of uploaded objects
+	MimeTypesFile string `json:"MimeTypesFile,omitempty"`
+	// KeyEncoding is how the mounter escapes the characters of file names
+	// which strict backends reject in keys, empty keeps the names
+	KeyEncoding string `json:"KeyEncoding,omitempty"`
+	// Prefetch warms the cache of the mounter after the volume is mounted
+	Prefetch *Prefetch `json:"Prefetch,omitempty"`
+	// Prefixes are the prefixes of the bucket the volume exposes as its
+	// directories instead of its own data, empty for other volumes
+	Prefixes []SubPrefix `json:"Prefixes,omitempty"`
+	// Env are environment variables added to the mounter process
+	Env map[string]string `json:"Env,omitempty"`
+	// GrantRead and GrantWrite are the grantees the objects written by the
+	// driver are shared with
+	GrantRead  []string `json:"GrantRead,omitempty"`
+	GrantWrite []string `json:"GrantWrite,omitempty"`
+	// DeleteProtection refuses the deletion of the volume until it is cleared
+	DeleteProtection bool `json:"DeleteProtection,omitempty"`
+	// Maintenance remounts the targets of the volume read-only until it is
+	// cleared
+	Maintenance bool `json:"Maintenance,omitempty"`
+	// MetadataPolicy is MetadataPolicyImmutable if the metadata is never
+	// overwritten but written in versions
+	MetadataPolicy string `json:"MetadataPolicy,omitempty"`
+	// SeedFrom is the bucket and prefix the data of the volume is
+	// initialized from, Seeded is set once all of its objects are copied
+	SeedFrom string `json:"SeedFrom,omitempty"`
+	Seeded   bool   `json:"Seeded,omitempty"`
+	// CreatedByVersion is the version of the driver which created the
+	// volume, LastWrittenByVersion the one which last wrote the metadata.
+	// Both are missing in older metadata.
+	CreatedByVersion     string `json:"CreatedByVersion,omitempty"`
+	LastWrittenByVersion string `json:"LastWrittenByVersion,omitempty"`
+	// Attachments maps the nodes the volume is attached to by
+	// ControllerPublishVolume to the time it has been attached, only
+	// recorded if attach bookkeeping is enabled
+	Attachments map[string]time.Time `json:"Attachments,omitempty"`
+	// SingleWriter is the target path the volume is published to with the
+	// SINGLE_NODE_SINGLE_WRITER access mode, it is stale once the target
+	// is not mounted anymore
+	SingleWriter string `json:"SingleWriter,omitempty"`
+	// ChecksumAlgorithm is the checksum the objects written by the driver
+	// are verified with, empty if they are not
+	ChecksumAlgorithm string `json:"ChecksumAlgorithm,omitempty"`
+	// S3backer are the integrity settings of an s3backer volume, volumes
+	// created before they existed are mounted without them
+	S3backer *S3backerOptions `json:"S3backer,omitempty"`
+	// KMS is the SSE-KMS the objects of the volume are written with, nil
+	// for the default encryption of the bucket
+	KMS *KMSOptions `json:"KMS,omitempty"`
+	// QuotaNamespace is the namespace whose quota the capacity of the
+	// volume counts against, empty if quotas were not enforced
+	QuotaNamespace string `json:"QuotaNamespace,omitempty"`
+	// PrefixCreatedByCsi is set if the prefix did not contain any data
+	// before the volume was created. It is missing in older metadata.
+	PrefixCreatedByCsi *bool `json:"PrefixCreatedByCsi,omitempty"`
+	// ExpansionHistory are the latest expansions of the capacity of the
+	// volume, oldest first
+	ExpansionHistory []Expansion `json:"ExpansionHistory,omitempty"`
+}
+
+// Expansion is an expansion of the capacity of a volume by
+// ControllerExpandVolume
+type Expansion struct {
+	Time             time.Time `json:"Time"`
+	OldCapacityBytes int64     `json:"OldCapacityBytes"`
+	NewCapacityBytes int64     `json:"NewCapacityBytes"`
+	// NodeExpansionRequired is set if the nodes had to grow the volume as
+	// well, never for the mounters of csi-s3 yet
+	NodeExpansionRequired bool `json:"NodeExpansionRequired,omitempty"`
+	// QuotaNamespace is the namespace whose quota was raised by the
+	// expansion, empty if the capacity is only advisory
+	QuotaNamespace string `json:"QuotaNamespace,omitempty"`
+}
+
+// S3backerOptions are the settings s3backer verifies and retries the
+// blocks of a volume with
+type S3backerOptions struct {
+	// MD5Check verifies reads of recently written blocks against the MD5
+	// checksum they were written with
+	MD5Check bool `json:"MD5Check"`
+	// RetryCount is how often a failed request is retried, 0 keeps the
+	// default of s3backer
+	RetryCount int `json:"RetryCount,omitempty"`
+	// TimeoutSeconds bounds a single request, 0 keeps the default of
+	// s3backer
+	TimeoutSeconds int `json:"TimeoutSeconds,omitempty"`
+}
+
+// Prefetch is how the node plugin warms the cache of the mounter of a
+// volume after it is mounted
+type Prefetch struct {
+	// Mode is metadata or full
+	Mode string `json:"Mode"`
+	// Glob limits the prefetch to the files it matches, empty matches all
+	Glob string `json:"Glob,omitempty"`
+	// MaxBytes bounds the bytes read in full mode
+	MaxBytes int64 `json:"MaxBytes"`
+	// BytesPerSecond limits the read rate, 0 does not limit it
+	BytesPerSecond int64 `json:"BytesPerSecond,omitempty"`
+}
+
+// SubPrefix is a prefix of the bucket which a volume with several prefixes
+// exposes as a directory
+type SubPrefix struct {
+	// Name is the directory of the prefix in the volume
+	Name   string `json:"Name"`
+	Prefix string `json:"Prefix"`
+	// ReadOnly mounts the prefix read-only however the volume is published
+	ReadOnly bool `json:"ReadOnly,omitempty"`
+	// Managed prefixes are created with the volume and removed with it,
+	// the others are neither
+	Managed bool `json:"Managed,omitempty"`
+}
+
+// Unbounded returns true if the volume has been created without a
+// capacity, its data is not limited
+func (meta *FSMeta) Unbounded() bool {
+	return meta.CapacityBytes == 0
+}
+
+// OwnsPrefix returns true if the data below the prefix of the volume was
+// created by csi-s3. Older metadata only records if the bucket was created.
+func (meta *FSMeta) OwnsPrefix() bool {
+	if meta.PrefixCreatedByCsi == nil {
+		return meta.CreatedByCsi
+	}
+	return *meta.PrefixCreatedByCsi
+}
+
+// Grants returns the grants the objects of the volume are written with,
+// a backend without support for them is tolerated
+func (meta *FSMeta) Grants() Grants {
+	return Grants{Read: meta.GrantRead, Write: meta.GrantWrite}
+}
+
+// internalPutOptions returns the options to write an object of the driver
+func internalPutOptions(contentType string) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if !options.DisableObjectTagging {
+		opts.UserTags = map[string]string{InternalTagKey: "true"}
+	}
+	return opts
+}
+
+// RetainedMarker is written next to the data of a volume whose bucket
+// was intentionally kept on DeleteVolume.
+type RetainedMarker struct {
+	PVName     string    `json:"PVName"`
+	RetainedAt time.Time `json:"RetainedAt"`
 }
 
 func NewClient(cfg *Config) (*s3Client, error) {
@@ -55,131 +398,828 @@ func NewClient(cfg *Config) (*s3Client, error) {
 	if u.Port() != "" {
 		endpoint = u.Hostname() + ":" + u.Port()
 	}
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(client.Config.AccessKeyID, client.Config.SecretAccessKey, client.Config.Region),
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(client.Config.AccessKeyID, client.Config.SecretAccessKey, client.Config.SessionToken),
 		Secure: ssl,
-	})
+		// without it minio-go signs for the location of each bucket
+		Region: client.Config.SigningRegion,
+	}
+	transport, err := transportFor(u.Scheme, u.Host, strings.TrimRight(u.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	opts.Transport = transport
+	minioClient, err := minio.New(endpoint, opts)
 	if err != nil {
 		return nil, err
 	}
 	client.minio = minioClient
+	client.transport = opts.Transport
 	client.ctx = context.Background()
 	return client, nil
 }
 
+// NewClientFromSecret creates a client with the credentials of the
+// credential provider selected in the secret, by default the secret itself
 func NewClientFromSecret(secret map[string]string) (*s3Client, error) {
-	return NewClient(&Config{
-		AccessKeyID:     secret["accessKeyID"],
-		SecretAccessKey: secret["secretAccessKey"],
-		Region:          secret["region"],
-		Endpoint:        secret["endpoint"],
+	provider, err := credentialProvider(secret)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := provider.Credentials(secret)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := configFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccessKeyID = creds.AccessKeyID
+	cfg.SecretAccessKey = creds.SecretAccessKey
+	cfg.SessionToken = creds.SessionToken
+	return NewClient(cfg)
+}
+
+func configFromSecret(secret map[string]string) (*Config, error) {
+	endpoint, err := normalizeEndpoint(secret["endpoint"], secret[useSSLKey])
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" && secret["region"] != "" {
+		endpoint = awsEndpoint(secret["region"])
+	}
+	var caseInsensitive bool
+	switch secret[keyCaseSensitivityKey] {
+	case "", KeyCaseSensitive:
+	case KeyCaseInsensitive:
+		caseInsensitive = true
+	default:
+		return nil, fmt.Errorf("invalid %s %s, must be %s or %s", keyCaseSensitivityKey, secret[keyCaseSensitivityKey], KeyCaseSensitive, KeyCaseInsensitive)
+	}
+	return &Config{
+		Region:        secret["region"],
+		SigningRegion: secret["signingRegion"],
+		Endpoint:      endpoint,
 		// Mounter is set in the volume preferences, not secrets
-		Mounter: "",
-	})
+		Mounter:             "",
+		MetaEncryptionKeys:  parseMetaKeys(secret["metaEncryptionKey"]),
+		CaseInsensitiveKeys: caseInsensitive,
+		RcloneConfig:        secret[rcloneConfigKey],
+	}, nil
+}
+
+// Location returns the URL of the objects below prefix in the bucket at
+// the endpoint, in path style. Credentials and query parameters of the
+// endpoint are left out, so it can be shown to users.
+func (cfg *Config) Location(bucketName, prefix string) string {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return "s3://" + path.Join(bucketName, prefix)
+	}
+	location := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join("/", u.Path, bucketName, prefix)}
+	return location.String()
+}
+
+// SignatureRegion returns the region requests are signed for, the signing
+// region if set, otherwise the region of the data
+func (cfg *Config) SignatureRegion() string {
+	if cfg.SigningRegion != "" {
+		return cfg.SigningRegion
+	}
+	return cfg.Region
 }
 
-func (client *s3Client) BucketExists(bucketName string) (bool, error) {
-	return client.minio.BucketExists(client.ctx, bucketName)
+// WithContext returns a client whose S3 calls are traced as children of
+// the span of ctx. Cancelling ctx does not cancel the calls.
+func (client *s3Client) WithContext(ctx context.Context) *s3Client {
+	c := *client
+	c.ctx = audit.WithIdentityOf(tracing.WithSpan(client.ctx, ctx), ctx)
+	return &c
 }
 
-func (client *s3Client) CreateBucket(bucketName string) error {
-	return client.minio.MakeBucket(client.ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region})
+// startSpan traces an S3 operation on the bucket
+func (client *s3Client) startSpan(operation, bucketName string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(client.ctx, tracing.KindClient, "s3."+operation)
+	span.SetAttribute("s3.bucket", bucketName)
+	return ctx, span
 }
 
-func (client *s3Client) CreatePrefix(bucketName string, prefix string) error {
-	_, err := client.minio.PutObject(client.ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
+// awsEndpoint returns the regional AWS S3 endpoint of region. us-east-1
+// is served by the global endpoint, China regions by their own domain.
+func awsEndpoint(region string) string {
+	if region == "us-east-1" {
+		return "https://s3.amazonaws.com"
+	}
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://s3.%s.%s", region, domain)
+}
+
+func (client *s3Client) BucketExists(bucketName string) (exists bool, err error) {
+	ctx, span := client.startSpan("BucketExists", bucketName)
+	defer span.End(&err)
+	exists, err = client.minio.BucketExists(ctx, bucketName)
+	return exists, wrapError(err)
+}
+
+func (client *s3Client) CreateBucket(bucketName string) (err error) {
+	ctx, span := client.startSpan("CreateBucket", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "CreateBucket", bucketName, "", &err)
+	return wrapError(client.minio.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region}))
+}
+
+func (client *s3Client) CreatePrefix(bucketName string, prefix string) (err error) {
+	ctx, span := client.startSpan("CreatePrefix", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "CreatePrefix", bucketName, prefix, &err)
+	key := DirPrefix(prefix)
+	if key == "" {
+		// the root of the bucket has no placeholder
+		return nil
+	}
+	info, err := client.putInternalObject(ctx, bucketName, key, nil, "")
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.waitVisible(ctx, bucketName, key, info.ETag)
+}
+
+// EnsurePrefix writes the placeholder of prefix unless it exists, e.g.
+// because it has been removed out of band. It returns true if the
+// placeholder has been written.
+func (client *s3Client) EnsurePrefix(bucketName string, prefix string) (created bool, err error) {
+	ctx, span := client.startSpan("EnsurePrefix", bucketName)
+	defer span.End(&err)
+	defer func() {
+		if created || err != nil {
+			audit.Log(ctx, "EnsurePrefix", bucketName, prefix, &err)
+		}
+	}()
+	key := DirPrefix(prefix)
+	if key == "" {
+		return false, nil
+	}
+	_, err = client.minio.StatObject(ctx, bucketName, key, minio.StatObjectOptions{})
+	if err = wrapError(err); !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+	if _, err := client.putInternalObject(ctx, bucketName, key, nil, ""); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (client *s3Client) RemovePrefix(bucketName string, prefix string) error {
-	if err := client.removeObjects(bucketName, prefix); err != nil {
+// RemovePrefix removes the data of the volume at prefix and then its
+// control objects, so a failed removal can be retried with the metadata.
+// In a versioned bucket every version of the objects is removed.
+func (client *s3Client) RemovePrefix(bucketName string, prefix string) (err error) {
+	ctx, span := client.startSpan("RemovePrefix", bucketName)
+	defer span.End(&err)
+	defer audit.LogSync(ctx, "RemovePrefix", bucketName, prefix)(&err)
+	dir := DirPrefix(prefix)
+	if dir == "" {
+		return fmt.Errorf("refusing to remove the root of bucket %s as a prefix", bucketName)
+	}
+	versions, err := client.bucketVersioned(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	if err := client.removeObjects(ctx, bucketName, dir, versions); err != nil {
+		return err
+	}
+	// some mounters mark directories with an object named like the prefix
+	if err := client.removeObject(ctx, bucketName, CleanPrefix(prefix), versions); err != nil {
 		return err
 	}
-	return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+	if options.ControlPrefix == "" {
+		return nil
+	}
+	return client.removeObjects(ctx, bucketName, controlKey(prefix, "")+"/", versions)
 }
 
-func (client *s3Client) RemoveBucket(bucketName string) error {
-	if err := client.removeObjects(bucketName, ""); err != nil {
+// RemoveBucket removes the objects of the bucket and then the bucket. In a
+// versioned bucket every version of the objects is removed, including
+// delete markers, as the bucket cannot be removed otherwise.
+func (client *s3Client) RemoveBucket(bucketName string) (err error) {
+	ctx, span := client.startSpan("RemoveBucket", bucketName)
+	defer span.End(&err)
+	defer audit.LogSync(ctx, "RemoveBucket", bucketName, "")(&err)
+	versions, err := client.bucketVersioned(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	if err := client.removeObjects(ctx, bucketName, "", versions); err != nil {
 		return err
 	}
-	return client.minio.RemoveBucket(client.ctx, bucketName)
+	return wrapError(client.minio.RemoveBucket(ctx, bucketName))
 }
 
-func (client *s3Client) removeObjects(bucketName, prefix string) error {
-	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
+// bucketVersioned returns whether the bucket keeps previous versions of
+// its objects, which it also does once versioning is suspended. Buckets
+// of providers without versioning are not versioned, neither are those
+// whose versioning the credentials may not read, so removing data does
+// not need that permission.
+func (client *s3Client) bucketVersioned(ctx context.Context, bucketName string) (bool, error) {
+	versioning, err := client.minio.GetBucketVersioning(ctx, bucketName)
+	switch code := minio.ToErrorResponse(err).Code; code {
+	case "NotImplemented", "AccessDenied":
+		glog.V(4).Infof("Treating bucket %s as unversioned, its versioning cannot be read: %s", bucketName, code)
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapError(err)
+	}
+	return versioning.Status != "", nil
+}
 
-	go func() {
-		defer close(objectsCh)
+// CountObjects returns the number of objects left in the bucket, apart
+// from the metadata of the volume at prefix. It stops listing once limit
+// objects are counted, so a large bucket is not listed as a whole.
+func (client *s3Client) CountObjects(bucketName, prefix string, limit int) (count int, err error) {
+	ctx, span := client.startSpan("CountObjects", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true, MaxKeys: limit}) {
+		if object.Err != nil {
+			return count, wrapError(object.Err)
+		}
+		if dir := path.Dir(object.Key); isMetadataName(path.Base(object.Key)) &&
+			(dir == path.Dir(controlKey(prefix, metadataName)) || dir == path.Dir(legacyControlKey(prefix, metadataName))) {
+			continue
+		}
+		if count++; count == limit {
+			break
+		}
+	}
+	return count, nil
+}
+
+// RemoveFSMeta removes the metadata of the volume at prefix with all of
+// its versions, in a versioned bucket also the previous versions of each
+// of them. Retained versions are kept.
+func (client *s3Client) RemoveFSMeta(bucketName, prefix string) (err error) {
+	ctx, span := client.startSpan("RemoveFSMeta", bucketName)
+	defer span.End(&err)
+	defer audit.LogSync(ctx, "RemoveFSMeta", bucketName, prefix)(&err)
+	versions, err := client.bucketVersioned(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	keys := []string{controlKey(prefix, metadataName)}
+	if options.ControlPrefix != "" {
+		keys = append(keys, legacyControlKey(prefix, metadataName))
+	}
+	for _, key := range keys {
+		err := client.removeObject(ctx, bucketName, key, versions)
+		if errors.Is(err, ErrObjectRetained) {
+			glog.Warningf("Keeping metadata %s of bucket %s, it is retained: %v", key, bucketName, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return client.removeMetadataVersions(ctx, bucketName, prefix, versions)
+}
+
+// removeObject removes the object at key, with versions every version of
+// it. Deleting a key of a versioned bucket without a version would only
+// add a delete marker. Versions under retention are kept, their error is
+// returned once the others are removed.
+func (client *s3Client) removeObject(ctx context.Context, bucketName, key string, versions bool) error {
+	if !versions {
+		return wrapError(client.minio.RemoveObject(ctx, bucketName, key, minio.RemoveObjectOptions{}))
+	}
+	var ids []string
+	for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: key, WithVersions: true}) {
+		if object.Err != nil {
+			return wrapError(object.Err)
+		}
+		if object.Key == key {
+			ids = append(ids, object.VersionID)
+		}
+	}
+	var retained error
+	for _, id := range ids {
+		err := wrapError(client.minio.RemoveObject(ctx, bucketName, key, minio.RemoveObjectOptions{VersionID: id}))
+		if errors.Is(err, ErrObjectRetained) {
+			retained = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return retained
+}
 
-		doneCh := make(chan struct{})
+// removeObjects lists all objects below prefix and removes them in batches
+// of removeBatchSize keys using parallel workers. The first failing batch
+// aborts the removal, the remaining objects are removed on the next call.
+// With versions, every version of the objects is removed.
+func (client *s3Client) removeObjects(ctx context.Context, bucketName, prefix string, versions bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		defer close(doneCh)
+	batches := make(chan []minio.ObjectInfo)
+	var listErr error
+
+	go func() {
+		defer close(batches)
 
-		for object := range client.minio.ListObjects(
-			client.ctx,
+		batch := make([]minio.ObjectInfo, 0, removeBatchSize)
+		send := func() bool {
+			select {
+			case batches <- batch:
+				batch = make([]minio.ObjectInfo, 0, removeBatchSize)
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for object := range client.listObjects(
+			ctx,
 			bucketName,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			minio.ListObjectsOptions{Prefix: prefix, Recursive: true, WithVersions: versions}) {
 			if object.Err != nil {
 				listErr = object.Err
 				return
 			}
-			objectsCh <- object
+			batch = append(batch, object)
+			if len(batch) == removeBatchSize && !send() {
+				return
+			}
+		}
+		if len(batch) > 0 {
+			send()
 		}
 	}()
 
+	workers := options.RemoveWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		batchErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := client.removeBatch(ctx, bucketName, batch); err != nil {
+					mu.Lock()
+					if batchErr == nil {
+						batchErr = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if batchErr != nil {
+		return batchErr
+	}
 	if listErr != nil {
 		glog.Error("Error listing objects", listErr)
-		return listErr
+		return wrapError(listErr)
+	}
+	return nil
+}
+
+func (client *s3Client) removeBatch(ctx context.Context, bucketName string, batch []minio.ObjectInfo) error {
+	objectsCh := make(chan minio.ObjectInfo, len(batch))
+	for _, object := range batch {
+		objectsCh <- object
 	}
+	close(objectsCh)
 
-	select {
-	default:
-		opts := minio.RemoveObjectsOptions{
-			GovernanceBypass: true,
-		}
-		errorCh := client.minio.RemoveObjects(client.ctx, bucketName, objectsCh, opts)
-		for e := range errorCh {
-			glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
-		}
-		if len(errorCh) != 0 {
-			return fmt.Errorf("Failed to remove all objects of bucket %s", bucketName)
+	opts := minio.RemoveObjectsOptions{
+		GovernanceBypass: true,
+	}
+	var (
+		failed   int
+		firstErr error
+	)
+	for e := range client.minio.RemoveObjects(ctx, bucketName, objectsCh, opts) {
+		glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
+		if failed == 0 {
+			firstErr = e.Err
 		}
+		failed++
+	}
+	if failed != 0 {
+		return fmt.Errorf("Failed to remove %d objects of bucket %s: %w", failed, bucketName, wrapError(firstErr))
 	}
+	return nil
+}
 
+// SetFSMeta writes the metadata of the volume. Under the immutable
+// metadata policy a new version is added instead of overwriting it. A
+// backend refusing the overwrite because of a retention switches the
+// volume to that policy.
+func (client *s3Client) SetFSMeta(meta *FSMeta) (err error) {
+	ctx, span := client.startSpan("SetFSMeta", meta.BucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "SetFSMeta", meta.BucketName, meta.Prefix, &err)
+	if err := CheckMetaVersion(meta); err != nil {
+		return err
+	}
+	meta.LastWrittenByVersion = options.DriverVersion
+	if client.grants.Empty() {
+		// later writes of the metadata keep the grants of the volume
+		client = client.WithGrants(meta.Grants())
+	}
+	if client.checksumAlgorithm == "" {
+		client = client.WithChecksum(meta.ChecksumAlgorithm)
+	}
+	if client.kms == nil {
+		client = client.WithKMS(meta.KMS)
+	}
+	b, err := client.encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	if meta.MetadataPolicy == MetadataPolicyImmutable {
+		return client.putMetadataVersion(ctx, meta, b)
+	}
+	key := controlKey(meta.Prefix, metadataName)
+	info, err := client.putInternalObject(ctx, meta.BucketName, key, b, "application/json")
+	if errors.Is(err, ErrObjectRetained) {
+		glog.Warningf("Metadata of %s cannot be overwritten, writing it with the %s metadata policy: %v",
+			path.Join(meta.BucketName, meta.Prefix), MetadataPolicyImmutable, err)
+		meta.MetadataPolicy = MetadataPolicyImmutable
+		if b, err = client.encodeFSMeta(meta); err != nil {
+			return err
+		}
+		return client.putMetadataVersion(ctx, meta, b)
+	}
+	if err != nil {
+		return err
+	}
+	// readers fall back to the legacy metadata until the new one is visible
+	if err := client.waitVisible(ctx, meta.BucketName, key, info.ETag); err != nil {
+		return err
+	}
+	if options.ControlPrefix == "" {
+		return nil
+	}
+	// metadata read from the legacy location is moved on its next write
+	legacy := legacyControlKey(meta.Prefix, metadataName)
+	if _, err := client.minio.StatObject(ctx, meta.BucketName, legacy, minio.StatObjectOptions{}); err != nil {
+		return nil
+	}
+	glog.Infof("Moving metadata %s of bucket %s below the control prefix %s", legacy, meta.BucketName, options.ControlPrefix)
+	if err := client.minio.RemoveObject(ctx, meta.BucketName, legacy, minio.RemoveObjectOptions{}); err != nil {
+		glog.Warningf("Failed to remove legacy metadata %s of bucket %s: %v", legacy, meta.BucketName, err)
+	}
 	return nil
 }
 
-func (client *s3Client) SetFSMeta(meta *FSMeta) error {
+// encodeFSMeta returns the metadata as it is stored
+func (client *s3Client) encodeFSMeta(meta *FSMeta) ([]byte, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(client.Config.MetaEncryptionKeys) > 0 {
+		if b, err = encryptMeta(client.Config.MetaEncryptionKeys, b); err != nil {
+			return nil, fmt.Errorf("failed to encrypt metadata: %v", err)
+		}
+	}
+	return b, nil
+}
+
+// SetRetainedMarker records that the data of the volume at prefix was
+// intentionally retained when its PV was deleted.
+func (client *s3Client) SetRetainedMarker(bucketName, prefix, pvName string) (err error) {
+	ctx, span := client.startSpan("SetRetainedMarker", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "SetRetainedMarker", bucketName, prefix, &err)
 	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(meta)
-	opts := minio.PutObjectOptions{ContentType: "application/json"}
-	_, err := client.minio.PutObject(
-		client.ctx, meta.BucketName, path.Join(meta.Prefix, metadataName), b, int64(b.Len()), opts,
-	)
+	json.NewEncoder(b).Encode(&RetainedMarker{PVName: pvName, RetainedAt: time.Now().UTC()})
+	_, err = client.putInternalObject(ctx, bucketName, controlKey(prefix, retainedMarkerName), b.Bytes(), "application/json")
 	return err
 }
 
-func (client *s3Client) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
-	opts := minio.GetObjectOptions{}
-	obj, err := client.minio.GetObject(client.ctx, bucketName, path.Join(prefix, metadataName), opts)
+// GetFSMeta reads the metadata of the volume at prefix, the latest version
+// if it has been written with the immutable metadata policy. Metadata
+// written before the control prefix was set is read from next to the data.
+// The versions are only listed if the metadata is missing or does not
+// match its versions, as most volumes have none.
+func (client *s3Client) GetFSMeta(bucketName, prefix string) (_ *FSMeta, err error) {
+	ctx, span := client.startSpan("GetFSMeta", bucketName)
+	defer span.End(&err)
+	b, getErr := client.getObject(ctx, bucketName, controlKey(prefix, metadataName))
+	if getErr == nil {
+		meta, err := client.decodeFSMeta(bucketName, b)
+		if err != nil {
+			return meta, err
+		}
+		if meta.MetadataPolicy != MetadataPolicyImmutable {
+			// a retained metadata keeps the policy it had before the
+			// volume switched to versions
+			_, err := client.minio.StatObject(ctx, bucketName, controlKey(prefix, metadataVersionName(1)), minio.StatObjectOptions{})
+			if errors.Is(wrapError(err), ErrObjectNotFound) {
+				return meta, nil
+			}
+			if err != nil {
+				return &FSMeta{}, wrapError(err)
+			}
+		}
+	} else if !errors.Is(getErr, ErrObjectNotFound) {
+		return &FSMeta{}, getErr
+	}
+	versions, err := client.listMetadataVersions(ctx, bucketName, prefix)
 	if err != nil {
 		return &FSMeta{}, err
 	}
-	objInfo, err := obj.Stat()
+	switch {
+	case len(versions) > 0:
+		b, err = client.getObject(ctx, bucketName, versions[0].key)
+	case b != nil:
+		// the versions have been removed since the metadata has been read
+	case options.ControlPrefix != "":
+		b, err = client.getObject(ctx, bucketName, legacyControlKey(prefix, metadataName))
+	default:
+		err = getErr
+	}
 	if err != nil {
 		return &FSMeta{}, err
 	}
+	return client.decodeFSMeta(bucketName, b)
+}
+
+// decodeFSMeta decrypts and decodes the metadata b of a volume in the bucket
+func (client *s3Client) decodeFSMeta(bucketName string, b []byte) (*FSMeta, error) {
+	b, err := decryptMeta(client.Config.MetaEncryptionKeys, b)
+	if err != nil {
+		return &FSMeta{}, fmt.Errorf("failed to read metadata of bucket %s: %w: %v", bucketName, ErrMetadataUnreadable, err)
+	}
+	var meta FSMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return &meta, fmt.Errorf("failed to read metadata of bucket %s: %w: %v", bucketName, ErrMetadataUnreadable, err)
+	}
+	return &meta, nil
+}
+
+// ListBuckets returns the names of all buckets of the credentials
+func (client *s3Client) ListBuckets() (_ []string, err error) {
+	ctx, span := client.startSpan("ListBuckets", "")
+	defer span.End(&err)
+	buckets, err := client.minio.ListBuckets(ctx)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	return names, nil
+}
+
+// ListFSMeta reads the metadata of every volume of the bucket, below the
+// control prefix as well as at the legacy location. The whole bucket is
+// listed for this.
+func (client *s3Client) ListFSMeta(bucketName string) (_ []*FSMeta, err error) {
+	ctx, span := client.startSpan("ListFSMeta", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var prefixes []string
+	seen := make(map[string]bool)
+	for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return nil, wrapError(object.Err)
+		}
+		if !isMetadataName(path.Base(object.Key)) {
+			continue
+		}
+		prefix := path.Dir(object.Key)
+		if isControlObject(object.Key) {
+			prefix = strings.TrimPrefix(prefix, options.ControlPrefix)
+		}
+		// metadata found at both locations belongs to the same volume
+		if prefix = CleanPrefix(prefix); !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	var metas []*FSMeta
+	for _, prefix := range prefixes {
+		meta, err := client.GetFSMeta(bucketName, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata of %s: %w", path.Join(bucketName, prefix), err)
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// FindPrefixVolumes returns the prefixes of the volumes of the bucket
+// other than the volume at its root. Only the control prefix is listed if
+// it is set, volumes whose metadata has not been moved below it yet are
+// not found then. Otherwise the whole bucket is listed.
+func (client *s3Client) FindPrefixVolumes(bucketName string) (_ []string, err error) {
+	ctx, span := client.startSpan("FindPrefixVolumes", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opts := minio.ListObjectsOptions{Recursive: true}
+	if options.ControlPrefix != "" {
+		opts.Prefix = options.ControlPrefix + "/"
+	}
+	var prefixes []string
+	seen := make(map[string]bool)
+	for object := range client.listObjects(ctx, bucketName, opts) {
+		if object.Err != nil {
+			return nil, wrapError(object.Err)
+		}
+		if !isMetadataName(path.Base(object.Key)) {
+			continue
+		}
+		prefix := path.Dir(object.Key)
+		if isControlObject(object.Key) {
+			prefix = strings.TrimPrefix(prefix, options.ControlPrefix)
+		}
+		if prefix = CleanPrefix(prefix); prefix != "" && !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// FindDataPrefixes returns the prefixes of the bucket holding a directory
+// named fsPath, the data directory of the volumes at these prefixes. A
+// volume whose data directory contains another one is only found once.
+// The whole bucket is listed for this.
+func (client *s3Client) FindDataPrefixes(bucketName, fsPath string) (_ []string, err error) {
+	ctx, span := client.startSpan("FindDataPrefixes", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var prefixes []string
+	seen := make(map[string]bool)
+	for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return nil, wrapError(object.Err)
+		}
+		if isControlObject(object.Key) {
+			continue
+		}
+		// the last segment is the name of the object, not a directory
+		segments := strings.Split(object.Key, "/")
+		for i, segment := range segments[:len(segments)-1] {
+			if segment != fsPath {
+				continue
+			}
+			if prefix := strings.Join(segments[:i], "/"); !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+			break
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// listObjects lists the objects of a bucket in pages of ListPageSize,
+// unless opts asks for a page of its own size
+func (client *s3Client) listObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	if opts.MaxKeys == 0 {
+		opts.MaxKeys = options.ListPageSize
+	}
+	return client.minio.ListObjects(ctx, bucketName, opts)
+}
+
+func (client *s3Client) getObject(ctx context.Context, bucketName, key string) ([]byte, error) {
+	obj, err := client.minio.GetObject(ctx, bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	objInfo, err := obj.Stat()
+	if err != nil {
+		return nil, wrapError(err)
+	}
 	b := make([]byte, objInfo.Size)
 	_, err = obj.Read(b)
 
 	if err != nil && err != io.EOF {
-		return &FSMeta{}, err
+		return nil, wrapError(err)
 	}
-	var meta FSMeta
-	err = json.Unmarshal(b, &meta)
-	return &meta, err
+	if err := verifyChecksum(bucketName, key, objInfo.Metadata, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RecoverFSMeta rebuilds minimal metadata of a volume whose metadata object
+// is missing, e.g. because a lifecycle rule expired it. It only succeeds if
+// the fs path of the volume still exists. Whether the driver created the
+// bucket of a volume without prefix is not known anymore, it is only
+// claimed with RecoveredMetaOwnsBucket, unless it has been retained before.
+// Otherwise an adopted bucket would be removed with the volume.
+func (client *s3Client) RecoverFSMeta(bucketName, prefix, fsPath string) (*FSMeta, error) {
+	prefix = CleanPrefix(prefix)
+	empty, err := client.IsEmpty(bucketName, DirPrefix(prefix, fsPath))
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return nil, fmt.Errorf("no data found in %s of bucket %s: %w", path.Join(prefix, fsPath), bucketName, ErrObjectNotFound)
+	}
+	owned := false
+	if prefix == "" {
+		if owned, err = client.RecoveredOwnsBucket(bucketName); err != nil {
+			return nil, err
+		}
+	}
+	return &FSMeta{
+		BucketName:   bucketName,
+		Prefix:       prefix,
+		FSPath:       fsPath,
+		CreatedByCsi: owned,
+		Recovered:    true,
+	}, nil
+}
+
+// RecoveredOwnsBucket returns true if a volume without prefix, whose
+// metadata is recovered, claims its bucket. It does with
+// RecoveredMetaOwnsBucket, unless the bucket has been retained before.
+func (client *s3Client) RecoveredOwnsBucket(bucketName string) (bool, error) {
+	if !options.RecoveredMetaOwnsBucket {
+		return false, nil
+	}
+	_, err := client.minio.StatObject(client.ctx, bucketName, controlKey("", retainedMarkerName), minio.StatObjectOptions{})
+	if err = wrapError(err); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindForeignObject returns the key of an object of the bucket which is
+// not below prefix, empty if there is none. Markers and control objects
+// are not counted. Only the directories along prefix are listed, not the
+// data below it.
+func (client *s3Client) FindForeignObject(bucketName, prefix string) (_ string, err error) {
+	ctx, span := client.startSpan("FindForeignObject", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	prefix = CleanPrefix(prefix)
+	if prefix == "" {
+		return "", nil
+	}
+	dir := ""
+	for _, segment := range strings.Split(prefix, "/") {
+		next := dir + segment + "/"
+		for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: dir}) {
+			if object.Err != nil {
+				return "", wrapError(object.Err)
+			}
+			name := path.Base(object.Key)
+			if object.Key == dir || object.Key == next || isMarkerObject(object.Key) || isControlObject(object.Key) ||
+				isMetadataName(name) || name == retainedMarkerName {
+				continue
+			}
+			return object.Key, nil
+		}
+		dir = next
+	}
+	return "", nil
+}
+
+// IsEmpty returns true if the bucket contains no objects below prefix.
+// Readiness markers and control objects are not counted as data.
+func (client *s3Client) IsEmpty(bucketName, prefix string) (_ bool, err error) {
+	ctx, span := client.startSpan("IsEmpty", bucketName)
+	defer span.End(&err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range client.listObjects(
+		ctx,
+		bucketName,
+		minio.ListObjectsOptions{Prefix: prefix, Recursive: true, MaxKeys: 1}) {
+		if object.Err != nil {
+			return false, wrapError(object.Err)
+		}
+		if isMarkerObject(object.Key) || isControlObject(object.Key) {
+			continue
+		}
+		return false, nil
+	}
+	return true, nil
 }
@@ -0,0 +1,431 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func newFakeClient(t testing.TB) (*s3Client, *s3test.Server) {
+	srv := s3test.NewServer()
+	t.Cleanup(srv.Close)
+	client, err := NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func putObjects(srv *s3test.Server, bucket, prefix string, count int) {
+	for i := 0; i < count; i++ {
+		srv.PutObject(bucket, fmt.Sprintf("%s/object-%05d", prefix, i), []byte("data"))
+	}
+}
+
+func TestRemovePrefixInBatches(t *testing.T) {
+	client, srv := newFakeClient(t)
+	putObjects(srv, "bucket", "volume", 2500)
+	putObjects(srv, "bucket", "other", 10)
+
+	if err := client.RemovePrefix("bucket", "volume"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := srv.Keys("bucket"); len(keys) != 10 {
+		t.Fatalf("expected only the objects of the other prefix to be left, got %d objects", len(keys))
+	}
+	// three batches of at most 1000 keys
+	if deletes := srv.Requests(http.MethodPost); deletes != 3 {
+		t.Fatalf("expected 3 multi-object deletes, got %d", deletes)
+	}
+}
+
+func TestRemovePrefixOfVersionedBucket(t *testing.T) {
+	client, srv := newFakeClient(t)
+	putObjects(srv, "bucket", "volume/csi-fs", 3)
+	srv.PutObject("bucket", "volume", nil)
+	if err := client.minio.EnableVersioning(context.Background(), "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	var listings, markers int
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		query := r.URL.Query()
+		if _, ok := query["versions"]; ok && r.Method == http.MethodGet {
+			listings++
+		}
+		// a delete without a version only adds a delete marker
+		if r.Method == http.MethodDelete && query.Get("versionId") == "" {
+			markers++
+		}
+		return false
+	}
+
+	if err := client.RemovePrefix("bucket", "volume"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := srv.Keys("bucket"); len(keys) != 0 {
+		t.Fatalf("expected every object of the volume to be removed, got %v", keys)
+	}
+	if listings == 0 || markers != 0 {
+		t.Fatalf("expected the versions to be listed and removed, got %d listings and %d deletes without a version", listings, markers)
+	}
+}
+
+func TestRemoveBucketFailingBatchIsResumable(t *testing.T) {
+	client, srv := newFakeClient(t)
+	putObjects(srv, "bucket", "volume", 3000)
+
+	failures := 0
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPost && failures == 0 {
+			failures++
+			s3test.Error(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	}
+	err := client.RemoveBucket("bucket")
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("expected the failing batch to fail the removal, got %v", err)
+	}
+	if !srv.BucketExists("bucket") {
+		t.Fatal("expected bucket to be kept after a failed batch")
+	}
+
+	// a retry removes whatever is left
+	if err := client.RemoveBucket("bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.BucketExists("bucket") {
+		t.Fatal("expected bucket to be removed")
+	}
+}
+
+func BenchmarkRemoveBucket(b *testing.B) {
+	defer SetOptions(options)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			SetOptions(Options{RemoveWorkers: workers})
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				client, srv := newFakeClient(b)
+				// deleting is a lot slower than listing on real providers
+				srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+					if r.Method == http.MethodPost {
+						time.Sleep(50 * time.Millisecond)
+					}
+					return false
+				}
+				putObjects(srv, "bucket", "volume", 20000)
+				b.StartTimer()
+				if err := client.RemoveBucket("bucket"); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				srv.Close()
+			}
+		})
+	}
+}
+
+func TestInternalObjectsAreTagged(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+
+	if err := client.CreatePrefix("bucket", "volume/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "volume"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"volume/csi-fs/", controlKey("volume", metadataName)} {
+		if tag := srv.GetObject("bucket", key).Tags[InternalTagKey]; tag != "true" {
+			t.Errorf("%s: expected internal tag, got %q", key, tag)
+		}
+	}
+
+	defer SetOptions(options)
+	SetOptions(Options{DisableObjectTagging: true})
+	if err := client.CreatePrefix("bucket", "untagged"); err != nil {
+		t.Fatal(err)
+	}
+	if tags := srv.GetObject("bucket", "untagged/").Tags; len(tags) != 0 {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+}
+
+func TestRecoverFSMeta(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.PutObject("bucket", "volume/csi-fs/file", []byte("data"))
+
+	meta, err := client.RecoverFSMeta("bucket", "volume", "csi-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.BucketName != "bucket" || meta.Prefix != "volume" || meta.FSPath != "csi-fs" || meta.CreatedByCsi {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if _, err := client.RecoverFSMeta("bucket", "other", "csi-fs"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected a volume without data not to be recovered, got %v", err)
+	}
+
+	// the bucket of a volume without prefix is only claimed explicitly
+	srv.PutObject("bucket", "csi-fs/file", []byte("data"))
+	if meta, err = client.RecoverFSMeta("bucket", "", "csi-fs"); err != nil || meta.CreatedByCsi {
+		t.Fatalf("expected the bucket not to be claimed, got %+v, %v", meta, err)
+	}
+	defer SetOptions(options)
+	SetOptions(Options{RecoveredMetaOwnsBucket: true})
+	if meta, err = client.RecoverFSMeta("bucket", "", "csi-fs"); err != nil || !meta.CreatedByCsi {
+		t.Fatalf("expected the bucket to be created by csi-s3, got %+v, %v", meta, err)
+	}
+	if err := client.SetRetainedMarker("bucket", "", "pv"); err != nil {
+		t.Fatal(err)
+	}
+	// a bucket whose volume has been retained was not created by csi-s3
+	if meta, err = client.RecoverFSMeta("bucket", "", "csi-fs"); err != nil || meta.CreatedByCsi {
+		t.Fatalf("expected the retained bucket not to be created by csi-s3, got %+v, %v", meta, err)
+	}
+}
+
+func TestFindPrefixVolumes(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	srv.PutObject("bucket", "csi-fs/file", []byte("data"))
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", FSPath: "csi-fs"}); err != nil {
+		t.Fatal(err)
+	}
+	if prefixes, err := client.FindPrefixVolumes("bucket"); err != nil || len(prefixes) != 0 {
+		t.Fatalf("expected no volume at a prefix, got %v, %v", prefixes, err)
+	}
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "team/pvc-a", FSPath: "csi-fs"}); err != nil {
+		t.Fatal(err)
+	}
+	if prefixes, err := client.FindPrefixVolumes("bucket"); err != nil || !reflect.DeepEqual(prefixes, []string{"team/pvc-a"}) {
+		t.Fatalf("expected volume team/pvc-a, got %v, %v", prefixes, err)
+	}
+
+	// only the control prefix is listed once it is set
+	defer SetOptions(options)
+	SetOptions(Options{ControlPrefix: DefaultControlPrefix})
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "team/pvc-b", FSPath: "csi-fs"}); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") != "" {
+			listed = append(listed, r.URL.Query().Get("prefix"))
+		}
+		return false
+	}
+	if prefixes, err := client.FindPrefixVolumes("bucket"); err != nil || !reflect.DeepEqual(prefixes, []string{"team/pvc-b"}) {
+		t.Fatalf("expected volume team/pvc-b, got %v, %v", prefixes, err)
+	}
+	if expected := []string{DefaultControlPrefix + "/"}; !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("expected only %v to be listed, got %v", expected, listed)
+	}
+}
+
+func TestFindDataPrefixes(t *testing.T) {
+	client, srv := newFakeClient(t)
+	defer SetOptions(options)
+	SetOptions(Options{ControlPrefix: DefaultControlPrefix})
+	srv.PutObject("bucket", "csi-fs/", nil)
+	srv.PutObject("bucket", "team/a/csi-fs/file", []byte("data"))
+	srv.PutObject("bucket", "team/a/csi-fs/backup/csi-fs/file", []byte("data"))
+	srv.PutObject("bucket", "team/b/csi-fs/", nil)
+	srv.PutObject("bucket", "team/c/csi-fs", []byte("not a directory"))
+	srv.PutObject("bucket", ".csi-s3/team/d/csi-fs/.metadata.json", []byte("{}"))
+
+	prefixes, err := client.FindDataPrefixes("bucket", "csi-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"", "team/a", "team/b"}; !reflect.DeepEqual(prefixes, expected) {
+		t.Fatalf("expected %v, got %v", expected, prefixes)
+	}
+}
+
+func TestListPageSize(t *testing.T) {
+	client, srv := newFakeClient(t)
+	putObjects(srv, "bucket", "volume/csi-fs", 5)
+	defer SetOptions(options)
+	SetOptions(Options{ListPageSize: 2})
+	var pages []string
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			pages = append(pages, r.URL.Query().Get("max-keys"))
+		}
+		return false
+	}
+
+	if _, err := client.CopyPrefix("bucket", "volume/csi-fs", "bucket", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"2", "2", "2"}; !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("expected 5 objects to be listed in pages of 2, got pages %v", pages)
+	}
+	// a listing asking for a smaller page keeps it
+	pages = nil
+	if _, err := client.IsEmpty("bucket", "volume/"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1"}; !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("expected a single page of 1, got %v", pages)
+	}
+}
+
+func TestCountObjectsStopsAtLimit(t *testing.T) {
+	client, srv := newFakeClient(t)
+	putObjects(srv, "bucket", "other", 2500)
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "volume"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := client.CountObjects("bucket", "volume", 3000); err != nil || count != 2500 {
+		t.Fatalf("expected every object apart from the metadata to be counted, got %d, %v", count, err)
+	}
+	listed := srv.Requests(http.MethodGet)
+	if count, err := client.CountObjects("bucket", "volume", 1000); err != nil || count != 1000 {
+		t.Fatalf("expected the count to stop at the limit, got %d, %v", count, err)
+	}
+	if pages := srv.Requests(http.MethodGet) - listed; pages != 1 {
+		t.Errorf("expected a single page to be listed, got %d requests", pages)
+	}
+}
+
+func TestAWSEndpointFromRegion(t *testing.T) {
+	tests := []struct {
+		region   string
+		endpoint string
+	}{
+		{region: "us-east-1", endpoint: "https://s3.amazonaws.com"},
+		{region: "us-west-2", endpoint: "https://s3.us-west-2.amazonaws.com"},
+		{region: "eu-central-1", endpoint: "https://s3.eu-central-1.amazonaws.com"},
+		{region: "ap-southeast-2", endpoint: "https://s3.ap-southeast-2.amazonaws.com"},
+		{region: "cn-north-1", endpoint: "https://s3.cn-north-1.amazonaws.com.cn"},
+	}
+	for _, test := range tests {
+		client, err := NewClientFromSecret(map[string]string{
+			"accessKeyID":     "key",
+			"secretAccessKey": "secret",
+			"region":          test.region,
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.region, err)
+			continue
+		}
+		if client.Config.Endpoint != test.endpoint {
+			t.Errorf("%s: expected endpoint %s, got %s", test.region, test.endpoint, client.Config.Endpoint)
+		}
+	}
+
+	// an explicit endpoint always wins
+	client, err := NewClientFromSecret(map[string]string{"region": "eu-west-1", "endpoint": "https://minio.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.Endpoint != "https://minio.example.com" {
+		t.Errorf("expected explicit endpoint to be kept, got %s", client.Config.Endpoint)
+	}
+}
+
+func TestIsEmptyIgnoresMarkers(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.PutObject("bucket", "volume/csi-fs/"+ReadyMarkerName, nil)
+	srv.PutObject("bucket", "volume/csi-fs/"+VolumeInfoName, []byte("{}"))
+
+	empty, err := client.IsEmpty("bucket", "volume/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty {
+		t.Fatal("expected a volume with only markers to be empty")
+	}
+	srv.PutObject("bucket", "volume/csi-fs/file", []byte("data"))
+	if empty, err = client.IsEmpty("bucket", "volume/"); err != nil || empty {
+		t.Fatalf("expected volume with data not to be empty: %v", err)
+	}
+}
+
+func TestControlObjectsBelowControlPrefix(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	defer SetOptions(options)
+	SetOptions(Options{ControlPrefix: "/.csi-s3/"})
+
+	// metadata written before the control prefix was set
+	srv.PutObject("bucket", "volume/"+metadataName, []byte(`{"Name":"bucket","Prefix":"volume","Mounter":"s3fs"}`))
+	meta, err := client.GetFSMeta("bucket", "volume")
+	if err != nil || meta.Mounter != "s3fs" {
+		t.Fatalf("expected legacy metadata to be read, got %+v, %v", meta, err)
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("bucket", ".csi-s3/volume/"+metadataName) == nil {
+		t.Fatal("expected metadata below the control prefix")
+	}
+	if srv.GetObject("bucket", "volume/"+metadataName) != nil {
+		t.Fatal("expected legacy metadata to be removed")
+	}
+	if err := client.SetRetainedMarker("bucket", "volume", "pv"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.GetObject("bucket", ".csi-s3/volume/"+retainedMarkerName) == nil {
+		t.Fatal("expected retained marker below the control prefix")
+	}
+
+	if empty, err := client.IsEmpty("bucket", ""); err != nil || !empty {
+		t.Fatalf("expected control objects not to be counted as data: %v", err)
+	}
+	srv.PutObject("bucket", "volume/csi-fs/file", []byte("data"))
+	srv.PutObject("bucket", ".csi-s3/other/"+metadataName, []byte("{}"))
+	if err := client.RemovePrefix("bucket", "volume"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := srv.Keys("bucket"); len(keys) != 1 || keys[0] != ".csi-s3/other/"+metadataName {
+		t.Fatalf("expected only the control objects of the other volume to be left, got %v", keys)
+	}
+}
+
+func TestSigningRegion(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bucket")
+	var authorization string
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		authorization = r.Header.Get("Authorization")
+		return false
+	}
+
+	secret := srv.Secret()
+	secret["region"] = "eu-central-1"
+	secret["signingRegion"] = "us-east-1"
+	client, err := NewClientFromSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.Region != "eu-central-1" || client.Config.SignatureRegion() != "us-east-1" {
+		t.Fatalf("unexpected regions %+v", client.Config)
+	}
+	if _, err := client.BucketExists("bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authorization, "/us-east-1/s3/aws4_request") {
+		t.Fatalf("expected request to be signed for us-east-1, got %q", authorization)
+	}
+
+	delete(secret, "signingRegion")
+	if client, err = NewClientFromSecret(secret); err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.SignatureRegion() != "eu-central-1" {
+		t.Fatalf("expected the data region to be used for signing, got %s", client.Config.SignatureRegion())
+	}
+}
@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	visibilityInitialBackoff = 50 * time.Millisecond
+	visibilityMaxBackoff     = time.Second
+)
+
+// waitVisible returns once the object written at key with etag can be
+// read back, for backends which are only eventually consistent. The wait
+// is bounded by the ReadAfterWriteTimeout option, without it writes are
+// trusted to be visible immediately.
+func (client *s3Client) waitVisible(ctx context.Context, bucketName, key, etag string) error {
+	timeout := options.ReadAfterWriteTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := visibilityInitialBackoff
+	for {
+		info, err := client.minio.StatObject(ctx, bucketName, key, minio.StatObjectOptions{})
+		err = wrapError(err)
+		switch {
+		case err == nil && (etag == "" || sameETag(info.ETag, etag)):
+			return nil
+		case err != nil && !errors.Is(err, ErrObjectNotFound):
+			return err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("object %s of bucket %s is not readable %s after it has been written", key, bucketName, timeout)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > visibilityMaxBackoff {
+			backoff = visibilityMaxBackoff
+		}
+	}
+}
+
+func sameETag(a, b string) bool {
+	return strings.Trim(a, `"`) == strings.Trim(b, `"`)
+}
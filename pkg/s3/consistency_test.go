@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+// hideWrites makes the server answer the first hidden HEAD requests with
+// 404, like an eventually consistent backend
+func hideWrites(srv *s3test.Server, hidden int) func() int {
+	var mu sync.Mutex
+	heads := 0
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodHead {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		heads++
+		if heads > hidden {
+			return false
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	}
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return heads
+	}
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	defer SetOptions(options)
+	SetOptions(Options{RemoveWorkers: 1, ReadAfterWriteTimeout: 5 * time.Second})
+
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	heads := hideWrites(srv, 2)
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "volume"}); err != nil {
+		t.Fatal(err)
+	}
+	if heads() != 3 {
+		t.Fatalf("expected the metadata to be read back until it is visible, got %d requests", heads())
+	}
+	if err := client.CreatePrefix("bucket", "volume/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	if heads() != 4 {
+		t.Fatalf("expected the prefix to be read back, got %d requests", heads())
+	}
+
+	SetOptions(Options{RemoveWorkers: 1, ReadAfterWriteTimeout: 200 * time.Millisecond})
+	hideWrites(srv, 1000)
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "volume"}); err == nil {
+		t.Fatal("expected an error if the metadata never becomes visible")
+	}
+
+	SetOptions(Options{RemoveWorkers: 1})
+	heads = hideWrites(srv, 1000)
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "volume"}); err != nil {
+		t.Fatal(err)
+	}
+	if heads() != 0 {
+		t.Fatalf("expected no check without timeout, got %d requests", heads())
+	}
+}
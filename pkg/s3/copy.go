@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/minio/minio-go/v7"
+)
+
+// maxCopyObjectSize is the largest object copied with a single request,
+// larger objects are copied in parts
+const maxCopyObjectSize = 5 << 30
+
+// isCopiedObject returns false for the objects of the driver below a
+// prefix, which belong to the volume they were written for and not to
+// its data
+func isCopiedObject(key string) bool {
+	name := path.Base(key)
+	return !isMarkerObject(key) && !isControlObject(key) && !isMetadataName(name) && name != retainedMarkerName
+}
+
+// CopyPrefix copies the objects below srcPrefix of srcBucket server-side
+// to dstPrefix of dstBucket and returns the number of copied objects.
+// Markers and control objects are not copied, existing objects of the
+// destination are overwritten, so a failed copy can be repeated. If the
+// destination is below the source, it is not copied into itself.
+func (client *s3Client) CopyPrefix(srcBucket, srcPrefix, dstBucket, dstPrefix string) (count int, err error) {
+	ctx, span := client.startSpan("CopyPrefix", dstBucket)
+	defer span.End(&err)
+	defer audit.Log(ctx, "CopyPrefix", dstBucket, dstPrefix, &err)
+	span.SetAttribute("s3.source_bucket", srcBucket)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	srcDir, dstDir := DirPrefix(srcPrefix), DirPrefix(dstPrefix)
+	for object := range client.listObjects(ctx, srcBucket, minio.ListObjectsOptions{Prefix: srcDir, Recursive: true}) {
+		if object.Err != nil {
+			return count, wrapError(object.Err)
+		}
+		// the placeholder of the destination has been written with it
+		if object.Key == srcDir || !isCopiedObject(object.Key) ||
+			(srcBucket == dstBucket && dstDir != "" && strings.HasPrefix(object.Key, dstDir)) {
+			continue
+		}
+		dst := minio.CopyDestOptions{
+			Bucket:     dstBucket,
+			Object:     dstDir + strings.TrimPrefix(object.Key, srcDir),
+			Encryption: client.serverSideEncryption(),
+		}
+		src := minio.CopySrcOptions{Bucket: srcBucket, Object: object.Key}
+		if object.Size > maxCopyObjectSize {
+			_, err = client.minio.ComposeObject(ctx, dst, src)
+		} else {
+			_, err = client.minio.CopyObject(ctx, dst, src)
+		}
+		if err != nil {
+			return count, wrapError(err)
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,52 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCopyPrefix(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("seed")
+	srv.CreateBucket("bucket")
+	srv.PutObject("seed", "base/", nil)
+	srv.PutObject("seed", "base/config.yaml", []byte("config"))
+	srv.PutObject("seed", "base/schema/v1.sql", []byte("schema"))
+	srv.PutObject("seed", "base/"+ReadyMarkerName, nil)
+	srv.PutObject("seed", "base/"+metadataName, []byte("{}"))
+	srv.PutObject("seed", "other/file", []byte("other"))
+
+	count, err := client.CopyPrefix("seed", "base", "bucket", "volume/csi-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 copied objects, got %d", count)
+	}
+	want := []string{"volume/csi-fs/config.yaml", "volume/csi-fs/schema/v1.sql"}
+	if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("expected %v, got %v", want, keys)
+	}
+	if o := srv.GetObject("bucket", "volume/csi-fs/schema/v1.sql"); string(o.Data) != "schema" {
+		t.Fatalf("expected the data of the source, got %q", o.Data)
+	}
+	// a repeated copy overwrites the objects
+	if count, err := client.CopyPrefix("seed", "base", "bucket", "volume/csi-fs"); err != nil || count != 2 {
+		t.Fatalf("expected the copy to be repeatable, got %d, %v", count, err)
+	}
+}
+
+func TestCopyPrefixIntoItself(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	srv.PutObject("bucket", "file", []byte("data"))
+	srv.PutObject("bucket", "volume/csi-fs/", nil)
+
+	if _, err := client.CopyPrefix("bucket", "", "bucket", "volume/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"file", "volume/csi-fs/", "volume/csi-fs/file"}
+	if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("expected %v, got %v", want, keys)
+	}
+}
@@ -0,0 +1,260 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// credentialProviderKey selects the credential provider in the secret
+	credentialProviderKey = "credentialProvider"
+	// SecretCredentialProvider reads the credentials from the secret itself
+	SecretCredentialProvider = "secret"
+	// VaultCredentialProvider reads the credentials from HashiCorp Vault
+	VaultCredentialProvider = "vault"
+
+	vaultAddressKey = "vaultAddress"
+	vaultTokenKey   = "vaultToken"
+	vaultPathKey    = "vaultPath"
+	// vaultCacheTTL is used for secrets without a lease, like the ones of
+	// the KV engines
+	vaultCacheTTL = 5 * time.Minute
+)
+
+// Credentials authenticate with the S3 provider
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials
+	SessionToken string
+}
+
+// CredentialProvider returns the credentials of a client. It gets the
+// secret of the request, which holds either the credentials or the
+// settings needed to fetch them.
+type CredentialProvider interface {
+	Credentials(secret map[string]string) (*Credentials, error)
+}
+
+var credentialProviders = map[string]CredentialProvider{
+	SecretCredentialProvider: secretProvider{},
+	VaultCredentialProvider:  newVaultProvider(),
+}
+
+// RegisterCredentialProvider makes a provider selectable with the
+// credentialProvider key of the secret. It replaces a provider of the
+// same name.
+func RegisterCredentialProvider(name string, provider CredentialProvider) {
+	credentialProviders[name] = provider
+}
+
+func credentialProvider(secret map[string]string) (CredentialProvider, error) {
+	name := secret[credentialProviderKey]
+	if name == "" {
+		name = SecretCredentialProvider
+	}
+	provider, ok := credentialProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q", credentialProviderKey, name)
+	}
+	return provider, nil
+}
+
+const (
+	// NodeAccessKeyIDKey is the key of the access key the nodes use in a
+	// provisioner secret, so the controller can check their access
+	NodeAccessKeyIDKey = "nodeAccessKeyID"
+	// NodeSecretAccessKeyKey is the key of the secret key the nodes use in
+	// a provisioner secret
+	NodeSecretAccessKeyKey = "nodeSecretAccessKey"
+)
+
+// DefaultAccessKeyIDKeys and DefaultSecretAccessKeyKeys are the keys of a
+// secret the credentials are read from, in the order they are tried. The
+// keys of csi-s3 come first, followed by the ones of other S3 drivers and
+// tools, so their secrets can be used as they are.
+var (
+	DefaultAccessKeyIDKeys = []string{
+		"accessKeyID",
+		// AWS CLI and SDKs, object bucket claims of Rook and NooBaa
+		"AWS_ACCESS_KEY_ID",
+		// Mountpoint for Amazon S3 CSI driver
+		"key_id",
+		"access-key",
+		"accesskey",
+	}
+	DefaultSecretAccessKeyKeys = []string{
+		"secretAccessKey",
+		"AWS_SECRET_ACCESS_KEY",
+		// the Mountpoint driver names the secret key access_key
+		"access_key",
+		"secret-key",
+		"secretkey",
+	}
+)
+
+// accessKeyIDKeys returns the keys the access key ID is read from
+func accessKeyIDKeys() []string {
+	if len(options.AccessKeyIDKeys) > 0 {
+		return options.AccessKeyIDKeys
+	}
+	return DefaultAccessKeyIDKeys
+}
+
+// secretAccessKeyKeys returns the keys the secret access key is read from
+func secretAccessKeyKeys() []string {
+	if len(options.SecretAccessKeyKeys) > 0 {
+		return options.SecretAccessKeyKeys
+	}
+	return DefaultSecretAccessKeyKeys
+}
+
+// firstValue returns the value of the first of the keys which is set
+func firstValue(value func(key string) string, keys []string) string {
+	for _, key := range keys {
+		if v := value(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// NodeCredentialsSecret returns a copy of the provisioner secret with the
+// node credentials in place of its own, false if it holds none. The
+// endpoint and all other settings are kept.
+func NodeCredentialsSecret(secret map[string]string) (map[string]string, bool) {
+	if secret[NodeAccessKeyIDKey] == "" {
+		return nil, false
+	}
+	node := make(map[string]string, len(secret))
+	for k, v := range secret {
+		node[k] = v
+	}
+	delete(node, credentialProviderKey)
+	// an alias tried before the key set here would shadow it
+	for _, key := range append(accessKeyIDKeys(), secretAccessKeyKeys()...) {
+		delete(node, key)
+	}
+	node[accessKeyIDKeys()[0]] = secret[NodeAccessKeyIDKey]
+	node[secretAccessKeyKeys()[0]] = secret[NodeSecretAccessKeyKey]
+	return node, true
+}
+
+// secretProvider reads the credentials from the keys of the secret
+type secretProvider struct{}
+
+func (secretProvider) Credentials(secret map[string]string) (*Credentials, error) {
+	value := func(key string) string { return secret[key] }
+	return &Credentials{
+		AccessKeyID:     firstValue(value, accessKeyIDKeys()),
+		SecretAccessKey: firstValue(value, secretAccessKeyKeys()),
+	}, nil
+}
+
+// vaultProvider reads the credentials from a secret in Vault. The Vault
+// secret uses the same keys as a Kubernetes secret, including the
+// aliases. Both KV engine versions are supported.
+type vaultProvider struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedCredentials
+}
+
+type cachedCredentials struct {
+	creds   *Credentials
+	expires time.Time
+}
+
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+func newVaultProvider() *vaultProvider {
+	return &vaultProvider{
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  make(map[string]cachedCredentials),
+	}
+}
+
+func (vault *vaultProvider) Credentials(secret map[string]string) (*Credentials, error) {
+	address := secret[vaultAddressKey]
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := secret[vaultTokenKey]
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	secretPath := strings.Trim(secret[vaultPathKey], "/")
+	if address == "" || token == "" || secretPath == "" {
+		return nil, fmt.Errorf("%s, %s and %s are required for the vault credential provider", vaultAddressKey, vaultTokenKey, vaultPathKey)
+	}
+	url := strings.TrimSuffix(address, "/") + "/v1/" + secretPath
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	if cached, ok := vault.cache[url]; ok && time.Now().Before(cached.expires) {
+		return cached.creds, nil
+	}
+	creds, ttl, err := vault.read(url, token)
+	if err != nil {
+		return nil, err
+	}
+	vault.cache[url] = cachedCredentials{creds: creds, expires: time.Now().Add(ttl)}
+	return creds, nil
+}
+
+func (vault *vaultProvider) read(url, token string) (*Credentials, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vault.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read credentials from vault: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("failed to read credentials from vault: %s: %s", resp.Status, body)
+	}
+	var result vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, fmt.Errorf("invalid response from vault: %v", err)
+	}
+
+	data := result.Data
+	// version 2 of the KV engine nests the secret
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	str := func(key string) string {
+		s, _ := data[key].(string)
+		return s
+	}
+	creds := &Credentials{
+		AccessKeyID:     firstValue(str, accessKeyIDKeys()),
+		SecretAccessKey: firstValue(str, secretAccessKeyKeys()),
+		SessionToken:    str("sessionToken"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, 0, fmt.Errorf("vault secret %s has none of the keys %v or none of %v", url, accessKeyIDKeys(), secretAccessKeyKeys())
+	}
+	ttl := vaultCacheTTL
+	if result.LeaseDuration > 0 && time.Duration(result.LeaseDuration)*time.Second < ttl {
+		ttl = time.Duration(result.LeaseDuration) * time.Second
+	}
+	return creds, ttl, nil
+}
@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewClientFromSecretWithVault(t *testing.T) {
+	reads := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reads++
+		switch r.URL.Path {
+		case "/v1/secret/data/s3":
+			w.Write([]byte(`{"lease_duration":0,"data":{"data":{"accessKeyID":"vault-key","secretAccessKey":"vault-secret"},"metadata":{"version":1}}}`))
+		case "/v1/kv/s3":
+			w.Write([]byte(`{"lease_duration":2764800,"data":{"accessKeyID":"kv1-key","secretAccessKey":"kv1-secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	secret := map[string]string{
+		"credentialProvider": "vault",
+		"vaultAddress":       vault.URL,
+		"vaultToken":         "vault-token",
+		"vaultPath":          "secret/data/s3",
+		"endpoint":           "https://minio.example.com",
+	}
+	for i := 0; i < 2; i++ {
+		client, err := NewClientFromSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Config.AccessKeyID != "vault-key" || client.Config.SecretAccessKey != "vault-secret" {
+			t.Fatalf("expected credentials from vault, got %+v", client.Config)
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("expected the credentials to be cached, got %d reads", reads)
+	}
+
+	secret["vaultPath"] = "/kv/s3"
+	client, err := NewClientFromSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.AccessKeyID != "kv1-key" {
+		t.Fatalf("expected credentials from the KV v1 engine, got %+v", client.Config)
+	}
+
+	secret["vaultPath"] = "missing"
+	if _, err := NewClientFromSecret(secret); err == nil {
+		t.Fatal("expected an error for a missing vault secret")
+	}
+	secret["vaultToken"] = ""
+	if _, err := NewClientFromSecret(secret); err == nil {
+		t.Fatal("expected an error without a vault token")
+	}
+}
+
+func TestNewClientFromSecretUnknownProvider(t *testing.T) {
+	if _, err := NewClientFromSecret(map[string]string{"credentialProvider": "unknown"}); err == nil {
+		t.Fatal("expected an error for an unknown credential provider")
+	}
+}
+
+func TestNodeCredentialsSecret(t *testing.T) {
+	if _, ok := NodeCredentialsSecret(map[string]string{"accessKeyID": "key"}); ok {
+		t.Fatal("expected no node credentials")
+	}
+	secret := map[string]string{
+		"accessKeyID":          "key",
+		"secretAccessKey":      "secret",
+		"endpoint":             "https://s3.example.com",
+		credentialProviderKey:  VaultCredentialProvider,
+		NodeAccessKeyIDKey:     "node-key",
+		NodeSecretAccessKeyKey: "node-secret",
+	}
+	node, ok := NodeCredentialsSecret(secret)
+	if !ok {
+		t.Fatal("expected node credentials")
+	}
+	if node["accessKeyID"] != "node-key" || node["secretAccessKey"] != "node-secret" || node["endpoint"] != secret["endpoint"] {
+		t.Fatalf("unexpected node secret %v", node)
+	}
+	if _, ok := node[credentialProviderKey]; ok || secret["accessKeyID"] != "key" {
+		t.Fatal("expected the node credentials to be read from the copy of the secret only")
+	}
+}
+
+func TestSecretKeyAliases(t *testing.T) {
+	defer SetOptions(options)
+	secret := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "aws-key",
+		"AWS_SECRET_ACCESS_KEY": "aws-secret",
+		"key_id":                "mountpoint-key",
+		"access_key":            "mountpoint-secret",
+	}
+	creds, err := secretProvider{}.Credentials(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "aws-key" || creds.SecretAccessKey != "aws-secret" {
+		t.Fatalf("expected the first alias to win, got %+v", creds)
+	}
+	secret["accessKeyID"] = "key"
+	secret["secretAccessKey"] = "secret"
+	if creds, _ := (secretProvider{}).Credentials(secret); creds.AccessKeyID != "key" || creds.SecretAccessKey != "secret" {
+		t.Fatalf("expected the keys of csi-s3 to take precedence, got %+v", creds)
+	}
+
+	SetOptions(Options{AccessKeyIDKeys: []string{"key_id"}, SecretAccessKeyKeys: []string{"access_key"}})
+	if creds, _ := (secretProvider{}).Credentials(secret); creds.AccessKeyID != "mountpoint-key" || creds.SecretAccessKey != "mountpoint-secret" {
+		t.Fatalf("expected only the configured keys to be read, got %+v", creds)
+	}
+	// the node credentials are not shadowed by the aliases of the secret
+	secret[NodeAccessKeyIDKey] = "node-key"
+	secret[NodeSecretAccessKeyKey] = "node-secret"
+	node, _ := NodeCredentialsSecret(secret)
+	if creds, _ := (secretProvider{}).Credentials(node); creds.AccessKeyID != "node-key" || creds.SecretAccessKey != "node-secret" {
+		t.Fatalf("expected the node credentials, got %+v", creds)
+	}
+}
@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedMeta is the stored form of an encrypted FSMeta. The metadata is
+// sealed with a random data key, which itself is sealed with the key of
+// the driver secret identified by KeyID.
+type encryptedMeta struct {
+	KeyID      string `json:"KeyID"`
+	WrappedKey []byte `json:"WrappedKey"`
+	Ciphertext []byte `json:"Ciphertext"`
+}
+
+// parseMetaKeys splits a comma separated list of keys. The first key is
+// used for encryption, all of them for decryption.
+func parseMetaKeys(keys string) []string {
+	var parsed []string
+	for _, k := range strings.Split(keys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			parsed = append(parsed, k)
+		}
+	}
+	return parsed
+}
+
+func deriveKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// encryptMeta encrypts the encoded metadata with the first key
+func encryptMeta(keys []string, plaintext []byte) ([]byte, error) {
+	master := deriveKey(keys[0])
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(master, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&encryptedMeta{KeyID: keyID(master), WrappedKey: wrapped, Ciphertext: ciphertext})
+}
+
+// decryptMeta returns the encoded metadata of b. Plaintext metadata
+// written before encryption was enabled is returned as is.
+func decryptMeta(keys []string, b []byte) ([]byte, error) {
+	var enc encryptedMeta
+	if err := json.Unmarshal(b, &enc); err != nil || len(enc.Ciphertext) == 0 {
+		return b, nil
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("metadata is encrypted, but no metaEncryptionKey is configured")
+	}
+	for _, k := range keys {
+		master := deriveKey(k)
+		if keyID(master) != enc.KeyID {
+			continue
+		}
+		dataKey, err := unseal(master, enc.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap metadata key: %v", err)
+		}
+		plaintext, err := unseal(dataKey, enc.Ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt metadata: %v", err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("metadata is encrypted with unknown key %s", enc.KeyID)
+}
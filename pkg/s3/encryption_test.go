@@ -0,0 +1,49 @@
+package s3
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedFSMeta(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+
+	// metadata written before encryption was enabled stays readable
+	meta := &FSMeta{BucketName: "bucket", Prefix: "volume", Mounter: "s3fs", FSPath: "csi-fs"}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	client.Config.MetaEncryptionKeys = parseMetaKeys("old-key")
+	if got, err := client.GetFSMeta("bucket", "volume"); err != nil || got.Mounter != "s3fs" {
+		t.Fatalf("expected plaintext metadata to be read, got %+v, %v", got, err)
+	}
+
+	// the next write encrypts it
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if stored := srv.GetObject("bucket", controlKey("volume", metadataName)).Data; bytes.Contains(stored, []byte("s3fs")) {
+		t.Fatalf("expected metadata to be encrypted, got %s", stored)
+	}
+
+	// rotation: encrypt with the new key, still decrypt with the old one
+	client.Config.MetaEncryptionKeys = parseMetaKeys("new-key, old-key")
+	if got, err := client.GetFSMeta("bucket", "volume"); err != nil || got.Mounter != "s3fs" {
+		t.Fatalf("expected metadata to be decrypted with the old key, got %+v, %v", got, err)
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	client.Config.MetaEncryptionKeys = parseMetaKeys("new-key")
+	if got, err := client.GetFSMeta("bucket", "volume"); err != nil || got.Mounter != "s3fs" {
+		t.Fatalf("expected metadata to be re-encrypted with the new key, got %+v, %v", got, err)
+	}
+
+	for _, keys := range []string{"", "other-key"} {
+		client.Config.MetaEncryptionKeys = parseMetaKeys(keys)
+		if _, err := client.GetFSMeta("bucket", "volume"); err == nil {
+			t.Errorf("keys %q: expected an error reading encrypted metadata", keys)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// useSSLKey of the secret selects the scheme of an endpoint given without one
+const useSSLKey = "useSSL"
+
+// normalizeEndpoint returns endpoint as scheme://host[:port][/base/path]
+// without trailing slashes, so the driver and all mounters use the same
+// form. Endpoints without scheme, like minio.example.com:9000, use https
+// unless useSSL is false.
+func normalizeEndpoint(endpoint, useSSL string) (string, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return "", nil
+	}
+	ssl := true
+	if useSSL != "" {
+		var err error
+		if ssl, err = strconv.ParseBool(useSSL); err != nil {
+			return "", fmt.Errorf("invalid %s %q, must be true or false", useSSLKey, useSSL)
+		}
+	}
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if !ssl {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("invalid endpoint %q, the scheme must be http or https", endpoint)
+	case useSSL != "" && (u.Scheme == "https") != ssl:
+		return "", fmt.Errorf("scheme of endpoint %q contradicts %s %s", endpoint, useSSLKey, useSSL)
+	case u.Hostname() == "":
+		return "", fmt.Errorf("invalid endpoint %q, the host is missing", endpoint)
+	case u.User != nil:
+		return "", fmt.Errorf("invalid endpoint, credentials must not be part of the URL")
+	case u.RawQuery != "" || u.Fragment != "":
+		return "", fmt.Errorf("invalid endpoint %q, it must not have a query or fragment", endpoint)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// EndpointPath returns the base path of the endpoint, e.g. /s3 for an S3
+// gateway served at https://gw.example.com/s3, empty if it has none
+func (cfg *Config) EndpointPath() string {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// ErrBucketNotFound is returned if the bucket does not exist
+	ErrBucketNotFound = errors.New("bucket not found")
+	// ErrObjectNotFound is returned if an object like the metadata does not exist
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrAccessDenied is returned if the credentials lack the permission for an operation
+	ErrAccessDenied = errors.New("access denied")
+	// ErrBucketNotEmpty is returned when removing a bucket which still contains objects
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+	// ErrBucketAlreadyExists is returned when creating a bucket which exists
+	// already, e.g. because it has been created concurrently
+	ErrBucketAlreadyExists = errors.New("bucket already exists")
+	// ErrReplicationNotConfigured is returned if an existing bucket is not
+	// versioned or not replicated to the expected destination
+	ErrReplicationNotConfigured = errors.New("bucket replication not configured")
+	// ErrObjectRetained is returned when overwriting or removing an object
+	// which is protected by a retention or an append-only policy
+	ErrObjectRetained = errors.New("object is retained")
+	// ErrGrantsNotSupported is returned if the backend refuses to write
+	// objects with ACL grants
+	ErrGrantsNotSupported = errors.New("ACL grants not supported")
+	// ErrMetadataTooNew is returned when changing metadata which has been
+	// written by a newer major version of the driver
+	ErrMetadataTooNew = errors.New("metadata written by a newer driver")
+	// ErrChecksumMismatch is returned if an object has been corrupted on
+	// its way to or from the backend
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrMetadataUnreadable is returned if the metadata of a volume exists,
+	// but cannot be decrypted or decoded
+	ErrMetadataUnreadable = errors.New("metadata cannot be decoded")
+)
+
+// retentionErrors are the error codes of objects which must not be
+// overwritten or removed. The providers answering with a generic code are
+// told apart by their exact message, an empty message matches any.
+var retentionErrors = []struct{ code, message string }{
+	{code: "ObjectLocked"},
+	// AWS S3 refusing to remove a version under retention
+	{code: "AccessDenied", message: "Access Denied because object protected by object lock."},
+	// MinIO refusing to overwrite or remove an object under retention
+	{code: "InvalidRequest", message: "Object is WORM protected and cannot be overwritten"},
+}
+
+func isRetentionError(resp minio.ErrorResponse) bool {
+	for _, e := range retentionErrors {
+		if resp.Code == e.code && (e.message == "" || resp.Message == e.message) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerError keeps the original error of the provider while
+// matching one of the exported errors with errors.Is.
+type providerError struct {
+	kind error
+	err  error
+}
+
+func (e *providerError) Error() string {
+	return e.err.Error()
+}
+
+func (e *providerError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *providerError) Unwrap() error {
+	return e.err
+}
+
+// wrapError converts errors returned by the provider into the errors
+// exported by this package. Unknown errors are returned unchanged.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return err
+	}
+	var kind error
+	switch {
+	case resp.Code == "NoSuchBucket":
+		kind = ErrBucketNotFound
+	case resp.Code == "NoSuchKey":
+		kind = ErrObjectNotFound
+	case resp.Code == "BucketNotEmpty":
+		kind = ErrBucketNotEmpty
+	case resp.Code == "BucketAlreadyOwnedByYou", resp.Code == "BucketAlreadyExists":
+		kind = ErrBucketAlreadyExists
+	case resp.Code == "BadDigest", resp.Code == "XAmzContentChecksumMismatch":
+		kind = ErrChecksumMismatch
+	case resp.Code == "AccessControlListNotSupported":
+		kind = ErrGrantsNotSupported
+	case isRetentionError(resp):
+		kind = ErrObjectRetained
+	case resp.Code == "AccessDenied", resp.StatusCode == http.StatusForbidden:
+		kind = ErrAccessDenied
+	default:
+		return err
+	}
+	return &providerError{kind: kind, err: err}
+}
@@ -0,0 +1,152 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const locationResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`
+
+const emptyListResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><KeyCount>0</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated></ListBucketResult>`
+
+func errorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// newTestClient returns a client talking to a fake provider. Bucket
+// location and listing requests are answered, everything else is passed
+// to the handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *s3Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if _, ok := query["location"]; ok {
+			fmt.Fprint(w, locationResponse)
+			return
+		}
+		if query.Get("list-type") == "2" {
+			fmt.Fprint(w, emptyListResponse)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewClient(&Config{AccessKeyID: "key", SecretAccessKey: "secret", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTypedErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		code     string
+		call     func(c *s3Client) error
+		expected error
+	}{
+		{
+			name:   "missing metadata",
+			status: http.StatusNotFound,
+			code:   "NoSuchKey",
+			call: func(c *s3Client) error {
+				_, err := c.GetFSMeta("bucket", "prefix")
+				return err
+			},
+			expected: ErrObjectNotFound,
+		},
+		{
+			name:   "missing bucket",
+			status: http.StatusNotFound,
+			code:   "NoSuchBucket",
+			call: func(c *s3Client) error {
+				return c.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "prefix"})
+			},
+			expected: ErrBucketNotFound,
+		},
+		{
+			name:   "access denied on create",
+			status: http.StatusForbidden,
+			code:   "AccessDenied",
+			call: func(c *s3Client) error {
+				return c.CreateBucket("bucket")
+			},
+			expected: ErrAccessDenied,
+		},
+		{
+			name:   "access denied with vendor specific code",
+			status: http.StatusForbidden,
+			code:   "SignatureDoesNotMatch",
+			call: func(c *s3Client) error {
+				return c.CreatePrefix("bucket", "prefix")
+			},
+			expected: ErrAccessDenied,
+		},
+		{
+			name:   "bucket not empty",
+			status: http.StatusConflict,
+			code:   "BucketNotEmpty",
+			call: func(c *s3Client) error {
+				return c.RemoveBucket("bucket")
+			},
+			expected: ErrBucketNotEmpty,
+		},
+		{
+			name:   "bucket created concurrently",
+			status: http.StatusConflict,
+			code:   "BucketAlreadyOwnedByYou",
+			call: func(c *s3Client) error {
+				return c.CreateBucket("bucket")
+			},
+			expected: ErrBucketAlreadyExists,
+		},
+		{
+			name:   "bucket of another account",
+			status: http.StatusConflict,
+			code:   "BucketAlreadyExists",
+			call: func(c *s3Client) error {
+				return c.CreateBucket("bucket")
+			},
+			expected: ErrBucketAlreadyExists,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				errorResponse(w, test.status, test.code)
+			})
+			err := test.call(client)
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected error %q, got %v", test.expected, err)
+			}
+			var resp minio.ErrorResponse
+			if !errors.As(err, &resp) || resp.Code != test.code {
+				t.Fatalf("expected provider error with code %s to be preserved, got %v", test.code, err)
+			}
+		})
+	}
+}
+
+func TestUnknownErrorsAreNotWrapped(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, http.StatusBadRequest, "InvalidBucketName")
+	})
+	err := client.CreateBucket("bucket")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, known := range []error{ErrBucketNotFound, ErrObjectNotFound, ErrAccessDenied, ErrBucketNotEmpty} {
+		if errors.Is(err, known) {
+			t.Fatalf("expected unknown error, got %q", known)
+		}
+	}
+}
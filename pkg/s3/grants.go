@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	grantReadHeader = "x-amz-grant-read"
+	// objects have no write permission of their own, a grantee allowed to
+	// write gets full control over the objects of the volume
+	grantFullControlHeader = "x-amz-grant-full-control"
+)
+
+// Grants are the ACL grants the objects of a volume are written with
+type Grants struct {
+	// Read are the grantees which may read the objects
+	Read []string
+	// Write are the grantees which get full control over the objects
+	Write []string
+	// Required fails writes if the backend does not support grants,
+	// otherwise the objects are written without them
+	Required bool
+}
+
+// Empty returns true if nothing is granted
+func (g Grants) Empty() bool {
+	return len(g.Read) == 0 && len(g.Write) == 0
+}
+
+// Headers returns the request headers which apply the grants to a written
+// object, e.g. x-amz-grant-read: id="<canonical ID>"
+func (g Grants) Headers() map[string]string {
+	headers := map[string]string{}
+	if len(g.Read) > 0 {
+		headers[grantReadHeader] = granteeList(g.Read)
+	}
+	if len(g.Write) > 0 {
+		headers[grantFullControlHeader] = granteeList(g.Write)
+	}
+	return headers
+}
+
+func granteeList(grantees []string) string {
+	list := make([]string, len(grantees))
+	for i, g := range grantees {
+		if strings.Contains(g, "@") {
+			list[i] = fmt.Sprintf("emailAddress=%q", g)
+		} else {
+			list[i] = fmt.Sprintf("id=%q", g)
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// ParseGrantees parses a comma separated list of canonical user IDs and
+// email addresses
+func ParseGrantees(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var grantees []string
+	for _, g := range strings.Split(value, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" || strings.ContainsAny(g, "\"= \t") {
+			return nil, fmt.Errorf("invalid grantee %q, must be a canonical user ID or an email address", g)
+		}
+		grantees = append(grantees, g)
+	}
+	return grantees, nil
+}
+
+// WithGrants returns a client which writes the objects of the driver, like
+// the metadata and markers, with the grants
+func (client *s3Client) WithGrants(grants Grants) *s3Client {
+	c := *client
+	c.grants = grants
+	return &c
+}
+
+// isGrantError returns true if the backend refused the grants of a write
+func isGrantError(err error) bool {
+	if errors.Is(err, ErrGrantsNotSupported) {
+		return true
+	}
+	var resp minio.ErrorResponse
+	return errors.As(err, &resp) && resp.Code == "NotImplemented"
+}
+
+// putInternalObject writes an object of the driver with the grants of the
+// client. A backend which does not support grants gets the object without
+// them, unless they are required.
+func (client *s3Client) putInternalObject(ctx context.Context, bucketName, key string, data []byte, contentType string) (minio.UploadInfo, error) {
+	opts := internalPutOptions(contentType)
+	opts.ServerSideEncryption = client.serverSideEncryption()
+	client.addChecksum(&opts, data)
+	if client.grants.Empty() {
+		info, err := client.minio.PutObject(ctx, bucketName, key, bytes.NewReader(data), int64(len(data)), opts)
+		return info, wrapError(err)
+	}
+	withGrants := opts
+	withGrants.UserMetadata = client.grants.Headers()
+	for k, v := range opts.UserMetadata {
+		withGrants.UserMetadata[k] = v
+	}
+	info, err := client.minio.PutObject(ctx, bucketName, key, bytes.NewReader(data), int64(len(data)), withGrants)
+	if err = wrapError(err); err == nil || !isGrantError(err) {
+		return info, err
+	}
+	if client.grants.Required {
+		return info, &providerError{kind: ErrGrantsNotSupported, err: err}
+	}
+	glog.Warningf("Bucket %s does not support ACL grants, writing %s without them: %v", bucketName, key, err)
+	info, err = client.minio.PutObject(ctx, bucketName, key, bytes.NewReader(data), int64(len(data)), opts)
+	return info, wrapError(err)
+}
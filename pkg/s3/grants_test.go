@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestParseGrantees(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"":                      nil,
+		"79a59df900b949e5":      {"79a59df900b949e5"},
+		"79a59df9, ops@example": {"79a59df9", "ops@example"},
+	} {
+		grantees, err := ParseGrantees(value)
+		if err != nil || !reflect.DeepEqual(grantees, expected) {
+			t.Errorf("%q: expected %v, got %v, %v", value, expected, grantees, err)
+		}
+	}
+	for _, value := range []string{"a,,b", "id=79a59df9", `"79a59df9"`, "two words"} {
+		if _, err := ParseGrantees(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+// recordGrants records the grant headers of the object writes
+func recordGrants(srv *s3test.Server) map[string]http.Header {
+	grants := map[string]http.Header{}
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut {
+			h := http.Header{}
+			for _, key := range []string{grantReadHeader, grantFullControlHeader} {
+				if v := r.Header.Get(key); v != "" {
+					h.Set(key, v)
+				}
+			}
+			grants[r.URL.Path] = h
+		}
+		return false
+	}
+	return grants
+}
+
+func TestWriteWithGrants(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	grants := recordGrants(srv)
+
+	meta := &FSMeta{BucketName: "bucket", Prefix: "vol", GrantRead: []string{"79a59df9", "ops@example.com"}, GrantWrite: []string{"c0ffee"}}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WithGrants(meta.Grants()).CreatePrefix("bucket", "vol/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	expected := http.Header{}
+	expected.Set(grantReadHeader, `id="79a59df9", emailAddress="ops@example.com"`)
+	expected.Set(grantFullControlHeader, `id="c0ffee"`)
+	for _, key := range []string{"/bucket/vol/.metadata.json", "/bucket/vol/csi-fs/"} {
+		if !reflect.DeepEqual(grants[key], expected) {
+			t.Errorf("expected %s to be written with %v, got %v", key, expected, grants[key])
+		}
+	}
+}
+
+func TestWriteWithUnsupportedGrants(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	for _, code := range []string{"AccessControlListNotSupported", "NotImplemented"} {
+		srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodPut && r.Header.Get(grantReadHeader) != "" {
+				s3test.Error(w, http.StatusBadRequest, code)
+				return true
+			}
+			return false
+		}
+		grants := Grants{Read: []string{"79a59df9"}}
+		if err := client.WithGrants(grants).CreatePrefix("bucket", "vol"); err != nil {
+			t.Fatalf("%s: expected the prefix to be written without grants, got %v", code, err)
+		}
+		grants.Required = true
+		if err := client.WithGrants(grants).CreatePrefix("bucket", "vol"); !errors.Is(err, ErrGrantsNotSupported) {
+			t.Fatalf("%s: expected required grants to fail, got %v", code, err)
+		}
+	}
+}
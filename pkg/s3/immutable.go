@@ -0,0 +1,117 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// MetadataPolicyImmutable never overwrites the metadata of a volume,
+	// every write adds a new version of it instead. It is meant for
+	// backends which only allow objects to be written once.
+	MetadataPolicyImmutable = "immutable"
+
+	metadataVersionPrefix = ".metadata.v"
+	metadataVersionSuffix = ".json"
+)
+
+// metadataVersionName returns the name of version of the metadata
+func metadataVersionName(version int) string {
+	return fmt.Sprintf("%s%d%s", metadataVersionPrefix, version, metadataVersionSuffix)
+}
+
+// parseMetadataVersion returns the version of a versioned metadata object
+// name, false if name is not one
+func parseMetadataVersion(name string) (int, bool) {
+	if !strings.HasPrefix(name, metadataVersionPrefix) || !strings.HasSuffix(name, metadataVersionSuffix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, metadataVersionPrefix), metadataVersionSuffix))
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// isMetadataName returns true if name is the metadata of a volume or one
+// of its versions
+func isMetadataName(name string) bool {
+	_, versioned := parseMetadataVersion(name)
+	return name == metadataName || versioned
+}
+
+// metadataVersion is a version of the metadata of a volume
+type metadataVersion struct {
+	version int
+	key     string
+}
+
+// listMetadataVersions returns the versions of the metadata of the volume
+// at prefix, the latest version first
+func (client *s3Client) listMetadataVersions(ctx context.Context, bucketName, prefix string) ([]metadataVersion, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var versions []metadataVersion
+	listPrefix := controlKey(prefix, metadataVersionPrefix)
+	for object := range client.listObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: listPrefix}) {
+		if object.Err != nil {
+			return nil, wrapError(object.Err)
+		}
+		if version, ok := parseMetadataVersion(path.Base(object.Key)); ok && path.Dir(object.Key) == path.Dir(listPrefix) {
+			versions = append(versions, metadataVersion{version: version, key: object.Key})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].version > versions[j].version })
+	return versions, nil
+}
+
+// putMetadataVersion writes b as the next version of the metadata of the
+// volume. Two concurrent writes of the same version fail on a backend
+// which only allows objects to be written once, the later one is retried
+// by the caller.
+func (client *s3Client) putMetadataVersion(ctx context.Context, meta *FSMeta, b []byte) error {
+	versions, err := client.listMetadataVersions(ctx, meta.BucketName, meta.Prefix)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].version + 1
+	}
+	key := controlKey(meta.Prefix, metadataVersionName(next))
+	info, err := client.putInternalObject(ctx, meta.BucketName, key, b, "application/json")
+	if err != nil {
+		return err
+	}
+	glog.V(4).Infof("Wrote version %d of the metadata of %s", next, path.Join(meta.BucketName, meta.Prefix))
+	return client.waitVisible(ctx, meta.BucketName, key, info.ETag)
+}
+
+// removeMetadataVersions removes as many versions of the metadata of the
+// volume as possible, with versions also the previous versions of their
+// objects. Versions under retention are kept.
+func (client *s3Client) removeMetadataVersions(ctx context.Context, bucketName, prefix string, versions bool) error {
+	metaVersions, err := client.listMetadataVersions(ctx, bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	for _, version := range metaVersions {
+		err := client.removeObject(ctx, bucketName, version.key, versions)
+		if errors.Is(err, ErrObjectRetained) {
+			glog.Warningf("Keeping metadata %s of bucket %s, it is retained: %v", version.key, bucketName, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
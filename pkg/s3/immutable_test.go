@@ -0,0 +1,152 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// retentionError answers like MinIO for an object under retention
+func retentionError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidRequest</Code><Message>Object is WORM protected and cannot be overwritten</Message></Error>`)
+}
+
+func TestImmutableMetadata(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	meta := &FSMeta{BucketName: "bucket", Prefix: "vol", CapacityBytes: 1, MetadataPolicy: MetadataPolicyImmutable}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.CapacityBytes = 2
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"vol/.metadata.v1.json", "vol/.metadata.v2.json"}
+	if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected versions of the metadata, got %v", keys)
+	}
+	read, err := client.GetFSMeta("bucket", "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.CapacityBytes != 2 {
+		t.Fatalf("expected the latest version to be read, got %+v", read)
+	}
+	if metas, err := client.ListFSMeta("bucket"); err != nil || len(metas) != 1 {
+		t.Fatalf("expected a single volume to be listed, got %v, %v", metas, err)
+	}
+	if count, err := client.CountObjects("bucket", "vol", 10); err != nil || count != 0 {
+		t.Fatalf("expected the versions not to be counted as data, got %d, %v", count, err)
+	}
+
+	// the first version is retained, the others are removed
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, ".metadata.v1.json") {
+			retentionError(w)
+			return true
+		}
+		return false
+	}
+	if err := client.RemoveFSMeta("bucket", "vol"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, expected[:1]) {
+		t.Fatalf("expected only the retained version to be kept, got %v", keys)
+	}
+}
+
+func TestImmutableMetadataFallback(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	meta := &FSMeta{BucketName: "bucket", Prefix: "vol", CapacityBytes: 1}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/"+metadataName) {
+			retentionError(w)
+			return true
+		}
+		return false
+	}
+	meta.CapacityBytes = 2
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.MetadataPolicy != MetadataPolicyImmutable {
+		t.Fatal("expected the volume to switch to the immutable metadata policy")
+	}
+	read, err := client.GetFSMeta("bucket", "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.CapacityBytes != 2 || read.MetadataPolicy != MetadataPolicyImmutable {
+		t.Fatalf("expected the version to take precedence over the original metadata, got %+v", read)
+	}
+}
+
+func TestRetentionErrors(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock.</Message></Error>`)
+	})
+	err := client.RemoveFSMeta("bucket", "vol")
+	if err != nil {
+		t.Fatalf("expected retained metadata to be kept without an error, got %v", err)
+	}
+	err = client.CreatePrefix("bucket", "vol")
+	if !errors.Is(err, ErrObjectRetained) || errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("expected a retention error, got %v", err)
+	}
+
+	// only the code tells a retention apart
+	client = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Missing permission s3:PutObjectRetention</Message></Error>`)
+	})
+	err = client.CreatePrefix("bucket", "vol")
+	if errors.Is(err, ErrObjectRetained) || !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("expected an access denied error, got %v", err)
+	}
+}
+
+func TestGetFSMetaListsOnlyVersionedMetadata(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	lists := 0
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") != "" {
+			lists++
+		}
+		return false
+	}
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "vol", CapacityBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	lists = 0
+	if meta, err := client.GetFSMeta("bucket", "vol"); err != nil || meta.CapacityBytes != 1 {
+		t.Fatalf("expected the metadata to be read, got %+v, %v", meta, err)
+	}
+	if lists != 0 {
+		t.Errorf("expected the metadata to be read without listing, got %d lists", lists)
+	}
+
+	if err := client.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "immutable", CapacityBytes: 2, MetadataPolicy: MetadataPolicyImmutable}); err != nil {
+		t.Fatal(err)
+	}
+	lists = 0
+	if meta, err := client.GetFSMeta("bucket", "immutable"); err != nil || meta.CapacityBytes != 2 {
+		t.Fatalf("expected the version to be read, got %+v, %v", meta, err)
+	}
+	if lists != 1 {
+		t.Errorf("expected the versions to be listed once, got %d lists", lists)
+	}
+}
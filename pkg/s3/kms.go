@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+const (
+	sseHeader          = "X-Amz-Server-Side-Encryption"
+	sseKMSKeyIDHeader  = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+	sseContextHeader   = "X-Amz-Server-Side-Encryption-Context"
+	sseBucketKeyHeader = "X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"
+)
+
+// KMSOptions are the SSE-KMS settings the objects of a volume are written
+// with
+type KMSOptions struct {
+	// KeyID is the KMS key of the objects, empty for the AWS managed key
+	KeyID string `json:"KeyID,omitempty"`
+	// Context is the encryption context asserting the identity of the
+	// volume, KMS policies can require it to decrypt the objects
+	Context map[string]string `json:"Context,omitempty"`
+	// BucketKey has the objects encrypted with the S3 Bucket Key, which
+	// reduces the requests to KMS
+	BucketKey bool `json:"BucketKey,omitempty"`
+	// ContextRequired refuses to mount the volume with a mounter which
+	// cannot write the objects with the encryption context
+	ContextRequired bool `json:"ContextRequired,omitempty"`
+}
+
+// ParseKMSContext parses an encryption context, a JSON object of string
+// values, e.g. {"volume":"pvc-1234"}
+func ParseKMSContext(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var context map[string]string
+	if err := json.Unmarshal([]byte(value), &context); err != nil {
+		return nil, fmt.Errorf("invalid encryption context %s, must be a JSON object of strings: %v", value, err)
+	}
+	if len(context) == 0 {
+		return nil, fmt.Errorf("invalid encryption context %s, must not be empty", value)
+	}
+	return context, nil
+}
+
+// EncodedContext returns the encryption context as it is sent in
+// requests, base64 encoded JSON, empty if there is none
+func (o *KMSOptions) EncodedContext() string {
+	if len(o.Context) == 0 {
+		return ""
+	}
+	// the keys of a map are always sorted, the encoding is stable
+	b, _ := json.Marshal(o.Context)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// kmsEncryption writes objects with SSE-KMS. minio-go only knows the key
+// and the context, not the bucket key.
+type kmsEncryption struct {
+	options *KMSOptions
+}
+
+func (e kmsEncryption) Type() encrypt.Type {
+	return encrypt.KMS
+}
+
+func (e kmsEncryption) Marshal(h http.Header) {
+	h.Set(sseHeader, "aws:kms")
+	if e.options.KeyID != "" {
+		h.Set(sseKMSKeyIDHeader, e.options.KeyID)
+	}
+	if context := e.options.EncodedContext(); context != "" {
+		h.Set(sseContextHeader, context)
+	}
+	if e.options.BucketKey {
+		h.Set(sseBucketKeyHeader, "true")
+	}
+}
+
+// WithKMS returns a client which writes and copies the objects of the
+// driver with SSE-KMS, or with the default encryption of the bucket if
+// kms is nil
+func (client *s3Client) WithKMS(kms *KMSOptions) *s3Client {
+	c := *client
+	c.kms = kms
+	return &c
+}
+
+// serverSideEncryption returns the encryption of the objects written by
+// the client, nil for the default encryption of the bucket
+func (client *s3Client) serverSideEncryption() encrypt.ServerSide {
+	if client.kms == nil {
+		return nil
+	}
+	return kmsEncryption{options: client.kms}
+}
@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestParseKMSContext(t *testing.T) {
+	context, err := ParseKMSContext(`{"volume":"pvc-1234","team":"a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"volume": "pvc-1234", "team": "a"}; !reflect.DeepEqual(context, expected) {
+		t.Fatalf("expected %v, got %v", expected, context)
+	}
+	for _, value := range []string{"volume=pvc-1234", `{"replicas":3}`, "{}", `["pvc-1234"]`} {
+		if _, err := ParseKMSContext(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+// recordEncryption records the encryption headers of the object writes
+// and copies
+func recordEncryption(srv *s3test.Server) map[string]http.Header {
+	headers := map[string]http.Header{}
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut {
+			h := http.Header{}
+			for _, key := range []string{sseHeader, sseKMSKeyIDHeader, sseContextHeader, sseBucketKeyHeader} {
+				if v := r.Header.Get(key); v != "" {
+					h.Set(key, v)
+				}
+			}
+			headers[r.URL.Path] = h
+		}
+		return false
+	}
+	return headers
+}
+
+func TestWriteWithKMS(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	srv.PutObject("bucket", "seed/file", []byte("data"))
+	headers := recordEncryption(srv)
+
+	kms := &KMSOptions{KeyID: "alias/volumes", Context: map[string]string{"volume": "vol"}, BucketKey: true}
+	meta := &FSMeta{BucketName: "bucket", Prefix: "vol", KMS: kms}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WithKMS(meta.KMS).CreatePrefix("bucket", "vol/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WithKMS(meta.KMS).CopyPrefix("bucket", "seed", "bucket", "vol/csi-fs"); err != nil {
+		t.Fatal(err)
+	}
+	expected := http.Header{}
+	expected.Set(sseHeader, "aws:kms")
+	expected.Set(sseKMSKeyIDHeader, "alias/volumes")
+	expected.Set(sseContextHeader, base64.StdEncoding.EncodeToString([]byte(`{"volume":"vol"}`)))
+	expected.Set(sseBucketKeyHeader, "true")
+	for _, key := range []string{"/bucket/vol/.metadata.json", "/bucket/vol/csi-fs/", "/bucket/vol/csi-fs/file"} {
+		if !reflect.DeepEqual(headers[key], expected) {
+			t.Errorf("expected %s to be written with %v, got %v", key, expected, headers[key])
+		}
+	}
+
+	// without options the default encryption of the bucket applies
+	if err := client.CreatePrefix("bucket", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if h := headers["/bucket/other/"]; len(h) != 0 {
+		t.Errorf("expected no encryption headers, got %v", h)
+	}
+}
@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+const (
+	// OwnershipBucketOwnerEnforced disables ACLs, the bucket owner owns every object
+	OwnershipBucketOwnerEnforced = "BucketOwnerEnforced"
+	// OwnershipBucketOwnerPreferred makes the bucket owner own objects uploaded with the bucket-owner-full-control ACL
+	OwnershipBucketOwnerPreferred = "BucketOwnerPreferred"
+	// OwnershipObjectWriter makes the uploading account own an object
+	OwnershipObjectWriter = "ObjectWriter"
+)
+
+// ValidObjectOwnership returns true if ownership is a known object ownership
+func ValidObjectOwnership(ownership string) bool {
+	switch ownership {
+	case OwnershipBucketOwnerEnforced, OwnershipBucketOwnerPreferred, OwnershipObjectWriter:
+		return true
+	}
+	return false
+}
+
+type ownershipControls struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ OwnershipControls"`
+	Rule    struct {
+		ObjectOwnership string `xml:"ObjectOwnership"`
+	} `xml:"Rule"`
+}
+
+// SetObjectOwnership sets the object ownership controls of the bucket.
+// minio-go has no API for them, so the request is signed here.
+func (client *s3Client) SetObjectOwnership(bucketName, ownership string) (err error) {
+	ctx, span := client.startSpan("SetObjectOwnership", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "SetObjectOwnership", bucketName, "", &err)
+	var controls ownershipControls
+	controls.Rule.ObjectOwnership = ownership
+	body, err := xml.Marshal(&controls)
+	if err != nil {
+		return err
+	}
+
+	u := *client.minio.EndpointURL()
+	u.Path = "/" + bucketName
+	u.RawQuery = "ownershipControls="
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sha := sha256.Sum256(body)
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sha[:]))
+	region := client.Config.SignatureRegion()
+	if region == "" {
+		region = "us-east-1"
+	}
+	req = signer.SignV4(*req, client.Config.AccessKeyID, client.Config.SecretAccessKey, client.Config.SessionToken, region)
+
+	// the transport of the client honours its TLS and connection options
+	resp, err := (&http.Client{Transport: client.transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errResp := minio.ErrorResponse{StatusCode: resp.StatusCode}
+		if err := xml.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			errResp.Code = resp.Status
+			errResp.Message = "failed to set object ownership"
+		}
+		return wrapError(errResp)
+	}
+	return nil
+}
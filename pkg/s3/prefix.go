@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"path"
+	"strings"
+)
+
+// Prefixes are stored without leading and trailing slashes, in the
+// metadata as well as in volume IDs. The objects below a prefix are
+// listed with a trailing slash, so the prefix "a" never matches the data
+// of a sibling "ab", and the placeholder of a directory is the object
+// "<prefix>/", which is where the mounters look for it.
+
+// CleanPrefix returns prefix without leading, trailing and repeated
+// slashes
+func CleanPrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+// DirPrefix returns the key prefix of the objects in the directory at the
+// joined elements, which ends with a slash. It is empty for the root of
+// the bucket.
+func DirPrefix(elem ...string) string {
+	dir := CleanPrefix(path.Join(elem...))
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// DataPrefix returns the prefix of the data of the volume, which is the
+// directory the mounters serve
+func (meta *FSMeta) DataPrefix() string {
+	return CleanPrefix(path.Join(meta.Prefix, meta.FSPath))
+}
+
+// DataContainsControlObjects returns true if the control objects of the
+// volume, like its metadata, would be stored below its data prefix and
+// be served by the mounters
+func (meta *FSMeta) DataContainsControlObjects() bool {
+	if CleanPrefix(meta.FSPath) != "" {
+		return false
+	}
+	return options.ControlPrefix == "" || CleanPrefix(meta.Prefix) == ""
+}
@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCleanPrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":          "",
+		"/":         "",
+		"volume":    "volume",
+		"volume/":   "volume",
+		"/volume/":  "volume",
+		"a//b/":     "a/b",
+		"a/./b":     "a/b",
+		"../volume": "volume",
+	} {
+		if clean := CleanPrefix(prefix); clean != expected {
+			t.Errorf("%q: expected %q, got %q", prefix, expected, clean)
+		}
+	}
+	if dir := DirPrefix("", ""); dir != "" {
+		t.Errorf("expected no directory prefix for the root, got %q", dir)
+	}
+	if dir := DirPrefix("volume/", "/csi-fs"); dir != "volume/csi-fs/" {
+		t.Errorf("expected a single trailing slash, got %q", dir)
+	}
+}
+
+func TestPrefixPlaceholderMatchesMount(t *testing.T) {
+	for _, prefix := range []string{"volume", "volume/", "/volume"} {
+		client, srv := newFakeClient(t)
+		srv.CreateBucket("bucket")
+		meta := &FSMeta{BucketName: "bucket", Prefix: prefix, FSPath: "csi-fs"}
+		if err := client.CreatePrefix("bucket", meta.DataPrefix()); err != nil {
+			t.Fatal(err)
+		}
+		// the mounters serve the data prefix, s3backer lists the directory
+		if meta.DataPrefix() != "volume/csi-fs" {
+			t.Fatalf("%q: unexpected data prefix %q", prefix, meta.DataPrefix())
+		}
+		if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, []string{DirPrefix(meta.DataPrefix())}) {
+			t.Fatalf("%q: expected the placeholder at the directory of the mount, got %v", prefix, keys)
+		}
+	}
+}
+
+func TestEnsurePrefix(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("bucket")
+	if created, err := client.EnsurePrefix("bucket", "volume/csi-fs"); err != nil || !created {
+		t.Fatalf("expected the missing placeholder to be written, got %v, %v", created, err)
+	}
+	if created, err := client.EnsurePrefix("bucket", "volume/csi-fs"); err != nil || created {
+		t.Fatalf("expected the existing placeholder to be kept, got %v, %v", created, err)
+	}
+	if keys := srv.Keys("bucket"); !reflect.DeepEqual(keys, []string{"volume/csi-fs/"}) {
+		t.Fatalf("expected only the placeholder, got %v", keys)
+	}
+	// the root of the bucket has no placeholder
+	if created, err := client.EnsurePrefix("bucket", ""); err != nil || created {
+		t.Fatalf("expected nothing to be written for the root, got %v, %v", created, err)
+	}
+}
+
+func TestRemovePrefixKeepsSiblings(t *testing.T) {
+	for _, prefix := range []string{"volume", "volume/"} {
+		client, srv := newFakeClient(t)
+		putObjects(srv, "bucket", "volume", 3)
+		putObjects(srv, "bucket", "volume-2", 3)
+		srv.PutObject("bucket", "volume", nil)
+
+		if err := client.RemovePrefix("bucket", prefix); err != nil {
+			t.Fatal(err)
+		}
+		if keys := srv.Keys("bucket"); len(keys) != 3 || keys[0] != "volume-2/object-00000" {
+			t.Fatalf("%q: expected only the objects of the sibling prefix to be left, got %v", prefix, keys)
+		}
+	}
+
+	client, _ := newFakeClient(t)
+	if err := client.RemovePrefix("bucket", "/"); err == nil {
+		t.Fatal("expected the root of the bucket to be refused as a prefix")
+	}
+}
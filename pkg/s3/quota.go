@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+
+	"github.com/ctrox/csi-s3/pkg/audit"
+)
+
+// namespaceUsageDir is the directory below the control prefix of the quota
+// bucket the usage of each namespace is kept in
+const namespaceUsageDir = "namespaces"
+
+// NamespaceUsage is the capacity of the volumes provisioned for the PVCs of
+// a namespace, by volume name
+type NamespaceUsage struct {
+	Volumes map[string]int64 `json:"Volumes"`
+}
+
+// Total returns the capacity of all volumes of the namespace
+func (u *NamespaceUsage) Total() int64 {
+	var total int64
+	for _, capacity := range u.Volumes {
+		total += capacity
+	}
+	return total
+}
+
+// NamespaceUsageKey returns the key of the usage of a namespace in the
+// quota bucket
+func NamespaceUsageKey(namespace string) string {
+	return controlKey("", path.Join(namespaceUsageDir, namespace+".json"))
+}
+
+// GetNamespaceUsage reads the usage of a namespace, which is empty if none
+// of its volumes has been recorded yet
+func (client *s3Client) GetNamespaceUsage(bucketName, namespace string) (_ *NamespaceUsage, err error) {
+	ctx, span := client.startSpan("GetNamespaceUsage", bucketName)
+	defer span.End(&err)
+	usage := &NamespaceUsage{Volumes: map[string]int64{}}
+	b, err := client.getObject(ctx, bucketName, NamespaceUsageKey(namespace))
+	if errors.Is(err, ErrObjectNotFound) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, usage); err != nil {
+		return nil, err
+	}
+	if usage.Volumes == nil {
+		usage.Volumes = map[string]int64{}
+	}
+	return usage, nil
+}
+
+// SetNamespaceUsage writes the usage of a namespace
+func (client *s3Client) SetNamespaceUsage(bucketName, namespace string, usage *NamespaceUsage) (err error) {
+	ctx, span := client.startSpan("SetNamespaceUsage", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "SetNamespaceUsage", bucketName, NamespaceUsageKey(namespace), &err)
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	_, err = client.putInternalObject(ctx, bucketName, NamespaceUsageKey(namespace), b, "application/json")
+	return err
+}
@@ -0,0 +1,229 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/audit"
+	"github.com/golang/glog"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/replication"
+)
+
+// ReplicationTarget is the destination objects of a volume are replicated to
+type ReplicationTarget struct {
+	// Arn identifies the remote target registered for the source bucket
+	// on MinIO, or the IAM role assumed for replication on AWS
+	Arn string
+	// Bucket is the name or the ARN of the destination bucket
+	Bucket string
+}
+
+// Validate returns an error if the target cannot be used in a
+// replication rule
+func (target ReplicationTarget) Validate() error {
+	var cfg replication.Config
+	return cfg.AddRule(replication.Options{
+		Op:         replication.AddOption,
+		RuleStatus: "enable",
+		Priority:   "1",
+		RoleArn:    target.Arn,
+		DestBucket: target.Bucket,
+	})
+}
+
+// destinationArn returns the destination bucket as it is stored in
+// replication rules
+func (target ReplicationTarget) destinationArn() string {
+	if strings.HasPrefix(target.Bucket, "arn:") {
+		return target.Bucket
+	}
+	return "arn:aws:s3:::" + target.Bucket
+}
+
+// replicationRuleID returns a stable rule ID for a volume, so a retried
+// CreateVolume finds the rule it has added before.
+func replicationRuleID(bucketName, prefix string) string {
+	h := sha1.New()
+	h.Write([]byte(path.Join(bucketName, prefix)))
+	return "csi-s3-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+var (
+	// replicationMu serializes the changes of replication configs, which
+	// are read, modified and written as a whole
+	replicationMu sync.Mutex
+	// replicationAttempts bounds the writes of a replication config which
+	// conflict with a concurrent change
+	replicationAttempts = 3
+	// replicationBackoff is the initial wait after a conflicting write
+	replicationBackoff = 200 * time.Millisecond
+)
+
+// isConflict returns true if the provider refused a write because of a
+// concurrent change of the same resource
+func isConflict(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "OperationAborted" || resp.StatusCode == http.StatusConflict
+}
+
+// updateReplication reads the replication config of the bucket and writes
+// it back changed by update, until done reports the change as applied.
+// Another writer, e.g. a second controller, may replace the config between
+// the read and the write, so the config is read again after every write.
+func (client *s3Client) updateReplication(ctx context.Context, bucketName string, done func(*replication.Config) bool, update func(*replication.Config) error) error {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+	backoff := replicationBackoff
+	for attempt := 0; ; attempt++ {
+		cfg, err := client.minio.GetBucketReplication(ctx, bucketName)
+		if err != nil && minio.ToErrorResponse(err).Code != "ReplicationConfigurationNotFoundError" {
+			return wrapError(err)
+		}
+		if done(&cfg) {
+			return nil
+		}
+		if attempt == replicationAttempts {
+			return fmt.Errorf("replication config of bucket %s changed concurrently %d times", bucketName, attempt)
+		}
+		if attempt > 0 {
+			glog.V(4).Infof("Replication config of bucket %s changed concurrently, retrying in %v", bucketName, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err := update(&cfg); err != nil {
+			return err
+		}
+		if err := client.setReplication(ctx, bucketName, cfg); err != nil && !isConflict(err) {
+			return wrapError(err)
+		}
+	}
+}
+
+// setReplication writes the replication config of the bucket, a config
+// without rules removes it
+func (client *s3Client) setReplication(ctx context.Context, bucketName string, cfg replication.Config) error {
+	if len(cfg.Rules) == 0 {
+		return client.minio.RemoveBucketReplication(ctx, bucketName)
+	}
+	return client.minio.SetBucketReplication(ctx, bucketName, cfg)
+}
+
+// hasReplicationRule returns true if the config has a rule with the ID
+func hasReplicationRule(cfg *replication.Config, id string) bool {
+	for _, rule := range cfg.Rules {
+		if rule.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AddReplicationRule replicates all objects below prefix to target and
+// returns the ID of the rule. Rules of other volumes are kept.
+func (client *s3Client) AddReplicationRule(bucketName, prefix string, target ReplicationTarget) (_ string, err error) {
+	ctx, span := client.startSpan("AddReplicationRule", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "AddReplicationRule", bucketName, prefix, &err)
+	id := replicationRuleID(bucketName, prefix)
+	rulePrefix := prefix
+	if rulePrefix != "" {
+		rulePrefix += "/"
+	}
+	err = client.updateReplication(ctx, bucketName, func(cfg *replication.Config) bool {
+		return hasReplicationRule(cfg, id)
+	}, func(cfg *replication.Config) error {
+		priority := 0
+		for _, rule := range cfg.Rules {
+			if rule.Priority > priority {
+				priority = rule.Priority
+			}
+		}
+		err := cfg.AddRule(replication.Options{
+			Op:         replication.AddOption,
+			ID:         id,
+			Prefix:     rulePrefix,
+			RuleStatus: "enable",
+			Priority:   strconv.Itoa(priority + 1),
+			RoleArn:    target.Arn,
+			DestBucket: target.Bucket,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid replication rule for bucket %s: %v", bucketName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RemoveReplicationRule removes the rule with the ID, the replication
+// config of the bucket is removed together with its last rule.
+func (client *s3Client) RemoveReplicationRule(bucketName, id string) (err error) {
+	ctx, span := client.startSpan("RemoveReplicationRule", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "RemoveReplicationRule", bucketName, "", &err)
+	return client.updateReplication(ctx, bucketName, func(cfg *replication.Config) bool {
+		return !hasReplicationRule(cfg, id)
+	}, func(cfg *replication.Config) error {
+		var rules []replication.Rule
+		for _, rule := range cfg.Rules {
+			if rule.ID != id {
+				rules = append(rules, rule)
+			}
+		}
+		cfg.Rules = rules
+		return nil
+	})
+}
+
+// EnableBucketReplication enables versioning of the bucket, which
+// replication requires, and replicates all of its objects to target. It
+// returns the ID of the rule.
+func (client *s3Client) EnableBucketReplication(bucketName string, target ReplicationTarget) (_ string, err error) {
+	ctx, span := client.startSpan("EnableBucketReplication", bucketName)
+	defer span.End(&err)
+	defer audit.Log(ctx, "EnableBucketReplication", bucketName, "", &err)
+	if err := client.minio.EnableVersioning(ctx, bucketName); err != nil {
+		return "", fmt.Errorf("failed to enable versioning of bucket %s, which replication requires: %w", bucketName, wrapError(err))
+	}
+	return client.AddReplicationRule(bucketName, "", target)
+}
+
+// CheckBucketReplication returns ErrReplicationNotConfigured if the
+// bucket is not versioned or has no enabled rule replicating it to
+// target with the role of target.
+func (client *s3Client) CheckBucketReplication(bucketName string, target ReplicationTarget) (err error) {
+	ctx, span := client.startSpan("CheckBucketReplication", bucketName)
+	defer span.End(&err)
+	versioning, err := client.minio.GetBucketVersioning(ctx, bucketName)
+	if err != nil {
+		return wrapError(err)
+	}
+	if versioning.Status != "Enabled" {
+		return fmt.Errorf("%w: versioning of bucket %s is not enabled", ErrReplicationNotConfigured, bucketName)
+	}
+	cfg, err := client.minio.GetBucketReplication(ctx, bucketName)
+	if err != nil {
+		return wrapError(err)
+	}
+	if cfg.Role != target.Arn {
+		return fmt.Errorf("%w: bucket %s is not replicated with role %s", ErrReplicationNotConfigured, bucketName, target.Arn)
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Status == replication.Enabled && rule.Destination.Bucket == target.destinationArn() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: bucket %s has no enabled rule replicating to %s", ErrReplicationNotConfigured, bucketName, target.Bucket)
+}
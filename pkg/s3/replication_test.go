@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestReplicationRulesConcurrently(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("shared")
+	target := ReplicationTarget{Arn: "arn:minio:replication::site-b:shared", Bucket: "shared"}
+
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"pvc-a", "pvc-b", "pvc-c", "pvc-d"} {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			if _, err := client.AddReplicationRule("shared", prefix, target); err != nil {
+				t.Error(err)
+			}
+		}(prefix)
+	}
+	wg.Wait()
+	if rules := strings.Count(string(srv.BucketConfig("shared", "replication")), "<Rule>"); rules != 4 {
+		t.Fatalf("expected a rule for every prefix, got %d", rules)
+	}
+}
+
+func TestReplicationRuleRetriesConflicts(t *testing.T) {
+	defer func(backoff time.Duration) { replicationBackoff = backoff }(replicationBackoff)
+	replicationBackoff = time.Millisecond
+	client, srv := newFakeClient(t)
+	srv.CreateBucket("shared")
+	target := ReplicationTarget{Arn: "arn:minio:replication::site-b:shared", Bucket: "shared"}
+
+	conflicts := 1
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if _, ok := r.URL.Query()["replication"]; ok && r.Method == http.MethodPut && conflicts > 0 {
+			conflicts--
+			s3test.Error(w, http.StatusConflict, "OperationAborted")
+			return true
+		}
+		return false
+	}
+	id, err := client.AddReplicationRule("shared", "pvc-a", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := string(srv.BucketConfig("shared", "replication")); !strings.Contains(config, id) {
+		t.Fatalf("expected the rule to be written after the conflict, got %s", config)
+	}
+
+	// a rule which is lost to another writer every time fails
+	srv.Intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if _, ok := r.URL.Query()["replication"]; ok && r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+			return true
+		}
+		return false
+	}
+	if _, err := client.AddReplicationRule("shared", "pvc-b", target); err == nil {
+		t.Fatal("expected the lost rule to fail")
+	}
+}
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// dnsCache resolves the host of an endpoint for new connections and keeps
+// the addresses for a bounded time, so a changed endpoint is picked up
+// after the TTL at the latest.
+type dnsCache struct {
+	dial       func(ctx context.Context, network, addr string) (net.Conn, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	ttl        time.Duration
+	// changed is called when the addresses of a host changed, e.g. to drop
+	// idle connections to addresses which are gone
+	changed func()
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newDNSCache returns a cache dialing with dialer. A non-empty server is
+// queried instead of the resolver of the system.
+func newDNSCache(dialer *net.Dialer, server string, ttl time.Duration, changed func()) *dnsCache {
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &dnsCache{
+		dial:       dialer.DialContext,
+		lookupHost: resolver.LookupHost,
+		ttl:        ttl,
+		changed:    changed,
+		entries:    map[string]dnsEntry{},
+	}
+}
+
+// lookup returns the cached addresses of host or resolves them once they
+// expired
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	if ok && !equalStrings(e.addrs, addrs) {
+		glog.Infof("Addresses of S3 endpoint %s changed from %v to %v", host, e.addrs, addrs)
+		if c.changed != nil {
+			c.changed()
+		}
+	}
+	return addrs, nil
+}
+
+// forget drops the cached addresses of host, so the next connection
+// resolves it again
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[host]; ok {
+		e.expires = time.Time{}
+		c.entries[host] = e
+	}
+}
+
+// dialContext connects to the host of addr, dialing all of its addresses
+// at once, so an unreachable address does not delay the connection by a
+// dial timeout. The first connection established is used, the others are
+// cancelled or closed.
+func (c *dnsCache) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dial(ctx, network, addr)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	for _, ip := range addrs {
+		go func(ip string) {
+			conn, err := c.dial(ctx, network, net.JoinHostPort(ip, port))
+			results <- dialResult{conn: conn, err: err}
+		}(ip)
+	}
+	var lastErr error = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	for pending := len(addrs); pending > 0; pending-- {
+		r := <-results
+		if r.err == nil {
+			go closeConns(results, pending-1)
+			return r.conn, nil
+		}
+		lastErr = r.err
+	}
+	// the endpoint might have moved, resolve it again on the next attempt
+	c.forget(host)
+	return nil, lastErr
+}
+
+// dialResult is the outcome of dialing one address of a host
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// closeConns closes the connections of the remaining dials which were
+// established before they were cancelled
+func closeConns(results <-chan dialResult, remaining int) {
+	for ; remaining > 0; remaining-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	lookups := 0
+	addrs := []string{"127.0.0.1"}
+	changed := 0
+	c := newDNSCache(&net.Dialer{Timeout: time.Second}, "", time.Hour, func() { changed++ })
+	c.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if host != "s3.example.com" {
+			return nil, errors.New("unknown host")
+		}
+		return addrs, nil
+	}
+	dial := func() error {
+		conn, err := c.dialContext(context.Background(), "tcp", net.JoinHostPort("s3.example.com", port))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("expected the addresses to be cached, got %d lookups", lookups)
+	}
+
+	// an endpoint which moved is resolved again after a failed connection
+	addrs = []string{"127.0.0.2"}
+	c.entries["s3.example.com"] = dnsEntry{addrs: []string{"192.0.2.1"}, expires: time.Now().Add(time.Hour)}
+	c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(addr); host == "192.0.2.1" {
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+	if err := dial(); err == nil {
+		t.Fatal("expected the connection to the stale address to fail")
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("expected the new address to be used, got %v", err)
+	}
+	if lookups != 2 || changed != 1 {
+		t.Fatalf("expected the host to be resolved again and idle connections to be dropped, got %d lookups and %d changes", lookups, changed)
+	}
+
+	// addresses are resolved again once they expired
+	c.ttl = 0
+	c.forget("s3.example.com")
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 4 || changed != 1 {
+		t.Fatalf("expected a lookup for every connection without changes, got %d lookups and %d changes", lookups, changed)
+	}
+}
+
+func TestDNSCacheDialsInParallel(t *testing.T) {
+	c := newDNSCache(&net.Dialer{}, "", time.Hour, nil)
+	c.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"192.0.2.1", "192.0.2.2"}, nil
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(addr); host == "192.0.2.2" {
+			return client, nil
+		}
+		// an unreachable address hangs until the dial is cancelled
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.dialContext(ctx, "tcp", "s3.example.com:443")
+	if err != nil {
+		t.Fatalf("expected the reachable address not to wait for the unreachable one, got %v", err)
+	}
+	if conn != client {
+		t.Fatal("expected the connection of the reachable address")
+	}
+	conn.Close()
+}
@@ -0,0 +1,672 @@
+// Package s3test provides an in-memory S3 server for tests. It implements
+// the subset of the S3 API used by the driver.
+package s3test
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessKeyID     = "test-access-key"
+	secretAccessKey = "test-secret-key"
+	maxKeys         = 1000
+	streamingHeader = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+// Object is an object stored in the fake server
+type Object struct {
+	Data         []byte
+	ContentType  string
+	LastModified time.Time
+	// Tags are the tags set with the X-Amz-Tagging header
+	Tags map[string]string
+	// Metadata is the user metadata set with the X-Amz-Meta- headers
+	Metadata http.Header
+}
+
+// Server is a fake S3 server
+type Server struct {
+	*httptest.Server
+
+	// Intercept is called before every request is handled. If it returns
+	// true, the request is considered handled, which allows tests to
+	// inject errors.
+	Intercept func(w http.ResponseWriter, r *http.Request) bool
+	// Latency is added to every request
+	Latency time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*Object
+	// configs holds bucket subresources like the replication config
+	configs map[string]map[string][]byte
+	// Requests counts the handled requests by method
+	requests map[string]int
+}
+
+// NewServer starts a new fake S3 server, it has to be closed by the caller
+func NewServer() *Server {
+	s := &Server{
+		buckets:  make(map[string]map[string]*Object),
+		configs:  make(map[string]map[string][]byte),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Secret returns a secret as used by the driver to connect to the server
+func (s *Server) Secret() map[string]string {
+	return map[string]string{
+		"accessKeyID":     accessKeyID,
+		"secretAccessKey": secretAccessKey,
+		"endpoint":        s.URL,
+		"region":          "",
+	}
+}
+
+// CreateBucket creates a bucket without going through the API
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// BucketExists returns true if the bucket exists
+func (s *Server) BucketExists(bucket string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.buckets[bucket]
+	return ok
+}
+
+// PutObject stores an object without going through the API
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+	s.buckets[bucket][key] = &Object{Data: data, LastModified: time.Now().UTC()}
+}
+
+// GetObject returns the object or nil if it does not exist
+func (s *Server) GetObject(bucket, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[bucket][key]
+}
+
+// DeleteObject removes an object without going through the API
+func (s *Server) DeleteObject(bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], key)
+}
+
+// Keys returns the sorted keys of all objects in the bucket
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BucketConfig returns the raw document of a bucket subresource like
+// "replication", nil if it is not set.
+func (s *Server) BucketConfig(bucket, subresource string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.configs[bucket][subresource]
+}
+
+// Requests returns the number of handled requests with the method
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+// Error writes an S3 error response
+func Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.Latency > 0 {
+		time.Sleep(s.Latency)
+	}
+	if s.Intercept != nil && s.Intercept(w, r) {
+		return
+	}
+	s.mu.Lock()
+	s.requests[r.Method]++
+	s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+
+	if bucket == "" && r.Method == http.MethodGet {
+		s.listBuckets(w)
+		return
+	}
+	if key == "" {
+		for subresource, notFound := range subresources {
+			if has(query, subresource) {
+				s.bucketConfig(w, r, bucket, subresource, notFound)
+				return
+			}
+		}
+		switch {
+		case r.Method == http.MethodGet && has(query, "location"):
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Value   string   `xml:",chardata"`
+			}{Value: "us-east-1"})
+		case r.Method == http.MethodGet && has(query, "versions"):
+			s.listVersions(w, bucket, query)
+		case r.Method == http.MethodGet:
+			s.listObjects(w, bucket, query)
+		case r.Method == http.MethodHead:
+			if !s.BucketExists(bucket) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		case r.Method == http.MethodPut:
+			s.putBucket(w, bucket)
+		case r.Method == http.MethodDelete:
+			s.deleteBucket(w, bucket)
+		case r.Method == http.MethodPost && has(query, "delete"):
+			s.deleteObjects(w, r, bucket)
+		default:
+			Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			s.copyObject(w, source, bucket, key)
+			return
+		}
+		s.putObject(w, r, bucket, key)
+	case http.MethodGet, http.MethodHead:
+		s.getObject(w, r, bucket, key)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.buckets[bucket], key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// subresources are the bucket configs stored by the server with the error
+// code returned if they are not set
+var subresources = map[string]string{
+	"replication":       "ReplicationConfigurationNotFoundError",
+	"ownershipControls": "OwnershipControlsNotFoundError",
+	// buckets without a versioning config are unversioned
+	"versioning": "",
+}
+
+func (s *Server) bucketConfig(w http.ResponseWriter, r *http.Request, bucket, subresource, notFound string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		config, ok := s.configs[bucket][subresource]
+		if !ok && notFound == "" {
+			writeXML(w, struct {
+				XMLName xml.Name
+			}{XMLName: xml.Name{Local: strings.ToUpper(subresource[:1]) + subresource[1:] + "Configuration"}})
+			return
+		}
+		if !ok {
+			Error(w, http.StatusNotFound, notFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(config)
+	case http.MethodPut:
+		config, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if s.configs[bucket] == nil {
+			s.configs[bucket] = make(map[string][]byte)
+		}
+		s.configs[bucket][subresource] = config
+	case http.MethodDelete:
+		delete(s.configs[bucket], subresource)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func has(query map[string][]string, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+func (s *Server) putBucket(w http.ResponseWriter, bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; ok {
+		Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+		return
+	}
+	s.buckets[bucket] = make(map[string]*Object)
+}
+
+func (s *Server) deleteBucket(w http.ResponseWriter, bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(objects) > 0 {
+		Error(w, http.StatusConflict, "BucketNotEmpty")
+		return
+	}
+	delete(s.buckets, bucket)
+	delete(s.configs, bucket)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	IsTruncated           bool
+	NextContinuationToken string         `xml:",omitempty"`
+	Contents              []listEntry    `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type bucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketsResult struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) {
+	s.mu.Lock()
+	var names []string
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	result := listBucketsResult{}
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, bucketEntry{Name: name, CreationDate: time.Now().UTC().Format(time.RFC3339)})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, query map[string][]string) {
+	get := func(k string) string {
+		if v := query[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, delimiter, token := get("prefix"), get("delimiter"), get("continuation-token")
+	limit := maxKeys
+	if v, err := strconv.Atoi(get("max-keys")); err == nil && v > 0 && v < maxKeys {
+		limit = v
+	}
+
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		s.mu.Unlock()
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > token {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{Name: bucket, Prefix: prefix, MaxKeys: limit, Delimiter: delimiter}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if result.KeyCount == limit {
+			result.IsTruncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+					result.KeyCount++
+				}
+				result.NextContinuationToken = k
+				continue
+			}
+		}
+		o := objects[k]
+		result.Contents = append(result.Contents, listEntry{
+			Key:          k,
+			LastModified: o.LastModified.Format(time.RFC3339),
+			ETag:         etag(o.Data),
+			Size:         len(o.Data),
+			StorageClass: "STANDARD",
+		})
+		result.NextContinuationToken = k
+		result.KeyCount++
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	s.mu.Unlock()
+	writeXML(w, result)
+}
+
+type versionEntry struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type versionsResult struct {
+	XMLName     xml.Name `xml:"ListVersionsResult"`
+	Name        string
+	Prefix      string
+	MaxKeys     int
+	IsTruncated bool
+	Versions    []versionEntry `xml:"Version"`
+}
+
+// listVersions lists the objects below the prefix as their only version,
+// the server does not keep previous versions.
+func (s *Server) listVersions(w http.ResponseWriter, bucket string, query map[string][]string) {
+	prefix := ""
+	if v := query["prefix"]; len(v) > 0 {
+		prefix = v[0]
+	}
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		s.mu.Unlock()
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	result := versionsResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+	for _, k := range keys {
+		o := objects[k]
+		result.Versions = append(result.Versions, versionEntry{
+			Key:          k,
+			VersionId:    "null",
+			IsLatest:     true,
+			LastModified: o.LastModified.Format(time.RFC3339),
+			ETag:         etag(o.Data),
+			Size:         len(o.Data),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	} `xml:"Deleted"`
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req deleteRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var result deleteResult
+	s.mu.Lock()
+	for _, o := range req.Objects {
+		delete(s.buckets[bucket], o.Key)
+		result.Deleted = append(result.Deleted, struct{ Key string }{Key: o.Key})
+	}
+	s.mu.Unlock()
+	writeXML(w, result)
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var body io.Reader = r.Body
+	if r.Header.Get("X-Amz-Content-Sha256") == streamingHeader {
+		body = newChunkedReader(r.Body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if digest := r.Header.Get("Content-Md5"); digest != "" {
+		sum := md5.Sum(data)
+		if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	metadata := http.Header{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			metadata[k] = v
+		}
+	}
+	tags := make(map[string]string)
+	if tagging, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging")); err == nil {
+		for k := range tagging {
+			tags[k] = tagging.Get(k)
+		}
+	}
+	objects[key] = &Object{Data: data, ContentType: r.Header.Get("Content-Type"), LastModified: time.Now().UTC(), Tags: tags, Metadata: metadata}
+	w.Header().Set("ETag", etag(data))
+}
+
+// copyObject copies the object named by the X-Amz-Copy-Source header of a
+// server-side copy with its metadata
+func (s *Server) copyObject(w http.ResponseWriter, source, bucket, key string) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		Error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	src, srcOK := s.buckets[parts[0]]
+	if !ok || !srcOK {
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	var o *Object
+	if len(parts) == 2 {
+		o = src[parts[1]]
+	}
+	if o == nil {
+		Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	copied := *o
+	copied.LastModified = time.Now().UTC()
+	objects[key] = &copied
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: etag(o.Data), LastModified: copied.LastModified.Format(time.RFC3339)})
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	var o *Object
+	if ok {
+		o = objects[key]
+	}
+	s.mu.Unlock()
+	if !ok {
+		Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if o == nil {
+		Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag(o.Data))
+	w.Header().Set("Last-Modified", o.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.Data)))
+	if o.ContentType != "" {
+		w.Header().Set("Content-Type", o.ContentType)
+	}
+	for k, v := range o.Metadata {
+		w.Header()[k] = v
+	}
+	if r.Method == http.MethodGet {
+		w.Write(o.Data)
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// chunkedReader decodes the aws-chunked encoding used for streaming
+// signatures, chunk signatures are not verified.
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int
+	done bool
+}
+
+func newChunkedReader(r io.Reader) *chunkedReader {
+	return &chunkedReader{r: bufio.NewReader(r)}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = int(size)
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= n
+	return n, err
+}
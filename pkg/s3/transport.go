@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// sharedTransport pools the connections to an endpoint for all clients of
+// the driver, instead of every client opening its own connections.
+type sharedTransport struct {
+	*http.Transport
+	// basePath of the endpoint, which minio-go does not support
+	basePath string
+	// open is the number of connections currently open to the endpoint
+	open int64
+}
+
+var (
+	transportsMu sync.Mutex
+	// transports maps endpoints to their transport
+	transports = map[string]*sharedTransport{}
+)
+
+// transportFor returns the transport shared by the clients of the endpoint
+// at scheme, host and basePath, tuned by the options.
+func transportFor(scheme, host, basePath string) (*sharedTransport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	key := scheme + "://" + host + basePath
+	if t, ok := transports[key]; ok {
+		return t, nil
+	}
+	tr, err := minio.DefaultTransport(scheme == "https")
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxIdleConns > 0 {
+		// every connection of the transport goes to the same host
+		tr.MaxIdleConns = options.MaxIdleConns
+		tr.MaxIdleConnsPerHost = options.MaxIdleConns
+	}
+	if options.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = options.IdleConnTimeout
+	}
+	tr.MaxConnsPerHost = options.MaxConnsPerHost
+	tr.DisableKeepAlives = options.DisableKeepAlives
+
+	t := &sharedTransport{Transport: tr, basePath: basePath}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if options.DNSCacheTTL > 0 || options.DNSServer != "" {
+		dial = newDNSCache(dialer, options.DNSServer, options.DNSCacheTTL, tr.CloseIdleConnections).dialContext
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&t.open, 1)
+		return &countedConn{Conn: conn, open: &t.open}, nil
+	}
+	transports[key] = t
+	return t, nil
+}
+
+// RoundTrip sends the request below the base path of the endpoint.
+// minio-go signs requests without it, so this matches a reverse proxy
+// which strips the base path before passing requests on to S3.
+func (t *sharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.basePath == "" {
+		return t.Transport.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.URL.Path = t.basePath + req.URL.Path
+	if req.URL.RawPath != "" {
+		r.URL.RawPath = t.basePath + req.URL.RawPath
+	}
+	return t.Transport.RoundTrip(r)
+}
+
+// resetTransports drops the shared transports, so clients created
+// afterwards use transports tuned by the current options.
+func resetTransports() {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	for key, t := range transports {
+		t.CloseIdleConnections()
+		delete(transports, key)
+	}
+}
+
+// OpenConnections returns the number of connections currently open to
+// each endpoint the driver talked to, keyed by the endpoint.
+func OpenConnections() map[string]int64 {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	open := make(map[string]int64, len(transports))
+	for key, t := range transports {
+		open[key] = atomic.LoadInt64(&t.open)
+	}
+	return open
+}
+
+// countedConn decrements the open connections of its transport once it
+// is closed
+type countedConn struct {
+	net.Conn
+	open   *int64
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { atomic.AddInt64(c.open, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,62 @@
+package s3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/s3/s3test"
+)
+
+func TestClientsShareTransport(t *testing.T) {
+	defer SetOptions(options)
+	SetOptions(Options{MaxIdleConns: 4, MaxConnsPerHost: 8, IdleConnTimeout: time.Second, DisableKeepAlives: true})
+
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bucket")
+	first, err := NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := first.Config.Endpoint
+	if len(transports) != 1 {
+		t.Fatalf("expected one transport for %s, got %d", u, len(transports))
+	}
+	tr := transports[u]
+	if tr.MaxIdleConnsPerHost != 4 || tr.MaxConnsPerHost != 8 || tr.IdleConnTimeout != time.Second || !tr.DisableKeepAlives {
+		t.Fatalf("expected transport to be tuned by the options, got %+v", tr.Transport)
+	}
+
+	for _, client := range []*s3Client{first, second} {
+		if _, err := client.BucketExists("bucket"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without keep-alive every connection is closed after its request
+	deadline := time.Now().Add(time.Second)
+	for OpenConnections()[u] != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open := OpenConnections()[u]; open != 0 {
+		t.Fatalf("expected no open connections, got %d", open)
+	}
+
+	// clients created with new options use a new transport
+	SetOptions(Options{})
+	client, err := NewClientFromSecret(srv.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.BucketExists("bucket"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if open := OpenConnections()[u]; open != 1 {
+		t.Fatalf("expected the connection to be kept alive and reused, got %d open connections", open)
+	}
+}
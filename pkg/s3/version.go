@@ -0,0 +1,74 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parseVersion returns the major, minor and patch number of a version
+// like v1.2.3, false if it cannot be parsed
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	version = strings.TrimPrefix(version, "v")
+	// pre-releases and builds are compared like their release
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// compareVersions returns -1, 0 or 1 if a is older, the same or newer
+// than b, and false if either cannot be parsed
+func compareVersions(a, b string) (int, bool) {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, true
+		case va[i] > vb[i]:
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// WrittenByNewerVersion returns true if the metadata has last been written
+// by a newer version of the driver than this one
+func (meta *FSMeta) WrittenByNewerVersion() bool {
+	cmp, ok := compareVersions(meta.LastWrittenByVersion, options.DriverVersion)
+	return ok && cmp > 0
+}
+
+// CheckMetaVersion returns ErrMetadataTooNew if the metadata has last been
+// written by a newer major version of the driver, whose fields this version
+// might not know and would drop when writing it, unless metadata downgrades
+// are allowed
+func CheckMetaVersion(meta *FSMeta) error {
+	if options.AllowMetadataDowngrade {
+		return nil
+	}
+	written, okWritten := parseVersion(meta.LastWrittenByVersion)
+	own, okOwn := parseVersion(options.DriverVersion)
+	if !okWritten || !okOwn || written[0] <= own[0] {
+		return nil
+	}
+	return fmt.Errorf("metadata of %s has been written by csi-s3 %s, refusing to change it with %s, upgrade the driver or allow metadata downgrades: %w",
+		path.Join(meta.BucketName, meta.Prefix), meta.LastWrittenByVersion, options.DriverVersion, ErrMetadataTooNew)
+}
@@ -0,0 +1,80 @@
+package s3
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// metadata as written by the driver at different versions
+const (
+	legacyMeta = `{"Name":"bucket","Prefix":"vol","Mounter":"s3fs","FSPath":"csi-fs","CapacityBytes":1073741824,"CreatedByCsi":false,"PVName":"pv-1","ReplicationRuleID":"","ObjectOwnership":"","CacheMode":"","ClientEncrypted":false}`
+	patchMeta  = `{"Name":"bucket","Prefix":"vol","Mounter":"rclone","FSPath":"csi-fs","CapacityBytes":0,"CreatedByCsi":true,"PVName":"pv-1","CreatedByVersion":"v1.1.0","LastWrittenByVersion":"v1.1.2"}`
+	minorMeta  = `{"Name":"bucket","Prefix":"vol","Mounter":"rclone","FSPath":"csi-fs","CapacityBytes":0,"CreatedByCsi":true,"PVName":"pv-1","CreatedByVersion":"v1.1.0","LastWrittenByVersion":"v1.4.0-rc.1","NewField":true}`
+	majorMeta  = `{"Name":"bucket","Prefix":"vol","Mounter":"rclone","FSPath":"csi-fs","CapacityBytes":0,"CreatedByCsi":true,"PVName":"pv-1","CreatedByVersion":"v2.0.0","LastWrittenByVersion":"v2.1.0","Layout":2}`
+	devMeta    = `{"Name":"bucket","Prefix":"vol","Mounter":"rclone","FSPath":"csi-fs","CapacityBytes":0,"CreatedByCsi":true,"PVName":"pv-1","LastWrittenByVersion":"dev"}`
+)
+
+func TestMetadataVersions(t *testing.T) {
+	defer SetOptions(options)
+	opts := options
+	opts.DriverVersion = "v1.1.1"
+	SetOptions(opts)
+
+	for _, tc := range []struct {
+		name     string
+		fixture  string
+		newer    bool
+		writable bool
+	}{
+		{"legacy", legacyMeta, false, true},
+		{"patch", patchMeta, true, true},
+		{"minor", minorMeta, true, true},
+		{"major", majorMeta, true, false},
+		{"unparsable", devMeta, false, true},
+	} {
+		client, srv := newFakeClient(t)
+		srv.PutObject("bucket", controlKey("vol", metadataName), []byte(tc.fixture))
+		meta, err := client.GetFSMeta("bucket", "vol")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if meta.WrittenByNewerVersion() != tc.newer {
+			t.Errorf("%s: expected written by a newer version to be %v", tc.name, tc.newer)
+		}
+		err = client.SetFSMeta(meta)
+		if tc.writable != (err == nil) {
+			t.Fatalf("%s: expected writable=%v, got %v", tc.name, tc.writable, err)
+		}
+		if !tc.writable {
+			if !errors.Is(err, ErrMetadataTooNew) || !strings.Contains(err.Error(), "v2.1.0") {
+				t.Errorf("%s: expected the newer version to be named, got %v", tc.name, err)
+			}
+			if b := srv.GetObject("bucket", controlKey("vol", metadataName)).Data; string(b) != tc.fixture {
+				t.Errorf("%s: expected the metadata to be kept, got %s", tc.name, b)
+			}
+			continue
+		}
+		written, err := client.GetFSMeta("bucket", "vol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the creator is kept, legacy metadata does not know it
+		if written.LastWrittenByVersion != "v1.1.1" || written.CreatedByVersion != meta.CreatedByVersion {
+			t.Errorf("%s: unexpected versions %q and %q", tc.name, written.CreatedByVersion, written.LastWrittenByVersion)
+		}
+	}
+
+	// a downgrade drops what the older driver does not know about
+	opts.AllowMetadataDowngrade = true
+	SetOptions(opts)
+	client, srv := newFakeClient(t)
+	srv.PutObject("bucket", controlKey("vol", metadataName), []byte(majorMeta))
+	meta, err := client.GetFSMeta("bucket", "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFSMeta(meta); err != nil {
+		t.Fatalf("expected the downgrade to be allowed, got %v", err)
+	}
+}
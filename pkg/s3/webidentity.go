@@ -0,0 +1,93 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultSTSEndpoint is used to exchange web identity tokens if no other
+// STS endpoint is configured
+const DefaultSTSEndpoint = "https://sts.amazonaws.com"
+
+// WebIdentity holds the token of a workload and the role it assumes
+type WebIdentity struct {
+	// RoleArn is the role assumed with the token, it may be empty for
+	// providers like MinIO which map the token to a policy
+	RoleArn string
+	// TokenFile is the file the token is written to for the mounters
+	TokenFile string
+	// STSEndpoint exchanges the token for temporary credentials
+	STSEndpoint string
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleWithWebIdentityResponse"`
+	Result  struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+// NewClientFromWebIdentity exchanges the web identity token for temporary
+// credentials. The mounters are configured to use the token file, so they
+// refresh their credentials on their own when the file is updated.
+func NewClientFromWebIdentity(secret map[string]string, identity *WebIdentity) (*s3Client, error) {
+	cfg, err := configFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	token, err := ioutil.ReadFile(identity.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	stsEndpoint := identity.STSEndpoint
+	if stsEndpoint == "" {
+		stsEndpoint = DefaultSTSEndpoint
+	}
+	v := url.Values{}
+	v.Set("Action", "AssumeRoleWithWebIdentity")
+	v.Set("Version", "2011-06-15")
+	v.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	v.Set("RoleSessionName", fmt.Sprintf("csi-s3-%d", time.Now().UnixNano()))
+	if identity.RoleArn != "" {
+		v.Set("RoleArn", identity.RoleArn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume role with web identity: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to assume role with web identity: %s: %s", resp.Status, body)
+	}
+	var result assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response to AssumeRoleWithWebIdentity: %v", err)
+	}
+
+	creds := result.Result.Credentials
+	cfg.AccessKeyID = creds.AccessKeyID
+	cfg.SecretAccessKey = creds.SecretAccessKey
+	cfg.SessionToken = creds.SessionToken
+	cfg.WebIdentity = identity
+	return NewClient(cfg)
+}
@@ -0,0 +1,47 @@
+package s3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewClientFromWebIdentity(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "token" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/app" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>temporary-key</AccessKeyId><SecretAccessKey>temporary-secret</SecretAccessKey>
+<SessionToken>session</SessionToken><Expiration>2026-10-14T12:00:00Z</Expiration>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	identity := &WebIdentity{RoleArn: "arn:aws:iam::123456789012:role/app", TokenFile: tokenFile, STSEndpoint: sts.URL}
+	client, err := NewClientFromWebIdentity(map[string]string{"region": "eu-west-1"}, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := client.Config
+	if cfg.AccessKeyID != "temporary-key" || cfg.SecretAccessKey != "temporary-secret" || cfg.SessionToken != "session" {
+		t.Fatalf("expected temporary credentials, got %+v", cfg)
+	}
+	if cfg.Endpoint != "https://s3.eu-west-1.amazonaws.com" || cfg.WebIdentity != identity {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	identity.RoleArn = "arn:aws:iam::123456789012:role/other"
+	if _, err := NewClientFromWebIdentity(nil, identity); err == nil {
+		t.Fatal("expected an error for a rejected token")
+	}
+}
@@ -0,0 +1,103 @@
+// Package tracing traces the driver with OpenTelemetry. Spans are started
+// with the global tracer provider, which records nothing until the driver
+// registers the provider of NewProvider.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kind is the kind of a span
+type Kind = trace.SpanKind
+
+const (
+	// KindInternal spans are operations within the driver
+	KindInternal = trace.SpanKindInternal
+	// KindServer spans handle a request, like a CSI RPC
+	KindServer = trace.SpanKindServer
+	// KindClient spans send a request, like an S3 call
+	KindClient = trace.SpanKindClient
+)
+
+const (
+	scopeName = "github.com/ctrox/csi-s3"
+	// maxQueuedSpans bounds the memory of an unreachable collector, spans
+	// beyond it are dropped
+	maxQueuedSpans = 2048
+)
+
+// Span is an operation of a trace
+type Span struct {
+	span trace.Span
+}
+
+// NewProvider returns a tracer provider exporting spans in batches to the
+// OTLP/HTTP endpoint of a collector, e.g. http://otel-collector:4318, and
+// registers it as the global provider. Its owner has to shut it down to
+// export the spans which are still queued.
+func NewProvider(endpoint, serviceName string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, must be an http or https URL", endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithMaxQueueSize(maxQueuedSpans)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// Start starts a span as child of the span in ctx, if any. It returns a
+// context holding the new span.
+func Start(ctx context.Context, kind Kind, name string) (context.Context, *Span) {
+	ctx, span := otel.Tracer(scopeName).Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &Span{span: span}
+}
+
+// WithSpan returns ctx holding the span of from, so spans started with it
+// are children of that span
+func WithSpan(ctx, from context.Context) context.Context {
+	if span := trace.SpanFromContext(from); span.SpanContext().IsValid() {
+		return trace.ContextWithSpan(ctx, span)
+	}
+	return ctx
+}
+
+// SetAttribute records a string attribute of the span
+func (s *Span) SetAttribute(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// End finishes the span. The span fails if err points to an error, it is
+// taken as a pointer so End can be deferred with a named error result.
+func (s *Span) End(err *error) {
+	if err != nil && *err != nil {
+		s.span.RecordError(*err)
+		s.span.SetStatus(codes.Error, (*err).Error())
+	}
+	s.span.End()
+}
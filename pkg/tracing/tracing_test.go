@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSpansLinkChildren(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, rpc := Start(context.Background(), KindServer, "csi.v1.Controller/CreateVolume")
+	// the S3 client keeps its own context which only takes the span
+	_, call := Start(WithSpan(context.Background(), ctx), KindClient, "s3.CreateBucket")
+	call.SetAttribute("s3.bucket", "bucket")
+	err := errors.New("access denied")
+	call.End(&err)
+	rpc.End(nil)
+
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	child, parent := ended[0], ended[1]
+	if child.Parent().SpanID() != parent.SpanContext().SpanID() || child.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+		t.Fatal("expected the S3 call to be a child of the RPC")
+	}
+	if child.SpanKind() != trace.SpanKindClient || parent.SpanKind() != trace.SpanKindServer {
+		t.Errorf("unexpected span kinds %v and %v", child.SpanKind(), parent.SpanKind())
+	}
+	if child.Status().Code != codes.Error || child.Status().Description != "access denied" || parent.Status().Code == codes.Error {
+		t.Fatalf("expected only the S3 call to fail, got %+v and %+v", child.Status(), parent.Status())
+	}
+	if attrs := child.Attributes(); len(attrs) != 1 || attrs[0].Value.AsString() != "bucket" {
+		t.Fatalf("unexpected attributes %+v", attrs)
+	}
+}
+
+func TestProviderExportsOnShutdown(t *testing.T) {
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&exports, 1)
+	}))
+	defer collector.Close()
+
+	if _, err := NewProvider("collector:4318", "test"); err == nil {
+		t.Fatal("expected an endpoint without scheme to be refused")
+	}
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	provider, err := NewProvider(collector.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), KindInternal, "span")
+	span.End(nil)
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&exports) == 0 {
+		t.Fatal("expected the queued span to be exported on shutdown")
+	}
+}
@@ -0,0 +1,80 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateDeleteVolume(t *testing.T) {
+	requireMinio(t)
+	for _, params := range []map[string]string{
+		{"mounter": "s3fs"},
+		{"mounter": "rclone", "bucket": "e2e-shared"},
+	} {
+		volume := createVolume(t, "pvc-e2e-create", params, 1<<20)
+		// CreateVolume is idempotent
+		again := createVolume(t, "pvc-e2e-create", params, 1<<20)
+		if again.GetVolumeId() != volume.GetVolumeId() {
+			t.Errorf("expected the same volume ID, got %s and %s", volume.GetVolumeId(), again.GetVolumeId())
+		}
+		deleteVolume(t, volume.GetVolumeId())
+		// so is DeleteVolume
+		deleteVolume(t, volume.GetVolumeId())
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	requireMinio(t)
+	bad := map[string]string{}
+	for k, v := range secrets {
+		bad[k] = v
+	}
+	bad["secretAccessKey"] = "wrong"
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-e2e-bad-credentials",
+		VolumeCapabilities: []*csi.VolumeCapability{volumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{"mounter": "s3fs"},
+		Secrets:            bad,
+	})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	requireMinio(t)
+	_, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pvc-e2e-missing",
+		VolumeCapabilities: []*csi.VolumeCapability{volumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Secrets:            secrets,
+	})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	// deleting a volume which is gone succeeds
+	deleteVolume(t, "pvc-e2e-missing")
+}
+
+func TestOversizedRecreate(t *testing.T) {
+	requireMinio(t)
+	volume := createVolume(t, "pvc-e2e-oversized", map[string]string{"mounter": "s3fs"}, 1<<20)
+	defer deleteVolume(t, volume.GetVolumeId())
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-e2e-oversized",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{volumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{"mounter": "s3fs"},
+		Secrets:            secrets,
+	})
+	if code := status.Code(err); code != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e runs the driver in process against a MinIO server and
+// exercises the CSI RPCs end to end. Tests which mount volumes need FUSE
+// and are additionally gated behind the fuse build tag:
+//
+//	go test -tags e2e ./test/e2e/
+//	go test -tags e2e,fuse ./test/e2e/
+//
+// MinIO is taken from CSI_S3_E2E_ENDPOINT, with the credentials in
+// CSI_S3_E2E_ACCESS_KEY and CSI_S3_E2E_SECRET_KEY. Otherwise a minio
+// binary in the PATH is started, and the tests are skipped without one.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/driver"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultAccessKey = "e2e-access-key"
+	defaultSecretKey = "e2e-secret-key"
+)
+
+var (
+	// skipReason is set if no MinIO server is available
+	skipReason string
+	secrets    map[string]string
+
+	controller csi.ControllerClient
+	node       csi.NodeClient
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "csi-s3-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := os.Getenv("CSI_S3_E2E_ENDPOINT")
+	accessKey, secretKey := os.Getenv("CSI_S3_E2E_ACCESS_KEY"), os.Getenv("CSI_S3_E2E_SECRET_KEY")
+	if endpoint == "" {
+		var stop func()
+		endpoint, stop, err = startMinio(filepath.Join(dir, "minio"))
+		if err != nil {
+			skipReason = err.Error()
+			return m.Run()
+		}
+		defer stop()
+		accessKey, secretKey = defaultAccessKey, defaultSecretKey
+	}
+	secrets = map[string]string{
+		"accessKeyID":     accessKey,
+		"secretAccessKey": secretKey,
+		"endpoint":        endpoint,
+		"region":          "",
+	}
+
+	socket := filepath.Join(dir, "csi.sock")
+	// the defaults of the flags of the driver
+	drv, err := driver.New("e2e-node", "unix://"+socket, driver.Options{
+		S3: s3.Options{RemoveWorkers: 4, ControlPrefix: s3.DefaultControlPrefix},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	go drv.Run()
+
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(10*time.Second),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to driver: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	controller = csi.NewControllerClient(conn)
+	node = csi.NewNodeClient(conn)
+	return m.Run()
+}
+
+// startMinio runs a minio server on a free port storing its data in dir
+func startMinio(dir string) (string, func(), error) {
+	bin, err := exec.LookPath("minio")
+	if err != nil {
+		return "", nil, fmt.Errorf("no MinIO available, set CSI_S3_E2E_ENDPOINT or install minio: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(bin, "server", "--address", addr, dir)
+	cmd.Env = append(os.Environ(),
+		"MINIO_ACCESS_KEY="+defaultAccessKey, "MINIO_SECRET_KEY="+defaultSecretKey,
+		"MINIO_ROOT_USER="+defaultAccessKey, "MINIO_ROOT_PASSWORD="+defaultSecretKey,
+	)
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	endpoint := "http://" + addr
+	for start := time.Now(); time.Since(start) < 30*time.Second; time.Sleep(200 * time.Millisecond) {
+		resp, err := http.Get(endpoint + "/minio/health/live")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return endpoint, stop, nil
+			}
+		}
+	}
+	stop()
+	return "", nil, fmt.Errorf("minio did not become ready at %s", endpoint)
+}
+
+func requireMinio(t *testing.T) {
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+}
+
+func volumeCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func createVolume(t *testing.T, name string, parameters map[string]string, capacity int64) *csi.Volume {
+	t.Helper()
+	resp, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: capacity},
+		VolumeCapabilities: []*csi.VolumeCapability{volumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         parameters,
+		Secrets:            secrets,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume %s: %v", name, err)
+	}
+	return resp.GetVolume()
+}
+
+func deleteVolume(t *testing.T, volumeID string) {
+	t.Helper()
+	if _, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: secrets}); err != nil {
+		t.Errorf("DeleteVolume %s: %v", volumeID, err)
+	}
+}
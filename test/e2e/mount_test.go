@@ -0,0 +1,142 @@
+//go:build e2e && fuse
+// +build e2e,fuse
+
+package e2e
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// mounters maps every mounter to the binary it needs, goofys runs in process
+var mounters = map[string]string{
+	"s3fs":     "s3fs",
+	"goofys":   "",
+	"rclone":   "rclone",
+	"s3backer": "s3backer",
+}
+
+func TestMountLifecycle(t *testing.T) {
+	requireMinio(t)
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	for mounter, bin := range mounters {
+		for _, bucket := range []string{"", "e2e-shared"} {
+			name := mounter
+			if bucket != "" {
+				name += "-prefix"
+			}
+			t.Run(name, func(t *testing.T) {
+				if bin != "" {
+					if _, err := exec.LookPath(bin); err != nil {
+						t.Skipf("%s is not installed", bin)
+					}
+				}
+				params := map[string]string{"mounter": mounter}
+				if bucket != "" {
+					params["bucket"] = bucket
+				}
+				mountLifecycle(t, "pvc-e2e-"+name, params)
+			})
+		}
+	}
+}
+
+func TestGoofysNewVolume(t *testing.T) {
+	requireMinio(t)
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	for name, fsPath := range map[string]string{"default": "", "root": "/"} {
+		t.Run(name, func(t *testing.T) {
+			params := map[string]string{"mounter": "goofys", "bucket": "e2e-shared"}
+			if fsPath != "" {
+				params["fsPath"] = fsPath
+			}
+			volume := createVolume(t, "pvc-e2e-goofys-"+name, params, 1<<30)
+			defer deleteVolume(t, volume.GetVolumeId())
+			targetPath, unpublish := publishVolume(t, volume)
+			defer unpublish()
+			// nothing has been written to the volume yet
+			entries, err := ioutil.ReadDir(targetPath)
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected a new volume to be empty, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func mountLifecycle(t *testing.T, name string, params map[string]string) {
+	volume := createVolume(t, name, params, 1<<30)
+	defer deleteVolume(t, volume.GetVolumeId())
+	targetPath, unpublish := publishVolume(t, volume)
+	defer unpublish()
+
+	file := filepath.Join(targetPath, "e2e")
+	if err := ioutil.WriteFile(file, []byte("written by e2e"), 0644); err != nil {
+		t.Errorf("write: %v", err)
+	} else if b, err := ioutil.ReadFile(file); err != nil || string(b) != "written by e2e" {
+		t.Errorf("read %q: %v", b, err)
+	}
+}
+
+// publishVolume stages and publishes the volume, it returns the target
+// path and a func which unpublishes and unstages the volume again
+func publishVolume(t *testing.T, volume *csi.Volume) (string, func()) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	capability := volumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volume.GetVolumeId(),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volume.GetVolumeContext(),
+		Secrets:           secrets,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	unstage := func() {
+		_, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volume.GetVolumeId(), StagingTargetPath: stagingPath})
+		if err != nil {
+			t.Errorf("NodeUnstageVolume: %v", err)
+		}
+	}
+
+	_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          volume.GetVolumeId(),
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volume.GetVolumeContext(),
+		Secrets:           secrets,
+	})
+	if err != nil {
+		unstage()
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	return targetPath, func() {
+		_, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volume.GetVolumeId(), TargetPath: targetPath})
+		if err != nil {
+			t.Errorf("NodeUnpublishVolume: %v", err)
+		}
+		unstage()
+	}
+}
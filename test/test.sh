@@ -6,3 +6,5 @@ mkdir -p /tmp/minio
 minio server /tmp/minio &>/dev/null &
 sleep 5
 go test ./... -cover
+CSI_S3_E2E_ENDPOINT=http://127.0.0.1:9000 CSI_S3_E2E_ACCESS_KEY=$MINIO_ACCESS_KEY CSI_S3_E2E_SECRET_KEY=$MINIO_SECRET_KEY \
+  go test -tags e2e,fuse ./test/e2e/